@@ -12,14 +12,17 @@ import (
 	"github.com/sourcegraph/sourcegraph/internal/types"
 )
 
-func getEventRepoMetadata(ctx context.Context, db dbutil.DB, event streaming.SearchEvent) (map[api.RepoID]*types.SearchedRepo, error) {
+// getEventRepoMetadata returns metadata of repositories referenced by results in
+// the event, keyed by repository ID. Only the given fields are loaded in addition
+// to the ID and Name, use database.RepoMetadataAll to load everything.
+func getEventRepoMetadata(ctx context.Context, db dbutil.DB, event streaming.SearchEvent, fields database.RepoMetadataFields) (map[api.RepoID]*types.SearchedRepo, error) {
 	ids := repoIDs(event.Results)
 	if len(ids) == 0 {
 		// Return early if there are no repos in the event
 		return nil, nil
 	}
 
-	metadataList, err := database.Repos(db).Metadata(ctx, ids...)
+	metadataList, err := database.Repos(db).MetadataWithFields(ctx, fields, ids...)
 	if err != nil {
 		return nil, errors.Wrap(err, "fetch metadata from db")
 	}
@@ -22,6 +22,7 @@ import (
 	"github.com/sourcegraph/sourcegraph/cmd/frontend/graphqlbackend"
 	searchlogs "github.com/sourcegraph/sourcegraph/cmd/frontend/internal/search/logs"
 	"github.com/sourcegraph/sourcegraph/internal/api"
+	"github.com/sourcegraph/sourcegraph/internal/database"
 	"github.com/sourcegraph/sourcegraph/internal/database/dbutil"
 	"github.com/sourcegraph/sourcegraph/internal/honey"
 	"github.com/sourcegraph/sourcegraph/internal/lazyregexp"
@@ -175,7 +176,7 @@ func (h *streamHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 			display = match.Limit(display)
 		}
 
-		repoMetadata, err := getEventRepoMetadata(ctx, h.db, event)
+		repoMetadata, err := getEventRepoMetadata(ctx, h.db, event, renderedRepoMetadataFields(event.Results))
 		if err != nil {
 			log15.Error("failed to get repo metadata", "error", err)
 			continue
@@ -379,6 +380,17 @@ func fromStrPtr(s *string) string {
 	return *s
 }
 
+// renderedRepoMetadataFields returns the fields of repository metadata rendered
+// in the events of the matches.
+func renderedRepoMetadataFields(matches []result.Match) database.RepoMetadataFields {
+	for _, match := range matches {
+		if _, ok := match.(*result.RepoMatch); ok {
+			return database.RepoMetadataAll
+		}
+	}
+	return database.RepoMetadataStars | database.RepoMetadataLastFetched
+}
+
 func fromMatch(match result.Match, repoCache map[api.RepoID]*types.SearchedRepo) streamhttp.EventMatch {
 	switch v := match.(type) {
 	case *result.FileMatch:
@@ -247,3 +247,15 @@ func (h *mockSearchResolver) Inputs() run.SearchInputs {
 	}
 	return *h.inputs
 }
+
+func TestRenderedRepoMetadataFields(t *testing.T) {
+	fileMatch := &result.FileMatch{}
+	repoMatch := &result.RepoMatch{}
+
+	if got, want := renderedRepoMetadataFields([]result.Match{fileMatch}), database.RepoMetadataStars|database.RepoMetadataLastFetched; got != want {
+		t.Errorf("file matches: want fields %b but got %b", want, got)
+	}
+	if got, want := renderedRepoMetadataFields([]result.Match{fileMatch, repoMatch}), database.RepoMetadataAll; got != want {
+		t.Errorf("repository matches: want fields %b but got %b", want, got)
+	}
+}
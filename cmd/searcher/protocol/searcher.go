@@ -4,6 +4,7 @@ package protocol
 import (
 	"fmt"
 	"strings"
+	"time"
 
 	"github.com/sourcegraph/sourcegraph/internal/api"
 )
@@ -193,6 +194,20 @@ type Response struct {
 
 	// DeadlineHit is true if Matches may not include all FileMatches because a deadline was hit.
 	DeadlineHit bool
+
+	// Structural is the timing breakdown of a structural search. It is only set when
+	// the request is a structural search.
+	Structural *StructuralTimings `json:",omitempty"`
+}
+
+// StructuralTimings is the timing breakdown of a structural search.
+type StructuralTimings struct {
+	// Parse is the time spent translating the structural pattern into a query and
+	// running it to narrow down the files to match.
+	Parse time.Duration
+
+	// Match is the time spent matching the narrowed down files with comby.
+	Match time.Duration
 }
 
 // FileMatch is the struct used by vscode to receive search results
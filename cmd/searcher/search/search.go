@@ -115,7 +115,12 @@ func (s *Service) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	ctx, cancel, stream := newLimitedStreamCollector(ctx, p.Limit)
 	defer cancel()
 
-	deadlineHit, err := s.search(ctx, &p, stream)
+	var structuralTimings *protocol.StructuralTimings
+	if p.IsStructuralPat {
+		structuralTimings = &protocol.StructuralTimings{}
+	}
+
+	deadlineHit, err := s.search(ctx, &p, stream, structuralTimings)
 	if err != nil {
 		code := http.StatusInternalServerError
 		if errcode.IsBadRequest(err) || errors.Is(ctx.Err(), context.Canceled) {
@@ -134,6 +139,7 @@ func (s *Service) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		Matches:     stream.Collected(),
 		LimitHit:    stream.LimitHit(),
 		DeadlineHit: deadlineHit,
+		Structural:  structuralTimings,
 	}
 	// The only reasonable error is the client going away now since we know we
 	// can encode resp. This happens relatively often due to our
@@ -170,10 +176,16 @@ func (s *Service) streamSearch(ctx context.Context, w http.ResponseWriter, p pro
 	ctx, cancel, stream := newLimitedStream(ctx, p.Limit, onMatches)
 	defer cancel()
 
-	deadlineHit, err := s.search(ctx, &p, stream)
+	var structuralTimings *protocol.StructuralTimings
+	if p.IsStructuralPat {
+		structuralTimings = &protocol.StructuralTimings{}
+	}
+
+	deadlineHit, err := s.search(ctx, &p, stream, structuralTimings)
 	doneEvent := searcher.EventDone{
 		DeadlineHit: deadlineHit,
 		LimitHit:    stream.LimitHit(),
+		Structural:  structuralTimings,
 	}
 	if err != nil {
 		doneEvent.Error = err.Error()
@@ -188,7 +200,10 @@ func (s *Service) streamSearch(ctx context.Context, w http.ResponseWriter, p pro
 	}
 }
 
-func (s *Service) search(ctx context.Context, p *protocol.Request, sender matchSender) (deadlineHit bool, err error) {
+// search runs the search request p and sends matches to sender. If structuralTimings
+// is non-nil and p is a structural search, it is populated with the time spent in
+// each step of the structural search.
+func (s *Service) search(ctx context.Context, p *protocol.Request, sender matchSender, structuralTimings *protocol.StructuralTimings) (deadlineHit bool, err error) {
 	tr := nettrace.New("search", fmt.Sprintf("%s@%s", p.Repo, p.Commit))
 	tr.LazyPrintf("%s", p.Pattern)
 
@@ -251,7 +266,7 @@ func (s *Service) search(ctx context.Context, p *protocol.Request, sender matchS
 	if p.IsStructuralPat && p.Indexed {
 		// Execute the new structural search path that directly calls Zoekt.
 		// TODO use limit in indexed structural search
-		return structuralSearchWithZoekt(ctx, p, sender)
+		return structuralSearchWithZoekt(ctx, p, sender, structuralTimings)
 	}
 
 	// Compile pattern before fetching from store incase it is bad.
@@ -298,7 +313,7 @@ func (s *Service) search(ctx context.Context, p *protocol.Request, sender matchS
 	archiveSize.Observe(float64(bytes))
 
 	if p.IsStructuralPat {
-		return false, filteredStructuralSearch(ctx, zipPath, zf, &p.PatternInfo, p.Repo, sender)
+		return false, filteredStructuralSearch(ctx, zipPath, zf, &p.PatternInfo, p.Repo, sender, structuralTimings)
 	} else {
 		return false, regexSearch(ctx, rg, zf, p.Limit, p.PatternMatchesContent, p.PatternMatchesPath, p.IsNegated, sender)
 	}
@@ -175,8 +175,11 @@ func lookupMatcher(language string) string {
 	return ".generic"
 }
 
-// filteredStructuralSearch filters the list of files with a regex search before passing the zip to comby
-func filteredStructuralSearch(ctx context.Context, zipPath string, zipFile *store.ZipFile, p *protocol.PatternInfo, repo api.RepoName, sender matchSender) error {
+// filteredStructuralSearch filters the list of files with a regex search before passing the zip to comby.
+// If timings is non-nil, it is populated with the time spent in each step.
+func filteredStructuralSearch(ctx context.Context, zipPath string, zipFile *store.ZipFile, p *protocol.PatternInfo, repo api.RepoName, sender matchSender, timings *protocol.StructuralTimings) error {
+	start := time.Now()
+
 	// Make a copy of the pattern info to modify it to work for a regex search
 	rp := *p
 	rp.Pattern = comby.StructuralPatToRegexpQuery(p.Pattern, false)
@@ -202,7 +205,13 @@ func filteredStructuralSearch(ctx context.Context, zipPath string, zipFile *stor
 		extensionHint = filepath.Ext(matchedPaths[0])
 	}
 
-	return structuralSearch(ctx, zipPath, Subset(matchedPaths), extensionHint, p.Pattern, p.CombyRule, p.Languages, repo, sender)
+	parsed := time.Now()
+	err = structuralSearch(ctx, zipPath, Subset(matchedPaths), extensionHint, p.Pattern, p.CombyRule, p.Languages, repo, sender)
+	if timings != nil {
+		timings.Parse = parsed.Sub(start)
+		timings.Match = time.Since(parsed)
+	}
+	return err
 }
 
 // toMatcher returns the matcher that parameterizes structural search. It
@@ -277,7 +286,17 @@ func structuralSearch(ctx context.Context, zipPath string, paths filePatterns, e
 	return nil
 }
 
-func structuralSearchWithZoekt(ctx context.Context, p *protocol.Request, sender matchSender) (deadlineHit bool, err error) {
+// structuralSearchWithZoekt narrows down the files to match with a Zoekt search before passing
+// them to comby. If timings is non-nil, it is populated with the time spent in each step.
+func structuralSearchWithZoekt(ctx context.Context, p *protocol.Request, sender matchSender, timings *protocol.StructuralTimings) (deadlineHit bool, err error) {
+	start := time.Now()
+	defer func() {
+		if timings != nil && timings.Parse == 0 {
+			// We never got to the matching step.
+			timings.Parse = time.Since(start)
+		}
+	}()
+
 	patternInfo := &search.TextPatternInfo{
 		Pattern:                      p.Pattern,
 		IsNegated:                    p.IsNegated,
@@ -326,7 +345,13 @@ func structuralSearchWithZoekt(ctx context.Context, p *protocol.Request, sender
 		extensionHint = filepath.Ext(filename)
 	}
 
-	return false, structuralSearch(ctx, zipFile.Name(), All, extensionHint, p.Pattern, p.CombyRule, p.Languages, p.Repo, sender)
+	parsed := time.Now()
+	err = structuralSearch(ctx, zipFile.Name(), All, extensionHint, p.Pattern, p.CombyRule, p.Languages, p.Repo, sender)
+	if timings != nil {
+		timings.Parse = parsed.Sub(start)
+		timings.Match = time.Since(parsed)
+	}
+	return false, err
 }
 
 var requestTotalStructuralSearch = promauto.NewCounterVec(prometheus.CounterOpts{
@@ -233,7 +233,7 @@ func foo(real string) {}
 	}
 	ctx, cancel, sender := newLimitedStreamCollector(context.Background(), 1000000000)
 	defer cancel()
-	err = filteredStructuralSearch(ctx, zPath, zFile, p, "foo", sender)
+	err = filteredStructuralSearch(ctx, zPath, zFile, p, "foo", sender, nil)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -103,7 +103,7 @@ func NewMockWorkerStore() *MockWorkerStore {
 			},
 		},
 		ResetStalledFunc: &WorkerStoreResetStalledFunc{
-			defaultHook: func(context.Context) (map[int]time.Duration, map[int]time.Duration, error) {
+			defaultHook: func(context.Context, []*sqlf.Query) (map[int]time.Duration, map[int]time.Duration, error) {
 				return nil, nil, nil
 			},
 		},
@@ -1163,24 +1163,24 @@ func (c WorkerStoreRequeueFuncCall) Results() []interface{} {
 // WorkerStoreResetStalledFunc describes the behavior when the ResetStalled
 // method of the parent MockWorkerStore instance is invoked.
 type WorkerStoreResetStalledFunc struct {
-	defaultHook func(context.Context) (map[int]time.Duration, map[int]time.Duration, error)
-	hooks       []func(context.Context) (map[int]time.Duration, map[int]time.Duration, error)
+	defaultHook func(context.Context, []*sqlf.Query) (map[int]time.Duration, map[int]time.Duration, error)
+	hooks       []func(context.Context, []*sqlf.Query) (map[int]time.Duration, map[int]time.Duration, error)
 	history     []WorkerStoreResetStalledFuncCall
 	mutex       sync.Mutex
 }
 
 // ResetStalled delegates to the next hook function in the queue and stores
 // the parameter and result values of this invocation.
-func (m *MockWorkerStore) ResetStalled(v0 context.Context) (map[int]time.Duration, map[int]time.Duration, error) {
-	r0, r1, r2 := m.ResetStalledFunc.nextHook()(v0)
-	m.ResetStalledFunc.appendCall(WorkerStoreResetStalledFuncCall{v0, r0, r1, r2})
+func (m *MockWorkerStore) ResetStalled(v0 context.Context, v1 []*sqlf.Query) (map[int]time.Duration, map[int]time.Duration, error) {
+	r0, r1, r2 := m.ResetStalledFunc.nextHook()(v0, v1)
+	m.ResetStalledFunc.appendCall(WorkerStoreResetStalledFuncCall{v0, v1, r0, r1, r2})
 	return r0, r1, r2
 }
 
 // SetDefaultHook sets function that is called when the ResetStalled method
 // of the parent MockWorkerStore instance is invoked and the hook queue is
 // empty.
-func (f *WorkerStoreResetStalledFunc) SetDefaultHook(hook func(context.Context) (map[int]time.Duration, map[int]time.Duration, error)) {
+func (f *WorkerStoreResetStalledFunc) SetDefaultHook(hook func(context.Context, []*sqlf.Query) (map[int]time.Duration, map[int]time.Duration, error)) {
 	f.defaultHook = hook
 }
 
@@ -1188,7 +1188,7 @@ func (f *WorkerStoreResetStalledFunc) SetDefaultHook(hook func(context.Context)
 // ResetStalled method of the parent MockWorkerStore instance invokes the
 // hook at the front of the queue and discards it. After the queue is empty,
 // the default hook function is invoked for any future action.
-func (f *WorkerStoreResetStalledFunc) PushHook(hook func(context.Context) (map[int]time.Duration, map[int]time.Duration, error)) {
+func (f *WorkerStoreResetStalledFunc) PushHook(hook func(context.Context, []*sqlf.Query) (map[int]time.Duration, map[int]time.Duration, error)) {
 	f.mutex.Lock()
 	f.hooks = append(f.hooks, hook)
 	f.mutex.Unlock()
@@ -1197,7 +1197,7 @@ func (f *WorkerStoreResetStalledFunc) PushHook(hook func(context.Context) (map[i
 // SetDefaultReturn calls SetDefaultDefaultHook with a function that returns
 // the given values.
 func (f *WorkerStoreResetStalledFunc) SetDefaultReturn(r0 map[int]time.Duration, r1 map[int]time.Duration, r2 error) {
-	f.SetDefaultHook(func(context.Context) (map[int]time.Duration, map[int]time.Duration, error) {
+	f.SetDefaultHook(func(context.Context, []*sqlf.Query) (map[int]time.Duration, map[int]time.Duration, error) {
 		return r0, r1, r2
 	})
 }
@@ -1205,12 +1205,12 @@ func (f *WorkerStoreResetStalledFunc) SetDefaultReturn(r0 map[int]time.Duration,
 // PushReturn calls PushDefaultHook with a function that returns the given
 // values.
 func (f *WorkerStoreResetStalledFunc) PushReturn(r0 map[int]time.Duration, r1 map[int]time.Duration, r2 error) {
-	f.PushHook(func(context.Context) (map[int]time.Duration, map[int]time.Duration, error) {
+	f.PushHook(func(context.Context, []*sqlf.Query) (map[int]time.Duration, map[int]time.Duration, error) {
 		return r0, r1, r2
 	})
 }
 
-func (f *WorkerStoreResetStalledFunc) nextHook() func(context.Context) (map[int]time.Duration, map[int]time.Duration, error) {
+func (f *WorkerStoreResetStalledFunc) nextHook() func(context.Context, []*sqlf.Query) (map[int]time.Duration, map[int]time.Duration, error) {
 	f.mutex.Lock()
 	defer f.mutex.Unlock()
 
@@ -1246,6 +1246,9 @@ type WorkerStoreResetStalledFuncCall struct {
 	// Arg0 is the value of the 1st argument passed to this method
 	// invocation.
 	Arg0 context.Context
+	// Arg1 is the value of the 2nd argument passed to this method
+	// invocation.
+	Arg1 []*sqlf.Query
 	// Result0 is the value of the 1st result returned from this method
 	// invocation.
 	Result0 map[int]time.Duration
@@ -1260,7 +1263,7 @@ type WorkerStoreResetStalledFuncCall struct {
 // Args returns an interface slice containing the arguments of this
 // invocation.
 func (c WorkerStoreResetStalledFuncCall) Args() []interface{} {
-	return []interface{}{c.Arg0}
+	return []interface{}{c.Arg0, c.Arg1}
 }
 
 // Results returns an interface slice containing the results of this
@@ -0,0 +1,73 @@
+package authz
+
+import (
+	"sync"
+
+	"github.com/sourcegraph/sourcegraph/internal/extsvc"
+)
+
+// accountIDsCacheKey is the key of a cached external account ID resolution.
+type accountIDsCacheKey struct {
+	serviceType string
+	serviceID   string
+	accountID   string
+}
+
+// accountIDsCache caches resolutions of external account IDs (e.g. emails for
+// Perforce) to user IDs, to be shared across repository-centric syncs within
+// the same schedule pass. Account IDs that are not associated with any user are
+// cached as well.
+type accountIDsCache struct {
+	mu    sync.Mutex
+	cache map[accountIDsCacheKey]int32 // Zero value indicates no associated user.
+}
+
+func newAccountIDsCache() *accountIDsCache {
+	return &accountIDsCache{
+		cache: make(map[accountIDsCacheKey]int32),
+	}
+}
+
+// get returns cached "account ID -> user ID" resolutions of given accounts, and
+// the list of account IDs that are not in the cache.
+func (c *accountIDsCache) get(accounts *extsvc.Accounts) (userIDs map[string]int32, missing []string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	userIDs = make(map[string]int32, len(accounts.AccountIDs))
+	for _, accountID := range accounts.AccountIDs {
+		userID, ok := c.cache[accountIDsCacheKey{
+			serviceType: accounts.ServiceType,
+			serviceID:   accounts.ServiceID,
+			accountID:   accountID,
+		}]
+		if !ok {
+			missing = append(missing, accountID)
+		} else if userID > 0 {
+			userIDs[accountID] = userID
+		}
+	}
+	return userIDs, missing
+}
+
+// set caches resolutions of given accounts, account IDs that are not present in
+// the userIDs are cached as not associated with any user.
+func (c *accountIDsCache) set(accounts *extsvc.Accounts, userIDs map[string]int32) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for _, accountID := range accounts.AccountIDs {
+		c.cache[accountIDsCacheKey{
+			serviceType: accounts.ServiceType,
+			serviceID:   accounts.ServiceID,
+			accountID:   accountID,
+		}] = userIDs[accountID]
+	}
+}
+
+// reset clears all cached resolutions.
+func (c *accountIDsCache) reset() {
+	c.mu.Lock()
+	c.cache = make(map[accountIDsCacheKey]int32)
+	c.mu.Unlock()
+}
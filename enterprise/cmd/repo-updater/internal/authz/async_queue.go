@@ -0,0 +1,58 @@
+package authz
+
+import (
+	"context"
+
+	"github.com/inconshreveable/log15"
+)
+
+// asyncQueueBufferSize is the maximum number of items waiting to be handled by an
+// asyncQueue, new items are dropped when the buffer is full.
+const asyncQueueBufferSize = 1000
+
+// asyncQueue passes buffered items to a handler from a single goroutine, so that
+// a slow or failing handler never blocks syncing.
+type asyncQueue struct {
+	// The name of the queue used in logs.
+	name   string
+	items  chan interface{}
+	handle func(ctx context.Context, item interface{})
+}
+
+func newAsyncQueue(name string, handle func(ctx context.Context, item interface{})) *asyncQueue {
+	return &asyncQueue{
+		name:   name,
+		items:  make(chan interface{}, asyncQueueBufferSize),
+		handle: handle,
+	}
+}
+
+// enqueue buffers the item of the sync of given type and ID, the item is
+// dropped if the buffer is full.
+func (q *asyncQueue) enqueue(item interface{}, typ requestType, id int32) {
+	select {
+	case q.items <- item:
+	default:
+		log15.Warn("PermsSyncer.asyncQueue.dropped", "queue", q.name, "type", typ.label(), "id", id)
+	}
+}
+
+// len returns the number of buffered items.
+func (q *asyncQueue) len() int {
+	return len(q.items)
+}
+
+// run passes buffered items to the handler until the context is canceled.
+func (q *asyncQueue) run(ctx context.Context) {
+	log15.Debug("PermsSyncer.asyncQueue.started", "queue", q.name)
+	defer log15.Info("PermsSyncer.asyncQueue.stopped", "queue", q.name)
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case item := <-q.items:
+			q.handle(ctx, item)
+		}
+	}
+}
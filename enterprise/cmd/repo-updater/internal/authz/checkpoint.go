@@ -0,0 +1,53 @@
+package authz
+
+import (
+	"fmt"
+	"time"
+)
+
+// checkpointStore is the key-value store to persist sync checkpoints, which is
+// satisfied by *rcache.Cache.
+type checkpointStore interface {
+	Get(key string) ([]byte, bool)
+	Set(key string, b []byte)
+}
+
+// syncCheckpoint records users and repositories that have completed syncing
+// within the current cycle. Because it is persisted outside of the process, a
+// restarted syncer is able to skip entities that have already been synced
+// instead of starting the whole cycle over.
+//
+// Cycles are aligned to multiples of the cycle duration, entries recorded in a
+// previous cycle are never consulted and expire along with the cycle.
+type syncCheckpoint struct {
+	store checkpointStore
+	// The mockable function to return the current time.
+	clock func() time.Time
+	// The time duration of a sync cycle.
+	cycle time.Duration
+}
+
+func newSyncCheckpoint(store checkpointStore, clock func() time.Time, cycle time.Duration) *syncCheckpoint {
+	return &syncCheckpoint{
+		store: store,
+		clock: clock,
+		cycle: cycle,
+	}
+}
+
+// key returns the key of given entity for the current cycle.
+func (c *syncCheckpoint) key(typ requestType, id int32) string {
+	return fmt.Sprintf("%d:%d:%d", c.clock().Truncate(c.cycle).Unix(), typ, id)
+}
+
+// completed returns true if given entity has completed syncing in the current
+// cycle.
+func (c *syncCheckpoint) completed(typ requestType, id int32) bool {
+	_, ok := c.store.Get(c.key(typ, id))
+	return ok
+}
+
+// complete records given entity has completed syncing in the current cycle.
+func (c *syncCheckpoint) complete(typ requestType, id int32) {
+	c.store.Set(c.key(typ, id), []byte("1"))
+}
@@ -0,0 +1,144 @@
+package authz
+
+import (
+	"context"
+	"database/sql"
+	"testing"
+	"time"
+
+	edb "github.com/sourcegraph/sourcegraph/enterprise/internal/database"
+	"github.com/sourcegraph/sourcegraph/internal/api"
+	"github.com/sourcegraph/sourcegraph/internal/authz"
+	"github.com/sourcegraph/sourcegraph/internal/database"
+	"github.com/sourcegraph/sourcegraph/internal/database/dbtesting"
+	"github.com/sourcegraph/sourcegraph/internal/extsvc"
+	"github.com/sourcegraph/sourcegraph/internal/repos"
+	"github.com/sourcegraph/sourcegraph/internal/types"
+)
+
+type memCheckpointStore map[string][]byte
+
+func (m memCheckpointStore) Get(key string) ([]byte, bool) {
+	b, ok := m[key]
+	return b, ok
+}
+
+func (m memCheckpointStore) Set(key string, b []byte) {
+	m[key] = b
+}
+
+func TestPermsSyncer_syncPerms_checkpoint(t *testing.T) {
+	p := &mockProvider{
+		serviceType: extsvc.TypeGitLab,
+		serviceID:   "https://gitlab.com/",
+	}
+	authz.SetProviders(false, []authz.Provider{p})
+	defer authz.SetProviders(true, nil)
+
+	extAccount := extsvc.Account{
+		AccountSpec: extsvc.AccountSpec{
+			ServiceType: p.ServiceType(),
+			ServiceID:   p.ServiceID(),
+		},
+	}
+
+	database.Mocks.Users.GetByID = func(ctx context.Context, id int32) (*types.User, error) {
+		return &types.User{ID: id}, nil
+	}
+	database.Mocks.ExternalAccounts.TouchLastValid = func(ctx context.Context, id int32) error {
+		return nil
+	}
+	edb.Mocks.Perms.ListExternalAccounts = func(context.Context, int32) ([]*extsvc.Account, error) {
+		return []*extsvc.Account{&extAccount}, nil
+	}
+	database.Mocks.Repos.ListRepoNames = func(v0 context.Context, args database.ReposListOptions) ([]types.RepoName, error) {
+		return []types.RepoName{{ID: 1}}, nil
+	}
+	database.Mocks.UserEmails.ListByUser = func(ctx context.Context, opt database.UserEmailsListOptions) ([]*database.UserEmail, error) {
+		return nil, nil
+	}
+	database.Mocks.ExternalServices.List = func(opt database.ExternalServicesListOptions) ([]*types.ExternalService, error) {
+		return []*types.ExternalService{}, nil
+	}
+	database.Mocks.Repos.ListExternalServiceRepoIDsByUserID = func(ctx context.Context, userID int32) ([]api.RepoID, error) {
+		return []api.RepoID{}, nil
+	}
+	defer func() {
+		database.Mocks = database.MockStores{}
+		edb.Mocks.Perms = edb.MockPerms{}
+	}()
+
+	p.fetchUserPerms = func(context.Context, *extsvc.Account) (*authz.ExternalUserPermissions, error) {
+		return &authz.ExternalUserPermissions{
+			Exacts: []extsvc.RepoID{"1"},
+		}, nil
+	}
+
+	var synced []int32
+	edb.Mocks.Perms.SetUserPermissionsWithDiff = func(_ context.Context, p *authz.UserPermissions) (*edb.UserPermissionsDiff, error) {
+		synced = append(synced, p.UserID)
+		return &edb.UserPermissionsDiff{}, nil
+	}
+
+	now := time.Date(2021, 6, 1, 10, 0, 0, 0, time.UTC)
+	clock := func() time.Time { return now }
+	store := make(memCheckpointStore)
+	newSyncer := func() *PermsSyncer {
+		s := NewPermsSyncer(repos.NewStore(&dbtesting.MockDB{}, sql.TxOptions{}), edb.Perms(nil, clock), clock, nil, PermsSyncerOptions{})
+		s.checkpoint = newSyncCheckpoint(store, clock, time.Hour)
+		return s
+	}
+	syncUser := func(t *testing.T, s *PermsSyncer, userID int32, priority Priority) {
+		t.Helper()
+
+		request := &syncRequest{
+			requestMeta: &requestMeta{
+				Priority: priority,
+				Type:     requestTypeUser,
+				ID:       userID,
+			},
+			acquired: true,
+		}
+		if err := s.syncPerms(context.Background(), request); err != nil {
+			t.Fatal(err)
+		}
+	}
+	assertSynced := func(t *testing.T, want ...int32) {
+		t.Helper()
+
+		if len(synced) != len(want) {
+			t.Fatalf("synced: want %v but got %v", want, synced)
+		}
+		for i := range want {
+			if synced[i] != want[i] {
+				t.Fatalf("synced: want %v but got %v", want, synced)
+			}
+		}
+		synced = nil
+	}
+
+	s := newSyncer()
+	syncUser(t, s, 1, PriorityLow)
+	assertSynced(t, 1)
+
+	// Simulate a restart in the middle of the cycle, the new syncer should only
+	// sync users that have not been synced in the cycle.
+	now = now.Add(30 * time.Minute)
+	s = newSyncer()
+	syncUser(t, s, 1, PriorityLow)
+	syncUser(t, s, 2, PriorityLow)
+	assertSynced(t, 2)
+
+	t.Run("user-triggered requests are not skipped", func(t *testing.T) {
+		syncUser(t, s, 1, PriorityHigh)
+		assertSynced(t, 1)
+	})
+
+	t.Run("checkpoint expires with the cycle", func(t *testing.T) {
+		now = now.Add(30 * time.Minute)
+		s = newSyncer()
+		syncUser(t, s, 1, PriorityLow)
+		syncUser(t, s, 2, PriorityLow)
+		assertSynced(t, 1, 2)
+	})
+}
@@ -0,0 +1,158 @@
+package authz
+
+import (
+	"context"
+	"sync"
+)
+
+// inflightSyncs tracks syncs that are in progress along with the code hosts
+// they have talked to, so that they can be canceled by code host.
+type inflightSyncs struct {
+	mu    sync.Mutex
+	syncs map[*inflightSync]struct{}
+}
+
+// inflightSync is a single sync that is in progress.
+type inflightSync struct {
+	cancel context.CancelFunc
+	// The type and ID of the request being synced.
+	key requestQueueKey
+	// The service IDs of code hosts the sync has talked to, guarded by the mutex
+	// of inflightSyncs.
+	serviceIDs map[string]struct{}
+	// The number of repositories or users the sync has persisted, guarded by the
+	// mutex of inflightSyncs.
+	resultSize int
+	// Whether the sync has proceeded with partial results from the code host,
+	// guarded by the mutex of inflightSyncs.
+	partial bool
+}
+
+type inflightSyncKey struct{}
+
+func newInflightSyncs() *inflightSyncs {
+	return &inflightSyncs{
+		syncs: make(map[*inflightSync]struct{}),
+	}
+}
+
+// start registers a new in-flight sync of given request and returns its
+// cancelable context. The returned function must be called when the sync
+// finishes.
+func (s *inflightSyncs) start(ctx context.Context, typ requestType, id int32) (context.Context, func()) {
+	ctx, cancel := context.WithCancel(ctx)
+	inflight := &inflightSync{
+		cancel:     cancel,
+		key:        requestQueueKey{typ: typ, id: id},
+		serviceIDs: make(map[string]struct{}),
+	}
+
+	s.mu.Lock()
+	s.syncs[inflight] = struct{}{}
+	s.mu.Unlock()
+
+	return context.WithValue(ctx, inflightSyncKey{}, inflight), func() {
+		s.mu.Lock()
+		delete(s.syncs, inflight)
+		s.mu.Unlock()
+		cancel()
+	}
+}
+
+// use records that the in-flight sync of given context is talking to the code
+// host. It is a no-op if the context does not belong to an in-flight sync.
+func (s *inflightSyncs) use(ctx context.Context, serviceID string) {
+	inflight, ok := ctx.Value(inflightSyncKey{}).(*inflightSync)
+	if !ok {
+		return
+	}
+
+	s.mu.Lock()
+	inflight.serviceIDs[serviceID] = struct{}{}
+	s.mu.Unlock()
+}
+
+// cancel cancels all in-flight syncs that have talked to the code host, and
+// returns the number of syncs canceled.
+func (s *inflightSyncs) cancel(serviceID string) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	canceled := 0
+	for inflight := range s.syncs {
+		if _, ok := inflight.serviceIDs[serviceID]; ok {
+			inflight.cancel()
+			canceled++
+		}
+	}
+	return canceled
+}
+
+// cancelRequest cancels the in-flight sync of given request, and returns true if
+// there was such a sync.
+func (s *inflightSyncs) cancelRequest(typ requestType, id int32) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	key := requestQueueKey{typ: typ, id: id}
+	canceled := false
+	for inflight := range s.syncs {
+		if inflight.key == key {
+			inflight.cancel()
+			canceled = true
+		}
+	}
+	return canceled
+}
+
+// setResultSize records the result size of the in-flight sync of given context.
+// It is a no-op if the context does not belong to an in-flight sync.
+func (s *inflightSyncs) setResultSize(ctx context.Context, size int) {
+	inflight, ok := ctx.Value(inflightSyncKey{}).(*inflightSync)
+	if !ok {
+		return
+	}
+
+	s.mu.Lock()
+	inflight.resultSize = size
+	s.mu.Unlock()
+}
+
+// resultSize returns the result size of the in-flight sync of given context.
+func (s *inflightSyncs) resultSize(ctx context.Context) int {
+	inflight, ok := ctx.Value(inflightSyncKey{}).(*inflightSync)
+	if !ok {
+		return 0
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return inflight.resultSize
+}
+
+// setPartial records that the in-flight sync of given context has proceeded with
+// partial results. It is a no-op if the context does not belong to an in-flight
+// sync.
+func (s *inflightSyncs) setPartial(ctx context.Context) {
+	inflight, ok := ctx.Value(inflightSyncKey{}).(*inflightSync)
+	if !ok {
+		return
+	}
+
+	s.mu.Lock()
+	inflight.partial = true
+	s.mu.Unlock()
+}
+
+// partial returns true if the in-flight sync of given context has proceeded with
+// partial results.
+func (s *inflightSyncs) partial(ctx context.Context) bool {
+	inflight, ok := ctx.Value(inflightSyncKey{}).(*inflightSync)
+	if !ok {
+		return false
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return inflight.partial
+}
@@ -0,0 +1,221 @@
+package authz
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"strconv"
+	"testing"
+
+	"github.com/cockroachdb/errors"
+	"github.com/google/go-cmp/cmp"
+
+	edb "github.com/sourcegraph/sourcegraph/enterprise/internal/database"
+	"github.com/sourcegraph/sourcegraph/internal/api"
+	"github.com/sourcegraph/sourcegraph/internal/authz"
+	"github.com/sourcegraph/sourcegraph/internal/database"
+	"github.com/sourcegraph/sourcegraph/internal/database/dbtesting"
+	"github.com/sourcegraph/sourcegraph/internal/extsvc"
+	"github.com/sourcegraph/sourcegraph/internal/repos"
+	"github.com/sourcegraph/sourcegraph/internal/timeutil"
+	"github.com/sourcegraph/sourcegraph/internal/types"
+)
+
+func TestPermsSyncer_CancelByServiceID(t *testing.T) {
+	started := make(chan string, 2)
+	release := make(chan struct{})
+	fetchRepoPerms := func(ctx context.Context, repo *extsvc.Repository) ([]extsvc.AccountID, error) {
+		started <- repo.ID
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-release:
+			return []extsvc.AccountID{}, nil
+		}
+	}
+	gitlab := &mockProvider{
+		id:             1,
+		serviceType:    extsvc.TypeGitLab,
+		serviceID:      "https://gitlab.com/",
+		fetchRepoPerms: fetchRepoPerms,
+	}
+	github := &mockProvider{
+		id:             2,
+		serviceType:    extsvc.TypeGitHub,
+		serviceID:      "https://github.com/",
+		fetchRepoPerms: fetchRepoPerms,
+	}
+	authz.SetProviders(false, []authz.Provider{gitlab, github})
+	defer authz.SetProviders(true, nil)
+
+	newRepo := func(id api.RepoID, p *mockProvider) *types.Repo {
+		return &types.Repo{
+			ID:      id,
+			Private: true,
+			ExternalRepo: api.ExternalRepoSpec{
+				ID:          strconv.Itoa(int(id)),
+				ServiceType: p.ServiceType(),
+				ServiceID:   p.ServiceID(),
+			},
+			Sources: map[string]*types.SourceInfo{
+				p.URN(): {},
+			},
+		}
+	}
+	allRepos := map[api.RepoID]*types.Repo{
+		1: newRepo(1, gitlab),
+		2: newRepo(2, github),
+		3: newRepo(3, gitlab),
+		4: newRepo(4, github),
+	}
+	database.Mocks.Repos.List = func(_ context.Context, opt database.ReposListOptions) ([]*types.Repo, error) {
+		var rs []*types.Repo
+		for _, id := range opt.IDs {
+			if r, ok := allRepos[id]; ok {
+				rs = append(rs, r)
+			}
+		}
+		return rs, nil
+	}
+	database.Mocks.Repos.ListExternalServiceUserIDsByRepoID = func(ctx context.Context, repoID api.RepoID) ([]int32, error) {
+		return []int32{}, nil
+	}
+	edb.Mocks.Perms.Transact = func(context.Context) (*edb.PermsStore, error) {
+		return &edb.PermsStore{}, nil
+	}
+	edb.Mocks.Perms.GetUserIDsByExternalAccounts = func(context.Context, *extsvc.Accounts) (map[string]int32, error) {
+		return map[string]int32{}, nil
+	}
+	edb.Mocks.Perms.SetRepoPermissions = func(context.Context, *authz.RepoPermissions) error {
+		return nil
+	}
+	edb.Mocks.Perms.SetRepoPendingPermissions = func(context.Context, *extsvc.Accounts, *authz.RepoPermissions) error {
+		return nil
+	}
+	defer func() {
+		database.Mocks.Repos = database.MockRepos{}
+		edb.Mocks.Perms = edb.MockPerms{}
+	}()
+
+	s := NewPermsSyncer(repos.NewStore(&dbtesting.MockDB{}, sql.TxOptions{}), edb.Perms(nil, timeutil.Now), timeutil.Now, nil, PermsSyncerOptions{})
+
+	// Start syncing repositories 1 and 2 in the background, and queue up
+	// repositories 3 and 4.
+	errs := make(map[api.RepoID]chan error, 2)
+	for _, id := range []api.RepoID{1, 2} {
+		s.queue.enqueue(&requestMeta{Type: requestTypeRepo, ID: int32(id)})
+	}
+	for range []api.RepoID{1, 2} {
+		request := s.queue.acquireNext()
+		errCh := make(chan error, 1)
+		errs[api.RepoID(request.ID)] = errCh
+		go func() {
+			errCh <- s.syncPerms(context.Background(), request)
+		}()
+	}
+	<-started
+	<-started
+	for _, id := range []api.RepoID{3, 4} {
+		s.queue.enqueue(&requestMeta{Type: requestTypeRepo, ID: int32(id)})
+	}
+
+	s.CancelByServiceID(gitlab.ServiceID())
+
+	if err := <-errs[1]; !errors.Is(err, context.Canceled) {
+		t.Fatalf("repo 1: want %v but got %v", context.Canceled, err)
+	}
+
+	// Syncing of the other code host continues.
+	close(release)
+	if err := <-errs[2]; err != nil {
+		t.Fatalf("repo 2: %v", err)
+	}
+
+	if diff := cmp.Diff([]int32{4}, s.queue.queuedIDs(requestTypeRepo)); diff != "" {
+		t.Fatalf("queued repos mismatch (-want +got):\n%s", diff)
+	}
+}
+
+func TestPermsSyncer_CancelUserAndRepo(t *testing.T) {
+	started := make(chan struct{})
+	p := &mockProvider{
+		id:          1,
+		serviceType: extsvc.TypeGitLab,
+		serviceID:   "https://gitlab.com/",
+		fetchRepoPerms: func(ctx context.Context, repo *extsvc.Repository) ([]extsvc.AccountID, error) {
+			close(started)
+			<-ctx.Done()
+			return nil, ctx.Err()
+		},
+	}
+	authz.SetProviders(false, []authz.Provider{p})
+	defer authz.SetProviders(true, nil)
+
+	database.Mocks.Repos.List = func(context.Context, database.ReposListOptions) ([]*types.Repo, error) {
+		return []*types.Repo{
+			{
+				ID:      1,
+				Private: true,
+				ExternalRepo: api.ExternalRepoSpec{
+					ID:          "1",
+					ServiceType: p.ServiceType(),
+					ServiceID:   p.ServiceID(),
+				},
+				Sources: map[string]*types.SourceInfo{
+					p.URN(): {},
+				},
+			},
+		}, nil
+	}
+	database.Mocks.Repos.ListExternalServiceUserIDsByRepoID = func(ctx context.Context, repoID api.RepoID) ([]int32, error) {
+		return []int32{}, nil
+	}
+	defer func() {
+		database.Mocks.Repos = database.MockRepos{}
+	}()
+
+	s := NewPermsSyncer(repos.NewStore(&dbtesting.MockDB{}, sql.TxOptions{}), edb.Perms(nil, timeutil.Now), timeutil.Now, nil, PermsSyncerOptions{})
+
+	queueSize := func() int {
+		dump, err := json.Marshal(s.DebugDump())
+		if err != nil {
+			t.Fatal(err)
+		}
+		var data struct{ Size int }
+		if err := json.Unmarshal(dump, &data); err != nil {
+			t.Fatal(err)
+		}
+		return data.Size
+	}
+
+	// Cancelling non-existent requests is a no-op.
+	s.CancelUser(1)
+	s.CancelRepo(1)
+
+	// Start syncing repository 1 in the background, and queue up user 1.
+	s.queue.enqueue(&requestMeta{Type: requestTypeRepo, ID: 1})
+	request := s.queue.acquireNext()
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- s.syncPerms(context.Background(), request)
+	}()
+	<-started
+	s.queue.enqueue(&requestMeta{Type: requestTypeUser, ID: 1})
+
+	if got := queueSize(); got != 2 {
+		t.Fatalf("queue size: want 2 but got %d", got)
+	}
+
+	s.CancelUser(1)
+	if got := queueSize(); got != 1 {
+		t.Fatalf("queue size: want 1 but got %d", got)
+	}
+
+	s.CancelRepo(1)
+	if got := queueSize(); got != 0 {
+		t.Fatalf("queue size: want 0 but got %d", got)
+	}
+	if err := <-errCh; !errors.Is(err, context.Canceled) {
+		t.Fatalf("want %v but got %v", context.Canceled, err)
+	}
+}
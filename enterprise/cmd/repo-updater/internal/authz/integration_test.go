@@ -124,7 +124,7 @@ func TestIntegration_GitHubPermissions(t *testing.T) {
 	}
 
 	permsStore := edb.Perms(testDB, timeutil.Now)
-	syncer := NewPermsSyncer(reposStore, permsStore, timeutil.Now, nil)
+	syncer := NewPermsSyncer(reposStore, permsStore, timeutil.Now, nil, PermsSyncerOptions{})
 
 	err = syncer.syncRepoPerms(ctx, repo.ID, false)
 	if err != nil {
@@ -28,8 +28,33 @@ var (
 		Name: "src_repoupdater_perms_syncer_sync_errors_total",
 		Help: "Total number of permissions sync errors",
 	}, []string{"type"})
+	metricsSyncTimeouts = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "src_repoupdater_perms_syncer_sync_timeouts_total",
+		Help: "Total number of permissions syncs that timed out",
+	}, []string{"type"})
 	metricsQueueSize = promauto.NewGauge(prometheus.GaugeOpts{
 		Name: "src_repoupdater_perms_syncer_queue_size",
 		Help: "The size of the sync request queue",
 	})
+	metricsQueueWaitSeconds = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "src_repoupdater_perms_syncer_queue_wait_seconds",
+		Help:    "Time sync requests spent in the queue before being synced",
+		Buckets: []float64{1, 5, 30, 60, 300, 900, 1800, 3600},
+	}, []string{"type", "priority"})
+	metricsQueueEvictions = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "src_repoupdater_perms_syncer_queue_evictions_total",
+		Help: "Total number of sync requests dropped because the queue is full",
+	}, []string{"type", "priority"})
+	metricsOldestQueuedAge = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "src_repo_perms_syncer_oldest_queued_age_seconds",
+		Help: "The age of the oldest sync request waiting in the queue",
+	})
+	metricsSkippedExcluded = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "src_repoupdater_perms_syncer_skipped_excluded_total",
+		Help: "Total number of sync requests skipped because the record is excluded",
+	}, []string{"type"})
+	metricsMaxReposExceeded = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "src_repoupdater_perms_syncer_max_repos_exceeded_total",
+		Help: "Total number of user syncs that matched more repositories than the configured maximum",
+	}, []string{"policy"})
 )
@@ -6,12 +6,20 @@ import (
 	"fmt"
 	"net/http"
 	"strconv"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/RoaringBitmap/roaring"
 	"github.com/cockroachdb/errors"
+	"github.com/derision-test/glock"
+	"github.com/gobwas/glob"
+	"github.com/hashicorp/go-multierror"
 	"github.com/inconshreveable/log15"
 	otlog "github.com/opentracing/opentracing-go/log"
+	"golang.org/x/sync/errgroup"
+	"golang.org/x/sync/singleflight"
+	"golang.org/x/time/rate"
 
 	"github.com/sourcegraph/sourcegraph/cmd/frontend/globals"
 	edb "github.com/sourcegraph/sourcegraph/enterprise/internal/database"
@@ -23,7 +31,9 @@ import (
 	"github.com/sourcegraph/sourcegraph/internal/errcode"
 	"github.com/sourcegraph/sourcegraph/internal/extsvc"
 	"github.com/sourcegraph/sourcegraph/internal/extsvc/github"
+	"github.com/sourcegraph/sourcegraph/internal/extsvc/perforce"
 	"github.com/sourcegraph/sourcegraph/internal/ratelimit"
+	"github.com/sourcegraph/sourcegraph/internal/rcache"
 	"github.com/sourcegraph/sourcegraph/internal/repos"
 	"github.com/sourcegraph/sourcegraph/internal/trace"
 	"github.com/sourcegraph/sourcegraph/internal/types"
@@ -44,8 +54,212 @@ type PermsSyncer struct {
 	clock func() time.Time
 	// The rate limit registry for code hosts.
 	rateLimiterRegistry *ratelimit.Registry
+	// The mutex guards the schedule intervals and limits, which may be changed
+	// while running.
+	scheduleMu sync.RWMutex
 	// The time duration of how often to re-compute schedule for users and repositories.
 	scheduleInterval time.Duration
+	// The time durations of how often to re-compute schedule for users and
+	// repositories respectively, zero value falls back to scheduleInterval.
+	userScheduleInterval time.Duration
+	repoScheduleInterval time.Duration
+	// The maximum number of users and repositories with oldest permissions to be
+	// scheduled in every schedule pass.
+	userScheduleLimit int
+	repoScheduleLimit int
+	// The channel is notified when the schedule intervals are changed, so that
+	// runSchedule resets its tickers.
+	scheduleIntervalChanged chan struct{}
+	// The clock of the schedule tickers, mockable for testing.
+	scheduleClock glock.Clock
+
+	// The users and repositories that should never be scheduled for permissions syncing.
+	exclusionsMu sync.RWMutex
+	exclusions   *syncExclusions
+
+	// The optional in-memory index for resolving private repositories by exact
+	// external repository specs, nil when it is not enabled.
+	repoIndex *repoIndex
+	// The cache of external account IDs to user IDs resolutions, which is reset
+	// on every schedule pass.
+	accountIDsCache *accountIDsCache
+	// The optional checkpoint of users and repositories that have completed
+	// syncing in the current cycle, nil when it is not enabled.
+	checkpoint *syncCheckpoint
+
+	// The maximum number of repositories a single user-centric sync is allowed to
+	// persist, zero value indicates no limit.
+	maxUserPermsRepos int
+	// The policy to apply when a user-centric sync exceeds maxUserPermsRepos.
+	maxUserPermsReposPolicy MaxReposPolicy
+	// Whether archived repositories are included in repository-centric scheduling.
+	includeArchivedRepos bool
+	// Whether errors of user-centric syncs are persisted in the database.
+	recordUserSyncErrors bool
+	// The maximum number of attempts of syncing a request before giving up on
+	// retrying, zero value indicates failed requests are not retried.
+	maxSyncAttempts int
+	// The maximum time duration a single sync is allowed to take, so that a slow
+	// code host does not block other requests in the queue. Zero value indicates
+	// no limit.
+	syncTimeout time.Duration
+	// Whether the scheduling queries are run concurrently.
+	concurrentSchedule bool
+	// The jitter applied to the next sync time of users and repositories with
+	// oldest permissions.
+	scheduleJitter *scheduleJitter
+	// The optional cooldown of low priority schedules of the same user or
+	// repository, nil when it is not enabled.
+	scheduleCooldown *scheduleCooldown
+
+	// Whether repository-centric syncs only write the changed halves of the
+	// permissions when previously stored permissions exist.
+	incrementalRepoSync bool
+
+	// The optional set of repositories synced without an authz provider that are
+	// touched in batches instead of individually, nil when it is not enabled.
+	repoTouches *repoTouches
+	// The time duration of how often to touch repositories in repoTouches.
+	repoTouchInterval time.Duration
+
+	// The syncs that are in progress, to be canceled by code host.
+	inflight *inflightSyncs
+	// Whether syncing and scheduling are paused, non-zero when paused. It must be
+	// accessed atomically.
+	paused int32
+
+	// The buffered sync events to be published, nil when no publisher is set.
+	events *asyncQueue
+	// The buffered sync results to be passed to the callback set by
+	// PermsSyncerOptions.OnSyncComplete, nil when it is not set.
+	syncResults *asyncQueue
+
+	// The mockable function to return all configured authz providers.
+	getProviders func() []authz.Provider
+	// The time duration of how long the computed provider maps are reused.
+	providersTTL time.Duration
+	// providersGroup ensures concurrent callers share a single computation of
+	// provider maps.
+	providersGroup singleflight.Group
+	providersMu    sync.Mutex
+	providers      *providerMaps
+	providersAt    time.Time
+}
+
+// providerMaps contains the authz providers keyed in different ways, the maps
+// are shared by all callers and must not be modified.
+type providerMaps struct {
+	byServiceID map[string]authz.Provider
+	byURN       map[string]authz.Provider
+}
+
+// MaxReposPolicy is the policy to apply when the number of repositories matched by
+// a user-centric sync exceeds the configured maximum.
+type MaxReposPolicy int
+
+const (
+	// MaxReposPolicyRefuse refuses to persist any permissions for the user and
+	// fails the sync.
+	MaxReposPolicyRefuse MaxReposPolicy = iota
+	// MaxReposPolicyTruncate persists permissions for up to the maximum number of
+	// repositories, in the order of repository IDs.
+	MaxReposPolicyTruncate
+)
+
+func (p MaxReposPolicy) String() string {
+	switch p {
+	case MaxReposPolicyRefuse:
+		return "refuse"
+	case MaxReposPolicyTruncate:
+		return "truncate"
+	}
+	return strconv.Itoa(int(p))
+}
+
+// syncExclusions contains the users and repositories that are excluded from
+// permissions syncing.
+type syncExclusions struct {
+	userIDs   map[int32]struct{}
+	repoIDs   map[api.RepoID]struct{}
+	repoNames []glob.Glob
+}
+
+// PermsSyncerOptions contains the optional features and tuning of a PermsSyncer.
+// The zero value disables all optional features and keeps the defaults.
+type PermsSyncerOptions struct {
+	// RepoIndexInterval enables an in-memory index of private repositories keyed
+	// by their external repository specs, which is rebuilt every given interval.
+	// It avoids a database round-trip for resolving exact repository matches in
+	// user-centric syncing. Zero value disables the index.
+	RepoIndexInterval time.Duration
+	// SyncCheckpointCycle enables recording users and repositories that have
+	// completed syncing, so that they are not synced again within the same cycle
+	// after a restart. Zero value disables the checkpoint.
+	SyncCheckpointCycle time.Duration
+	// RecordUserSyncErrors enables persisting the error of the most recent sync of
+	// every user in the database, which is cleared when the next sync of the user
+	// succeeds. Users whose most recent sync failed are listed by
+	// UsersWithSyncErrors.
+	RecordUserSyncErrors bool
+	// MaxUserPermsRepos is the maximum number of repositories a single
+	// user-centric sync is allowed to persist, and MaxUserPermsReposPolicy is the
+	// policy to apply when it is exceeded. Zero value indicates no limit.
+	MaxUserPermsRepos       int
+	MaxUserPermsReposPolicy MaxReposPolicy
+	// RepoTouchInterval makes syncing of repositories that have no authz provider,
+	// or whose code host denies access to their permissions, record them in
+	// memory instead of touching their permissions in the database one by one.
+	// Recorded repositories are not rescheduled, and are touched in a single batch
+	// every given interval. Zero value disables batching.
+	RepoTouchInterval time.Duration
+	// IncrementalRepoSync makes repository-centric syncs compare fetched
+	// permissions against the stored ones, and only write the bound users and the
+	// pending accounts that have changed. Syncs with partial results, or of
+	// repositories without stored permissions, always rewrite both in full.
+	IncrementalRepoSync bool
+	// MaxSyncAttempts makes failed requests be retried with exponential backoff
+	// until they have been attempted the given number of times, instead of waiting
+	// for the scheduler to pick them up again. Zero value disables retries.
+	MaxSyncAttempts int
+	// SyncTimeout is the maximum time duration a single sync is allowed to take,
+	// syncs that time out fail and are retried like other transient errors. Zero
+	// value indicates the default of 10 minutes, and a negative value disables
+	// the limit.
+	SyncTimeout time.Duration
+	// MaxQueueSize bounds the number of requests in the queue. When the queue is
+	// full, the request that would be synced last is dropped to admit a new one
+	// that would be synced earlier. High priority requests are always admitted.
+	// Zero value indicates no limit.
+	MaxQueueSize int
+	// ScheduleJitter is the maximum jitter applied to the next sync time of users
+	// and repositories with oldest permissions, as a percentage of the time since
+	// their last sync, capped at 100. Zero value indicates the default of 10, and
+	// a negative value disables the jitter.
+	ScheduleJitter float64
+	// ScheduleJitterSeed makes the schedule jitter deterministic when non-zero,
+	// i.e. the same user or repository is always moved by the same fraction of
+	// the jitter.
+	ScheduleJitterSeed int64
+	// MinScheduleInterval skips low priority schedules of users and repositories
+	// that have already been scheduled with low priority within the given
+	// interval. Schedules of higher priority (e.g. triggered by user actions) are
+	// never skipped. Zero value disables the cooldown.
+	MinScheduleInterval time.Duration
+	// ConcurrentSchedule makes the independent database queries of a schedule
+	// pass run concurrently, which reduces the latency of every pass at the cost
+	// of using more database connections at once.
+	ConcurrentSchedule bool
+	// ExcludeArchivedRepos skips archived private repositories in
+	// repository-centric scheduling, they are included by default.
+	ExcludeArchivedRepos bool
+	// EventPublisher is the optional publisher of sync events. Events are
+	// published asynchronously so that a slow or failing sink never blocks
+	// syncing.
+	EventPublisher SyncEventPublisher
+	// OnSyncComplete is the optional callback to be invoked with the result of
+	// every sync. It is invoked asynchronously from a single goroutine so that a
+	// slow callback never blocks syncing.
+	OnSyncComplete func(SyncResult)
 }
 
 // NewPermsSyncer returns a new permissions syncing manager.
@@ -54,15 +268,95 @@ func NewPermsSyncer(
 	permsStore *edb.PermsStore,
 	clock func() time.Time,
 	rateLimiterRegistry *ratelimit.Registry,
+	opts PermsSyncerOptions,
 ) *PermsSyncer {
-	return &PermsSyncer{
-		queue:               newRequestQueue(),
+	queue := newRequestQueue()
+	if clock != nil {
+		queue.clock = clock
+	}
+	queue.maxSize = opts.MaxQueueSize
+
+	s := &PermsSyncer{
+		queue:               queue,
 		reposStore:          reposStore,
 		permsStore:          permsStore,
 		clock:               clock,
 		rateLimiterRegistry: rateLimiterRegistry,
 		scheduleInterval:    time.Minute,
+		userScheduleLimit:   10,
+		repoScheduleLimit:   10,
+		scheduleClock:       glock.NewRealClock(),
+		scheduleJitter:      newScheduleJitter(10),
+		accountIDsCache:     newAccountIDsCache(),
+		inflight:            newInflightSyncs(),
+		getProviders: func() []authz.Provider {
+			_, ps := authz.GetProviders()
+			return ps
+		},
+		providersTTL:         5 * time.Second,
+		includeArchivedRepos: !opts.ExcludeArchivedRepos,
+		syncTimeout:          10 * time.Minute,
+
+		maxUserPermsRepos:       opts.MaxUserPermsRepos,
+		maxUserPermsReposPolicy: opts.MaxUserPermsReposPolicy,
+		recordUserSyncErrors:    opts.RecordUserSyncErrors,
+		maxSyncAttempts:         opts.MaxSyncAttempts,
+		concurrentSchedule:      opts.ConcurrentSchedule,
+		incrementalRepoSync:     opts.IncrementalRepoSync,
+
+		scheduleIntervalChanged: make(chan struct{}, 1),
+	}
+
+	if opts.SyncTimeout > 0 {
+		s.syncTimeout = opts.SyncTimeout
+	} else if opts.SyncTimeout < 0 {
+		s.syncTimeout = 0
+	}
+
+	if opts.ScheduleJitter > 100 {
+		s.scheduleJitter.percent = 100
+	} else if opts.ScheduleJitter > 0 {
+		s.scheduleJitter.percent = opts.ScheduleJitter
+	} else if opts.ScheduleJitter < 0 {
+		s.scheduleJitter.percent = 0
+	}
+	if opts.ScheduleJitterSeed != 0 {
+		s.scheduleJitter.seed = opts.ScheduleJitterSeed
+		s.scheduleJitter.seeded = true
+	}
+
+	if opts.RepoIndexInterval > 0 {
+		s.repoIndex = newRepoIndex(
+			func(ctx context.Context) ([]*types.Repo, error) {
+				return s.reposStore.RepoStore.List(ctx, database.ReposListOptions{
+					OnlyPrivate: true,
+				})
+			},
+			s.clock,
+			opts.RepoIndexInterval,
+		)
+	}
+	if opts.SyncCheckpointCycle > 0 {
+		s.checkpoint = newSyncCheckpoint(
+			rcache.NewWithTTL("perms_syncer_checkpoint", int(opts.SyncCheckpointCycle.Seconds())),
+			s.clock,
+			opts.SyncCheckpointCycle,
+		)
+	}
+	if opts.RepoTouchInterval > 0 {
+		s.repoTouches = newRepoTouches()
+		s.repoTouchInterval = opts.RepoTouchInterval
+	}
+	if opts.MinScheduleInterval > 0 {
+		s.scheduleCooldown = newScheduleCooldown(s.clock, opts.MinScheduleInterval)
 	}
+	if opts.EventPublisher != nil {
+		s.events = newEventQueue(opts.EventPublisher)
+	}
+	if opts.OnSyncComplete != nil {
+		s.syncResults = newSyncResultQueue(opts.OnSyncComplete)
+	}
+	return s
 }
 
 // ScheduleUsers schedules new permissions syncing requests for given users.
@@ -80,7 +374,7 @@ func (s *PermsSyncer) ScheduleUsers(ctx context.Context, userIDs ...int32) {
 	users := make([]scheduledUser, len(userIDs))
 	for i := range userIDs {
 		users[i] = scheduledUser{
-			priority: priorityHigh,
+			priority: PriorityHigh,
 			userID:   userIDs[i],
 			// NOTE: Have nextSyncAt with zero value (i.e. not set) gives it higher priority,
 			// as the request is most likely triggered by a user action from OSS namespace.
@@ -90,24 +384,247 @@ func (s *PermsSyncer) ScheduleUsers(ctx context.Context, userIDs ...int32) {
 	s.scheduleUsers(ctx, users...)
 }
 
-func (s *PermsSyncer) scheduleUsers(ctx context.Context, users ...scheduledUser) {
-	for _, u := range users {
+// UsersWithSyncErrors returns users whose most recent sync failed along with the
+// errors, most recent failures first and capped by the limit. Errors are only
+// recorded when PermsSyncerOptions.RecordUserSyncErrors is set.
+func (s *PermsSyncer) UsersWithSyncErrors(ctx context.Context, limit int) ([]*edb.UserSyncError, error) {
+	return s.permsStore.UsersWithSyncErrors(ctx, limit)
+}
+
+// Pause stops syncing and scheduling of permissions, e.g. during database
+// maintenance. Syncs already in progress run to completion and queued requests
+// are kept until Resume is called.
+func (s *PermsSyncer) Pause() {
+	atomic.StoreInt32(&s.paused, 1)
+	log15.Info("PermsSyncer.Pause")
+}
+
+// Resume continues syncing and scheduling of permissions after Pause.
+func (s *PermsSyncer) Resume() {
+	atomic.StoreInt32(&s.paused, 0)
+	log15.Info("PermsSyncer.Resume")
+
+	// Wake up runSync to process requests queued while paused.
+	notify(s.queue.notifyEnqueue)
+}
+
+// isPaused returns true if syncing and scheduling are paused.
+func (s *PermsSyncer) isPaused() bool {
+	return atomic.LoadInt32(&s.paused) != 0
+}
+
+// SetScheduleIntervals sets how often to re-compute schedule for users and
+// repositories independently, so that the cheaper side can be refreshed more
+// often than the other. A zero value keeps the interval set by
+// SetScheduleInterval for that side. It is safe to be called while running.
+func (s *PermsSyncer) SetScheduleIntervals(users, repos time.Duration) {
+	s.scheduleMu.Lock()
+	s.userScheduleInterval = users
+	s.repoScheduleInterval = repos
+	s.scheduleMu.Unlock()
+
+	notify(s.scheduleIntervalChanged)
+}
+
+// SetScheduleInterval overrides the default of one minute for how often to
+// re-compute schedule for users and repositories. It is safe to be called while
+// running, the running schedule starts over with the new interval immediately
+// instead of waiting out the old one.
+func (s *PermsSyncer) SetScheduleInterval(interval time.Duration) error {
+	if interval <= 0 {
+		return errors.Errorf("schedule interval must be positive but got %v", interval)
+	}
+
+	s.scheduleMu.Lock()
+	s.scheduleInterval = interval
+	s.scheduleMu.Unlock()
+
+	notify(s.scheduleIntervalChanged)
+	return nil
+}
+
+// SetScheduleLimits overrides the default of 10 for the maximum number of users
+// and repositories with oldest permissions to be scheduled in every schedule
+// pass. It is safe to be called while running, and takes effect from the next
+// schedule pass.
+func (s *PermsSyncer) SetScheduleLimits(users, repos int) error {
+	if users <= 0 || repos <= 0 {
+		return errors.Errorf("schedule limits must be positive but got %d users and %d repos", users, repos)
+	}
+
+	s.scheduleMu.Lock()
+	s.userScheduleLimit = users
+	s.repoScheduleLimit = repos
+	s.scheduleMu.Unlock()
+	return nil
+}
+
+// scheduleIntervals returns the current schedule intervals of users and
+// repositories.
+func (s *PermsSyncer) scheduleIntervals() (users, repos time.Duration) {
+	s.scheduleMu.RLock()
+	defer s.scheduleMu.RUnlock()
+
+	users, repos = s.userScheduleInterval, s.repoScheduleInterval
+	if users == 0 {
+		users = s.scheduleInterval
+	}
+	if repos == 0 {
+		repos = s.scheduleInterval
+	}
+	return users, repos
+}
+
+// scheduleLimits returns the current schedule limits of users and repositories.
+func (s *PermsSyncer) scheduleLimits() (users, repos int) {
+	s.scheduleMu.RLock()
+	defer s.scheduleMu.RUnlock()
+	return s.userScheduleLimit, s.repoScheduleLimit
+}
+
+// SetExclusions sets the users and repositories that should never be scheduled for
+// permissions syncing, including schedules triggered by user actions, webhooks and
+// retries of failed requests. Repositories can be excluded either by their IDs or
+// by glob patterns matching their names (e.g. "github.com/sourcegraph/*"). It
+// replaces any previously set exclusions, and is configured by the
+// "permissions.syncExclusions" site configuration in repo-updater.
+func (s *PermsSyncer) SetExclusions(userIDs []int32, repoIDs []api.RepoID, repoNamePatterns []string) error {
+	e := &syncExclusions{
+		userIDs: make(map[int32]struct{}, len(userIDs)),
+		repoIDs: make(map[api.RepoID]struct{}, len(repoIDs)),
+	}
+	for _, id := range userIDs {
+		e.userIDs[id] = struct{}{}
+	}
+	for _, id := range repoIDs {
+		e.repoIDs[id] = struct{}{}
+	}
+	for _, pattern := range repoNamePatterns {
+		g, err := glob.Compile(pattern)
+		if err != nil {
+			return errors.Wrapf(err, "compile repository name pattern %q", pattern)
+		}
+		e.repoNames = append(e.repoNames, g)
+	}
+
+	s.exclusionsMu.Lock()
+	s.exclusions = e
+	s.exclusionsMu.Unlock()
+	return nil
+}
+
+// filterExcluded returns the given requests without the ones for users and
+// repositories that are excluded from permissions syncing. Names of repositories
+// are only looked up when there are name patterns to match against.
+func (s *PermsSyncer) filterExcluded(ctx context.Context, metas []*requestMeta) ([]*requestMeta, error) {
+	// Exclusions are replaced as a whole and never modified, so the lock does not
+	// have to be held while repository names are listed.
+	s.exclusionsMu.RLock()
+	exclusions := s.exclusions
+	s.exclusionsMu.RUnlock()
+
+	if exclusions == nil || len(metas) == 0 {
+		return metas, nil
+	}
+
+	var names map[api.RepoID]api.RepoName
+	if len(exclusions.repoNames) > 0 {
+		var ids []api.RepoID
+		for _, meta := range metas {
+			if meta.Type == requestTypeRepo {
+				ids = append(ids, api.RepoID(meta.ID))
+			}
+		}
+		if len(ids) > 0 {
+			rs, err := s.reposStore.RepoStore.ListRepoNames(ctx, database.ReposListOptions{IDs: ids})
+			if err != nil {
+				return nil, errors.Wrap(err, "list repository names")
+			}
+			names = make(map[api.RepoID]api.RepoName, len(rs))
+			for _, r := range rs {
+				names[r.ID] = r.Name
+			}
+		}
+	}
+
+	filtered := make([]*requestMeta, 0, len(metas))
+	for _, meta := range metas {
+		switch meta.Type {
+		case requestTypeUser:
+			if _, ok := exclusions.userIDs[meta.ID]; ok {
+				metricsSkippedExcluded.WithLabelValues(meta.Type.label()).Inc()
+				log15.Debug("PermsSyncer.enqueue.excluded", "userID", meta.ID)
+				continue
+			}
+		case requestTypeRepo:
+			if exclusions.isRepoExcluded(api.RepoID(meta.ID), names[api.RepoID(meta.ID)]) {
+				metricsSkippedExcluded.WithLabelValues(meta.Type.label()).Inc()
+				log15.Debug("PermsSyncer.enqueue.excluded", "repoID", meta.ID)
+				continue
+			}
+		}
+		filtered = append(filtered, meta)
+	}
+	return filtered, nil
+}
+
+// isRepoExcluded returns true if the repository is excluded from permissions
+// syncing.
+func (e *syncExclusions) isRepoExcluded(id api.RepoID, name api.RepoName) bool {
+	if _, ok := e.repoIDs[id]; ok {
+		return true
+	}
+	if name == "" {
+		return false
+	}
+	for _, g := range e.repoNames {
+		if g.Match(string(name)) {
+			return true
+		}
+	}
+	return false
+}
+
+// enqueue adds the requests to the queue except for the excluded users and
+// repositories. Every request is enqueued through it regardless of whether it
+// is scheduled, triggered by a user action or a webhook, or retried.
+func (s *PermsSyncer) enqueue(ctx context.Context, metas ...*requestMeta) {
+	metas, err := s.filterExcluded(ctx, metas)
+	if err != nil {
+		log15.Error("PermsSyncer.enqueue.filterExcluded", "error", err)
+		return
+	}
+
+	for _, meta := range metas {
 		select {
 		case <-ctx.Done():
-			log15.Debug("PermsSyncer.scheduleUsers.canceled")
+			log15.Debug("PermsSyncer.enqueue.canceled")
 			return
 		default:
 		}
 
-		updated := s.queue.enqueue(&requestMeta{
+		updated := s.queue.enqueue(meta)
+		log15.Debug("PermsSyncer.queue.enqueued", "type", meta.Type.label(), "id", meta.ID, "updated", updated)
+	}
+}
+
+func (s *PermsSyncer) scheduleUsers(ctx context.Context, users ...scheduledUser) {
+	metas := make([]*requestMeta, 0, len(users))
+	for _, u := range users {
+		if u.priority == PriorityLow && s.scheduleCooldown != nil && !s.scheduleCooldown.allow(requestTypeUser, u.userID) {
+			log15.Debug("PermsSyncer.scheduleUsers.cooldown", "userID", u.userID)
+			continue
+		}
+
+		metas = append(metas, &requestMeta{
 			Priority:   u.priority,
 			Type:       requestTypeUser,
 			ID:         u.userID,
 			NextSyncAt: u.nextSyncAt,
 			NoPerms:    u.noPerms,
 		})
-		log15.Debug("PermsSyncer.queue.enqueued", "userID", u.userID, "updated", updated)
 	}
+	s.enqueue(ctx, metas...)
 }
 
 // ScheduleRepos schedules new permissions syncing requests for given repositories.
@@ -115,6 +632,13 @@ func (s *PermsSyncer) scheduleUsers(ctx context.Context, users ...scheduledUser)
 //
 // This method implements the repoupdater.Server.PermsSyncer in the OSS namespace.
 func (s *PermsSyncer) ScheduleRepos(ctx context.Context, repoIDs ...api.RepoID) {
+	s.ScheduleReposWithPriority(ctx, PriorityHigh, repoIDs...)
+}
+
+// ScheduleReposWithPriority schedules new permissions syncing requests for given
+// repositories in given priority, e.g. PriorityMedium for requests triggered by
+// webhooks of repository membership changes.
+func (s *PermsSyncer) ScheduleReposWithPriority(ctx context.Context, p Priority, repoIDs ...api.RepoID) {
 	if len(repoIDs) == 0 {
 		return
 	} else if s.isDisabled() {
@@ -125,10 +649,11 @@ func (s *PermsSyncer) ScheduleRepos(ctx context.Context, repoIDs ...api.RepoID)
 	repos := make([]scheduledRepo, len(repoIDs))
 	for i := range repoIDs {
 		repos[i] = scheduledRepo{
-			priority: priorityHigh,
+			priority: p,
 			repoID:   repoIDs[i],
 			// NOTE: Have nextSyncAt with zero value (i.e. not set) gives it higher priority,
-			// as the request is most likely triggered by a user action from OSS namespace.
+			// as the request is most likely triggered by a user action from OSS namespace
+			// or an external event.
 		}
 	}
 
@@ -136,52 +661,130 @@ func (s *PermsSyncer) ScheduleRepos(ctx context.Context, repoIDs ...api.RepoID)
 }
 
 func (s *PermsSyncer) scheduleRepos(ctx context.Context, repos ...scheduledRepo) {
+	metas := make([]*requestMeta, 0, len(repos))
 	for _, r := range repos {
-		select {
-		case <-ctx.Done():
-			log15.Debug("PermsSyncer.scheduleRepos.canceled")
-			return
-		default:
+		if r.priority == PriorityLow && s.scheduleCooldown != nil && !s.scheduleCooldown.allow(requestTypeRepo, int32(r.repoID)) {
+			log15.Debug("PermsSyncer.scheduleRepos.cooldown", "repoID", r.repoID)
+			continue
 		}
 
-		updated := s.queue.enqueue(&requestMeta{
+		metas = append(metas, &requestMeta{
 			Priority:   r.priority,
 			Type:       requestTypeRepo,
 			ID:         int32(r.repoID),
 			NextSyncAt: r.nextSyncAt,
 			NoPerms:    r.noPerms,
 		})
-		log15.Debug("PermsSyncer.queue.enqueued", "repoID", r.repoID, "updated", updated)
 	}
+	s.enqueue(ctx, metas...)
+}
+
+// providerMaps returns the authz providers configured in the external services.
+// The maps are computed at most once for concurrent callers and reused for the
+// duration of providersTTL.
+func (s *PermsSyncer) providerMaps() *providerMaps {
+	s.providersMu.Lock()
+	if s.providers != nil && time.Since(s.providersAt) < s.providersTTL {
+		defer s.providersMu.Unlock()
+		return s.providers
+	}
+	s.providersMu.Unlock()
+
+	v, _, _ := s.providersGroup.Do("providers", func() (interface{}, error) {
+		ps := s.getProviders()
+		m := &providerMaps{
+			byServiceID: make(map[string]authz.Provider, len(ps)),
+			byURN:       make(map[string]authz.Provider, len(ps)),
+		}
+		for _, p := range ps {
+			m.byServiceID[p.ServiceID()] = p
+			m.byURN[p.URN()] = p
+		}
+
+		s.providersMu.Lock()
+		s.providers = m
+		s.providersAt = time.Now()
+		s.providersMu.Unlock()
+		return m, nil
+	})
+	return v.(*providerMaps)
 }
 
 // providersByServiceID returns a list of authz.Provider configured in the external services.
-// Keys are ServiceID, e.g. "https://github.com/".
+// Keys are ServiceID, e.g. "https://github.com/". The returned map must not be modified.
 func (s *PermsSyncer) providersByServiceID() map[string]authz.Provider {
-	_, ps := authz.GetProviders()
-	providers := make(map[string]authz.Provider, len(ps))
-	for _, p := range ps {
-		providers[p.ServiceID()] = p
-	}
-	return providers
+	return s.providerMaps().byServiceID
 }
 
 // providersByURNs returns a list of authz.Provider configured in the external services.
-// Keys are URN, e.g. "extsvc:github:1".
+// Keys are URN, e.g. "extsvc:github:1". The returned map must not be modified.
 func (s *PermsSyncer) providersByURNs() map[string]authz.Provider {
-	_, ps := authz.GetProviders()
-	providers := make(map[string]authz.Provider, len(ps))
-	for _, p := range ps {
-		providers[p.URN()] = p
-	}
-	return providers
+	return s.providerMaps().byURN
 }
 
 // listPrivateRepoNamesByExact slices over the `repoSpecs` at pace of 10000
 // elements at a time to workaround Postgres' limit of 65535 bind parameters
 // using exact name matching. This method only includes private repository names
 // and does not do deduplication on the returned list.
+//
+// When the repository index is enabled, specs found in the index are resolved by
+// their IDs instead of matching external repository specs in the database.
 func (s *PermsSyncer) listPrivateRepoNamesByExact(ctx context.Context, repoSpecs []api.ExternalRepoSpec) ([]types.RepoName, error) {
+	if len(repoSpecs) == 0 {
+		return []types.RepoName{}, nil
+	} else if s.repoIndex == nil {
+		return s.listPrivateRepoNamesByExactFromDB(ctx, repoSpecs)
+	}
+
+	found, missing, err := s.repoIndex.lookup(ctx, repoSpecs)
+	if err != nil {
+		log15.Warn("PermsSyncer.listPrivateRepoNamesByExact.lookupIndex", "error", err)
+		return s.listPrivateRepoNamesByExactFromDB(ctx, repoSpecs)
+	}
+
+	// Repositories in the index may have been deleted, made public or renamed since
+	// the index was built, so the current names are loaded by IDs.
+	ids := make([]api.RepoID, len(found))
+	for i := range found {
+		ids[i] = found[i].ID
+	}
+	verified, err := s.listPrivateRepoNamesByIDs(ctx, ids)
+	if err != nil {
+		return nil, err
+	}
+
+	rs, err := s.listPrivateRepoNamesByExactFromDB(ctx, missing)
+	if err != nil {
+		return nil, err
+	}
+
+	// Finding any repository in the database that is missing from the index means
+	// new repositories have been added since the index was built, and any index
+	// hit not found in the database means repositories have been removed.
+	if len(rs) > 0 || len(verified) < len(found) {
+		s.repoIndex.invalidate()
+	}
+	return append(verified, rs...), nil
+}
+
+// listPrivateRepoNamesByIDs returns names of private repositories that are not
+// deleted with given IDs.
+func (s *PermsSyncer) listPrivateRepoNamesByIDs(ctx context.Context, ids []api.RepoID) ([]types.RepoName, error) {
+	if len(ids) == 0 {
+		return []types.RepoName{}, nil
+	}
+
+	return s.reposStore.RepoStore.ListRepoNames(ctx,
+		database.ReposListOptions{
+			IDs:         ids,
+			OnlyPrivate: true,
+		},
+	)
+}
+
+// listPrivateRepoNamesByExactFromDB does the same thing as listPrivateRepoNamesByExact
+// but always resolves repository names from the database.
+func (s *PermsSyncer) listPrivateRepoNamesByExactFromDB(ctx context.Context, repoSpecs []api.ExternalRepoSpec) ([]types.RepoName, error) {
 	if len(repoSpecs) == 0 {
 		return []types.RepoName{}, nil
 	}
@@ -214,27 +817,227 @@ func (s *PermsSyncer) listPrivateRepoNamesByExact(ctx context.Context, repoSpecs
 	return repoNames, nil
 }
 
+// relinkExternalAccount checks whether the account ID of the existing external
+// account has changed for the same external identity, and re-links the user to the
+// account with the new account ID if so. It returns the re-linked account, or nil
+// if no re-link was needed.
+//
+// This only applies to Perforce, whose external accounts are identified by email
+// addresses, thus the account ID changes whenever the email of the user changes.
+// A change is detected when the account ID is no longer one of the user's verified
+// emails, and the account fetched from the code host has the same username.
+func (s *PermsSyncer) relinkExternalAccount(
+	ctx context.Context,
+	provider authz.Provider,
+	user *types.User,
+	existing *extsvc.Account,
+	accts []*extsvc.Account,
+	emails []string,
+) (*extsvc.Account, error) {
+	if existing.ServiceType != extsvc.TypePerforce {
+		return nil, nil
+	}
+	for _, email := range emails {
+		if existing.AccountID == email {
+			return nil, nil
+		}
+	}
+
+	acct, err := provider.FetchAccount(ctx, user, accts, emails)
+	if err != nil {
+		return nil, errors.Wrap(err, "fetch account")
+	} else if acct == nil || acct.AccountID == existing.AccountID {
+		return nil, nil
+	}
+
+	oldData, err := perforce.GetExternalAccountData(&existing.AccountData)
+	if err != nil {
+		return nil, errors.Wrap(err, "get existing account data")
+	}
+	newData, err := perforce.GetExternalAccountData(&acct.AccountData)
+	if err != nil {
+		return nil, errors.Wrap(err, "get new account data")
+	}
+	if oldData == nil || newData == nil || oldData.Username != newData.Username {
+		return nil, nil
+	}
+
+	// NOTE: Associate the new account before deleting the old one, so a failure in
+	// between leaves the user with duplicated accounts rather than no account.
+	accounts := database.ExternalAccountsWith(s.reposStore)
+	err = accounts.AssociateUserAndSave(ctx, user.ID, acct.AccountSpec, acct.AccountData)
+	if err != nil {
+		return nil, errors.Wrap(err, "associate new account")
+	}
+	err = accounts.Delete(ctx, existing.ID)
+	if err != nil {
+		return nil, errors.Wrap(err, "delete old account")
+	}
+
+	log15.Info("PermsSyncer.relinkExternalAccount.relinked",
+		"userID", user.ID,
+		"authzProvider", provider.ServiceID(),
+		"username", newData.Username,
+	)
+	return acct, nil
+}
+
+// userSyncBatch contains the data resolved once and shared by user-centric syncs of
+// a batch of users.
+type userSyncBatch struct {
+	byServiceID map[string]authz.Provider
+	byURN       map[string]authz.Provider
+	// The GitHub and GitLab external services owned by users in the batch, keyed
+	// by user ID.
+	svcs map[int32][]*types.ExternalService
+	// Whether to only use external accounts that are already linked to users.
+	skipAccountLinking bool
+}
+
+// newUserSyncBatch resolves the authz providers and external services owned by
+// given users with a single listing.
+func (s *PermsSyncer) newUserSyncBatch(ctx context.Context, userIDs []int32) (*userSyncBatch, error) {
+	svcs, err := database.ExternalServicesWith(s.reposStore).List(ctx, database.ExternalServicesListOptions{
+		NamespaceUserIDs: userIDs,
+		Kinds:            []string{extsvc.KindGitHub, extsvc.KindGitLab},
+	})
+	if err != nil {
+		return nil, errors.Wrap(err, "fetching external services")
+	}
+
+	batch := &userSyncBatch{
+		byServiceID: s.providersByServiceID(),
+		byURN:       s.providersByURNs(),
+		svcs:        make(map[int32][]*types.ExternalService, len(userIDs)),
+	}
+	for _, svc := range svcs {
+		batch.svcs[svc.NamespaceUserID] = append(batch.svcs[svc.NamespaceUserID], svc)
+	}
+	return batch, nil
+}
+
+// SyncUsersOptions contains options for syncing a batch of users.
+type SyncUsersOptions struct {
+	// Users whose permissions have been synced within FreshFor are skipped, a zero
+	// value syncs all of the given users.
+	FreshFor time.Duration
+	// SkipAccountLinking skips fetching external accounts from authz providers for
+	// users who have not linked an account to the code host, and re-linking of
+	// existing accounts. Only accounts that are already linked (e.g. via OAuth)
+	// are used, which avoids a code host call per provider for every user.
+	SkipAccountLinking bool
+}
+
+// SyncUsers synchronously syncs permissions for given users as a batch, which is
+// meant for syncing a large number of users at once (e.g. mass logins after
+// enforcing SSO). Authz providers and external services of users are resolved once
+// and shared by the whole batch. Duplicated users are skipped.
+func (s *PermsSyncer) SyncUsers(ctx context.Context, opts SyncUsersOptions, userIDs ...int32) error {
+	if len(userIDs) == 0 {
+		return nil
+	} else if s.isDisabled() {
+		log15.Warn("PermsSyncer.SyncUsers.disabled", "userIDs", userIDs)
+		return nil
+	}
+
+	users := make([]*requestMeta, 0, len(userIDs))
+	seen := make(map[int32]struct{}, len(userIDs))
+	for _, id := range userIDs {
+		if _, ok := seen[id]; ok {
+			continue
+		}
+		seen[id] = struct{}{}
+		users = append(users, &requestMeta{Type: requestTypeUser, ID: id})
+	}
+	users, err := s.filterExcluded(ctx, users)
+	if err != nil {
+		return err
+	}
+
+	ids := make([]int32, 0, len(users))
+	for _, u := range users {
+		if opts.FreshFor > 0 {
+			p := &authz.UserPermissions{
+				UserID: u.ID,
+				Perm:   authz.Read,
+				Type:   authz.PermRepos,
+			}
+			err := s.permsStore.LoadUserPermissions(ctx, p)
+			if err != nil && err != authz.ErrPermsNotFound {
+				return errors.Wrapf(err, "load permissions of user %d", u.ID)
+			} else if err == nil && s.clock().Sub(p.SyncedAt) < opts.FreshFor {
+				log15.Debug("PermsSyncer.SyncUsers.fresh", "userID", u.ID, "syncedAt", p.SyncedAt)
+				continue
+			}
+		}
+		ids = append(ids, u.ID)
+	}
+	if len(ids) == 0 {
+		return nil
+	}
+
+	batch, err := s.newUserSyncBatch(ctx, ids)
+	if err != nil {
+		return errors.Wrap(err, "resolve user sync batch")
+	}
+	batch.skipAccountLinking = opts.SkipAccountLinking
+
+	var errs *multierror.Error
+	for _, id := range ids {
+		_, err = s.syncUserPermsInBatch(ctx, id, false, batch)
+		// Having no authz provider is not a failure, the permissions are still
+		// recorded as synced.
+		if err != nil && !errors.Is(err, authz.ErrNoProvider) {
+			errs = multierror.Append(errs, errors.Wrapf(err, "sync permissions of user %d", id))
+		}
+	}
+	return errs.ErrorOrNil()
+}
+
 // syncUserPerms processes permissions syncing request in user-centric way. When `noPerms` is true,
 // the method will use partial results to update permissions tables even when error occurs.
-func (s *PermsSyncer) syncUserPerms(ctx context.Context, userID int32, noPerms bool) (err error) {
+// It returns the repository IDs the user gained and lost access to as a result of the sync,
+// along with the time recorded as the user's permissions synced at. The diff is
+// returned along with authz.ErrNoProvider when none of the user's external
+// accounts and services is matched by an authz provider.
+func (s *PermsSyncer) syncUserPerms(ctx context.Context, userID int32, noPerms bool) (diff *edb.UserPermissionsDiff, err error) {
+	return s.syncUserPermsInBatch(ctx, userID, noPerms, nil)
+}
+
+// syncUserPermsInBatch does the same thing as syncUserPerms but reuses the data
+// resolved for the batch the user belongs to. The batch is optional, all data is
+// resolved for the user alone when it is nil.
+func (s *PermsSyncer) syncUserPermsInBatch(ctx context.Context, userID int32, noPerms bool, batch *userSyncBatch) (diff *edb.UserPermissionsDiff, err error) {
 	ctx, save := s.observe(ctx, "PermsSyncer.syncUserPerms", "")
-	defer save(requestTypeUser, userID, &err)
+	defer func() {
+		if tr := trace.TraceFromContext(ctx); tr != nil && diff != nil {
+			tr.LogFields(
+				otlog.Int("added", len(diff.Added)),
+				otlog.Int("removed", len(diff.Removed)),
+				otlog.String("syncedAt", diff.SyncedAt.String()),
+			)
+		}
+		save(requestTypeUser, userID, &err)
+	}()
+	if s.recordUserSyncErrors {
+		defer func() { s.recordUserSyncError(ctx, userID, err) }()
+	}
 
 	// NOTE: If a <repo_id, user_id> pair is present in the external_service_repos
 	//  table, the user has proven that they have read access to the repository.
 	repoIDs, err := s.reposStore.ListExternalServicePrivateRepoIDsByUserID(ctx, userID)
 	if err != nil {
-		return errors.Wrap(err, "list external service repo IDs by user ID")
+		return nil, errors.Wrap(err, "list external service repo IDs by user ID")
 	}
 
 	user, err := database.UsersWith(s.reposStore).GetByID(ctx, userID)
 	if err != nil {
-		return errors.Wrap(err, "get user")
+		return nil, errors.Wrap(err, "get user")
 	}
 
 	accts, err := s.permsStore.ListExternalAccounts(ctx, user.ID)
 	if err != nil {
-		return errors.Wrap(err, "list external accounts")
+		return nil, errors.Wrap(err, "list external accounts")
 	}
 
 	serviceToAccounts := make(map[string]*extsvc.Account)
@@ -249,7 +1052,7 @@ func (s *PermsSyncer) syncUserPerms(ctx context.Context, userID int32, noPerms b
 		},
 	)
 	if err != nil {
-		return errors.Wrap(err, "list user verified emails")
+		return nil, errors.Wrap(err, "list user verified emails")
 	}
 
 	emails := make([]string, len(userEmails))
@@ -257,14 +1060,40 @@ func (s *PermsSyncer) syncUserPerms(ctx context.Context, userID int32, noPerms b
 		emails[i] = userEmails[i].Email
 	}
 
-	byServiceID := s.providersByServiceID()
+	var byServiceID, byURN map[string]authz.Provider
+	if batch != nil {
+		byServiceID, byURN = batch.byServiceID, batch.byURN
+	} else {
+		byServiceID, byURN = s.providersByServiceID(), s.providersByURNs()
+	}
 	accounts := database.ExternalAccountsWith(s.reposStore)
 
 	// Check if the user has an external account for every authz provider respectively,
-	// and try to fetch the account when not.
-	for _, provider := range byServiceID {
-		_, ok := serviceToAccounts[provider.ServiceType()+":"+provider.ServiceID()]
+	// and try to fetch the account when not. Only accounts that are already linked
+	// are used when account linking is skipped.
+	linkingProviders := byServiceID
+	if batch != nil && batch.skipAccountLinking {
+		linkingProviders = nil
+	}
+	for _, provider := range linkingProviders {
+		existing, ok := serviceToAccounts[provider.ServiceType()+":"+provider.ServiceID()]
 		if ok {
+			relinked, err := s.relinkExternalAccount(ctx, provider, user, existing, accts, emails)
+			if err != nil {
+				log15.Error("Could not re-link external account to user",
+					"userID", user.ID,
+					"authzProvider", provider.ServiceID(),
+					"error", err)
+				continue
+			}
+
+			if relinked != nil {
+				for i := range accts {
+					if accts[i] == existing {
+						accts[i] = relinked
+					}
+				}
+			}
 			continue
 		}
 
@@ -296,17 +1125,20 @@ func (s *PermsSyncer) syncUserPerms(ctx context.Context, userID int32, noPerms b
 	}
 
 	// Fetch all the users external services
-	externalServices := database.ExternalServicesWith(s.reposStore)
-	svcs, err := externalServices.List(ctx, database.ExternalServicesListOptions{
-		NamespaceUserID: userID,
-		Kinds:           []string{extsvc.KindGitHub, extsvc.KindGitLab},
-	})
-	if err != nil {
-		return errors.Wrap(err, "fetching external services")
+	var svcs []*types.ExternalService
+	if batch != nil {
+		svcs = batch.svcs[userID]
+	} else {
+		externalServices := database.ExternalServicesWith(s.reposStore)
+		svcs, err = externalServices.List(ctx, database.ExternalServicesListOptions{
+			NamespaceUserID: userID,
+			Kinds:           []string{extsvc.KindGitHub, extsvc.KindGitLab},
+		})
+		if err != nil {
+			return nil, errors.Wrap(err, "fetching external services")
+		}
 	}
 
-	byURN := s.providersByURNs()
-
 	var accountsOrServices []interface{}
 	for i := range accts {
 		accountsOrServices = append(accountsOrServices, accts[i])
@@ -317,6 +1149,17 @@ func (s *PermsSyncer) syncUserPerms(ctx context.Context, userID int32, noPerms b
 
 	var repoSpecs, includeContainsSpecs, excludeContainsSpecs []api.ExternalRepoSpec
 
+	// The permissions fetched for each external account in this sync, so that
+	// duplicated accounts of the user (e.g. linked through multiple external
+	// services of the same code host) are only fetched once.
+	type fetchedKey struct {
+		serviceID string
+		accountID string
+	}
+	fetched := make(map[fetchedKey]*authz.ExternalUserPermissions)
+
+	// Whether any external account or service is matched by an authz provider.
+	hasProvider := false
 	for _, accountOrService := range accountsOrServices {
 		var extIDs *authz.ExternalUserPermissions
 		var provider authz.Provider
@@ -328,11 +1171,25 @@ func (s *PermsSyncer) syncUserPerms(ctx context.Context, userID int32, noPerms b
 				// We have no authz provider configured for this external account or service
 				continue
 			}
+			hasProvider = true
 
-			if err := s.waitForRateLimit(ctx, provider.ServiceID(), 1); err != nil {
-				return errors.Wrap(err, "wait for rate limiter")
+			key := fetchedKey{serviceID: v.ServiceID, accountID: v.AccountID}
+			if cached, ok := fetched[key]; ok {
+				extIDs, err = cached, nil
+			} else {
+				var calls int
+				calls, err = s.estimateUserPermsCalls(ctx, provider, user.ID)
+				if err != nil {
+					return nil, errors.Wrap(err, "estimate user permissions calls")
+				}
+				if err := s.waitForRateLimit(ctx, provider.ServiceID(), calls); err != nil {
+					return nil, errors.Wrap(err, "wait for rate limiter")
+				}
+				extIDs, err = provider.FetchUserPerms(ctx, v)
+				if err == nil {
+					fetched[key] = extIDs
+				}
 			}
-			extIDs, err = provider.FetchUserPerms(ctx, v)
 
 			if err != nil {
 				// The "401 Unauthorized" is returned by code hosts when the token is no longer valid
@@ -346,7 +1203,7 @@ func (s *PermsSyncer) syncUserPerms(ctx context.Context, userID int32, noPerms b
 				if unauthorized || accountSuspended || forbidden {
 					err = accounts.TouchExpired(ctx, v.ID)
 					if err != nil {
-						return errors.Wrapf(err, "set expired for external account %d", v.ID)
+						return nil, errors.Wrapf(err, "set expired for external account %d", v.ID)
 					}
 					log15.Debug("PermsSyncer.syncUserPerms.setExternalAccountExpired",
 						"userID", user.ID, "id", v.ID,
@@ -358,13 +1215,14 @@ func (s *PermsSyncer) syncUserPerms(ctx context.Context, userID int32, noPerms b
 
 				// Process partial results if this is an initial fetch.
 				if !noPerms {
-					return errors.Wrap(err, "fetch user permissions")
+					return nil, errors.Wrap(err, "fetch user permissions")
 				}
 				log15.Warn("PermsSyncer.syncUserPerms.proceedWithPartialResults", "userID", user.ID, "error", err)
+				s.inflight.setPartial(ctx)
 			} else {
 				err = accounts.TouchLastValid(ctx, v.ID)
 				if err != nil {
-					return errors.Wrapf(err, "set last valid for external account %d", v.ID)
+					return nil, errors.Wrapf(err, "set last valid for external account %d", v.ID)
 				}
 			}
 
@@ -374,6 +1232,7 @@ func (s *PermsSyncer) syncUserPerms(ctx context.Context, userID int32, noPerms b
 				// We have no authz provider configured for this external service or service
 				continue
 			}
+			hasProvider = true
 			token, err := extsvc.ExtractToken(v.Config, v.Kind)
 			if err != nil {
 				log15.Warn("Extracting token from external service config", "error", err, "id", v.ID)
@@ -385,7 +1244,7 @@ func (s *PermsSyncer) syncUserPerms(ctx context.Context, userID int32, noPerms b
 			}
 
 			if err := s.waitForRateLimit(ctx, provider.ServiceID(), 1); err != nil {
-				return errors.Wrap(err, "wait for rate limiter")
+				return nil, errors.Wrap(err, "wait for rate limiter")
 			}
 
 			extIDs, err = provider.FetchUserPermsByToken(ctx, token)
@@ -441,7 +1300,7 @@ func (s *PermsSyncer) syncUserPerms(ctx context.Context, userID int32, noPerms b
 	// Get corresponding internal database IDs
 	repoNames, err := s.listPrivateRepoNamesByExact(ctx, repoSpecs)
 	if err != nil {
-		return errors.Wrap(err, "list external repositories by exact matching")
+		return nil, errors.Wrap(err, "list external repositories by exact matching")
 	}
 
 	// Exclusions are relative to inclusions, so if there is no inclusion, exclusion
@@ -455,7 +1314,7 @@ func (s *PermsSyncer) syncUserPerms(ctx context.Context, userID int32, noPerms b
 			},
 		)
 		if err != nil {
-			return errors.Wrap(err, "list external repositories by contains matching")
+			return nil, errors.Wrap(err, "list external repositories by contains matching")
 		}
 		repoNames = append(repoNames, rs...)
 	}
@@ -474,18 +1333,89 @@ func (s *PermsSyncer) syncUserPerms(ctx context.Context, userID int32, noPerms b
 		p.IDs.Add(uint32(repoIDs[i]))
 	}
 
-	err = s.permsStore.SetUserPermissions(ctx, p)
+	if s.maxUserPermsRepos > 0 && p.IDs.GetCardinality() > uint64(s.maxUserPermsRepos) {
+		metricsMaxReposExceeded.WithLabelValues(s.maxUserPermsReposPolicy.String()).Inc()
+		log15.Error("PermsSyncer.syncUserPerms.maxReposExceeded",
+			"userID", user.ID,
+			"count", p.IDs.GetCardinality(),
+			"max", s.maxUserPermsRepos,
+			"policy", s.maxUserPermsReposPolicy,
+		)
+
+		if s.maxUserPermsReposPolicy != MaxReposPolicyTruncate {
+			return nil, errors.Errorf("number of repositories %d exceeds the maximum %d", p.IDs.GetCardinality(), s.maxUserPermsRepos)
+		}
+		p.IDs = roaring.BitmapOf(p.IDs.ToArray()[:s.maxUserPermsRepos]...)
+	}
+
+	diff, err = s.permsStore.SetUserPermissionsWithDiff(ctx, p)
 	if err != nil {
-		return errors.Wrap(err, "set user permissions")
+		return nil, errors.Wrap(err, "set user permissions")
 	}
 
-	log15.Debug("PermsSyncer.syncUserPerms.synced", "userID", user.ID)
-	return nil
+	log15.Debug("PermsSyncer.syncUserPerms.synced", "userID", user.ID, "added", len(diff.Added), "removed", len(diff.Removed))
+	s.inflight.setResultSize(ctx, int(p.IDs.GetCardinality()))
+
+	// Permissions granted via external services are still persisted above, but
+	// callers should know that none of the code hosts enforces permissions for the
+	// user.
+	if !hasProvider {
+		return diff, authz.ErrNoProvider
+	}
+	return diff, nil
+}
+
+// recordUserSyncError persists the error of the user's sync, or clears the
+// previously persisted error if the sync succeeded. Having no authz provider is
+// not considered as an error.
+func (s *PermsSyncer) recordUserSyncError(ctx context.Context, userID int32, syncErr error) {
+	// The sync was interrupted rather than failed.
+	if ctx.Err() != nil {
+		return
+	}
+
+	var err error
+	if syncErr == nil || errors.Is(syncErr, authz.ErrNoProvider) {
+		err = s.permsStore.ClearUserSyncError(ctx, userID)
+	} else {
+		err = s.permsStore.SetUserSyncError(ctx, userID, syncErr.Error())
+	}
+	if err != nil {
+		log15.Error("PermsSyncer.recordUserSyncError", "userID", userID, "error", err)
+	}
+}
+
+// getUserIDsByExternalAccounts returns all user IDs matched by given external
+// accounts as "account ID -> user ID". Resolutions are cached until the next
+// schedule pass, so only account IDs that have not been resolved in the current
+// pass are looked up from the database.
+func (s *PermsSyncer) getUserIDsByExternalAccounts(ctx context.Context, accounts *extsvc.Accounts) (map[string]int32, error) {
+	userIDs, missing := s.accountIDsCache.get(accounts)
+	if len(missing) == 0 {
+		return userIDs, nil
+	}
+
+	missingAccounts := &extsvc.Accounts{
+		ServiceType: accounts.ServiceType,
+		ServiceID:   accounts.ServiceID,
+		AccountIDs:  missing,
+	}
+	resolved, err := s.permsStore.GetUserIDsByExternalAccounts(ctx, missingAccounts)
+	if err != nil {
+		return nil, err
+	}
+	s.accountIDsCache.set(missingAccounts, resolved)
+
+	for accountID, userID := range resolved {
+		userIDs[accountID] = userID
+	}
+	return userIDs, nil
 }
 
 // syncRepoPerms processes permissions syncing request in repository-centric way.
 // When `noPerms` is true, the method will use partial results to update permissions
-// tables even when error occurs.
+// tables even when error occurs. It returns authz.ErrNoProvider when no authz
+// provider is configured for the repository.
 func (s *PermsSyncer) syncRepoPerms(ctx context.Context, repoID api.RepoID, noPerms bool) (err error) {
 	ctx, save := s.observe(ctx, "PermsSyncer.syncRepoPerms", "")
 	defer save(requestTypeRepo, int32(repoID), &err)
@@ -532,13 +1462,28 @@ func (s *PermsSyncer) syncRepoPerms(ctx context.Context, repoID api.RepoID, noPe
 			"private", repo.Private,
 		)
 
+		// Repositories without a provider are touched in batches when enabled, so
+		// that losing the provider of a whole code host does not result in a
+		// database write for every one of its repositories.
+		if s.repoTouches != nil {
+			s.repoTouches.add(repo.ID)
+			return authz.ErrNoProvider
+		}
+
 		// We have no authz provider configured for the repository.
 		// However, we need to upsert the dummy record in order to
 		// prevent scheduler keep scheduling this repository.
-		return errors.Wrap(s.permsStore.TouchRepoPermissions(ctx, int32(repoID)), "touch repository permissions")
+		if err = s.permsStore.TouchRepoPermissions(ctx, int32(repoID)); err != nil {
+			return errors.Wrap(err, "touch repository permissions")
+		}
+		return authz.ErrNoProvider
 	}
 
-	if err := s.waitForRateLimit(ctx, provider.ServiceID(), 1); err != nil {
+	calls, err := s.estimateRepoPermsCalls(ctx, provider, repoID)
+	if err != nil {
+		return errors.Wrap(err, "estimate repository permissions calls")
+	}
+	if err := s.waitForRateLimit(ctx, provider.ServiceID(), calls); err != nil {
 		return errors.Wrap(err, "wait for rate limiter")
 	}
 
@@ -554,15 +1499,22 @@ func (s *PermsSyncer) syncRepoPerms(ctx context.Context, repoID api.RepoID, noPe
 	var e *github.APIError
 	if errors.As(err, &e) && e.Code == http.StatusNotFound {
 		log15.Warn("PermsSyncer.syncRepoPerms.ignoreUnauthorizedAPIError", "repoID", repo.ID, "err", err, "suggestion", "GitHub access token user may only have read access to the repository, but needs write for permissions")
+		if s.repoTouches != nil {
+			s.repoTouches.add(repo.ID)
+			return nil
+		}
 		return errors.Wrap(s.permsStore.TouchRepoPermissions(ctx, int32(repoID)), "touch repository permissions")
 	}
 
+	partial := false
 	if err != nil {
 		// Process partial results if this is an initial fetch.
 		if !noPerms {
 			return errors.Wrap(err, "fetch repository permissions")
 		}
 		log15.Warn("PermsSyncer.syncRepoPerms.proceedWithPartialResults", "repoID", repo.ID, "err", err)
+		s.inflight.setPartial(ctx)
+		partial = true
 	}
 
 	pendingAccountIDsSet := make(map[string]struct{})
@@ -574,7 +1526,7 @@ func (s *PermsSyncer) syncRepoPerms(ctx context.Context, repoID api.RepoID, noPe
 		}
 
 		// Get corresponding internal database IDs
-		accountIDToUserID, err = s.permsStore.GetUserIDsByExternalAccounts(ctx, &extsvc.Accounts{
+		accountIDToUserID, err = s.getUserIDsByExternalAccounts(ctx, &extsvc.Accounts{
 			ServiceType: provider.ServiceType(),
 			ServiceID:   provider.ServiceID(),
 			AccountIDs:  accountIDs,
@@ -625,47 +1577,292 @@ func (s *PermsSyncer) syncRepoPerms(ctx context.Context, repoID api.RepoID, noPe
 		AccountIDs:  pendingAccountIDs,
 	}
 
-	if err = txs.SetRepoPermissions(ctx, p); err != nil {
-		return errors.Wrap(err, "set repository permissions")
-	} else if err = txs.SetRepoPendingPermissions(ctx, accounts, p); err != nil {
-		return errors.Wrap(err, "set repository pending permissions")
+	// Partial results may be missing users who still have access, only a full
+	// rewrite is allowed to drop them.
+	usersChanged, pendingChanged := true, true
+	if s.incrementalRepoSync && !partial {
+		usersChanged, pendingChanged, err = repoPermsChanged(ctx, txs, p, accounts)
+		if err != nil {
+			return errors.Wrap(err, "compare repository permissions")
+		}
+	}
+
+	if usersChanged {
+		if err = txs.SetRepoPermissions(ctx, p); err != nil {
+			return errors.Wrap(err, "set repository permissions")
+		}
+	} else if err = txs.TouchRepoPermissions(ctx, int32(repoID)); err != nil {
+		// The synced time must still be updated for the rolling schedule.
+		return errors.Wrap(err, "touch repository permissions")
+	}
+	if pendingChanged {
+		// SetRepoPendingPermissions resets p.UserIDs to IDs of pending accounts.
+		pending := &authz.RepoPermissions{
+			RepoID: p.RepoID,
+			Perm:   p.Perm,
+		}
+		if err = txs.SetRepoPendingPermissions(ctx, accounts, pending); err != nil {
+			return errors.Wrap(err, "set repository pending permissions")
+		}
 	}
 
 	log15.Debug("PermsSyncer.syncRepoPerms.synced", "repoID", repo.ID, "name", repo.Name, "count", len(extAccountIDs))
+	s.inflight.setResultSize(ctx, int(p.UserIDs.GetCardinality()))
 	return nil
 }
 
-// waitForRateLimit blocks until rate limit permits n events to happen. It returns
-// an error if n exceeds the limiter's burst size, the context is canceled, or the
-// expected wait time exceeds the context's deadline. The burst limit is ignored if
-// the rate limit is Inf.
+// repoPermsChanged compares the users and the pending accounts of the given
+// permissions against the ones currently stored, and returns which of them have
+// changed. Both are reported as changed when there are no stored permissions.
+func repoPermsChanged(ctx context.Context, store *edb.PermsStore, p *authz.RepoPermissions, accounts *extsvc.Accounts) (usersChanged, pendingChanged bool, err error) {
+	stored, err := store.ExplainRepoPermissions(ctx, p.RepoID, p.Perm)
+	if err != nil {
+		return false, false, err
+	}
+	if len(stored.UserIDs) == 0 && len(stored.PendingAccounts) == 0 {
+		return true, true, nil
+	}
+
+	storedUserIDs := roaring.NewBitmap()
+	for _, id := range stored.UserIDs {
+		storedUserIDs.Add(uint32(id))
+	}
+	usersChanged = !storedUserIDs.Equals(p.UserIDs)
+
+	storedAccountIDs := make(map[string]struct{}, len(stored.PendingAccounts))
+	for _, spec := range stored.PendingAccounts {
+		if spec.ServiceType != accounts.ServiceType || spec.ServiceID != accounts.ServiceID {
+			// Accounts of other code hosts are removed by a full rewrite.
+			return usersChanged, true, nil
+		}
+		storedAccountIDs[spec.AccountID] = struct{}{}
+	}
+	pendingChanged = len(storedAccountIDs) != len(accounts.AccountIDs)
+	for _, aid := range accounts.AccountIDs {
+		if _, ok := storedAccountIDs[aid]; !ok {
+			pendingChanged = true
+			break
+		}
+	}
+	return usersChanged, pendingChanged, nil
+}
+
+// CancelByServiceID cancels all in-flight syncs that have talked to the code host
+// of given service ID, and removes queued repository-centric requests for
+// repositories of the code host. It is useful to pause syncing cleanly while
+// credentials of the code host are being rotated, canceled syncs fail without
+// persisting anything nor marking any external account as expired.
+//
+// User-centric requests span all code hosts of a user and are kept in the queue.
+func (s *PermsSyncer) CancelByServiceID(serviceID string) {
+	canceled := s.inflight.cancel(serviceID)
+
+	removed := 0
+	if repoIDs := s.queue.queuedIDs(requestTypeRepo); len(repoIDs) > 0 {
+		ids := make([]api.RepoID, len(repoIDs))
+		for i := range repoIDs {
+			ids[i] = api.RepoID(repoIDs[i])
+		}
+		rs, err := s.reposStore.RepoStore.List(context.Background(), database.ReposListOptions{
+			IDs: ids,
+		})
+		if err != nil {
+			log15.Error("PermsSyncer.CancelByServiceID.listRepos", "serviceID", serviceID, "error", err)
+		}
+		for _, r := range rs {
+			if r.ExternalRepo.ServiceID == serviceID && s.queue.remove(requestTypeRepo, int32(r.ID), false) {
+				removed++
+			}
+		}
+	}
+
+	log15.Info("PermsSyncer.CancelByServiceID", "serviceID", serviceID, "canceled", canceled, "removed", removed)
+}
+
+// CancelUser removes the queued permissions syncing request of given user, or
+// cancels the sync if it is in progress. It is a no-op if there is no request of
+// the user.
+func (s *PermsSyncer) CancelUser(userID int32) {
+	s.cancelRequest(requestTypeUser, userID)
+}
+
+// CancelRepo removes the queued permissions syncing request of given repository,
+// or cancels the sync if it is in progress. It is a no-op if there is no request
+// of the repository.
+func (s *PermsSyncer) CancelRepo(repoID api.RepoID) {
+	s.cancelRequest(requestTypeRepo, int32(repoID))
+}
+
+func (s *PermsSyncer) cancelRequest(typ requestType, id int32) {
+	if s.queue.remove(typ, id, false) {
+		log15.Info("PermsSyncer.cancelRequest.removed", "type", typ, "id", id)
+		return
+	}
+
+	// The acquired request is removed right away rather than when the canceled
+	// sync returns, so that it no longer shows up in the queue.
+	if s.inflight.cancelRequest(typ, id) {
+		s.queue.remove(typ, id, true)
+		log15.Info("PermsSyncer.cancelRequest.canceled", "type", typ, "id", id)
+	}
+}
+
+// waitForRateLimit blocks until rate limit permits n events to happen. Waits for
+// more than the limiter's burst size are split into multiple waits of at most the
+// burst size. It returns an error if the context is canceled, or the expected
+// wait time exceeds the context's deadline.
 func (s *PermsSyncer) waitForRateLimit(ctx context.Context, serviceID string, n int) error {
+	// Every call to a code host is preceded by waiting for its rate limit.
+	s.inflight.use(ctx, serviceID)
+
 	if s.rateLimiterRegistry == nil {
 		return nil
 	}
 
 	rl := s.rateLimiterRegistry.Get(serviceID)
-	if err := rl.WaitN(ctx, n); err != nil {
-		return err
+	for n > 0 {
+		// Waiting for more than the burst is never satisfied, wait for as much as
+		// the limiter allows at once instead.
+		wait := n
+		if rl.Limit() != rate.Inf && rl.Burst() > 0 && wait > rl.Burst() {
+			wait = rl.Burst()
+		}
+		if err := rl.WaitN(ctx, wait); err != nil {
+			return err
+		}
+		n -= wait
 	}
 	return nil
 }
 
+// estimateRepoPermsCalls returns the number of API calls the provider is
+// expected to make for fetching permissions of the repository, based on the
+// number of users who had access to the repository as of the last sync. It returns
+// 1 if the provider does not make such estimations.
+func (s *PermsSyncer) estimateRepoPermsCalls(ctx context.Context, provider authz.Provider, repoID api.RepoID) (int, error) {
+	estimator, ok := provider.(authz.RepoPermsCallsEstimator)
+	if !ok {
+		return 1, nil
+	}
+
+	p := &authz.RepoPermissions{
+		RepoID: int32(repoID),
+		Perm:   authz.Read,
+	}
+	err := s.permsStore.LoadRepoPermissions(ctx, p)
+	if err != nil && err != authz.ErrPermsNotFound {
+		return 0, errors.Wrap(err, "load repository permissions")
+	}
+
+	knownAccounts := 0
+	if p.UserIDs != nil {
+		knownAccounts = int(p.UserIDs.GetCardinality())
+	}
+
+	calls := estimator.EstimateRepoPermsCalls(knownAccounts)
+	if calls < 1 {
+		calls = 1
+	}
+	return calls, nil
+}
+
+// estimateUserPermsCalls returns the number of API calls the provider is
+// expected to make for fetching permissions of the user, based on the number of
+// repositories the user had access to as of the last sync. It returns 1 if the
+// provider does not make such estimations.
+func (s *PermsSyncer) estimateUserPermsCalls(ctx context.Context, provider authz.Provider, userID int32) (int, error) {
+	estimator, ok := provider.(authz.UserPermsCallsEstimator)
+	if !ok {
+		return 1, nil
+	}
+
+	p := &authz.UserPermissions{
+		UserID: userID,
+		Perm:   authz.Read,
+		Type:   authz.PermRepos,
+	}
+	err := s.permsStore.LoadUserPermissions(ctx, p)
+	if err != nil && err != authz.ErrPermsNotFound {
+		return 0, errors.Wrap(err, "load user permissions")
+	}
+
+	knownRepos := 0
+	if p.IDs != nil {
+		knownRepos = int(p.IDs.GetCardinality())
+	}
+
+	calls := estimator.EstimateUserPermsCalls(knownRepos)
+	if calls < 1 {
+		calls = 1
+	}
+	return calls, nil
+}
+
 // syncPerms processes the permissions syncing request and remove the request from
 // the queue once it is done (independent of success or failure).
-func (s *PermsSyncer) syncPerms(ctx context.Context, request *syncRequest) error {
-	defer s.queue.remove(request.Type, request.ID, true)
+func (s *PermsSyncer) syncPerms(ctx context.Context, request *syncRequest) (err error) {
+	// The context of the sync is canceled once it is done, the request is retried
+	// with the context it was started with.
+	defer func(ctx context.Context) {
+		s.queue.remove(request.Type, request.ID, true)
+
+		// The request must be removed from the queue before being retried, as
+		// enqueuing an acquired request is a no-op.
+		if err != nil && s.maxSyncAttempts > 0 {
+			s.retry(ctx, request, err)
+		}
+	}(ctx)
+
+	ctx, done := s.inflight.start(ctx, request.Type, request.ID)
+	defer done()
+
+	if s.syncResults != nil {
+		// Deferred after done so that the in-flight sync is still accessible.
+		started := s.clock()
+		defer func() {
+			s.enqueueSyncResult(ctx, request, s.clock().Sub(started), err)
+		}()
+	}
+
+	if s.syncTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, s.syncTimeout)
+		defer cancel()
+	}
+
+	// Only scheduled requests are skipped, user-triggered requests always sync.
+	if s.checkpoint != nil && request.Priority == PriorityLow && s.checkpoint.completed(request.Type, request.ID) {
+		log15.Debug("PermsSyncer.syncPerms.checkpointed", "type", request.Type, "id", request.ID)
+		return nil
+	}
 
-	var err error
 	switch request.Type {
 	case requestTypeUser:
-		err = s.syncUserPerms(ctx, request.ID, request.NoPerms)
+		_, err = s.syncUserPerms(ctx, request.ID, request.NoPerms)
 	case requestTypeRepo:
 		err = s.syncRepoPerms(ctx, api.RepoID(request.ID), request.NoPerms)
 	default:
 		err = errors.Errorf("unexpected request type: %v", request.Type)
 	}
 
+	// Having no authz provider is not a failure for scheduled syncing, the
+	// permissions are still recorded as synced.
+	if errors.Is(err, authz.ErrNoProvider) {
+		log15.Debug("PermsSyncer.syncPerms.noProvider", "type", request.Type, "id", request.ID)
+		err = nil
+	}
+
+	if err != nil && errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		log15.Warn("PermsSyncer.syncPerms.timeout", "type", request.Type, "id", request.ID, "timeout", s.syncTimeout)
+		metricsSyncTimeouts.WithLabelValues(request.Type.label()).Inc()
+	}
+
+	if err == nil && s.checkpoint != nil {
+		s.checkpoint.complete(request.Type, request.ID)
+	}
+	if err == nil && s.events != nil {
+		s.enqueueEvent(request.Type, request.ID, s.inflight.resultSize(ctx))
+	}
 	return err
 }
 
@@ -683,6 +1880,10 @@ func (s *PermsSyncer) runSync(ctx context.Context) {
 			return
 		}
 
+		if s.isPaused() {
+			continue
+		}
+
 		request := s.queue.acquireNext()
 		if request == nil {
 			// No waiting request is in the queue
@@ -690,7 +1891,7 @@ func (s *PermsSyncer) runSync(ctx context.Context) {
 		}
 
 		// Check if it's the time to sync the request
-		if wait := request.NextSyncAt.Sub(s.clock()); wait > 0 {
+		if wait := request.syncAt().Sub(s.clock()); wait > 0 {
 			s.queue.release(request.Type, request.ID)
 			time.AfterFunc(wait, func() {
 				notify(s.queue.notifyEnqueue)
@@ -702,6 +1903,10 @@ func (s *PermsSyncer) runSync(ctx context.Context) {
 
 		notify(notifyDequeued)
 
+		metricsQueueWaitSeconds.
+			WithLabelValues(request.Type.label(), request.Priority.label()).
+			Observe(s.clock().Sub(request.enqueuedAt).Seconds())
+
 		err := s.syncPerms(ctx, request)
 		if err != nil {
 			log15.Error("Failed to sync permissions", "type", request.Type, "id", request.ID, "err", err)
@@ -722,7 +1927,7 @@ func (s *PermsSyncer) scheduleUsersWithNoPerms(ctx context.Context) ([]scheduled
 	users := make([]scheduledUser, len(ids))
 	for i, id := range ids {
 		users[i] = scheduledUser{
-			priority: priorityLow,
+			priority: PriorityLow,
 			userID:   id,
 			// NOTE: Have nextSyncAt with zero value (i.e. not set) gives it higher priority.
 			noPerms: true,
@@ -734,20 +1939,25 @@ func (s *PermsSyncer) scheduleUsersWithNoPerms(ctx context.Context) ([]scheduled
 // scheduleReposWithNoPerms returns computed schedules for private repositories that
 // have no permissions found in database.
 func (s *PermsSyncer) scheduleReposWithNoPerms(ctx context.Context) ([]scheduledRepo, error) {
-	ids, err := s.permsStore.RepoIDsWithNoPerms(ctx)
+	ids, err := s.permsStore.RepoIDsWithNoPerms(ctx, s.includeArchivedRepos)
 	if err != nil {
 		return nil, err
 	}
 	metricsNoPerms.WithLabelValues("repo").Set(float64(len(ids)))
 
-	repos := make([]scheduledRepo, len(ids))
-	for i, id := range ids {
-		repos[i] = scheduledRepo{
-			priority: priorityLow,
+	repos := make([]scheduledRepo, 0, len(ids))
+	for _, id := range ids {
+		// Repositories that are waiting to be touched have been synced.
+		if s.repoTouches != nil && s.repoTouches.contains(id) {
+			continue
+		}
+
+		repos = append(repos, scheduledRepo{
+			priority: PriorityLow,
 			repoID:   id,
 			// NOTE: Have nextSyncAt with zero value (i.e. not set) gives it higher priority.
 			noPerms: true,
-		}
+		})
 	}
 	return repos, nil
 }
@@ -760,12 +1970,13 @@ func (s *PermsSyncer) scheduleUsersWithOldestPerms(ctx context.Context, limit in
 		return nil, err
 	}
 
+	now := s.clock()
 	users := make([]scheduledUser, 0, len(results))
 	for id, t := range results {
 		users = append(users, scheduledUser{
-			priority:   priorityLow,
+			priority:   PriorityLow,
 			userID:     id,
-			nextSyncAt: t,
+			nextSyncAt: s.scheduleJitter.apply(requestTypeUser, id, t, now),
 		})
 	}
 	return users, nil
@@ -774,17 +1985,23 @@ func (s *PermsSyncer) scheduleUsersWithOldestPerms(ctx context.Context, limit in
 // scheduleReposWithOldestPerms returns computed schedules for private repositories that
 // have oldest permissions in database.
 func (s *PermsSyncer) scheduleReposWithOldestPerms(ctx context.Context, limit int) ([]scheduledRepo, error) {
-	results, err := s.permsStore.ReposIDsWithOldestPerms(ctx, limit)
+	results, err := s.permsStore.ReposIDsWithOldestPerms(ctx, limit, s.includeArchivedRepos)
 	if err != nil {
 		return nil, err
 	}
 
+	now := s.clock()
 	repos := make([]scheduledRepo, 0, len(results))
 	for id, t := range results {
+		// Repositories that are waiting to be touched have been synced.
+		if s.repoTouches != nil && s.repoTouches.contains(id) {
+			continue
+		}
+
 		repos = append(repos, scheduledRepo{
-			priority:   priorityLow,
+			priority:   PriorityLow,
 			repoID:     id,
-			nextSyncAt: t,
+			nextSyncAt: s.scheduleJitter.apply(requestTypeRepo, int32(id), t, now),
 		})
 	}
 	return repos, nil
@@ -798,7 +2015,7 @@ type schedule struct {
 
 // scheduledUser contains information for scheduling a user.
 type scheduledUser struct {
-	priority   priority
+	priority   Priority
 	userID     int32
 	nextSyncAt time.Time
 
@@ -809,7 +2026,7 @@ type scheduledUser struct {
 
 // scheduledRepo contains for scheduling a repository.
 type scheduledRepo struct {
-	priority   priority
+	priority   Priority
 	repoID     api.RepoID
 	nextSyncAt time.Time
 
@@ -824,20 +2041,12 @@ type scheduledRepo struct {
 //   3. Rolling updating user permissions over time from oldest ones.
 //   4. Rolling updating repository permissions over time from oldest ones.
 func (s *PermsSyncer) schedule(ctx context.Context) (*schedule, error) {
-	schedule := new(schedule)
-
-	users, err := s.scheduleUsersWithNoPerms(ctx)
-	if err != nil {
-		return nil, errors.Wrap(err, "schedule users with no permissions")
-	}
-	schedule.Users = append(schedule.Users, users...)
-
-	repos, err := s.scheduleReposWithNoPerms(ctx)
-	if err != nil {
-		return nil, errors.Wrap(err, "schedule repositories with no permissions")
-	}
-	schedule.Repos = append(schedule.Repos, repos...)
+	return s.scheduleFor(ctx, true, true)
+}
 
+// scheduleFor is like schedule but only computes the lists of users and/or
+// repositories as requested, the lists of the other side are left empty.
+func (s *PermsSyncer) scheduleFor(ctx context.Context, users, repos bool) (*schedule, error) {
 	// TODO(jchen): Predict a limit taking account into:
 	//   1. Based on total repos and users that make sense to finish syncing before
 	//      next schedule call, so we don't waste database bandwidth.
@@ -846,27 +2055,77 @@ func (s *PermsSyncer) schedule(ctx context.Context) (*schedule, error) {
 	//   initial limit  = <predicted from the previous step>
 	//	 consumed by users = <initial limit> / (<total repos> / <page size>)
 	//   consumed by repos = (<initial limit> - <consumed by users>) / (<total users> / <page size>)
-	// Hard coded both to 10 for now.
-	const limit = 10
+	// Both default to 10 for now, and can be changed by SetScheduleLimits.
+	userLimit, repoLimit := s.scheduleLimits()
 
 	// TODO(jchen): Use better heuristics for setting NextSyncAt, the initial version
 	// just uses the value of LastUpdatedAt get from the perms tables.
 
-	users, err = s.scheduleUsersWithOldestPerms(ctx, limit)
-	if err != nil {
-		return nil, errors.Wrap(err, "load users with oldest permissions")
+	var (
+		usersWithNoPerms, usersWithOldestPerms []scheduledUser
+		reposWithNoPerms, reposWithOldestPerms []scheduledRepo
+	)
+	var queries []func(context.Context) error
+	if users {
+		queries = append(queries,
+			func(ctx context.Context) (err error) {
+				usersWithNoPerms, err = s.scheduleUsersWithNoPerms(ctx)
+				return errors.Wrap(err, "schedule users with no permissions")
+			},
+			func(ctx context.Context) (err error) {
+				usersWithOldestPerms, err = s.scheduleUsersWithOldestPerms(ctx, userLimit)
+				return errors.Wrap(err, "load users with oldest permissions")
+			},
+		)
+	}
+	if repos {
+		queries = append(queries,
+			func(ctx context.Context) (err error) {
+				reposWithNoPerms, err = s.scheduleReposWithNoPerms(ctx)
+				return errors.Wrap(err, "schedule repositories with no permissions")
+			},
+			func(ctx context.Context) (err error) {
+				reposWithOldestPerms, err = s.scheduleReposWithOldestPerms(ctx, repoLimit)
+				return errors.Wrap(err, "scan repositories with oldest permissions")
+			},
+		)
 	}
-	schedule.Users = append(schedule.Users, users...)
 
-	repos, err = s.scheduleReposWithOldestPerms(ctx, limit)
+	err := s.runScheduleQueries(ctx, queries...)
 	if err != nil {
-		return nil, errors.Wrap(err, "scan repositories with oldest permissions")
+		return nil, err
 	}
-	schedule.Repos = append(schedule.Repos, repos...)
 
+	schedule := new(schedule)
+	schedule.Users = append(schedule.Users, usersWithNoPerms...)
+	schedule.Users = append(schedule.Users, usersWithOldestPerms...)
+	schedule.Repos = append(schedule.Repos, reposWithNoPerms...)
+	schedule.Repos = append(schedule.Repos, reposWithOldestPerms...)
 	return schedule, nil
 }
 
+// runScheduleQueries runs the given scheduling queries, concurrently if it is
+// enabled, and returns the first error encountered.
+func (s *PermsSyncer) runScheduleQueries(ctx context.Context, queries ...func(context.Context) error) error {
+	if !s.concurrentSchedule {
+		for _, query := range queries {
+			if err := query(ctx); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	g, ctx := errgroup.WithContext(ctx)
+	for _, query := range queries {
+		query := query
+		g.Go(func() error {
+			return query(ctx)
+		})
+	}
+	return g.Wait()
+}
+
 // isDisabled returns true if the background permissions syncing is not enabled.
 // It is not enabled if:
 //   - Permissions user mapping is enabled
@@ -884,43 +2143,171 @@ func (s *PermsSyncer) runSchedule(ctx context.Context) {
 	log15.Debug("PermsSyncer.runSchedule.started")
 	defer log15.Info("PermsSyncer.runSchedule.stopped")
 
-	ticker := time.NewTicker(s.scheduleInterval)
-	defer ticker.Stop()
+	// Changes made before running are already picked up by the initial tickers.
+	select {
+	case <-s.scheduleIntervalChanged:
+	default:
+	}
+
+	newTickers := func() (users, repos glock.Ticker) {
+		userInterval, repoInterval := s.scheduleIntervals()
+		return s.scheduleClock.NewTicker(userInterval), s.scheduleClock.NewTicker(repoInterval)
+	}
+	userTicker, repoTicker := newTickers()
+	defer func() {
+		userTicker.Stop()
+		repoTicker.Stop()
+	}()
 
 	for {
+		var users, repos bool
 		select {
-		case <-ticker.C:
+		case <-userTicker.Chan():
+			users = true
+		case <-repoTicker.Chan():
+			repos = true
+		case <-s.scheduleIntervalChanged:
+			userTicker.Stop()
+			repoTicker.Stop()
+			userTicker, repoTicker = newTickers()
+			continue
 		case <-ctx.Done():
 			return
 		}
 
-		if s.isDisabled() {
+		if s.isDisabled() || s.isPaused() {
 			continue
 		}
 
-		schedule, err := s.schedule(ctx)
+		schedule, err := s.scheduleFor(ctx, users, repos)
 		if err != nil {
 			log15.Error("Failed to compute schedule", "err", err)
 			continue
 		}
 
+		// Account IDs resolutions are only shared within the same schedule pass.
+		s.accountIDsCache.reset()
+		if s.scheduleCooldown != nil {
+			s.scheduleCooldown.prune()
+		}
+
 		s.scheduleUsers(ctx, schedule.Users...)
 		s.scheduleRepos(ctx, schedule.Repos...)
 	}
 }
 
+// runTouchRepos periodically touches permissions of repositories synced
+// without an authz provider in batches.
+func (s *PermsSyncer) runTouchRepos(ctx context.Context) {
+	log15.Debug("PermsSyncer.runTouchRepos.started")
+	defer log15.Info("PermsSyncer.runTouchRepos.stopped")
+
+	ticker := time.NewTicker(s.repoTouchInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+
+		if err := s.touchRepos(ctx); err != nil {
+			log15.Error("Failed to touch repositories", "err", err)
+		}
+	}
+}
+
+// touchRepos touches permissions of all synced repositories that
+// are waiting to be touched, failed ones are retried on the next call.
+func (s *PermsSyncer) touchRepos(ctx context.Context) error {
+	ids := s.repoTouches.take()
+	if len(ids) == 0 {
+		return nil
+	}
+
+	if err := s.permsStore.TouchRepoPermissionsBatch(ctx, ids); err != nil {
+		s.repoTouches.restore(ids)
+		return errors.Wrap(err, "touch repository permissions")
+	}
+	return nil
+}
+
+// LimiterState is the state of the rate limiter of a code host.
+type LimiterState struct {
+	// Whether the rate limiter allows any rate of requests, in which case Rate
+	// and Available are meaningless.
+	Unlimited bool
+	// The number of requests allowed per second.
+	Rate float64
+	// The maximum number of requests allowed at once.
+	Burst int
+	// The number of requests that can be made immediately.
+	Available float64
+}
+
+// RateLimiterState returns the current state of rate limiters for code hosts of
+// all configured authz providers, keyed by their service IDs. It returns nil if
+// rate limiting is not enabled.
+func (s *PermsSyncer) RateLimiterState(ctx context.Context) map[string]LimiterState {
+	if s.rateLimiterRegistry == nil {
+		return nil
+	}
+
+	now := s.clock()
+	states := make(map[string]LimiterState)
+	for serviceID := range s.providersByServiceID() {
+		rl := s.rateLimiterRegistry.Get(serviceID)
+		if rl.Limit() == rate.Inf {
+			states[serviceID] = LimiterState{Unlimited: true, Burst: rl.Burst()}
+			continue
+		}
+
+		states[serviceID] = LimiterState{
+			Rate:      float64(rl.Limit()),
+			Burst:     rl.Burst(),
+			Available: availableTokens(rl, now),
+		}
+	}
+	return states
+}
+
+// availableTokens returns the number of tokens available in the limiter at the
+// given time. The limiter does not expose its tokens, so it is derived from how
+// long a reservation of the full burst would have to wait, and the reservation
+// is canceled right away to give back the tokens.
+func availableTokens(rl *rate.Limiter, now time.Time) float64 {
+	burst := rl.Burst()
+	r := rl.ReserveN(now, burst)
+	if !r.OK() {
+		return 0
+	}
+	delay := r.DelayFrom(now)
+	r.CancelAt(now)
+
+	available := float64(burst) - delay.Seconds()*float64(rl.Limit())
+	if available < 0 {
+		return 0
+	}
+	return available
+}
+
 // DebugDump returns the state of the permissions syncer for debugging.
 func (s *PermsSyncer) DebugDump() interface{} {
 	type requestInfo struct {
 		Meta     *requestMeta
 		Acquired bool
+		// The time duration since the request was enqueued.
+		Wait time.Duration
 	}
 	data := struct {
-		Name  string
-		Size  int
-		Queue []*requestInfo
+		Name   string
+		Paused bool
+		Size   int
+		Queue  []*requestInfo
 	}{
-		Name: "permissions",
+		Name:   "permissions",
+		Paused: s.isPaused(),
 	}
 
 	queue := requestQueue{
@@ -930,11 +2317,14 @@ func (s *PermsSyncer) DebugDump() interface{} {
 	s.queue.mu.RLock()
 	defer s.queue.mu.RUnlock()
 
+	now := s.queue.clock()
 	for i, request := range s.queue.heap {
 		// Copy the syncRequest as a value so that poping off the heap here won't
 		// update the index value of the real heap, and we don't do a racy read on
 		// the repo pointer which may change concurrently in the real heap.
 		requestCopy := *request
+		// The copied queue does not keep track of evictable requests.
+		requestCopy.evictIndex = -1
 		queue.heap[i] = &requestCopy
 	}
 
@@ -948,8 +2338,12 @@ func (s *PermsSyncer) DebugDump() interface{} {
 				Type:       request.Type,
 				ID:         request.ID,
 				NextSyncAt: request.NextSyncAt,
+
+				Attempts:    request.Attempts,
+				NextRetryAt: request.NextRetryAt,
 			},
 			Acquired: request.acquired,
+			Wait:     now.Sub(request.enqueuedAt),
 		})
 	}
 	data.Size = len(data.Queue)
@@ -976,7 +2370,7 @@ func (s *PermsSyncer) observe(ctx context.Context, family, title string) (contex
 			return
 		}
 
-		success := err == nil || *err == nil
+		success := err == nil || *err == nil || errors.Is(*err, authz.ErrNoProvider)
 		metricsSyncDuration.WithLabelValues(typLabel, strconv.FormatBool(success)).Observe(time.Since(began).Seconds())
 
 		if !success {
@@ -998,6 +2392,8 @@ func (s *PermsSyncer) collectMetrics(ctx context.Context) {
 			return
 		}
 
+		s.collectQueueMetrics()
+
 		m, err := s.permsStore.Metrics(ctx, 3*24*time.Hour)
 		if err != nil {
 			log15.Error("Failed to get metrics from database", "err", err)
@@ -1008,11 +2404,21 @@ func (s *PermsSyncer) collectMetrics(ctx context.Context) {
 		metricsPermsGap.WithLabelValues("user").Set(m.UsersPermsGapSeconds)
 		metricsStalePerms.WithLabelValues("repo").Set(float64(m.ReposWithStalePerms))
 		metricsPermsGap.WithLabelValues("repo").Set(m.ReposPermsGapSeconds)
+	}
+}
 
-		s.queue.mu.RLock()
-		metricsQueueSize.Set(float64(s.queue.Len()))
-		s.queue.mu.RUnlock()
+// collectQueueMetrics sets metrics values of the in-memory sync request queue.
+func (s *PermsSyncer) collectQueueMetrics() {
+	s.queue.mu.RLock()
+	defer s.queue.mu.RUnlock()
+
+	metricsQueueSize.Set(float64(s.queue.Len()))
+
+	var age time.Duration
+	if oldest := s.queue.oldestEnqueuedAt(); !oldest.IsZero() {
+		age = s.clock().Sub(oldest)
 	}
+	metricsOldestQueuedAge.Set(age.Seconds())
 }
 
 // Run kicks off the permissions syncing process, this method is blocking and
@@ -1021,6 +2427,15 @@ func (s *PermsSyncer) Run(ctx context.Context) {
 	go s.runSync(ctx)
 	go s.runSchedule(ctx)
 	go s.collectMetrics(ctx)
+	if s.repoTouches != nil {
+		go s.runTouchRepos(ctx)
+	}
+	if s.events != nil {
+		go s.events.run(ctx)
+	}
+	if s.syncResults != nil {
+		go s.syncResults.run(ctx)
+	}
 
 	<-ctx.Done()
 }
@@ -3,12 +3,23 @@ package authz
 import (
 	"context"
 	"database/sql"
+	"encoding/json"
+	"fmt"
 	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
+	"github.com/RoaringBitmap/roaring"
 	"github.com/cockroachdb/errors"
+	"github.com/derision-test/glock"
 	"github.com/google/go-cmp/cmp"
+	"github.com/google/go-cmp/cmp/cmpopts"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"golang.org/x/time/rate"
 
 	edb "github.com/sourcegraph/sourcegraph/enterprise/internal/database"
 	"github.com/sourcegraph/sourcegraph/internal/api"
@@ -28,12 +39,12 @@ func TestPermsSyncer_ScheduleUsers(t *testing.T) {
 	authz.SetProviders(true, []authz.Provider{&mockProvider{}})
 	defer authz.SetProviders(true, nil)
 
-	s := NewPermsSyncer(nil, nil, nil, nil)
+	s := NewPermsSyncer(nil, nil, nil, nil, PermsSyncerOptions{})
 	s.ScheduleUsers(context.Background(), 1)
 
 	expHeap := []*syncRequest{
 		{requestMeta: &requestMeta{
-			Priority: priorityHigh,
+			Priority: PriorityHigh,
 			Type:     requestTypeUser,
 			ID:       1,
 		}, acquired: false, index: 0},
@@ -43,16 +54,67 @@ func TestPermsSyncer_ScheduleUsers(t *testing.T) {
 	}
 }
 
+func TestPermsSyncer_providerMaps(t *testing.T) {
+	p := &mockProvider{
+		serviceType: extsvc.TypeGitHub,
+		serviceID:   "https://github.com/",
+	}
+
+	var calls int32
+	release := make(chan struct{})
+	s := NewPermsSyncer(nil, nil, nil, nil, PermsSyncerOptions{})
+	s.providersTTL = time.Hour
+	s.getProviders = func() []authz.Provider {
+		atomic.AddInt32(&calls, 1)
+		<-release
+		return []authz.Provider{p}
+	}
+
+	const numGoroutines = 50
+	var wg sync.WaitGroup
+	wg.Add(numGoroutines)
+	for i := 0; i < numGoroutines; i++ {
+		go func(i int) {
+			defer wg.Done()
+			if i%2 == 0 {
+				if got := s.providersByServiceID()[p.ServiceID()]; got != p {
+					t.Errorf("providersByServiceID: want %v but got %v", p, got)
+				}
+			} else {
+				if got := s.providersByURNs()[p.URN()]; got != p {
+					t.Errorf("providersByURNs: want %v but got %v", p, got)
+				}
+			}
+		}(i)
+	}
+
+	// Give goroutines a chance to pile up on the in-flight computation.
+	time.Sleep(10 * time.Millisecond)
+	close(release)
+	wg.Wait()
+
+	if got := atomic.LoadInt32(&calls); got != 1 {
+		t.Fatalf("calls: want 1 but got %d", got)
+	}
+
+	// Provider maps should be recomputed once expired.
+	s.providersTTL = 0
+	s.providersByServiceID()
+	if got := atomic.LoadInt32(&calls); got != 2 {
+		t.Fatalf("calls: want 2 but got %d", got)
+	}
+}
+
 func TestPermsSyncer_ScheduleRepos(t *testing.T) {
 	authz.SetProviders(true, []authz.Provider{&mockProvider{}})
 	defer authz.SetProviders(true, nil)
 
-	s := NewPermsSyncer(nil, nil, nil, nil)
+	s := NewPermsSyncer(nil, nil, nil, nil, PermsSyncerOptions{})
 	s.ScheduleRepos(context.Background(), 1)
 
 	expHeap := []*syncRequest{
 		{requestMeta: &requestMeta{
-			Priority: priorityHigh,
+			Priority: PriorityHigh,
 			Type:     requestTypeRepo,
 			ID:       1,
 		}, acquired: false, index: 0},
@@ -62,18 +124,92 @@ func TestPermsSyncer_ScheduleRepos(t *testing.T) {
 	}
 }
 
+func TestPermsSyncer_ScheduleReposWithPriority(t *testing.T) {
+	authz.SetProviders(true, []authz.Provider{&mockProvider{}})
+	defer authz.SetProviders(true, nil)
+
+	s := NewPermsSyncer(nil, nil, nil, nil, PermsSyncerOptions{})
+	s.queue.enqueue(&requestMeta{Priority: PriorityLow, Type: requestTypeRepo, ID: 1})
+	s.queue.enqueue(&requestMeta{Priority: PriorityHigh, Type: requestTypeRepo, ID: 2})
+	s.ScheduleReposWithPriority(context.Background(), PriorityMedium, 1, 3)
+
+	// Repository 1 is bumped to medium priority, and both medium priority
+	// requests are ordered after the high priority one.
+	var got []requestMeta
+	for request := s.queue.acquireNext(); request != nil; request = s.queue.acquireNext() {
+		got = append(got, *request.requestMeta)
+	}
+	if len(got) == 3 {
+		// Requests with equal priority and nextSyncAt have no particular order.
+		sort.Slice(got[1:], func(i, j int) bool { return got[1+i].ID < got[1+j].ID })
+	}
+	want := []requestMeta{
+		{Priority: PriorityHigh, Type: requestTypeRepo, ID: 2},
+		{Priority: PriorityMedium, Type: requestTypeRepo, ID: 1},
+		{Priority: PriorityMedium, Type: requestTypeRepo, ID: 3},
+	}
+	if diff := cmp.Diff(want, got, cmpOpts); diff != "" {
+		t.Fatalf("requests mismatch (-want +got):\n%s", diff)
+	}
+}
+
+func TestPermsSyncer_SetExclusions(t *testing.T) {
+	authz.SetProviders(true, []authz.Provider{&mockProvider{}})
+	defer authz.SetProviders(true, nil)
+
+	database.Mocks.Repos.ListRepoNames = func(_ context.Context, opt database.ReposListOptions) ([]types.RepoName, error) {
+		rs := make([]types.RepoName, 0, len(opt.IDs))
+		for _, id := range opt.IDs {
+			rs = append(rs, types.RepoName{ID: id, Name: api.RepoName(fmt.Sprintf("github.com/sourcegraph/repo-%d", id))})
+		}
+		return rs, nil
+	}
+	defer func() { database.Mocks = database.MockStores{} }()
+
+	s := NewPermsSyncer(repos.NewStore(&dbtesting.MockDB{}, sql.TxOptions{}), nil, time.Now, nil, PermsSyncerOptions{MaxSyncAttempts: 3})
+	err := s.SetExclusions([]int32{2}, []api.RepoID{3}, []string{"github.com/sourcegraph/repo-4"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx := context.Background()
+	s.ScheduleUsers(ctx, 1, 2)
+	s.ScheduleRepos(ctx, 3, 4, 5)
+	s.scheduleUsers(ctx, scheduledUser{priority: PriorityLow, userID: 2, noPerms: true})
+	s.scheduleRepos(ctx, scheduledRepo{priority: PriorityLow, repoID: 3, noPerms: true})
+	// Requests triggered by webhooks and retries go through the same exclusions.
+	s.ScheduleReposWithPriority(ctx, PriorityMedium, 4)
+	s.retry(ctx, &syncRequest{requestMeta: &requestMeta{Type: requestTypeRepo, ID: 3}}, errors.New("boom"))
+
+	got := make(map[requestQueueKey]bool)
+	for _, request := range s.queue.heap {
+		got[requestQueueKey{typ: request.Type, id: request.ID}] = true
+	}
+	want := map[requestQueueKey]bool{
+		{typ: requestTypeUser, id: 1}: true,
+		{typ: requestTypeRepo, id: 5}: true,
+	}
+	if diff := cmp.Diff(want, got, cmp.AllowUnexported(requestQueueKey{})); diff != "" {
+		t.Fatalf("queued requests mismatch (-want +got):\n%s", diff)
+	}
+}
+
 type mockProvider struct {
 	id          int64
 	serviceType string
 	serviceID   string
 
+	fetchAccount          func(context.Context, *types.User, []*extsvc.Account, []string) (*extsvc.Account, error)
 	fetchUserPerms        func(context.Context, *extsvc.Account) (*authz.ExternalUserPermissions, error)
 	fetchUserPermsByToken func(context.Context, string) (*authz.ExternalUserPermissions, error)
 	fetchRepoPerms        func(ctx context.Context, repo *extsvc.Repository) ([]extsvc.AccountID, error)
 }
 
-func (*mockProvider) FetchAccount(context.Context, *types.User, []*extsvc.Account, []string) (*extsvc.Account, error) {
-	return nil, nil
+func (p *mockProvider) FetchAccount(ctx context.Context, user *types.User, accts []*extsvc.Account, emails []string) (*extsvc.Account, error) {
+	if p.fetchAccount == nil {
+		return nil, nil
+	}
+	return p.fetchAccount(ctx, user, accts, emails)
 }
 
 func (p *mockProvider) ServiceType() string { return p.serviceType }
@@ -136,12 +272,12 @@ func TestPermsSyncer_syncUserPerms_unionExternalServiceRepos(t *testing.T) {
 	edb.Mocks.Perms.ListExternalAccounts = func(context.Context, int32) ([]*extsvc.Account, error) {
 		return []*extsvc.Account{&extAccount}, nil
 	}
-	edb.Mocks.Perms.SetUserPermissions = func(_ context.Context, p *authz.UserPermissions) error {
+	edb.Mocks.Perms.SetUserPermissionsWithDiff = func(_ context.Context, p *authz.UserPermissions) (*edb.UserPermissionsDiff, error) {
 		wantIDs := []uint32{1, 2, 3, 4}
 		if diff := cmp.Diff(wantIDs, p.IDs.ToArray()); diff != "" {
-			return errors.Errorf("IDs mismatch (-want +got):\n%s", diff)
+			return nil, errors.Errorf("IDs mismatch (-want +got):\n%s", diff)
 		}
-		return nil
+		return &edb.UserPermissionsDiff{}, nil
 	}
 	database.Mocks.Repos.ListRepoNames = func(v0 context.Context, args database.ReposListOptions) ([]types.RepoName, error) {
 		if !args.OnlyPrivate {
@@ -167,7 +303,7 @@ func TestPermsSyncer_syncUserPerms_unionExternalServiceRepos(t *testing.T) {
 	}()
 
 	permsStore := edb.Perms(nil, timeutil.Now)
-	s := NewPermsSyncer(repos.NewStore(&dbtesting.MockDB{}, sql.TxOptions{}), permsStore, timeutil.Now, nil)
+	s := NewPermsSyncer(repos.NewStore(&dbtesting.MockDB{}, sql.TxOptions{}), permsStore, timeutil.Now, nil, PermsSyncerOptions{})
 
 	p.fetchUserPerms = func(context.Context, *extsvc.Account) (*authz.ExternalUserPermissions, error) {
 		return &authz.ExternalUserPermissions{
@@ -180,7 +316,7 @@ func TestPermsSyncer_syncUserPerms_unionExternalServiceRepos(t *testing.T) {
 		}, nil
 	}
 
-	err := s.syncUserPerms(context.Background(), 1, true)
+	_, err := s.syncUserPerms(context.Background(), 1, true)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -218,16 +354,16 @@ func TestPermsSyncer_syncUserPerms(t *testing.T) {
 	edb.Mocks.Perms.ListExternalAccounts = func(context.Context, int32) ([]*extsvc.Account, error) {
 		return []*extsvc.Account{&extAccount}, nil
 	}
-	edb.Mocks.Perms.SetUserPermissions = func(_ context.Context, p *authz.UserPermissions) error {
+	edb.Mocks.Perms.SetUserPermissionsWithDiff = func(_ context.Context, p *authz.UserPermissions) (*edb.UserPermissionsDiff, error) {
 		if p.UserID != 1 {
-			return errors.Errorf("UserID: want 1 but got %d", p.UserID)
+			return nil, errors.Errorf("UserID: want 1 but got %d", p.UserID)
 		}
 
 		wantIDs := []uint32{1}
 		if diff := cmp.Diff(wantIDs, p.IDs.ToArray()); diff != "" {
-			return errors.Errorf("IDs mismatch (-want +got):\n%s", diff)
+			return nil, errors.Errorf("IDs mismatch (-want +got):\n%s", diff)
 		}
-		return nil
+		return &edb.UserPermissionsDiff{}, nil
 	}
 	database.Mocks.Repos.ListRepoNames = func(v0 context.Context, args database.ReposListOptions) ([]types.RepoName, error) {
 		if !args.OnlyPrivate {
@@ -250,7 +386,7 @@ func TestPermsSyncer_syncUserPerms(t *testing.T) {
 	}()
 
 	permsStore := edb.Perms(nil, timeutil.Now)
-	s := NewPermsSyncer(repos.NewStore(&dbtesting.MockDB{}, sql.TxOptions{}), permsStore, timeutil.Now, nil)
+	s := NewPermsSyncer(repos.NewStore(&dbtesting.MockDB{}, sql.TxOptions{}), permsStore, timeutil.Now, nil, PermsSyncerOptions{})
 
 	tests := []struct {
 		name     string
@@ -280,7 +416,7 @@ func TestPermsSyncer_syncUserPerms(t *testing.T) {
 				}, test.fetchErr
 			}
 
-			err := s.syncUserPerms(context.Background(), 1, test.noPerms)
+			_, err := s.syncUserPerms(context.Background(), 1, test.noPerms)
 			if err != nil {
 				t.Fatal(err)
 			}
@@ -288,6 +424,98 @@ func TestPermsSyncer_syncUserPerms(t *testing.T) {
 	}
 }
 
+func TestPermsSyncer_syncUserPerms_cachesFetchedPerms(t *testing.T) {
+	fetches := make(map[string]int)
+	p := &mockProvider{
+		id:          1,
+		serviceType: extsvc.TypeGitHub,
+		serviceID:   "https://github.com/",
+		fetchUserPerms: func(_ context.Context, acct *extsvc.Account) (*authz.ExternalUserPermissions, error) {
+			fetches[acct.AccountID]++
+			return &authz.ExternalUserPermissions{
+				Exacts: []extsvc.RepoID{extsvc.RepoID("repo-of-" + acct.AccountID)},
+			}, nil
+		},
+	}
+	authz.SetProviders(false, []authz.Provider{p})
+	defer authz.SetProviders(true, nil)
+
+	newAccount := func(id int32, accountID string) *extsvc.Account {
+		return &extsvc.Account{
+			ID: id,
+			AccountSpec: extsvc.AccountSpec{
+				ServiceType: p.ServiceType(),
+				ServiceID:   p.ServiceID(),
+				AccountID:   accountID,
+			},
+		}
+	}
+
+	var touched []int32
+	database.Mocks.Users.GetByID = func(ctx context.Context, id int32) (*types.User, error) {
+		return &types.User{ID: id}, nil
+	}
+	database.Mocks.ExternalAccounts.TouchLastValid = func(ctx context.Context, id int32) error {
+		touched = append(touched, id)
+		return nil
+	}
+	edb.Mocks.Perms.ListExternalAccounts = func(context.Context, int32) ([]*extsvc.Account, error) {
+		// Accounts 1 and 2 are the same account on the code host, account 3 is a
+		// different one on the same code host.
+		return []*extsvc.Account{newAccount(1, "alice"), newAccount(2, "alice"), newAccount(3, "bob")}, nil
+	}
+	edb.Mocks.Perms.SetUserPermissionsWithDiff = func(context.Context, *authz.UserPermissions) (*edb.UserPermissionsDiff, error) {
+		return &edb.UserPermissionsDiff{}, nil
+	}
+	var gotRepoIDs []string
+	database.Mocks.Repos.ListRepoNames = func(_ context.Context, args database.ReposListOptions) ([]types.RepoName, error) {
+		for _, spec := range args.ExternalRepos {
+			gotRepoIDs = append(gotRepoIDs, spec.ID)
+		}
+		return []types.RepoName{{ID: 1}}, nil
+	}
+	database.Mocks.UserEmails.ListByUser = func(ctx context.Context, opt database.UserEmailsListOptions) ([]*database.UserEmail, error) {
+		return nil, nil
+	}
+	database.Mocks.ExternalServices.List = func(opt database.ExternalServicesListOptions) ([]*types.ExternalService, error) {
+		return []*types.ExternalService{}, nil
+	}
+	database.Mocks.Repos.ListExternalServiceRepoIDsByUserID = func(ctx context.Context, userID int32) ([]api.RepoID, error) {
+		return []api.RepoID{}, nil
+	}
+	defer func() {
+		database.Mocks = database.MockStores{}
+		edb.Mocks.Perms = edb.MockPerms{}
+	}()
+
+	s := NewPermsSyncer(repos.NewStore(&dbtesting.MockDB{}, sql.TxOptions{}), edb.Perms(nil, timeutil.Now), timeutil.Now, nil, PermsSyncerOptions{})
+
+	_, err := s.syncUserPerms(context.Background(), 1, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if diff := cmp.Diff(map[string]int{"alice": 1, "bob": 1}, fetches); diff != "" {
+		t.Fatalf("fetches mismatch (-want +got):\n%s", diff)
+	}
+	wantRepoIDs := []string{"repo-of-alice", "repo-of-alice", "repo-of-bob"}
+	if diff := cmp.Diff(wantRepoIDs, gotRepoIDs, cmpopts.SortSlices(func(a, b string) bool { return a < b })); diff != "" {
+		t.Fatalf("repo IDs mismatch (-want +got):\n%s", diff)
+	}
+	if diff := cmp.Diff([]int32{1, 2, 3}, touched); diff != "" {
+		t.Fatalf("touched accounts mismatch (-want +got):\n%s", diff)
+	}
+
+	// The cache must not be shared across syncs.
+	_, err = s.syncUserPerms(context.Background(), 1, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff(map[string]int{"alice": 2, "bob": 2}, fetches); diff != "" {
+		t.Fatalf("fetches mismatch (-want +got):\n%s", diff)
+	}
+}
+
 func TestPermsSyncer_syncUserPerms_tokenExpire(t *testing.T) {
 	p := &mockProvider{
 		serviceType: extsvc.TypeGitHub,
@@ -309,8 +537,8 @@ func TestPermsSyncer_syncUserPerms_tokenExpire(t *testing.T) {
 	edb.Mocks.Perms.ListExternalAccounts = func(context.Context, int32) ([]*extsvc.Account, error) {
 		return []*extsvc.Account{&extAccount}, nil
 	}
-	edb.Mocks.Perms.SetUserPermissions = func(_ context.Context, p *authz.UserPermissions) error {
-		return nil
+	edb.Mocks.Perms.SetUserPermissionsWithDiff = func(_ context.Context, p *authz.UserPermissions) (*edb.UserPermissionsDiff, error) {
+		return &edb.UserPermissionsDiff{}, nil
 	}
 	database.Mocks.Repos.ListRepoNames = func(v0 context.Context, args database.ReposListOptions) ([]types.RepoName, error) {
 		if !args.OnlyPrivate {
@@ -333,7 +561,7 @@ func TestPermsSyncer_syncUserPerms_tokenExpire(t *testing.T) {
 	}()
 
 	permsStore := edb.Perms(nil, timeutil.Now)
-	s := NewPermsSyncer(repos.NewStore(&dbtesting.MockDB{}, sql.TxOptions{}), permsStore, timeutil.Now, nil)
+	s := NewPermsSyncer(repos.NewStore(&dbtesting.MockDB{}, sql.TxOptions{}), permsStore, timeutil.Now, nil, PermsSyncerOptions{})
 
 	t.Run("invalid token", func(t *testing.T) {
 		calledTouchExpired := false
@@ -346,7 +574,7 @@ func TestPermsSyncer_syncUserPerms_tokenExpire(t *testing.T) {
 			return nil, &github.APIError{Code: http.StatusUnauthorized}
 		}
 
-		err := s.syncUserPerms(context.Background(), 1, false)
+		_, err := s.syncUserPerms(context.Background(), 1, false)
 		if err != nil {
 			t.Fatal(err)
 		}
@@ -367,7 +595,7 @@ func TestPermsSyncer_syncUserPerms_tokenExpire(t *testing.T) {
 			return nil, gitlab.NewHTTPError(http.StatusForbidden, nil)
 		}
 
-		err := s.syncUserPerms(context.Background(), 1, false)
+		_, err := s.syncUserPerms(context.Background(), 1, false)
 		if err != nil {
 			t.Fatal(err)
 		}
@@ -392,7 +620,7 @@ func TestPermsSyncer_syncUserPerms_tokenExpire(t *testing.T) {
 			}
 		}
 
-		err := s.syncUserPerms(context.Background(), 1, false)
+		_, err := s.syncUserPerms(context.Background(), 1, false)
 		if err != nil {
 			t.Fatal(err)
 		}
@@ -427,8 +655,8 @@ func TestPermsSyncer_syncUserPerms_prefixSpecs(t *testing.T) {
 	edb.Mocks.Perms.ListExternalAccounts = func(context.Context, int32) ([]*extsvc.Account, error) {
 		return []*extsvc.Account{&extAccount}, nil
 	}
-	edb.Mocks.Perms.SetUserPermissions = func(_ context.Context, p *authz.UserPermissions) error {
-		return nil
+	edb.Mocks.Perms.SetUserPermissionsWithDiff = func(_ context.Context, p *authz.UserPermissions) (*edb.UserPermissionsDiff, error) {
+		return &edb.UserPermissionsDiff{}, nil
 	}
 	database.Mocks.Repos.ListRepoNames = func(v0 context.Context, args database.ReposListOptions) ([]types.RepoName, error) {
 		if !args.OnlyPrivate {
@@ -455,7 +683,7 @@ func TestPermsSyncer_syncUserPerms_prefixSpecs(t *testing.T) {
 	}()
 
 	permsStore := edb.Perms(nil, timeutil.Now)
-	s := NewPermsSyncer(repos.NewStore(&dbtesting.MockDB{}, sql.TxOptions{}), permsStore, timeutil.Now, nil)
+	s := NewPermsSyncer(repos.NewStore(&dbtesting.MockDB{}, sql.TxOptions{}), permsStore, timeutil.Now, nil, PermsSyncerOptions{})
 
 	p.fetchUserPerms = func(context.Context, *extsvc.Account) (*authz.ExternalUserPermissions, error) {
 		return &authz.ExternalUserPermissions{
@@ -464,130 +692,134 @@ func TestPermsSyncer_syncUserPerms_prefixSpecs(t *testing.T) {
 		}, nil
 	}
 
-	err := s.syncUserPerms(context.Background(), 1, false)
+	_, err := s.syncUserPerms(context.Background(), 1, false)
 	if err != nil {
 		t.Fatal(err)
 	}
 }
 
-func TestPermsSyncer_syncRepoPerms(t *testing.T) {
-	newPermsSyncer := func(store *repos.Store) *PermsSyncer {
-		return NewPermsSyncer(store, edb.Perms(nil, timeutil.Now), timeutil.Now, nil)
+func TestPermsSyncer_syncUserPerms_relinkAccount(t *testing.T) {
+	p := &mockProvider{
+		serviceType: extsvc.TypePerforce,
+		serviceID:   "ssl:111.222.333.444:1666",
 	}
+	authz.SetProviders(false, []authz.Provider{p})
+	defer authz.SetProviders(true, nil)
 
-	t.Run("TouchRepoPermissions is called when no authz provider", func(t *testing.T) {
-		calledTouchRepoPermissions := false
-		edb.Mocks.Perms.TouchRepoPermissions = func(ctx context.Context, repoID int32) error {
-			calledTouchRepoPermissions = true
-			return nil
-		}
-		database.Mocks.Repos.List = func(context.Context, database.ReposListOptions) ([]*types.Repo, error) {
-			return []*types.Repo{
-				{
-					ID:      1,
-					Private: true,
-					ExternalRepo: api.ExternalRepoSpec{
-						ServiceID: "https://gitlab.com/",
-					},
-					Sources: map[string]*types.SourceInfo{
-						extsvc.URN(extsvc.TypeGitLab, 0): {},
-					},
-				},
-			}, nil
-		}
-		database.Mocks.Repos.ListExternalServiceUserIDsByRepoID = func(ctx context.Context, repoID api.RepoID) ([]int32, error) {
-			return []int32{}, nil
+	perforceAccount := func(id int32, username, email string) *extsvc.Account {
+		data := json.RawMessage(fmt.Sprintf(`{"username":%q,"email":%q}`, username, email))
+		return &extsvc.Account{
+			ID:     id,
+			UserID: 1,
+			AccountSpec: extsvc.AccountSpec{
+				ServiceType: p.ServiceType(),
+				ServiceID:   p.ServiceID(),
+				AccountID:   email,
+			},
+			AccountData: extsvc.AccountData{
+				Data: &data,
+			},
 		}
-		defer func() {
-			edb.Mocks.Perms = edb.MockPerms{}
-			database.Mocks.Repos = database.MockRepos{}
-		}()
+	}
 
-		s := newPermsSyncer(repos.NewStore(&dbtesting.MockDB{}, sql.TxOptions{}))
+	database.Mocks.Users.GetByID = func(ctx context.Context, id int32) (*types.User, error) {
+		return &types.User{ID: id}, nil
+	}
+	database.Mocks.ExternalAccounts.TouchLastValid = func(ctx context.Context, id int32) error {
+		return nil
+	}
+	edb.Mocks.Perms.ListExternalAccounts = func(context.Context, int32) ([]*extsvc.Account, error) {
+		return []*extsvc.Account{perforceAccount(1, "alice", "alice@old.com")}, nil
+	}
+	edb.Mocks.Perms.SetUserPermissionsWithDiff = func(_ context.Context, p *authz.UserPermissions) (*edb.UserPermissionsDiff, error) {
+		return &edb.UserPermissionsDiff{}, nil
+	}
+	database.Mocks.Repos.ListRepoNames = func(v0 context.Context, args database.ReposListOptions) ([]types.RepoName, error) {
+		return []types.RepoName{{ID: 1}}, nil
+	}
+	database.Mocks.UserEmails.ListByUser = func(ctx context.Context, opt database.UserEmailsListOptions) ([]*database.UserEmail, error) {
+		return []*database.UserEmail{{UserID: 1, Email: "alice@new.com"}}, nil
+	}
+	database.Mocks.ExternalServices.List = func(opt database.ExternalServicesListOptions) ([]*types.ExternalService, error) {
+		return []*types.ExternalService{}, nil
+	}
+	database.Mocks.Repos.ListExternalServiceRepoIDsByUserID = func(ctx context.Context, userID int32) ([]api.RepoID, error) {
+		return []api.RepoID{}, nil
+	}
+	defer func() {
+		database.Mocks = database.MockStores{}
+		edb.Mocks.Perms = edb.MockPerms{}
+	}()
 
-		err := s.syncRepoPerms(context.Background(), 1, false)
-		if err != nil {
-			t.Fatal(err)
-		}
+	var (
+		associated []string
+		deleted    []int32
+		fetchedFor []string
+	)
+	database.Mocks.ExternalAccounts.AssociateUserAndSave = func(userID int32, spec extsvc.AccountSpec, data extsvc.AccountData) error {
+		associated = append(associated, spec.AccountID)
+		return nil
+	}
+	database.Mocks.ExternalAccounts.Delete = func(id int32) error {
+		deleted = append(deleted, id)
+		return nil
+	}
+	p.fetchUserPerms = func(_ context.Context, acct *extsvc.Account) (*authz.ExternalUserPermissions, error) {
+		fetchedFor = append(fetchedFor, acct.AccountID)
+		return &authz.ExternalUserPermissions{
+			Exacts: []extsvc.RepoID{"1"},
+		}, nil
+	}
 
-		if !calledTouchRepoPermissions {
-			t.Fatal("!calledTouchRepoPermissions")
-		}
-	})
+	permsStore := edb.Perms(nil, timeutil.Now)
+	s := NewPermsSyncer(repos.NewStore(&dbtesting.MockDB{}, sql.TxOptions{}), permsStore, timeutil.Now, nil, PermsSyncerOptions{})
 
-	t.Run("identify authz provider by URN", func(t *testing.T) {
-		// Even though both p1 and p2 are pointing to the same code host,
-		// but p2 should not be used because it is not responsible for listing
-		// test repository.
-		p1 := &mockProvider{
-			id:          1,
-			serviceType: extsvc.TypeGitLab,
-			serviceID:   "https://gitlab.com/",
-			fetchRepoPerms: func(ctx context.Context, repo *extsvc.Repository) ([]extsvc.AccountID, error) {
-				return []extsvc.AccountID{"user"}, nil
-			},
-		}
-		p2 := &mockProvider{
-			id:          2,
-			serviceType: extsvc.TypeGitLab,
-			serviceID:   "https://gitlab.com/",
-			fetchRepoPerms: func(ctx context.Context, repo *extsvc.Repository) ([]extsvc.AccountID, error) {
-				return nil, errors.New("not supposed to be called")
-			},
+	t.Run("email changed for the same username", func(t *testing.T) {
+		associated, deleted, fetchedFor = nil, nil, nil
+		p.fetchAccount = func(context.Context, *types.User, []*extsvc.Account, []string) (*extsvc.Account, error) {
+			return perforceAccount(0, "alice", "alice@new.com"), nil
 		}
-		authz.SetProviders(false, []authz.Provider{p1, p2})
-		defer authz.SetProviders(true, nil)
 
-		edb.Mocks.Perms.Transact = func(context.Context) (*edb.PermsStore, error) {
-			return &edb.PermsStore{}, nil
-		}
-		edb.Mocks.Perms.GetUserIDsByExternalAccounts = func(context.Context, *extsvc.Accounts) (map[string]int32, error) {
-			return map[string]int32{"user": 1}, nil
+		_, err := s.syncUserPerms(context.Background(), 1, false)
+		if err != nil {
+			t.Fatal(err)
 		}
-		edb.Mocks.Perms.SetRepoPermissions = func(_ context.Context, p *authz.RepoPermissions) error {
-			if p.RepoID != 1 {
-				return errors.Errorf("RepoID: want 1 but got %d", p.RepoID)
-			}
 
-			wantUserIDs := []uint32{1}
-			if diff := cmp.Diff(wantUserIDs, p.UserIDs.ToArray()); diff != "" {
-				return errors.Errorf("UserIDs mismatch (-want +got):\n%s", diff)
-			}
-			return nil
-		}
-		edb.Mocks.Perms.SetRepoPendingPermissions = func(ctx context.Context, accounts *extsvc.Accounts, p *authz.RepoPermissions) error {
-			return nil
+		if diff := cmp.Diff([]string{"alice@new.com"}, associated); diff != "" {
+			t.Fatalf("associated mismatch (-want +got):\n%s", diff)
 		}
-		database.Mocks.Repos.List = func(context.Context, database.ReposListOptions) ([]*types.Repo, error) {
-			return []*types.Repo{
-				{
-					ID:      1,
-					Private: true,
-					ExternalRepo: api.ExternalRepoSpec{
-						ServiceID: p1.ServiceID(),
-					},
-					Sources: map[string]*types.SourceInfo{
-						p1.URN(): {},
-					},
-				},
-			}, nil
+		if diff := cmp.Diff([]int32{1}, deleted); diff != "" {
+			t.Fatalf("deleted mismatch (-want +got):\n%s", diff)
 		}
-		database.Mocks.Repos.ListExternalServiceUserIDsByRepoID = func(ctx context.Context, repoID api.RepoID) ([]int32, error) {
-			return []int32{}, nil
+		if diff := cmp.Diff([]string{"alice@new.com"}, fetchedFor); diff != "" {
+			t.Fatalf("fetchedFor mismatch (-want +got):\n%s", diff)
 		}
-		defer func() {
-			edb.Mocks.Perms = edb.MockPerms{}
-			database.Mocks.Repos = database.MockRepos{}
-		}()
+	})
 
-		s := newPermsSyncer(repos.NewStore(&dbtesting.MockDB{}, sql.TxOptions{}))
+	t.Run("different username is not re-linked", func(t *testing.T) {
+		associated, deleted, fetchedFor = nil, nil, nil
+		p.fetchAccount = func(context.Context, *types.User, []*extsvc.Account, []string) (*extsvc.Account, error) {
+			return perforceAccount(0, "bob", "alice@new.com"), nil
+		}
 
-		err := s.syncRepoPerms(context.Background(), 1, false)
+		_, err := s.syncUserPerms(context.Background(), 1, false)
 		if err != nil {
 			t.Fatal(err)
 		}
+
+		if len(associated) > 0 {
+			t.Fatalf("associated: want none but got %v", associated)
+		}
+		if len(deleted) > 0 {
+			t.Fatalf("deleted: want none but got %v", deleted)
+		}
+		if diff := cmp.Diff([]string{"alice@old.com"}, fetchedFor); diff != "" {
+			t.Fatalf("fetchedFor mismatch (-want +got):\n%s", diff)
+		}
 	})
+}
 
+func TestPermsSyncer_syncUserPerms_diff(t *testing.T) {
 	p := &mockProvider{
 		serviceType: extsvc.TypeGitLab,
 		serviceID:   "https://gitlab.com/",
@@ -595,32 +827,1086 @@ func TestPermsSyncer_syncRepoPerms(t *testing.T) {
 	authz.SetProviders(false, []authz.Provider{p})
 	defer authz.SetProviders(true, nil)
 
-	edb.Mocks.Perms.Transact = func(context.Context) (*edb.PermsStore, error) {
-		return &edb.PermsStore{}, nil
+	extAccount := extsvc.Account{
+		AccountSpec: extsvc.AccountSpec{
+			ServiceType: p.ServiceType(),
+			ServiceID:   p.ServiceID(),
+		},
 	}
-	edb.Mocks.Perms.GetUserIDsByExternalAccounts = func(context.Context, *extsvc.Accounts) (map[string]int32, error) {
+
+	database.Mocks.Users.GetByID = func(ctx context.Context, id int32) (*types.User, error) {
+		return &types.User{ID: id}, nil
+	}
+	database.Mocks.ExternalAccounts.TouchLastValid = func(ctx context.Context, id int32) error {
+		return nil
+	}
+	edb.Mocks.Perms.ListExternalAccounts = func(context.Context, int32) ([]*extsvc.Account, error) {
+		return []*extsvc.Account{&extAccount}, nil
+	}
+	database.Mocks.Repos.ListRepoNames = func(v0 context.Context, args database.ReposListOptions) ([]types.RepoName, error) {
+		return []types.RepoName{{ID: 2}, {ID: 3}}, nil
+	}
+	database.Mocks.UserEmails.ListByUser = func(ctx context.Context, opt database.UserEmailsListOptions) ([]*database.UserEmail, error) {
+		return nil, nil
+	}
+	database.Mocks.ExternalServices.List = func(opt database.ExternalServicesListOptions) ([]*types.ExternalService, error) {
+		return []*types.ExternalService{}, nil
+	}
+	database.Mocks.Repos.ListExternalServiceRepoIDsByUserID = func(ctx context.Context, userID int32) ([]api.RepoID, error) {
+		return []api.RepoID{}, nil
+	}
+	defer func() {
+		database.Mocks = database.MockStores{}
+		edb.Mocks.Perms = edb.MockPerms{}
+	}()
+
+	// Simulate the store diffing against previously stored permissions of {1, 2}.
+	stored := roaring.BitmapOf(1, 2)
+	syncedAt := timeutil.Now()
+	edb.Mocks.Perms.SetUserPermissionsWithDiff = func(_ context.Context, p *authz.UserPermissions) (*edb.UserPermissionsDiff, error) {
+		syncedAt = syncedAt.Add(time.Minute)
+		diff := &edb.UserPermissionsDiff{
+			Added:    roaring.AndNot(p.IDs, stored).ToArray(),
+			Removed:  roaring.AndNot(stored, p.IDs).ToArray(),
+			SyncedAt: syncedAt,
+		}
+		stored = p.IDs.Clone()
+		return diff, nil
+	}
+
+	permsStore := edb.Perms(nil, timeutil.Now)
+	s := NewPermsSyncer(repos.NewStore(&dbtesting.MockDB{}, sql.TxOptions{}), permsStore, timeutil.Now, nil, PermsSyncerOptions{})
+
+	p.fetchUserPerms = func(context.Context, *extsvc.Account) (*authz.ExternalUserPermissions, error) {
+		return &authz.ExternalUserPermissions{
+			Exacts: []extsvc.RepoID{"2", "3"},
+		}, nil
+	}
+
+	diff, err := s.syncUserPerms(context.Background(), 1, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := &edb.UserPermissionsDiff{
+		Added:    []uint32{3},
+		Removed:  []uint32{1},
+		SyncedAt: syncedAt,
+	}
+	if d := cmp.Diff(want, diff); d != "" {
+		t.Fatalf("diff mismatch (-want +got):\n%s", d)
+	}
+
+	// A second sync with the same permissions should report no changes.
+	diff, err = s.syncUserPerms(context.Background(), 1, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want = &edb.UserPermissionsDiff{
+		Added:    []uint32{},
+		Removed:  []uint32{},
+		SyncedAt: syncedAt,
+	}
+	if d := cmp.Diff(want, diff); d != "" {
+		t.Fatalf("diff mismatch (-want +got):\n%s", d)
+	}
+}
+
+func TestPermsSyncer_syncUserPerms_maxRepos(t *testing.T) {
+	p := &mockProvider{
+		serviceType: extsvc.TypeGitLab,
+		serviceID:   "https://gitlab.com/",
+	}
+	authz.SetProviders(false, []authz.Provider{p})
+	defer authz.SetProviders(true, nil)
+
+	extAccount := extsvc.Account{
+		AccountSpec: extsvc.AccountSpec{
+			ServiceType: p.ServiceType(),
+			ServiceID:   p.ServiceID(),
+		},
+	}
+
+	database.Mocks.Users.GetByID = func(ctx context.Context, id int32) (*types.User, error) {
+		return &types.User{ID: id}, nil
+	}
+	database.Mocks.ExternalAccounts.TouchLastValid = func(ctx context.Context, id int32) error {
+		return nil
+	}
+	edb.Mocks.Perms.ListExternalAccounts = func(context.Context, int32) ([]*extsvc.Account, error) {
+		return []*extsvc.Account{&extAccount}, nil
+	}
+	database.Mocks.Repos.ListRepoNames = func(v0 context.Context, args database.ReposListOptions) ([]types.RepoName, error) {
+		return []types.RepoName{{ID: 1}, {ID: 2}, {ID: 3}}, nil
+	}
+	database.Mocks.UserEmails.ListByUser = func(ctx context.Context, opt database.UserEmailsListOptions) ([]*database.UserEmail, error) {
+		return nil, nil
+	}
+	database.Mocks.ExternalServices.List = func(opt database.ExternalServicesListOptions) ([]*types.ExternalService, error) {
+		return []*types.ExternalService{}, nil
+	}
+	database.Mocks.Repos.ListExternalServiceRepoIDsByUserID = func(ctx context.Context, userID int32) ([]api.RepoID, error) {
+		return []api.RepoID{}, nil
+	}
+	defer func() {
+		database.Mocks = database.MockStores{}
+		edb.Mocks.Perms = edb.MockPerms{}
+	}()
+
+	p.fetchUserPerms = func(context.Context, *extsvc.Account) (*authz.ExternalUserPermissions, error) {
+		return &authz.ExternalUserPermissions{
+			Exacts: []extsvc.RepoID{"1", "2", "3"},
+		}, nil
+	}
+
+	tests := []struct {
+		name    string
+		max     int
+		policy  MaxReposPolicy
+		wantIDs []uint32
+		wantErr bool
+	}{
+		{
+			name:    "no limit",
+			max:     0,
+			wantIDs: []uint32{1, 2, 3},
+		},
+		{
+			name:    "under the limit",
+			max:     3,
+			policy:  MaxReposPolicyRefuse,
+			wantIDs: []uint32{1, 2, 3},
+		},
+		{
+			name:    "over the limit refused",
+			max:     2,
+			policy:  MaxReposPolicyRefuse,
+			wantErr: true,
+		},
+		{
+			name:    "over the limit truncated",
+			max:     2,
+			policy:  MaxReposPolicyTruncate,
+			wantIDs: []uint32{1, 2},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var gotIDs []uint32
+			edb.Mocks.Perms.SetUserPermissionsWithDiff = func(_ context.Context, p *authz.UserPermissions) (*edb.UserPermissionsDiff, error) {
+				gotIDs = p.IDs.ToArray()
+				return &edb.UserPermissionsDiff{}, nil
+			}
+
+			s := NewPermsSyncer(repos.NewStore(&dbtesting.MockDB{}, sql.TxOptions{}), edb.Perms(nil, timeutil.Now), timeutil.Now, nil, PermsSyncerOptions{
+				MaxUserPermsRepos:       test.max,
+				MaxUserPermsReposPolicy: test.policy,
+			})
+
+			before := testutil.ToFloat64(metricsMaxReposExceeded.WithLabelValues(test.policy.String()))
+			_, err := s.syncUserPerms(context.Background(), 1, false)
+			if gotErr := err != nil; gotErr != test.wantErr {
+				t.Fatalf("err: want %v but got %v", test.wantErr, err)
+			}
+			if diff := cmp.Diff(test.wantIDs, gotIDs); diff != "" {
+				t.Fatalf("IDs mismatch (-want +got):\n%s", diff)
+			}
+
+			wantExceeded := float64(0)
+			if test.max > 0 && test.max < 3 {
+				wantExceeded = 1
+			}
+			after := testutil.ToFloat64(metricsMaxReposExceeded.WithLabelValues(test.policy.String()))
+			if after-before != wantExceeded {
+				t.Fatalf("exceeded metric: want %v but got %v", wantExceeded, after-before)
+			}
+		})
+	}
+}
+
+func TestPermsSyncer_SyncUsers(t *testing.T) {
+	p := &mockProvider{
+		serviceType: extsvc.TypeGitLab,
+		serviceID:   "https://gitlab.com/",
+	}
+	// None of the users has linked an account to the GitHub provider.
+	fetchAccountCalls := 0
+	p2 := &mockProvider{
+		serviceType: extsvc.TypeGitHub,
+		serviceID:   "https://github.com/",
+		fetchAccount: func(context.Context, *types.User, []*extsvc.Account, []string) (*extsvc.Account, error) {
+			fetchAccountCalls++
+			return nil, nil
+		},
+	}
+	authz.SetProviders(false, []authz.Provider{p, p2})
+	defer authz.SetProviders(true, nil)
+
+	database.Mocks.Users.GetByID = func(ctx context.Context, id int32) (*types.User, error) {
+		return &types.User{ID: id}, nil
+	}
+	database.Mocks.ExternalAccounts.TouchLastValid = func(ctx context.Context, id int32) error {
+		return nil
+	}
+	edb.Mocks.Perms.ListExternalAccounts = func(context.Context, int32) ([]*extsvc.Account, error) {
+		return []*extsvc.Account{
+			{
+				AccountSpec: extsvc.AccountSpec{
+					ServiceType: p.ServiceType(),
+					ServiceID:   p.ServiceID(),
+				},
+			},
+		}, nil
+	}
+	database.Mocks.UserEmails.ListByUser = func(ctx context.Context, opt database.UserEmailsListOptions) ([]*database.UserEmail, error) {
+		return nil, nil
+	}
+	database.Mocks.Repos.ListExternalServiceRepoIDsByUserID = func(ctx context.Context, userID int32) ([]api.RepoID, error) {
+		return []api.RepoID{}, nil
+	}
+	database.Mocks.Repos.ListRepoNames = func(v0 context.Context, args database.ReposListOptions) ([]types.RepoName, error) {
+		return []types.RepoName{}, nil
+	}
+
+	p.fetchUserPerms = func(context.Context, *extsvc.Account) (*authz.ExternalUserPermissions, error) {
+		return &authz.ExternalUserPermissions{}, nil
+	}
+
+	// User 3 has been synced recently.
+	edb.Mocks.Perms.LoadUserPermissions = func(_ context.Context, p *authz.UserPermissions) error {
+		if p.UserID != 3 {
+			return authz.ErrPermsNotFound
+		}
+		p.SyncedAt = timeutil.Now().Add(-time.Minute)
+		return nil
+	}
+
+	var listOpts []database.ExternalServicesListOptions
+	database.Mocks.ExternalServices.List = func(opt database.ExternalServicesListOptions) ([]*types.ExternalService, error) {
+		listOpts = append(listOpts, opt)
+		return []*types.ExternalService{}, nil
+	}
+
+	var synced []int32
+	edb.Mocks.Perms.SetUserPermissionsWithDiff = func(_ context.Context, p *authz.UserPermissions) (*edb.UserPermissionsDiff, error) {
+		synced = append(synced, p.UserID)
+		return &edb.UserPermissionsDiff{}, nil
+	}
+	defer func() {
+		database.Mocks = database.MockStores{}
+		edb.Mocks.Perms = edb.MockPerms{}
+	}()
+
+	s := NewPermsSyncer(repos.NewStore(&dbtesting.MockDB{}, sql.TxOptions{}), edb.Perms(nil, timeutil.Now), timeutil.Now, nil, PermsSyncerOptions{})
+	err := s.SyncUsers(context.Background(), SyncUsersOptions{FreshFor: time.Hour}, 1, 2, 1, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if diff := cmp.Diff([]int32{1, 2}, synced); diff != "" {
+		t.Fatalf("synced users mismatch (-want +got):\n%s", diff)
+	}
+	if fetchAccountCalls != 2 {
+		t.Fatalf("fetchAccountCalls: want 2 but got %d", fetchAccountCalls)
+	}
+
+	// External services should only be listed once for the whole batch.
+	wantListOpts := []database.ExternalServicesListOptions{
+		{
+			NamespaceUserIDs: []int32{1, 2},
+			Kinds:            []string{extsvc.KindGitHub, extsvc.KindGitLab},
+		},
+	}
+	if diff := cmp.Diff(wantListOpts, listOpts); diff != "" {
+		t.Fatalf("list options mismatch (-want +got):\n%s", diff)
+	}
+
+	t.Run("skip account linking", func(t *testing.T) {
+		synced = nil
+		fetchAccountCalls = 0
+
+		err := s.SyncUsers(context.Background(), SyncUsersOptions{SkipAccountLinking: true}, 1, 2)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if diff := cmp.Diff([]int32{1, 2}, synced); diff != "" {
+			t.Fatalf("synced users mismatch (-want +got):\n%s", diff)
+		}
+		if fetchAccountCalls != 0 {
+			t.Fatalf("fetchAccountCalls: want 0 but got %d", fetchAccountCalls)
+		}
+	})
+}
+
+func TestPermsSyncer_syncUserPerms_noProvider(t *testing.T) {
+	// The only configured provider does not match the user's external account.
+	authz.SetProviders(false, []authz.Provider{
+		&mockProvider{
+			serviceType: extsvc.TypeGitHub,
+			serviceID:   "https://github.com/",
+		},
+	})
+	defer authz.SetProviders(true, nil)
+
+	database.Mocks.Users.GetByID = func(ctx context.Context, id int32) (*types.User, error) {
+		return &types.User{ID: id}, nil
+	}
+	edb.Mocks.Perms.ListExternalAccounts = func(context.Context, int32) ([]*extsvc.Account, error) {
+		return []*extsvc.Account{
+			{
+				AccountSpec: extsvc.AccountSpec{
+					ServiceType: extsvc.TypeGitLab,
+					ServiceID:   "https://gitlab.com/",
+				},
+			},
+		}, nil
+	}
+	database.Mocks.UserEmails.ListByUser = func(ctx context.Context, opt database.UserEmailsListOptions) ([]*database.UserEmail, error) {
+		return nil, nil
+	}
+	database.Mocks.ExternalServices.List = func(opt database.ExternalServicesListOptions) ([]*types.ExternalService, error) {
+		return []*types.ExternalService{}, nil
+	}
+	database.Mocks.Repos.ListExternalServiceRepoIDsByUserID = func(ctx context.Context, userID int32) ([]api.RepoID, error) {
+		return []api.RepoID{1}, nil
+	}
+	database.Mocks.Repos.ListRepoNames = func(v0 context.Context, args database.ReposListOptions) ([]types.RepoName, error) {
+		return []types.RepoName{}, nil
+	}
+
+	var gotIDs []uint32
+	edb.Mocks.Perms.SetUserPermissionsWithDiff = func(_ context.Context, p *authz.UserPermissions) (*edb.UserPermissionsDiff, error) {
+		gotIDs = p.IDs.ToArray()
+		return &edb.UserPermissionsDiff{}, nil
+	}
+	defer func() {
+		database.Mocks = database.MockStores{}
+		edb.Mocks.Perms = edb.MockPerms{}
+	}()
+
+	s := NewPermsSyncer(repos.NewStore(&dbtesting.MockDB{}, sql.TxOptions{}), edb.Perms(nil, timeutil.Now), timeutil.Now, nil, PermsSyncerOptions{})
+
+	_, err := s.syncUserPerms(context.Background(), 1, false)
+	if err != authz.ErrNoProvider {
+		t.Fatalf("err: want %v but got %v", authz.ErrNoProvider, err)
+	}
+
+	// Permissions granted via external services should still be persisted.
+	if diff := cmp.Diff([]uint32{1}, gotIDs); diff != "" {
+		t.Fatalf("IDs mismatch (-want +got):\n%s", diff)
+	}
+
+	t.Run("not a failure for SyncUsers", func(t *testing.T) {
+		gotIDs = nil
+		if err := s.SyncUsers(context.Background(), SyncUsersOptions{}, 1); err != nil {
+			t.Fatal(err)
+		}
+		if diff := cmp.Diff([]uint32{1}, gotIDs); diff != "" {
+			t.Fatalf("IDs mismatch (-want +got):\n%s", diff)
+		}
+	})
+
+	t.Run("not a failure for scheduled syncing", func(t *testing.T) {
+		request := &syncRequest{
+			requestMeta: &requestMeta{
+				Type: requestTypeUser,
+				ID:   1,
+			},
+			acquired: true,
+		}
+		if err := s.syncPerms(context.Background(), request); err != nil {
+			t.Fatal(err)
+		}
+	})
+}
+
+func TestPermsSyncer_syncUserPerms_syncErrors(t *testing.T) {
+	p := &mockProvider{
+		serviceType: extsvc.TypeGitLab,
+		serviceID:   "https://gitlab.com/",
+	}
+	authz.SetProviders(false, []authz.Provider{p})
+	defer authz.SetProviders(true, nil)
+
+	database.Mocks.Users.GetByID = func(ctx context.Context, id int32) (*types.User, error) {
+		return &types.User{ID: id}, nil
+	}
+	database.Mocks.ExternalAccounts.TouchLastValid = func(ctx context.Context, id int32) error {
+		return nil
+	}
+	edb.Mocks.Perms.ListExternalAccounts = func(context.Context, int32) ([]*extsvc.Account, error) {
+		return []*extsvc.Account{
+			{
+				AccountSpec: extsvc.AccountSpec{
+					ServiceType: p.ServiceType(),
+					ServiceID:   p.ServiceID(),
+				},
+			},
+		}, nil
+	}
+	database.Mocks.UserEmails.ListByUser = func(ctx context.Context, opt database.UserEmailsListOptions) ([]*database.UserEmail, error) {
+		return nil, nil
+	}
+	database.Mocks.ExternalServices.List = func(opt database.ExternalServicesListOptions) ([]*types.ExternalService, error) {
+		return []*types.ExternalService{}, nil
+	}
+	database.Mocks.Repos.ListExternalServiceRepoIDsByUserID = func(ctx context.Context, userID int32) ([]api.RepoID, error) {
+		return []api.RepoID{}, nil
+	}
+	database.Mocks.Repos.ListRepoNames = func(v0 context.Context, args database.ReposListOptions) ([]types.RepoName, error) {
+		return []types.RepoName{}, nil
+	}
+	edb.Mocks.Perms.SetUserPermissionsWithDiff = func(context.Context, *authz.UserPermissions) (*edb.UserPermissionsDiff, error) {
+		return &edb.UserPermissionsDiff{}, nil
+	}
+
+	syncErrors := make(map[int32]string)
+	edb.Mocks.Perms.SetUserSyncError = func(_ context.Context, userID int32, syncErr string) error {
+		syncErrors[userID] = syncErr
+		return nil
+	}
+	edb.Mocks.Perms.ClearUserSyncError = func(_ context.Context, userID int32) error {
+		delete(syncErrors, userID)
+		return nil
+	}
+	edb.Mocks.Perms.UsersWithSyncErrors = func(context.Context, int) ([]*edb.UserSyncError, error) {
+		var errs []*edb.UserSyncError
+		for userID, syncErr := range syncErrors {
+			errs = append(errs, &edb.UserSyncError{UserID: userID, Error: syncErr})
+		}
+		return errs, nil
+	}
+	defer func() {
+		database.Mocks = database.MockStores{}
+		edb.Mocks.Perms = edb.MockPerms{}
+	}()
+
+	s := NewPermsSyncer(repos.NewStore(&dbtesting.MockDB{}, sql.TxOptions{}), edb.Perms(nil, timeutil.Now), timeutil.Now, nil, PermsSyncerOptions{RecordUserSyncErrors: true})
+
+	p.fetchUserPerms = func(context.Context, *extsvc.Account) (*authz.ExternalUserPermissions, error) {
+		return nil, errors.New("boom")
+	}
+	if _, err := s.syncUserPerms(context.Background(), 1, false); err == nil {
+		t.Fatal("want error but got nil")
+	}
+
+	errs, err := s.UsersWithSyncErrors(context.Background(), 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wantErrs := []*edb.UserSyncError{
+		{UserID: 1, Error: "fetch user permissions: boom"},
+	}
+	if diff := cmp.Diff(wantErrs, errs); diff != "" {
+		t.Fatalf("errs mismatch (-want +got):\n%s", diff)
+	}
+
+	// The error is cleared after a successful sync.
+	p.fetchUserPerms = func(context.Context, *extsvc.Account) (*authz.ExternalUserPermissions, error) {
+		return &authz.ExternalUserPermissions{}, nil
+	}
+	if _, err = s.syncUserPerms(context.Background(), 1, false); err != nil {
+		t.Fatal(err)
+	}
+
+	errs, err = s.UsersWithSyncErrors(context.Background(), 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(errs) != 0 {
+		t.Fatalf("want no errors but got %v", errs)
+	}
+}
+
+func TestPermsSyncer_syncRepoPerms(t *testing.T) {
+	newPermsSyncer := func(store *repos.Store) *PermsSyncer {
+		return NewPermsSyncer(store, edb.Perms(nil, timeutil.Now), timeutil.Now, nil, PermsSyncerOptions{})
+	}
+
+	t.Run("TouchRepoPermissions is called when no authz provider", func(t *testing.T) {
+		calledTouchRepoPermissions := false
+		edb.Mocks.Perms.TouchRepoPermissions = func(ctx context.Context, repoID int32) error {
+			calledTouchRepoPermissions = true
+			return nil
+		}
+		database.Mocks.Repos.List = func(context.Context, database.ReposListOptions) ([]*types.Repo, error) {
+			return []*types.Repo{
+				{
+					ID:      1,
+					Private: true,
+					ExternalRepo: api.ExternalRepoSpec{
+						ServiceID: "https://gitlab.com/",
+					},
+					Sources: map[string]*types.SourceInfo{
+						extsvc.URN(extsvc.TypeGitLab, 0): {},
+					},
+				},
+			}, nil
+		}
+		database.Mocks.Repos.ListExternalServiceUserIDsByRepoID = func(ctx context.Context, repoID api.RepoID) ([]int32, error) {
+			return []int32{}, nil
+		}
+		defer func() {
+			edb.Mocks.Perms = edb.MockPerms{}
+			database.Mocks.Repos = database.MockRepos{}
+		}()
+
+		s := newPermsSyncer(repos.NewStore(&dbtesting.MockDB{}, sql.TxOptions{}))
+
+		err := s.syncRepoPerms(context.Background(), 1, false)
+		if err != authz.ErrNoProvider {
+			t.Fatalf("err: want %v but got %v", authz.ErrNoProvider, err)
+		}
+
+		if !calledTouchRepoPermissions {
+			t.Fatal("!calledTouchRepoPermissions")
+		}
+	})
+
+	t.Run("identify authz provider by URN", func(t *testing.T) {
+		// Even though both p1 and p2 are pointing to the same code host,
+		// but p2 should not be used because it is not responsible for listing
+		// test repository.
+		p1 := &mockProvider{
+			id:          1,
+			serviceType: extsvc.TypeGitLab,
+			serviceID:   "https://gitlab.com/",
+			fetchRepoPerms: func(ctx context.Context, repo *extsvc.Repository) ([]extsvc.AccountID, error) {
+				return []extsvc.AccountID{"user"}, nil
+			},
+		}
+		p2 := &mockProvider{
+			id:          2,
+			serviceType: extsvc.TypeGitLab,
+			serviceID:   "https://gitlab.com/",
+			fetchRepoPerms: func(ctx context.Context, repo *extsvc.Repository) ([]extsvc.AccountID, error) {
+				return nil, errors.New("not supposed to be called")
+			},
+		}
+		authz.SetProviders(false, []authz.Provider{p1, p2})
+		defer authz.SetProviders(true, nil)
+
+		edb.Mocks.Perms.Transact = func(context.Context) (*edb.PermsStore, error) {
+			return &edb.PermsStore{}, nil
+		}
+		edb.Mocks.Perms.GetUserIDsByExternalAccounts = func(context.Context, *extsvc.Accounts) (map[string]int32, error) {
+			return map[string]int32{"user": 1}, nil
+		}
+		edb.Mocks.Perms.SetRepoPermissions = func(_ context.Context, p *authz.RepoPermissions) error {
+			if p.RepoID != 1 {
+				return errors.Errorf("RepoID: want 1 but got %d", p.RepoID)
+			}
+
+			wantUserIDs := []uint32{1}
+			if diff := cmp.Diff(wantUserIDs, p.UserIDs.ToArray()); diff != "" {
+				return errors.Errorf("UserIDs mismatch (-want +got):\n%s", diff)
+			}
+			return nil
+		}
+		edb.Mocks.Perms.SetRepoPendingPermissions = func(ctx context.Context, accounts *extsvc.Accounts, p *authz.RepoPermissions) error {
+			return nil
+		}
+		database.Mocks.Repos.List = func(context.Context, database.ReposListOptions) ([]*types.Repo, error) {
+			return []*types.Repo{
+				{
+					ID:      1,
+					Private: true,
+					ExternalRepo: api.ExternalRepoSpec{
+						ServiceID: p1.ServiceID(),
+					},
+					Sources: map[string]*types.SourceInfo{
+						p1.URN(): {},
+					},
+				},
+			}, nil
+		}
+		database.Mocks.Repos.ListExternalServiceUserIDsByRepoID = func(ctx context.Context, repoID api.RepoID) ([]int32, error) {
+			return []int32{}, nil
+		}
+		defer func() {
+			edb.Mocks.Perms = edb.MockPerms{}
+			database.Mocks.Repos = database.MockRepos{}
+		}()
+
+		s := newPermsSyncer(repos.NewStore(&dbtesting.MockDB{}, sql.TxOptions{}))
+
+		err := s.syncRepoPerms(context.Background(), 1, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+	})
+
+	p := &mockProvider{
+		serviceType: extsvc.TypeGitLab,
+		serviceID:   "https://gitlab.com/",
+	}
+	authz.SetProviders(false, []authz.Provider{p})
+	defer authz.SetProviders(true, nil)
+
+	edb.Mocks.Perms.Transact = func(context.Context) (*edb.PermsStore, error) {
+		return &edb.PermsStore{}, nil
+	}
+	edb.Mocks.Perms.GetUserIDsByExternalAccounts = func(context.Context, *extsvc.Accounts) (map[string]int32, error) {
 		return map[string]int32{"user": 1}, nil
 	}
 	edb.Mocks.Perms.SetRepoPermissions = func(_ context.Context, p *authz.RepoPermissions) error {
-		if p.RepoID != 1 {
-			return errors.Errorf("RepoID: want 1 but got %d", p.RepoID)
+		if p.RepoID != 1 {
+			return errors.Errorf("RepoID: want 1 but got %d", p.RepoID)
+		}
+
+		wantUserIDs := []uint32{1}
+		if diff := cmp.Diff(wantUserIDs, p.UserIDs.ToArray()); diff != "" {
+			return errors.Errorf("UserIDs mismatch (-want +got):\n%s", diff)
+		}
+		return nil
+	}
+	edb.Mocks.Perms.SetRepoPendingPermissions = func(_ context.Context, accounts *extsvc.Accounts, _ *authz.RepoPermissions) error {
+		wantAccounts := &extsvc.Accounts{
+			ServiceType: p.ServiceType(),
+			ServiceID:   p.ServiceID(),
+			AccountIDs:  []string{"pending_user"},
+		}
+		if diff := cmp.Diff(wantAccounts, accounts); diff != "" {
+			return errors.Errorf("accounts mismatch (-want +got):\n%s", diff)
+		}
+		return nil
+	}
+	database.Mocks.Repos.List = func(context.Context, database.ReposListOptions) ([]*types.Repo, error) {
+		return []*types.Repo{
+			{
+				ID:      1,
+				Private: true,
+				ExternalRepo: api.ExternalRepoSpec{
+					ServiceID: p.ServiceID(),
+				},
+				Sources: map[string]*types.SourceInfo{
+					p.URN(): {},
+				},
+			},
+		}, nil
+	}
+	database.Mocks.Repos.ListExternalServiceUserIDsByRepoID = func(ctx context.Context, repoID api.RepoID) ([]int32, error) {
+		return []int32{}, nil
+	}
+	defer func() {
+		edb.Mocks.Perms = edb.MockPerms{}
+		database.Mocks.Repos = database.MockRepos{}
+	}()
+
+	s := newPermsSyncer(repos.NewStore(&dbtesting.MockDB{}, sql.TxOptions{}))
+
+	tests := []struct {
+		name     string
+		noPerms  bool
+		fetchErr error
+	}{
+		{
+			name:     "sync for the first time and encounter an error",
+			noPerms:  true,
+			fetchErr: errors.New("random error"),
+		},
+		{
+			name:    "sync for the second time and succeed",
+			noPerms: false,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			p.fetchRepoPerms = func(context.Context, *extsvc.Repository) ([]extsvc.AccountID, error) {
+				return []extsvc.AccountID{"user", "pending_user"}, test.fetchErr
+			}
+
+			err := s.syncRepoPerms(context.Background(), 1, test.noPerms)
+			if err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
+
+func TestPermsSyncer_syncRepoPerms_cachesAccountIDs(t *testing.T) {
+	p := &mockProvider{
+		serviceType: extsvc.TypePerforce,
+		serviceID:   "ssl:111.222.333.444:1666",
+	}
+	authz.SetProviders(false, []authz.Provider{p})
+	defer authz.SetProviders(true, nil)
+
+	p.fetchRepoPerms = func(ctx context.Context, repo *extsvc.Repository) ([]extsvc.AccountID, error) {
+		if repo.ID == "1" {
+			return []extsvc.AccountID{"alice@example.com", "bob@example.com"}, nil
+		}
+		return []extsvc.AccountID{"alice@example.com", "bob@example.com", "cindy@example.com"}, nil
+	}
+
+	var requested [][]string
+	edb.Mocks.Perms.GetUserIDsByExternalAccounts = func(_ context.Context, accounts *extsvc.Accounts) (map[string]int32, error) {
+		requested = append(requested, accounts.AccountIDs)
+		userIDs := map[string]int32{"alice@example.com": 1, "cindy@example.com": 3}
+		result := make(map[string]int32)
+		for _, accountID := range accounts.AccountIDs {
+			if userID, ok := userIDs[accountID]; ok {
+				result[accountID] = userID
+			}
+		}
+		return result, nil
+	}
+	edb.Mocks.Perms.Transact = func(context.Context) (*edb.PermsStore, error) {
+		return &edb.PermsStore{}, nil
+	}
+	var gotUserIDs [][]uint32
+	edb.Mocks.Perms.SetRepoPermissions = func(_ context.Context, p *authz.RepoPermissions) error {
+		gotUserIDs = append(gotUserIDs, p.UserIDs.ToArray())
+		return nil
+	}
+	edb.Mocks.Perms.SetRepoPendingPermissions = func(ctx context.Context, accounts *extsvc.Accounts, p *authz.RepoPermissions) error {
+		return nil
+	}
+	database.Mocks.Repos.List = func(_ context.Context, opt database.ReposListOptions) ([]*types.Repo, error) {
+		return []*types.Repo{
+			{
+				ID:      opt.IDs[0],
+				Private: true,
+				ExternalRepo: api.ExternalRepoSpec{
+					ID:          strconv.Itoa(int(opt.IDs[0])),
+					ServiceType: p.ServiceType(),
+					ServiceID:   p.ServiceID(),
+				},
+				Sources: map[string]*types.SourceInfo{
+					p.URN(): {},
+				},
+			},
+		}, nil
+	}
+	database.Mocks.Repos.ListExternalServiceUserIDsByRepoID = func(ctx context.Context, repoID api.RepoID) ([]int32, error) {
+		return []int32{}, nil
+	}
+	defer func() {
+		edb.Mocks.Perms = edb.MockPerms{}
+		database.Mocks.Repos = database.MockRepos{}
+	}()
+
+	s := NewPermsSyncer(repos.NewStore(&dbtesting.MockDB{}, sql.TxOptions{}), edb.Perms(nil, timeutil.Now), timeutil.Now, nil, PermsSyncerOptions{})
+
+	for _, repoID := range []api.RepoID{1, 2} {
+		err := s.syncRepoPerms(context.Background(), repoID, false)
+		if err != nil {
+			t.Fatal(err)
 		}
+	}
 
-		wantUserIDs := []uint32{1}
-		if diff := cmp.Diff(wantUserIDs, p.UserIDs.ToArray()); diff != "" {
-			return errors.Errorf("UserIDs mismatch (-want +got):\n%s", diff)
+	// The second sync should only look up the account ID that was not resolved by
+	// the first sync, including the ones not associated with any user.
+	wantRequested := [][]string{
+		{"alice@example.com", "bob@example.com"},
+		{"cindy@example.com"},
+	}
+	if diff := cmp.Diff(wantRequested, requested); diff != "" {
+		t.Fatalf("requested account IDs mismatch (-want +got):\n%s", diff)
+	}
+
+	wantUserIDs := [][]uint32{{1}, {1, 3}}
+	if diff := cmp.Diff(wantUserIDs, gotUserIDs); diff != "" {
+		t.Fatalf("user IDs mismatch (-want +got):\n%s", diff)
+	}
+
+	// The cache is invalidated for a new schedule pass.
+	s.accountIDsCache.reset()
+	requested = nil
+	err := s.syncRepoPerms(context.Background(), 1, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff([][]string{{"alice@example.com", "bob@example.com"}}, requested); diff != "" {
+		t.Fatalf("requested account IDs mismatch (-want +got):\n%s", diff)
+	}
+}
+
+type estimatingProvider struct {
+	*mockProvider
+	estimateRepoPermsCalls func(knownAccounts int) int
+}
+
+func (p *estimatingProvider) EstimateRepoPermsCalls(knownAccounts int) int {
+	return p.estimateRepoPermsCalls(knownAccounts)
+}
+
+type userEstimatingProvider struct {
+	*mockProvider
+	estimateUserPermsCalls func(knownRepos int) int
+}
+
+func (p *userEstimatingProvider) EstimateUserPermsCalls(knownRepos int) int {
+	return p.estimateUserPermsCalls(knownRepos)
+}
+
+func TestPermsSyncer_syncUserPerms_reservesEstimatedCalls(t *testing.T) {
+	var gotKnownRepos int
+	p := &userEstimatingProvider{
+		mockProvider: &mockProvider{
+			serviceType: extsvc.TypeGitHub,
+			serviceID:   "https://github.com/",
+			fetchUserPerms: func(context.Context, *extsvc.Account) (*authz.ExternalUserPermissions, error) {
+				return &authz.ExternalUserPermissions{}, nil
+			},
+		},
+		estimateUserPermsCalls: func(knownRepos int) int {
+			gotKnownRepos = knownRepos
+			return 4
+		},
+	}
+	authz.SetProviders(false, []authz.Provider{p})
+	defer authz.SetProviders(true, nil)
+
+	extAccount := extsvc.Account{
+		AccountSpec: extsvc.AccountSpec{
+			ServiceType: p.ServiceType(),
+			ServiceID:   p.ServiceID(),
+		},
+	}
+
+	database.Mocks.Users.GetByID = func(ctx context.Context, id int32) (*types.User, error) {
+		return &types.User{ID: id}, nil
+	}
+	database.Mocks.ExternalAccounts.TouchLastValid = func(ctx context.Context, id int32) error {
+		return nil
+	}
+	database.Mocks.UserEmails.ListByUser = func(ctx context.Context, opt database.UserEmailsListOptions) ([]*database.UserEmail, error) {
+		return nil, nil
+	}
+	database.Mocks.ExternalServices.List = func(opt database.ExternalServicesListOptions) ([]*types.ExternalService, error) {
+		return []*types.ExternalService{}, nil
+	}
+	database.Mocks.Repos.ListExternalServiceRepoIDsByUserID = func(ctx context.Context, userID int32) ([]api.RepoID, error) {
+		return []api.RepoID{}, nil
+	}
+	edb.Mocks.Perms.ListExternalAccounts = func(context.Context, int32) ([]*extsvc.Account, error) {
+		return []*extsvc.Account{&extAccount}, nil
+	}
+	edb.Mocks.Perms.LoadUserPermissions = func(_ context.Context, p *authz.UserPermissions) error {
+		p.IDs = roaring.BitmapOf(1, 2, 3)
+		return nil
+	}
+	edb.Mocks.Perms.SetUserPermissionsWithDiff = func(context.Context, *authz.UserPermissions) (*edb.UserPermissionsDiff, error) {
+		return &edb.UserPermissionsDiff{}, nil
+	}
+	defer func() {
+		database.Mocks = database.MockStores{}
+		edb.Mocks.Perms = edb.MockPerms{}
+	}()
+
+	// The limiter is practically not refilled during the test, so the remaining
+	// tokens reflect exactly how many have been charged.
+	rateLimiterRegistry := ratelimit.NewRegistry()
+	l := rateLimiterRegistry.GetOrSet(p.ServiceID(), rate.NewLimiter(rate.Every(time.Hour), 10))
+
+	s := NewPermsSyncer(repos.NewStore(&dbtesting.MockDB{}, sql.TxOptions{}), edb.Perms(nil, timeutil.Now), timeutil.Now, rateLimiterRegistry, PermsSyncerOptions{})
+	_, err := s.syncUserPerms(context.Background(), 1, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if gotKnownRepos != 3 {
+		t.Fatalf("knownRepos: want 3 but got %d", gotKnownRepos)
+	}
+
+	now := time.Now()
+	if !l.AllowN(now, 6) {
+		t.Fatal("want 6 tokens remaining but not available")
+	}
+	if l.AllowN(now, 1) {
+		t.Fatal("want no tokens remaining but still available")
+	}
+}
+
+func TestPermsSyncer_syncRepoPerms_incremental(t *testing.T) {
+	var fetchErr error
+	p := &mockProvider{
+		serviceType: extsvc.TypeGitLab,
+		serviceID:   "https://gitlab.com/",
+		fetchRepoPerms: func(ctx context.Context, repo *extsvc.Repository) ([]extsvc.AccountID, error) {
+			return []extsvc.AccountID{"alice", "bob"}, fetchErr
+		},
+	}
+	authz.SetProviders(false, []authz.Provider{p})
+	defer authz.SetProviders(true, nil)
+
+	var calls []string
+	edb.Mocks.Perms.Transact = func(context.Context) (*edb.PermsStore, error) {
+		return &edb.PermsStore{}, nil
+	}
+	edb.Mocks.Perms.GetUserIDsByExternalAccounts = func(context.Context, *extsvc.Accounts) (map[string]int32, error) {
+		return map[string]int32{"alice": 1}, nil
+	}
+	edb.Mocks.Perms.SetRepoPermissions = func(_ context.Context, p *authz.RepoPermissions) error {
+		calls = append(calls, "SetRepoPermissions")
+		return nil
+	}
+	edb.Mocks.Perms.TouchRepoPermissions = func(context.Context, int32) error {
+		calls = append(calls, "TouchRepoPermissions")
+		return nil
+	}
+	edb.Mocks.Perms.SetRepoPendingPermissions = func(_ context.Context, accounts *extsvc.Accounts, _ *authz.RepoPermissions) error {
+		calls = append(calls, "SetRepoPendingPermissions")
+		return nil
+	}
+	database.Mocks.Repos.List = func(context.Context, database.ReposListOptions) ([]*types.Repo, error) {
+		return []*types.Repo{
+			{
+				ID:      1,
+				Private: true,
+				ExternalRepo: api.ExternalRepoSpec{
+					ServiceID: p.ServiceID(),
+				},
+				Sources: map[string]*types.SourceInfo{
+					p.URN(): {},
+				},
+			},
+		}, nil
+	}
+	database.Mocks.Repos.ListExternalServiceUserIDsByRepoID = func(ctx context.Context, repoID api.RepoID) ([]int32, error) {
+		return []int32{}, nil
+	}
+	defer func() {
+		edb.Mocks.Perms = edb.MockPerms{}
+		database.Mocks.Repos = database.MockRepos{}
+	}()
+
+	pending := func(serviceID string, accountIDs ...string) []extsvc.AccountSpec {
+		specs := make([]extsvc.AccountSpec, len(accountIDs))
+		for i := range accountIDs {
+			specs[i] = extsvc.AccountSpec{
+				ServiceType: extsvc.TypeGitLab,
+				ServiceID:   serviceID,
+				AccountID:   accountIDs[i],
+			}
+		}
+		return specs
+	}
+
+	tests := []struct {
+		name      string
+		stored    *edb.RepoPermissionsExplanation
+		fetchErr  error
+		wantCalls []string
+	}{
+		{
+			name:      "no stored permissions",
+			stored:    &edb.RepoPermissionsExplanation{},
+			wantCalls: []string{"SetRepoPermissions", "SetRepoPendingPermissions"},
+		},
+		{
+			name: "unchanged",
+			stored: &edb.RepoPermissionsExplanation{
+				UserIDs:         []int32{1},
+				PendingAccounts: pending(p.ServiceID(), "bob"),
+			},
+			wantCalls: []string{"TouchRepoPermissions"},
+		},
+		{
+			name: "users changed",
+			stored: &edb.RepoPermissionsExplanation{
+				UserIDs:         []int32{1, 2},
+				PendingAccounts: pending(p.ServiceID(), "bob"),
+			},
+			wantCalls: []string{"SetRepoPermissions"},
+		},
+		{
+			name: "pending accounts changed",
+			stored: &edb.RepoPermissionsExplanation{
+				UserIDs:         []int32{1},
+				PendingAccounts: pending(p.ServiceID(), "bob", "cindy"),
+			},
+			wantCalls: []string{"TouchRepoPermissions", "SetRepoPendingPermissions"},
+		},
+		{
+			name: "pending accounts of another code host",
+			stored: &edb.RepoPermissionsExplanation{
+				UserIDs:         []int32{1},
+				PendingAccounts: pending("https://gitlab.example.com/", "bob"),
+			},
+			wantCalls: []string{"TouchRepoPermissions", "SetRepoPendingPermissions"},
+		},
+		{
+			name: "partial results",
+			stored: &edb.RepoPermissionsExplanation{
+				UserIDs:         []int32{1},
+				PendingAccounts: pending(p.ServiceID(), "bob"),
+			},
+			fetchErr:  errors.New("rate limited"),
+			wantCalls: []string{"SetRepoPermissions", "SetRepoPendingPermissions"},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			calls = nil
+			fetchErr = test.fetchErr
+			edb.Mocks.Perms.ExplainRepoPermissions = func(context.Context, int32, authz.Perms) (*edb.RepoPermissionsExplanation, error) {
+				return test.stored, nil
+			}
+
+			s := NewPermsSyncer(repos.NewStore(&dbtesting.MockDB{}, sql.TxOptions{}), edb.Perms(nil, timeutil.Now), timeutil.Now, nil, PermsSyncerOptions{IncrementalRepoSync: true})
+
+			err := s.syncRepoPerms(context.Background(), 1, true)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if diff := cmp.Diff(test.wantCalls, calls); diff != "" {
+				t.Fatalf("calls mismatch (-want +got):\n%s", diff)
+			}
+		})
+	}
+
+	t.Run("error of loading stored permissions", func(t *testing.T) {
+		calls = nil
+		fetchErr = nil
+		edb.Mocks.Perms.ExplainRepoPermissions = func(context.Context, int32, authz.Perms) (*edb.RepoPermissionsExplanation, error) {
+			return nil, errors.New("boom")
+		}
+
+		s := NewPermsSyncer(repos.NewStore(&dbtesting.MockDB{}, sql.TxOptions{}), edb.Perms(nil, timeutil.Now), timeutil.Now, nil, PermsSyncerOptions{IncrementalRepoSync: true})
+
+		err := s.syncRepoPerms(context.Background(), 1, false)
+		if err == nil {
+			t.Fatal("want error but got nil")
 		}
+		if len(calls) != 0 {
+			t.Fatalf("want no writes but got %v", calls)
+		}
+	})
+}
+
+func TestPermsSyncer_syncRepoPerms_reservesEstimatedCalls(t *testing.T) {
+	var gotKnownAccounts int
+	p := &estimatingProvider{
+		mockProvider: &mockProvider{
+			serviceType: extsvc.TypeGitHub,
+			serviceID:   "https://github.com/",
+			fetchRepoPerms: func(ctx context.Context, repo *extsvc.Repository) ([]extsvc.AccountID, error) {
+				return []extsvc.AccountID{}, nil
+			},
+		},
+		estimateRepoPermsCalls: func(knownAccounts int) int {
+			gotKnownAccounts = knownAccounts
+			return 3
+		},
+	}
+	authz.SetProviders(false, []authz.Provider{p})
+	defer authz.SetProviders(true, nil)
+
+	edb.Mocks.Perms.LoadRepoPermissions = func(_ context.Context, p *authz.RepoPermissions) error {
+		p.UserIDs = roaring.BitmapOf(1, 2, 3, 4, 5)
+		return nil
+	}
+	edb.Mocks.Perms.Transact = func(context.Context) (*edb.PermsStore, error) {
+		return &edb.PermsStore{}, nil
+	}
+	edb.Mocks.Perms.SetRepoPermissions = func(_ context.Context, p *authz.RepoPermissions) error {
 		return nil
 	}
-	edb.Mocks.Perms.SetRepoPendingPermissions = func(_ context.Context, accounts *extsvc.Accounts, _ *authz.RepoPermissions) error {
-		wantAccounts := &extsvc.Accounts{
-			ServiceType: p.ServiceType(),
-			ServiceID:   p.ServiceID(),
-			AccountIDs:  []string{"pending_user"},
-		}
-		if diff := cmp.Diff(wantAccounts, accounts); diff != "" {
-			return errors.Errorf("accounts mismatch (-want +got):\n%s", diff)
-		}
+	edb.Mocks.Perms.SetRepoPendingPermissions = func(ctx context.Context, accounts *extsvc.Accounts, p *authz.RepoPermissions) error {
 		return nil
 	}
 	database.Mocks.Repos.List = func(context.Context, database.ReposListOptions) ([]*types.Repo, error) {
@@ -645,41 +1931,34 @@ func TestPermsSyncer_syncRepoPerms(t *testing.T) {
 		database.Mocks.Repos = database.MockRepos{}
 	}()
 
-	s := newPermsSyncer(repos.NewStore(&dbtesting.MockDB{}, sql.TxOptions{}))
+	// The limiter is practically not refilled during the test, so the remaining
+	// tokens reflect exactly how many have been charged.
+	rateLimiterRegistry := ratelimit.NewRegistry()
+	l := rateLimiterRegistry.GetOrSet(p.ServiceID(), rate.NewLimiter(rate.Every(time.Hour), 10))
 
-	tests := []struct {
-		name     string
-		noPerms  bool
-		fetchErr error
-	}{
-		{
-			name:     "sync for the first time and encounter an error",
-			noPerms:  true,
-			fetchErr: errors.New("random error"),
-		},
-		{
-			name:    "sync for the second time and succeed",
-			noPerms: false,
-		},
+	s := NewPermsSyncer(repos.NewStore(&dbtesting.MockDB{}, sql.TxOptions{}), edb.Perms(nil, timeutil.Now), timeutil.Now, rateLimiterRegistry, PermsSyncerOptions{})
+	err := s.syncRepoPerms(context.Background(), 1, false)
+	if err != nil {
+		t.Fatal(err)
 	}
-	for _, test := range tests {
-		t.Run(test.name, func(t *testing.T) {
-			p.fetchRepoPerms = func(context.Context, *extsvc.Repository) ([]extsvc.AccountID, error) {
-				return []extsvc.AccountID{"user", "pending_user"}, test.fetchErr
-			}
 
-			err := s.syncRepoPerms(context.Background(), 1, test.noPerms)
-			if err != nil {
-				t.Fatal(err)
-			}
-		})
+	if gotKnownAccounts != 5 {
+		t.Fatalf("knownAccounts: want 5 but got %d", gotKnownAccounts)
+	}
+
+	now := time.Now()
+	if !l.AllowN(now, 7) {
+		t.Fatal("want 7 tokens remaining but not available")
+	}
+	if l.AllowN(now, 1) {
+		t.Fatal("want no tokens remaining but still available")
 	}
 }
 
 func TestPermsSyncer_waitForRateLimit(t *testing.T) {
 	ctx := context.Background()
 	t.Run("no rate limit registry", func(t *testing.T) {
-		s := NewPermsSyncer(nil, nil, nil, nil)
+		s := NewPermsSyncer(nil, nil, nil, nil, PermsSyncerOptions{})
 
 		ctx, cancel := context.WithTimeout(ctx, time.Second)
 		defer cancel()
@@ -691,7 +1970,7 @@ func TestPermsSyncer_waitForRateLimit(t *testing.T) {
 
 	t.Run("enough quota available", func(t *testing.T) {
 		rateLimiterRegistry := ratelimit.NewRegistry()
-		s := NewPermsSyncer(nil, nil, nil, rateLimiterRegistry)
+		s := NewPermsSyncer(nil, nil, nil, rateLimiterRegistry, PermsSyncerOptions{})
 
 		ctx, cancel := context.WithTimeout(ctx, time.Second)
 		defer cancel()
@@ -705,7 +1984,7 @@ func TestPermsSyncer_waitForRateLimit(t *testing.T) {
 		rateLimiterRegistry := ratelimit.NewRegistry()
 		l := rateLimiterRegistry.Get("https://github.com/")
 		l.SetLimit(1)
-		s := NewPermsSyncer(nil, nil, nil, rateLimiterRegistry)
+		s := NewPermsSyncer(nil, nil, nil, rateLimiterRegistry, PermsSyncerOptions{})
 
 		ctx, cancel := context.WithTimeout(ctx, time.Second)
 		defer cancel()
@@ -714,6 +1993,25 @@ func TestPermsSyncer_waitForRateLimit(t *testing.T) {
 			t.Fatalf("err: want %v but got nil", context.Canceled)
 		}
 	})
+
+	t.Run("more than burst is split into multiple waits", func(t *testing.T) {
+		rateLimiterRegistry := ratelimit.NewRegistry()
+		rateLimiterRegistry.GetOrSet("https://github.com/", rate.NewLimiter(rate.Limit(50), 10))
+		s := NewPermsSyncer(nil, nil, nil, rateLimiterRegistry, PermsSyncerOptions{})
+
+		ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+		defer cancel()
+		start := time.Now()
+		err := s.waitForRateLimit(ctx, "https://github.com/", 30)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// The first 10 are available right away, the other 20 take 400ms to refill.
+		if elapsed := time.Since(start); elapsed < 300*time.Millisecond {
+			t.Fatalf("want waiting for refills but returned after %s", elapsed)
+		}
+	})
 }
 
 func TestPermsSyncer_syncPerms(t *testing.T) {
@@ -726,7 +2024,7 @@ func TestPermsSyncer_syncPerms(t *testing.T) {
 	}
 
 	// Request should be removed from the queue even if error occurred.
-	s := NewPermsSyncer(nil, nil, nil, nil)
+	s := NewPermsSyncer(nil, nil, nil, nil, PermsSyncerOptions{})
 	s.queue.Push(request)
 
 	expErr := "unexpected request type: 3"
@@ -739,3 +2037,473 @@ func TestPermsSyncer_syncPerms(t *testing.T) {
 		t.Fatalf("queue length: want 0 but got %d", s.queue.Len())
 	}
 }
+
+func TestPermsSyncer_syncPerms_timeout(t *testing.T) {
+	p := &mockProvider{
+		id:          1,
+		serviceType: extsvc.TypeGitLab,
+		serviceID:   "https://gitlab.com/",
+		fetchRepoPerms: func(ctx context.Context, repo *extsvc.Repository) ([]extsvc.AccountID, error) {
+			<-ctx.Done()
+			return nil, ctx.Err()
+		},
+	}
+	authz.SetProviders(false, []authz.Provider{p})
+	defer authz.SetProviders(true, nil)
+
+	database.Mocks.Repos.List = func(context.Context, database.ReposListOptions) ([]*types.Repo, error) {
+		return []*types.Repo{
+			{
+				ID:      1,
+				Private: true,
+				ExternalRepo: api.ExternalRepoSpec{
+					ID:          "1",
+					ServiceType: p.ServiceType(),
+					ServiceID:   p.ServiceID(),
+				},
+				Sources: map[string]*types.SourceInfo{
+					p.URN(): {},
+				},
+			},
+		}, nil
+	}
+	database.Mocks.Repos.ListExternalServiceUserIDsByRepoID = func(ctx context.Context, repoID api.RepoID) ([]int32, error) {
+		return []int32{}, nil
+	}
+	defer func() {
+		database.Mocks.Repos = database.MockRepos{}
+	}()
+
+	s := NewPermsSyncer(repos.NewStore(&dbtesting.MockDB{}, sql.TxOptions{}), edb.Perms(nil, timeutil.Now), timeutil.Now, nil, PermsSyncerOptions{
+		SyncTimeout:     10 * time.Millisecond,
+		MaxSyncAttempts: 3,
+	})
+
+	before := testutil.ToFloat64(metricsSyncTimeouts.WithLabelValues("repo"))
+
+	s.queue.enqueue(&requestMeta{Type: requestTypeRepo, ID: 1})
+	err := s.syncPerms(context.Background(), s.queue.acquireNext())
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("want %v but got %v", context.DeadlineExceeded, err)
+	}
+
+	if got := testutil.ToFloat64(metricsSyncTimeouts.WithLabelValues("repo")) - before; got != 1 {
+		t.Fatalf("timeouts: want 1 but got %v", got)
+	}
+
+	// The timed out request is retried later.
+	if s.queue.Len() != 1 {
+		t.Fatalf("queue length: want 1 but got %d", s.queue.Len())
+	}
+	if attempts := s.queue.heap[0].Attempts; attempts != 1 {
+		t.Fatalf("attempts: want 1 but got %d", attempts)
+	}
+}
+
+func TestPermsSyncer_RateLimiterState(t *testing.T) {
+	now := time.Now()
+	clock := func() time.Time { return now }
+
+	rateLimiterRegistry := ratelimit.NewRegistry()
+	l := rateLimiterRegistry.GetOrSet("https://github.com/", rate.NewLimiter(rate.Limit(1), 10))
+	if !l.AllowN(now, 4) {
+		t.Fatal("want 4 tokens to be allowed")
+	}
+
+	s := NewPermsSyncer(nil, nil, clock, rateLimiterRegistry, PermsSyncerOptions{})
+	s.getProviders = func() []authz.Provider {
+		return []authz.Provider{
+			&mockProvider{serviceType: extsvc.TypeGitHub, serviceID: "https://github.com/"},
+			&mockProvider{serviceType: extsvc.TypeGitLab, serviceID: "https://gitlab.com/"},
+		}
+	}
+
+	want := map[string]LimiterState{
+		"https://github.com/": {
+			Rate:      1,
+			Burst:     10,
+			Available: 6,
+		},
+		"https://gitlab.com/": {
+			Unlimited: true,
+			Burst:     100,
+		},
+	}
+	if diff := cmp.Diff(want, s.RateLimiterState(context.Background())); diff != "" {
+		t.Fatalf("mismatch (-want +got):\n%s", diff)
+	}
+
+	// Inspecting the state should not consume any tokens.
+	if !l.AllowN(now, 6) {
+		t.Fatal("want 6 tokens to be available")
+	}
+}
+
+func TestPermsSyncer_collectQueueMetrics(t *testing.T) {
+	now := time.Date(2021, 6, 1, 10, 0, 0, 0, time.UTC)
+	clock := func() time.Time { return now }
+	s := NewPermsSyncer(nil, nil, clock, nil, PermsSyncerOptions{})
+
+	s.collectQueueMetrics()
+	if got := testutil.ToFloat64(metricsOldestQueuedAge); got != 0 {
+		t.Fatalf("empty queue: want 0 but got %v", got)
+	}
+
+	// Enqueue requests of known ages, the oldest one is then acquired and should
+	// not be counted as queued.
+	for i, age := range []time.Duration{10 * time.Minute, 5 * time.Minute, time.Minute} {
+		now = time.Date(2021, 6, 1, 10, 0, 0, 0, time.UTC).Add(-age)
+		s.queue.enqueue(&requestMeta{Type: requestTypeRepo, ID: int32(i + 1)})
+	}
+	now = time.Date(2021, 6, 1, 10, 0, 0, 0, time.UTC)
+
+	s.collectQueueMetrics()
+	if got := testutil.ToFloat64(metricsOldestQueuedAge); got != 600 {
+		t.Fatalf("want 600 but got %v", got)
+	}
+	if got := testutil.ToFloat64(metricsQueueSize); got != 3 {
+		t.Fatalf("queue size: want 3 but got %v", got)
+	}
+
+	s.queue.acquireNext()
+	s.collectQueueMetrics()
+	if got := testutil.ToFloat64(metricsOldestQueuedAge); got != 300 {
+		t.Fatalf("after acquire: want 300 but got %v", got)
+	}
+}
+
+func TestPermsSyncer_DebugDump_wait(t *testing.T) {
+	now := time.Date(2021, 6, 1, 10, 0, 0, 0, time.UTC)
+	clock := func() time.Time { return now }
+	s := NewPermsSyncer(nil, nil, clock, nil, PermsSyncerOptions{})
+
+	s.queue.enqueue(&requestMeta{Type: requestTypeUser, ID: 1})
+	now = now.Add(90 * time.Second)
+	s.queue.enqueue(&requestMeta{Type: requestTypeRepo, ID: 1})
+	now = now.Add(30 * time.Second)
+
+	dump, err := json.Marshal(s.DebugDump())
+	if err != nil {
+		t.Fatal(err)
+	}
+	var data struct {
+		Queue []struct {
+			Meta struct{ Type requestType }
+			Wait time.Duration
+		}
+	}
+	if err := json.Unmarshal(dump, &data); err != nil {
+		t.Fatal(err)
+	}
+
+	got := make(map[requestType]time.Duration)
+	for _, request := range data.Queue {
+		got[request.Meta.Type] = request.Wait
+	}
+	want := map[requestType]time.Duration{
+		requestTypeUser: 2 * time.Minute,
+		requestTypeRepo: 30 * time.Second,
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Fatalf("wait mismatch (-want +got):\n%s", diff)
+	}
+}
+
+func TestPermsSyncer_schedule_concurrent(t *testing.T) {
+	syncedAt := time.Date(2021, 6, 1, 10, 0, 0, 0, time.UTC)
+	edb.Mocks.Perms.UserIDsWithNoPerms = func(context.Context) ([]int32, error) {
+		return []int32{1, 2}, nil
+	}
+	edb.Mocks.Perms.RepoIDsWithNoPerms = func(context.Context, bool) ([]api.RepoID, error) {
+		return []api.RepoID{3}, nil
+	}
+	edb.Mocks.Perms.UserIDsWithOldestPerms = func(context.Context, int) (map[int32]time.Time, error) {
+		return map[int32]time.Time{4: syncedAt}, nil
+	}
+	edb.Mocks.Perms.ReposIDsWithOldestPerms = func(context.Context, int, bool) (map[api.RepoID]time.Time, error) {
+		return map[api.RepoID]time.Time{5: syncedAt, 6: syncedAt.Add(time.Minute)}, nil
+	}
+	defer func() {
+		edb.Mocks.Perms = edb.MockPerms{}
+	}()
+
+	// Results of both passes must be comparable.
+	s := NewPermsSyncer(nil, edb.Perms(nil, timeutil.Now), timeutil.Now, nil, PermsSyncerOptions{ScheduleJitter: -1})
+	want, err := s.schedule(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s.concurrentSchedule = true
+	got, err := s.schedule(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Results of the oldest permissions come from maps and are not ordered.
+	opts := cmp.Options{
+		cmp.AllowUnexported(scheduledUser{}, scheduledRepo{}),
+		cmpopts.SortSlices(func(a, b scheduledUser) bool { return a.userID < b.userID }),
+		cmpopts.SortSlices(func(a, b scheduledRepo) bool { return a.repoID < b.repoID }),
+	}
+	if diff := cmp.Diff(want, got, opts...); diff != "" {
+		t.Fatalf("schedule mismatch (-want +got):\n%s", diff)
+	}
+	if len(got.Users) != 3 || len(got.Repos) != 3 {
+		t.Fatalf("want 3 users and 3 repos but got %d users and %d repos", len(got.Users), len(got.Repos))
+	}
+
+	// A failing query must not leak a partial schedule.
+	edb.Mocks.Perms.RepoIDsWithNoPerms = func(context.Context, bool) ([]api.RepoID, error) {
+		return nil, errors.New("boom")
+	}
+	got, err = s.schedule(context.Background())
+	if err == nil {
+		t.Fatal("want error but got nil")
+	}
+	if got != nil {
+		t.Fatalf("want no schedule but got %+v", got)
+	}
+}
+
+func TestPermsSyncer_runSchedule_intervals(t *testing.T) {
+	userCalls := make(chan struct{}, 10)
+	repoCalls := make(chan struct{}, 10)
+	edb.Mocks.Perms.UserIDsWithNoPerms = func(context.Context) ([]int32, error) {
+		userCalls <- struct{}{}
+		return nil, nil
+	}
+	edb.Mocks.Perms.RepoIDsWithNoPerms = func(context.Context, bool) ([]api.RepoID, error) {
+		repoCalls <- struct{}{}
+		return nil, nil
+	}
+	edb.Mocks.Perms.UserIDsWithOldestPerms = func(context.Context, int) (map[int32]time.Time, error) {
+		return nil, nil
+	}
+	edb.Mocks.Perms.ReposIDsWithOldestPerms = func(context.Context, int, bool) (map[api.RepoID]time.Time, error) {
+		return nil, nil
+	}
+	defer func() {
+		edb.Mocks.Perms = edb.MockPerms{}
+	}()
+
+	clock := glock.NewMockClock()
+	s := NewPermsSyncer(nil, edb.Perms(nil, timeutil.Now), timeutil.Now, nil, PermsSyncerOptions{})
+	s.scheduleClock = clock
+	s.SetScheduleIntervals(time.Minute, 3*time.Minute)
+	s.getProviders = func() []authz.Provider {
+		return []authz.Provider{&mockProvider{serviceType: extsvc.TypeGitHub, serviceID: "https://github.com/"}}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		s.runSchedule(ctx)
+	}()
+
+	wait := func(calls chan struct{}, name string, minute int) {
+		t.Helper()
+		select {
+		case <-calls:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("%s were not scheduled at minute %d", name, minute)
+		}
+	}
+
+	// Wait for both tickers to be created before advancing the clock.
+	var tickers []time.Duration
+	for len(tickers) < 2 {
+		tickers = append(tickers, clock.GetTickerArgs()...)
+		time.Sleep(time.Millisecond)
+	}
+	if diff := cmp.Diff([]time.Duration{time.Minute, 3 * time.Minute}, tickers); diff != "" {
+		t.Fatalf("ticker intervals mismatch (-want +got):\n%s", diff)
+	}
+
+	for minute := 1; minute <= 6; minute++ {
+		clock.Advance(time.Minute)
+		wait(userCalls, "users", minute)
+		if minute%3 == 0 {
+			wait(repoCalls, "repos", minute)
+		}
+	}
+	cancel()
+	<-done
+
+	if len(userCalls) != 0 {
+		t.Fatalf("want users to be scheduled 6 times but got %d more", len(userCalls))
+	}
+	if len(repoCalls) != 0 {
+		t.Fatalf("want repos to be scheduled 2 times but got %d more", len(repoCalls))
+	}
+}
+
+func TestPermsSyncer_SetScheduleInterval(t *testing.T) {
+	calls := make(chan string, 10)
+	edb.Mocks.Perms.UserIDsWithNoPerms = func(context.Context) ([]int32, error) {
+		calls <- "users"
+		return nil, nil
+	}
+	edb.Mocks.Perms.RepoIDsWithNoPerms = func(context.Context, bool) ([]api.RepoID, error) {
+		calls <- "repos"
+		return nil, nil
+	}
+	edb.Mocks.Perms.UserIDsWithOldestPerms = func(context.Context, int) (map[int32]time.Time, error) {
+		return nil, nil
+	}
+	edb.Mocks.Perms.ReposIDsWithOldestPerms = func(context.Context, int, bool) (map[api.RepoID]time.Time, error) {
+		return nil, nil
+	}
+	defer func() {
+		edb.Mocks.Perms = edb.MockPerms{}
+	}()
+
+	clock := glock.NewMockClock()
+	s := NewPermsSyncer(nil, edb.Perms(nil, timeutil.Now), timeutil.Now, nil, PermsSyncerOptions{})
+	s.scheduleClock = clock
+	s.getProviders = func() []authz.Provider {
+		return []authz.Provider{&mockProvider{serviceType: extsvc.TypeGitHub, serviceID: "https://github.com/"}}
+	}
+
+	if err := s.SetScheduleInterval(0); err == nil {
+		t.Fatal("want error for zero interval but got nil")
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		s.runSchedule(ctx)
+	}()
+
+	waitTickers := func(want ...time.Duration) {
+		t.Helper()
+		var tickers []time.Duration
+		for len(tickers) < len(want) {
+			tickers = append(tickers, clock.GetTickerArgs()...)
+			time.Sleep(time.Millisecond)
+		}
+		if diff := cmp.Diff(want, tickers); diff != "" {
+			t.Fatalf("ticker intervals mismatch (-want +got):\n%s", diff)
+		}
+	}
+	waitTickers(time.Minute, time.Minute)
+
+	// The new interval takes effect without waiting out the old one.
+	if err := s.SetScheduleInterval(10 * time.Second); err != nil {
+		t.Fatal(err)
+	}
+	waitTickers(10*time.Second, 10*time.Second)
+
+	clock.Advance(10 * time.Second)
+	got := make(map[string]int)
+	for i := 0; i < 2; i++ {
+		select {
+		case call := <-calls:
+			got[call]++
+		case <-time.After(5 * time.Second):
+			t.Fatal("timed out waiting for schedule")
+		}
+	}
+	cancel()
+	<-done
+
+	if diff := cmp.Diff(map[string]int{"users": 1, "repos": 1}, got); diff != "" {
+		t.Fatalf("schedules mismatch (-want +got):\n%s", diff)
+	}
+}
+
+func TestPermsSyncer_SetScheduleLimits(t *testing.T) {
+	var userLimit, repoLimit int
+	edb.Mocks.Perms.UserIDsWithNoPerms = func(context.Context) ([]int32, error) {
+		return nil, nil
+	}
+	edb.Mocks.Perms.RepoIDsWithNoPerms = func(context.Context, bool) ([]api.RepoID, error) {
+		return nil, nil
+	}
+	edb.Mocks.Perms.UserIDsWithOldestPerms = func(_ context.Context, limit int) (map[int32]time.Time, error) {
+		userLimit = limit
+		return nil, nil
+	}
+	edb.Mocks.Perms.ReposIDsWithOldestPerms = func(_ context.Context, limit int, _ bool) (map[api.RepoID]time.Time, error) {
+		repoLimit = limit
+		return nil, nil
+	}
+	defer func() {
+		edb.Mocks.Perms = edb.MockPerms{}
+	}()
+
+	s := NewPermsSyncer(nil, edb.Perms(nil, timeutil.Now), timeutil.Now, nil, PermsSyncerOptions{})
+	check := func(wantUsers, wantRepos int) {
+		t.Helper()
+		if _, err := s.schedule(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+		if userLimit != wantUsers || repoLimit != wantRepos {
+			t.Fatalf("limits: want %d users and %d repos but got %d users and %d repos", wantUsers, wantRepos, userLimit, repoLimit)
+		}
+	}
+	check(10, 10)
+
+	if err := s.SetScheduleLimits(50, 0); err == nil {
+		t.Fatal("want error for zero limit but got nil")
+	}
+	check(10, 10)
+
+	if err := s.SetScheduleLimits(50, 20); err != nil {
+		t.Fatal(err)
+	}
+	check(50, 20)
+}
+
+func TestPermsSyncer_PauseAndResume(t *testing.T) {
+	s := NewPermsSyncer(nil, nil, timeutil.Now, nil, PermsSyncerOptions{})
+
+	paused := func() bool {
+		dump, err := json.Marshal(s.DebugDump())
+		if err != nil {
+			t.Fatal(err)
+		}
+		var data struct{ Paused bool }
+		if err := json.Unmarshal(dump, &data); err != nil {
+			t.Fatal(err)
+		}
+		return data.Paused
+	}
+
+	s.Pause()
+	if !paused() {
+		t.Fatal("want paused in debug dump")
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go s.runSync(ctx)
+
+	// Requests of an unexpected type fail right away and are removed from the
+	// queue once processed.
+	s.queue.enqueue(&requestMeta{Type: 3, ID: 1})
+	time.Sleep(50 * time.Millisecond)
+	if got := s.queue.queuedIDs(3); len(got) != 1 {
+		t.Fatalf("want request kept in the queue while paused but got %v", got)
+	}
+
+	s.Resume()
+	if paused() {
+		t.Fatal("want not paused in debug dump")
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		s.queue.mu.RLock()
+		n := s.queue.Len()
+		s.queue.mu.RUnlock()
+		if n == 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("request was not processed after resuming")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
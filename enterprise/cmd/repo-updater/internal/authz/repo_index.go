@@ -0,0 +1,113 @@
+package authz
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/sourcegraph/sourcegraph/internal/api"
+	"github.com/sourcegraph/sourcegraph/internal/types"
+)
+
+// repoIndex is an in-memory index of private repositories keyed by their external
+// repository specs. It allows resolving exact matches without a database round-trip
+// for instances where the set of repositories is stable.
+type repoIndex struct {
+	// The function to list all private repositories to build the index from.
+	list func(ctx context.Context) ([]*types.Repo, error)
+	// The mockable function to return the current time.
+	clock func() time.Time
+	// The time duration of how long the index is valid before it is rebuilt.
+	ttl time.Duration
+
+	// refreshMu ensures only one rebuild happens at a time.
+	refreshMu sync.Mutex
+
+	mu          sync.RWMutex
+	repos       map[api.ExternalRepoSpec]types.RepoName
+	refreshedAt time.Time // Zero value indicates the index needs to be rebuilt.
+	generation  int       // Incremented on every invalidation.
+}
+
+func newRepoIndex(list func(ctx context.Context) ([]*types.Repo, error), clock func() time.Time, ttl time.Duration) *repoIndex {
+	return &repoIndex{
+		list:  list,
+		clock: clock,
+		ttl:   ttl,
+	}
+}
+
+// stale returns true if the index has been invalidated or has expired.
+func (idx *repoIndex) stale() bool {
+	idx.mu.RLock()
+	defer idx.mu.RUnlock()
+	return idx.refreshedAt.IsZero() || idx.clock().Sub(idx.refreshedAt) >= idx.ttl
+}
+
+// invalidate marks the index as stale so it is rebuilt on next lookup. It should
+// be called whenever repositories are known to be added or removed.
+func (idx *repoIndex) invalidate() {
+	idx.mu.Lock()
+	idx.refreshedAt = time.Time{}
+	idx.generation++
+	idx.mu.Unlock()
+}
+
+// refresh rebuilds the index if it is stale.
+func (idx *repoIndex) refresh(ctx context.Context) error {
+	idx.refreshMu.Lock()
+	defer idx.refreshMu.Unlock()
+
+	// Another goroutine may have rebuilt the index while we were waiting.
+	if !idx.stale() {
+		return nil
+	}
+
+	idx.mu.RLock()
+	generation := idx.generation
+	idx.mu.RUnlock()
+
+	began := idx.clock()
+	rs, err := idx.list(ctx)
+	if err != nil {
+		return err
+	}
+
+	repos := make(map[api.ExternalRepoSpec]types.RepoName, len(rs))
+	for _, r := range rs {
+		repos[r.ExternalRepo] = types.RepoName{ID: r.ID, Name: r.Name}
+	}
+
+	idx.mu.Lock()
+	idx.repos = repos
+	// Any invalidation happened during the listing means the result may already be
+	// outdated, keep the index stale so it is rebuilt on next lookup.
+	if idx.generation == generation {
+		idx.refreshedAt = began
+	}
+	idx.mu.Unlock()
+	return nil
+}
+
+// lookup returns names of repositories found in the index by given specs, and the
+// list of specs that are not found, rebuilding the index first if it is stale.
+func (idx *repoIndex) lookup(ctx context.Context, repoSpecs []api.ExternalRepoSpec) (found []types.RepoName, missing []api.ExternalRepoSpec, err error) {
+	if idx.stale() {
+		if err = idx.refresh(ctx); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	idx.mu.RLock()
+	defer idx.mu.RUnlock()
+
+	found = make([]types.RepoName, 0, len(repoSpecs))
+	for _, spec := range repoSpecs {
+		if r, ok := idx.repos[spec]; ok {
+			found = append(found, r)
+		} else {
+			missing = append(missing, spec)
+		}
+	}
+	return found, missing, nil
+}
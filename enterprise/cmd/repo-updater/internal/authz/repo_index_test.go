@@ -0,0 +1,246 @@
+package authz
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/cockroachdb/errors"
+	"github.com/google/go-cmp/cmp"
+
+	edb "github.com/sourcegraph/sourcegraph/enterprise/internal/database"
+	"github.com/sourcegraph/sourcegraph/internal/api"
+	"github.com/sourcegraph/sourcegraph/internal/database"
+	"github.com/sourcegraph/sourcegraph/internal/database/dbtesting"
+	"github.com/sourcegraph/sourcegraph/internal/extsvc"
+	"github.com/sourcegraph/sourcegraph/internal/repos"
+	"github.com/sourcegraph/sourcegraph/internal/types"
+)
+
+func testRepoSpec(id string) api.ExternalRepoSpec {
+	return api.ExternalRepoSpec{
+		ID:          id,
+		ServiceType: extsvc.TypeGitHub,
+		ServiceID:   "https://github.com/",
+	}
+}
+
+func testRepo(id api.RepoID) *types.Repo {
+	return &types.Repo{
+		ID:           id,
+		Name:         api.RepoName(fmt.Sprintf("github.com/org/repo-%d", id)),
+		ExternalRepo: testRepoSpec(fmt.Sprintf("%d", id)),
+	}
+}
+
+func TestRepoIndex(t *testing.T) {
+	now := time.Now()
+	clock := func() time.Time { return now }
+
+	stored := []*types.Repo{testRepo(1), testRepo(2)}
+	calledList := 0
+	idx := newRepoIndex(
+		func(context.Context) ([]*types.Repo, error) {
+			calledList++
+			return stored, nil
+		},
+		clock,
+		time.Minute,
+	)
+
+	lookup := func(t *testing.T, wantFound []api.RepoID, wantMissing []api.ExternalRepoSpec) {
+		t.Helper()
+
+		found, missing, err := idx.lookup(context.Background(), []api.ExternalRepoSpec{
+			testRepoSpec("1"),
+			testRepoSpec("2"),
+			testRepoSpec("3"),
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		gotFound := make([]api.RepoID, 0, len(found))
+		for _, r := range found {
+			gotFound = append(gotFound, r.ID)
+		}
+		if diff := cmp.Diff(wantFound, gotFound); diff != "" {
+			t.Fatalf("found mismatch (-want +got):\n%s", diff)
+		}
+		if diff := cmp.Diff(wantMissing, missing); diff != "" {
+			t.Fatalf("missing mismatch (-want +got):\n%s", diff)
+		}
+	}
+
+	lookup(t, []api.RepoID{1, 2}, []api.ExternalRepoSpec{testRepoSpec("3")})
+	if calledList != 1 {
+		t.Fatalf("calledList: want 1 but got %d", calledList)
+	}
+
+	// The index should not be rebuilt while it is still valid.
+	stored = []*types.Repo{testRepo(2), testRepo(3)}
+	lookup(t, []api.RepoID{1, 2}, []api.ExternalRepoSpec{testRepoSpec("3")})
+	if calledList != 1 {
+		t.Fatalf("calledList: want 1 but got %d", calledList)
+	}
+
+	t.Run("rebuild after invalidation", func(t *testing.T) {
+		idx.invalidate()
+		lookup(t, []api.RepoID{2, 3}, []api.ExternalRepoSpec{testRepoSpec("1")})
+		if calledList != 2 {
+			t.Fatalf("calledList: want 2 but got %d", calledList)
+		}
+	})
+
+	t.Run("rebuild after expiry", func(t *testing.T) {
+		stored = []*types.Repo{testRepo(1)}
+		now = now.Add(time.Minute)
+		lookup(t, []api.RepoID{1}, []api.ExternalRepoSpec{testRepoSpec("2"), testRepoSpec("3")})
+		if calledList != 3 {
+			t.Fatalf("calledList: want 3 but got %d", calledList)
+		}
+	})
+
+	t.Run("invalidation during rebuild keeps index stale", func(t *testing.T) {
+		idx.list = func(context.Context) ([]*types.Repo, error) {
+			calledList++
+			idx.invalidate()
+			return stored, nil
+		}
+		idx.invalidate()
+		lookup(t, []api.RepoID{1}, []api.ExternalRepoSpec{testRepoSpec("2"), testRepoSpec("3")})
+		if !idx.stale() {
+			t.Fatal("index should be stale")
+		}
+	})
+}
+
+func TestPermsSyncer_listPrivateRepoNamesByExact_repoIndex(t *testing.T) {
+	stored := []*types.Repo{testRepo(1), testRepo(2)}
+	calledList, calledListRepoNames := 0, 0
+	database.Mocks.Repos.List = func(_ context.Context, opt database.ReposListOptions) ([]*types.Repo, error) {
+		if !opt.OnlyPrivate {
+			return nil, errors.New("OnlyPrivate want true but got false")
+		}
+		calledList++
+		return stored, nil
+	}
+	database.Mocks.Repos.ListRepoNames = func(_ context.Context, opt database.ReposListOptions) ([]types.RepoName, error) {
+		calledListRepoNames++
+		var rs []types.RepoName
+		for _, r := range stored {
+			for _, id := range opt.IDs {
+				if r.ID == id {
+					rs = append(rs, types.RepoName{ID: r.ID, Name: r.Name})
+				}
+			}
+			for _, spec := range opt.ExternalRepos {
+				if r.ExternalRepo == spec {
+					rs = append(rs, types.RepoName{ID: r.ID, Name: r.Name})
+				}
+			}
+		}
+		return rs, nil
+	}
+	defer func() {
+		database.Mocks = database.MockStores{}
+	}()
+
+	s := NewPermsSyncer(repos.NewStore(&dbtesting.MockDB{}, sql.TxOptions{}), edb.Perms(nil, nil), time.Now, nil, PermsSyncerOptions{RepoIndexInterval: time.Hour})
+
+	list := func(t *testing.T, want []api.RepoID) {
+		t.Helper()
+
+		rs, err := s.listPrivateRepoNamesByExact(context.Background(), []api.ExternalRepoSpec{
+			testRepoSpec("1"),
+			testRepoSpec("2"),
+			testRepoSpec("3"),
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		got := make([]api.RepoID, 0, len(rs))
+		for _, r := range rs {
+			got = append(got, r.ID)
+		}
+		if diff := cmp.Diff(want, got); diff != "" {
+			t.Fatalf("mismatch (-want +got):\n%s", diff)
+		}
+	}
+
+	list(t, []api.RepoID{1, 2})
+
+	// A newly added repository is resolved from the database and invalidates the index.
+	stored = append(stored, testRepo(3))
+	list(t, []api.RepoID{1, 2, 3})
+	if !s.repoIndex.stale() {
+		t.Fatal("index should be stale")
+	}
+
+	list(t, []api.RepoID{1, 2, 3})
+	if calledList != 2 {
+		t.Fatalf("calledList: want 2 but got %d", calledList)
+	}
+
+	// A deleted (or made public) repository is no longer resolved even though it
+	// is still in the index, and invalidates the index.
+	stored = stored[1:]
+	list(t, []api.RepoID{2, 3})
+	if !s.repoIndex.stale() {
+		t.Fatal("index should be stale")
+	}
+
+	// A renamed repository is resolved with its current name, even if the index
+	// has the old name.
+	list(t, []api.RepoID{2, 3})
+	stored[0] = &types.Repo{ID: 2, Name: "github.com/org/renamed", ExternalRepo: testRepoSpec("2")}
+	calledListRepoNames = 0
+	rs, err := s.listPrivateRepoNamesByExact(context.Background(), []api.ExternalRepoSpec{testRepoSpec("2")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff([]types.RepoName{{ID: 2, Name: "github.com/org/renamed"}}, rs); diff != "" {
+		t.Fatalf("mismatch (-want +got):\n%s", diff)
+	}
+	// Index hits are resolved by IDs with a single query.
+	if calledListRepoNames != 1 {
+		t.Fatalf("calledListRepoNames: want 1 but got %d", calledListRepoNames)
+	}
+}
+
+func BenchmarkRepoIndex_lookup(b *testing.B) {
+	const numRepos = 100000
+
+	stored := make([]*types.Repo, numRepos)
+	for i := range stored {
+		stored[i] = testRepo(api.RepoID(i + 1))
+	}
+	idx := newRepoIndex(
+		func(context.Context) ([]*types.Repo, error) {
+			return stored, nil
+		},
+		time.Now,
+		time.Hour,
+	)
+
+	specs := make([]api.ExternalRepoSpec, 1000)
+	for i := range specs {
+		specs[i] = testRepoSpec(fmt.Sprintf("%d", i*(numRepos/len(specs))+1))
+	}
+
+	ctx := context.Background()
+	if _, _, err := idx.lookup(ctx, specs); err != nil {
+		b.Fatal(err)
+	}
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		_, _, err := idx.lookup(ctx, specs)
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+}
@@ -0,0 +1,60 @@
+package authz
+
+import (
+	"sync"
+
+	"github.com/sourcegraph/sourcegraph/internal/api"
+)
+
+// repoTouches collects repositories that have been synced without an authz
+// provider (e.g. public repositories, or private ones whose code host has lost
+// its provider) but not yet touched in the database. Repositories in the set are
+// not rescheduled until they are touched in a batch, which avoids a database
+// write for every such repository being synced.
+type repoTouches struct {
+	mu      sync.Mutex
+	pending map[api.RepoID]struct{}
+}
+
+func newRepoTouches() *repoTouches {
+	return &repoTouches{
+		pending: make(map[api.RepoID]struct{}),
+	}
+}
+
+// add records the repository as synced.
+func (t *repoTouches) add(repoID api.RepoID) {
+	t.mu.Lock()
+	t.pending[repoID] = struct{}{}
+	t.mu.Unlock()
+}
+
+// contains returns true if the repository has been synced but not yet touched.
+func (t *repoTouches) contains(repoID api.RepoID) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	_, ok := t.pending[repoID]
+	return ok
+}
+
+// take returns all pending repositories and clears the set.
+func (t *repoTouches) take() []int32 {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	ids := make([]int32, 0, len(t.pending))
+	for id := range t.pending {
+		ids = append(ids, int32(id))
+	}
+	t.pending = make(map[api.RepoID]struct{})
+	return ids
+}
+
+// restore puts back repositories that failed to be touched.
+func (t *repoTouches) restore(repoIDs []int32) {
+	t.mu.Lock()
+	for _, id := range repoIDs {
+		t.pending[api.RepoID(id)] = struct{}{}
+	}
+	t.mu.Unlock()
+}
@@ -0,0 +1,129 @@
+package authz
+
+import (
+	"context"
+	"database/sql"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/cockroachdb/errors"
+	"github.com/google/go-cmp/cmp"
+
+	edb "github.com/sourcegraph/sourcegraph/enterprise/internal/database"
+	"github.com/sourcegraph/sourcegraph/internal/api"
+	"github.com/sourcegraph/sourcegraph/internal/authz"
+	"github.com/sourcegraph/sourcegraph/internal/database"
+	"github.com/sourcegraph/sourcegraph/internal/database/dbtesting"
+	"github.com/sourcegraph/sourcegraph/internal/repos"
+	"github.com/sourcegraph/sourcegraph/internal/timeutil"
+	"github.com/sourcegraph/sourcegraph/internal/types"
+)
+
+func TestPermsSyncer_syncRepoPerms_batchRepoTouches(t *testing.T) {
+	calledTouchRepoPermissions := 0
+	edb.Mocks.Perms.TouchRepoPermissions = func(ctx context.Context, repoID int32) error {
+		calledTouchRepoPermissions++
+		return nil
+	}
+	var touchErr error
+	var touched [][]int32
+	edb.Mocks.Perms.TouchRepoPermissionsBatch = func(ctx context.Context, repoIDs []int32) error {
+		if touchErr != nil {
+			return touchErr
+		}
+		sort.Slice(repoIDs, func(i, j int) bool { return repoIDs[i] < repoIDs[j] })
+		touched = append(touched, repoIDs)
+		return nil
+	}
+	database.Mocks.Repos.List = func(_ context.Context, opt database.ReposListOptions) ([]*types.Repo, error) {
+		// Repository 1 is public, and repository 2 is private but its code host
+		// has no authz provider.
+		return []*types.Repo{{ID: opt.IDs[0], Private: opt.IDs[0] == 2}}, nil
+	}
+	database.Mocks.Repos.ListExternalServiceUserIDsByRepoID = func(ctx context.Context, repoID api.RepoID) ([]int32, error) {
+		return []int32{}, nil
+	}
+	defer func() {
+		edb.Mocks.Perms = edb.MockPerms{}
+		database.Mocks.Repos = database.MockRepos{}
+	}()
+
+	s := NewPermsSyncer(repos.NewStore(&dbtesting.MockDB{}, sql.TxOptions{}), edb.Perms(nil, timeutil.Now), timeutil.Now, nil, PermsSyncerOptions{RepoTouchInterval: time.Minute})
+
+	for _, repoID := range []api.RepoID{1, 2} {
+		err := s.syncRepoPerms(context.Background(), repoID, false)
+		if err != authz.ErrNoProvider {
+			t.Fatalf("err: want %v but got %v", authz.ErrNoProvider, err)
+		}
+	}
+
+	// Repositories without a provider should not be touched individually.
+	if calledTouchRepoPermissions != 0 {
+		t.Fatalf("calledTouchRepoPermissions: want 0 but got %d", calledTouchRepoPermissions)
+	}
+	if !s.repoTouches.contains(1) || !s.repoTouches.contains(2) {
+		t.Fatal("synced repositories should be waiting to be touched")
+	}
+
+	// A failed batch should be retried on the next call.
+	touchErr = errors.New("boom")
+	if err := s.touchRepos(context.Background()); err == nil {
+		t.Fatal("want error but got nil")
+	}
+	touchErr = nil
+	if err := s.touchRepos(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	if diff := cmp.Diff([][]int32{{1, 2}}, touched); diff != "" {
+		t.Fatalf("touched mismatch (-want +got):\n%s", diff)
+	}
+	if s.repoTouches.contains(1) || s.repoTouches.contains(2) {
+		t.Fatal("touched repositories should no longer be waiting")
+	}
+
+	// Nothing to touch.
+	if err := s.touchRepos(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if len(touched) != 1 {
+		t.Fatalf("touched: want 1 batch but got %d", len(touched))
+	}
+}
+
+func TestPermsSyncer_scheduleRepos_batchRepoTouches(t *testing.T) {
+	edb.Mocks.Perms.RepoIDsWithNoPerms = func(ctx context.Context, includeArchived bool) ([]api.RepoID, error) {
+		return []api.RepoID{1, 2}, nil
+	}
+	edb.Mocks.Perms.ReposIDsWithOldestPerms = func(ctx context.Context, limit int, includeArchived bool) (map[api.RepoID]time.Time, error) {
+		return map[api.RepoID]time.Time{3: {}, 4: {}}, nil
+	}
+	defer func() {
+		edb.Mocks.Perms = edb.MockPerms{}
+	}()
+
+	s := NewPermsSyncer(repos.NewStore(&dbtesting.MockDB{}, sql.TxOptions{}), edb.Perms(nil, timeutil.Now), timeutil.Now, nil, PermsSyncerOptions{RepoTouchInterval: time.Minute})
+
+	// Repositories waiting to be touched have been synced and must not be
+	// scheduled again, whether or not they have permissions in the database.
+	s.repoTouches.add(1)
+	s.repoTouches.add(3)
+
+	noPerms, err := s.scheduleReposWithNoPerms(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	oldest, err := s.scheduleReposWithOldestPerms(context.Background(), 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var got []api.RepoID
+	for _, r := range append(noPerms, oldest...) {
+		got = append(got, r.repoID)
+	}
+	if diff := cmp.Diff([]api.RepoID{2, 4}, got); diff != "" {
+		t.Fatalf("scheduled mismatch (-want +got):\n%s", diff)
+	}
+}
@@ -2,20 +2,37 @@ package authz
 
 import (
 	"container/heap"
+	"strconv"
 	"sync"
 	"time"
 )
 
 // priority defines how urgent the permissions syncing request is.
 // Generally, if the request is driven from a user action (e.g. sign up, log in)
-// then it should be priorityHigh. All other cases should be priorityLow.
-type priority int
+// then it should be PriorityHigh. If the request is driven from an external
+// event (e.g. a webhook of repository membership changes) then it should be
+// PriorityMedium. All other cases should be PriorityLow.
+type Priority int
 
 const (
-	priorityLow priority = iota
-	priorityHigh
+	PriorityLow Priority = iota
+	PriorityMedium
+	PriorityHigh
 )
 
+// label returns the metrics label of the priority.
+func (p Priority) label() string {
+	switch p {
+	case PriorityLow:
+		return "low"
+	case PriorityMedium:
+		return "medium"
+	case PriorityHigh:
+		return "high"
+	}
+	return strconv.Itoa(int(p))
+}
+
 // requestType is the type of the permissions syncing request. It defines the
 // permissions syncing is either repository-centric or user-centric.
 type requestType int
@@ -28,6 +45,17 @@ const (
 	requestTypeUser
 )
 
+// label returns the metrics label of the request type.
+func (t requestType) label() string {
+	switch t {
+	case requestTypeRepo:
+		return "repo"
+	case requestTypeUser:
+		return "user"
+	}
+	return strconv.Itoa(int(t))
+}
+
 // higherPriorityThan returns true if the current request type has higher priority
 // than the other one.
 func (t1 requestType) higherPriorityThan(t2 requestType) bool {
@@ -36,19 +64,26 @@ func (t1 requestType) higherPriorityThan(t2 requestType) bool {
 
 // requestMeta contains metadata of a permissions syncing request.
 type requestMeta struct {
-	Priority   priority
+	Priority   Priority
 	Type       requestType
 	ID         int32
 	NextSyncAt time.Time
 	NoPerms    bool
+
+	// Attempts is the number of failed attempts of syncing the request so far.
+	Attempts int
+	// NextRetryAt is the earliest time a failed request is retried.
+	NextRetryAt time.Time
 }
 
 // syncRequest is a permissions syncing request with its current status in the queue.
 type syncRequest struct {
 	*requestMeta
 
-	acquired bool // Whether the request has been acquired
-	index    int  // The index in the heap
+	acquired   bool      // Whether the request has been acquired
+	index      int       // The index in the heap
+	evictIndex int       // The index in the evictable heap, -1 if acquired
+	enqueuedAt time.Time // The time the request was first enqueued
 }
 
 // requestQueueKey is the key type for index in a requestQueue.
@@ -64,6 +99,15 @@ type requestQueue struct {
 	mu    sync.RWMutex
 	heap  []*syncRequest
 	index map[requestQueueKey]*syncRequest
+	// The requests that are not acquired, ordered by which would be synced last.
+	evictable evictableHeap
+
+	// The clock used to stamp when requests are enqueued.
+	clock func() time.Time
+	// The maximum number of requests in the queue, zero value indicates no
+	// limit. High priority requests are always admitted even if the queue is
+	// full of requests that can't be evicted.
+	maxSize int
 
 	// The queue performs a non-blocking send on this channel
 	// when a new value is enqueued so that the update loop
@@ -74,6 +118,7 @@ type requestQueue struct {
 func newRequestQueue() *requestQueue {
 	return &requestQueue{
 		index:         make(map[requestQueueKey]*syncRequest),
+		clock:         time.Now,
 		notifyEnqueue: make(chan struct{}, 1),
 	}
 }
@@ -109,8 +154,14 @@ func (q *requestQueue) enqueue(meta *requestMeta) (updated bool) {
 	}
 	request := q.index[key]
 	if request == nil {
+		if q.maxSize > 0 && len(q.heap) >= q.maxSize && !q.evictFor(meta) {
+			metricsQueueEvictions.WithLabelValues(meta.Type.label(), meta.Priority.label()).Inc()
+			return false
+		}
+
 		heap.Push(q, &syncRequest{
 			requestMeta: meta,
+			enqueuedAt:  q.clock(),
 		})
 		notify(q.notifyEnqueue)
 		return false
@@ -123,10 +174,31 @@ func (q *requestQueue) enqueue(meta *requestMeta) (updated bool) {
 
 	request.requestMeta = meta
 	heap.Fix(q, request.index)
+	heap.Fix(&q.evictable, request.evictIndex)
 	notify(q.notifyEnqueue)
 	return true
 }
 
+// evictFor makes room for the given request in a full queue by evicting the
+// request that would be synced last, and returns false if the given request
+// should be dropped instead. The caller must hold the lock of the queue.
+func (q *requestQueue) evictFor(meta *requestMeta) bool {
+	var last *syncRequest
+	if len(q.evictable) > 0 {
+		last = q.evictable[0]
+	}
+
+	if last == nil || !syncsBefore(meta, last.requestMeta) {
+		// High priority requests are triggered by user actions and must never be
+		// dropped, even if there is nothing to evict.
+		return meta.Priority == PriorityHigh
+	}
+
+	heap.Remove(q, last.index)
+	metricsQueueEvictions.WithLabelValues(last.Type.label(), last.Priority.label()).Inc()
+	return true
+}
+
 // remove removes the sync request from the queue if the request.acquired matches the
 // acquired argument.
 func (q *requestQueue) remove(typ requestType, id int32, acquired bool) (removed bool) {
@@ -150,6 +222,51 @@ func (q *requestQueue) remove(typ requestType, id int32, acquired bool) (removed
 	return false
 }
 
+// queuedIDs returns IDs of requests of given type that are in the queue and not
+// yet acquired.
+func (q *requestQueue) queuedIDs(typ requestType) []int32 {
+	q.mu.RLock()
+	defer q.mu.RUnlock()
+
+	var ids []int32
+	for _, request := range q.heap {
+		if request.Type == typ && !request.acquired {
+			ids = append(ids, request.ID)
+		}
+	}
+	return ids
+}
+
+// lookup returns a copy of the metadata of the request with given type and ID,
+// and whether it has been acquired. The ok is false if there is no such request
+// in the queue. The queue is not modified.
+func (q *requestQueue) lookup(typ requestType, id int32) (meta requestMeta, acquired, ok bool) {
+	q.mu.RLock()
+	defer q.mu.RUnlock()
+
+	request := q.index[requestQueueKey{typ: typ, id: id}]
+	if request == nil {
+		return requestMeta{}, false, false
+	}
+	return *request.requestMeta, request.acquired, true
+}
+
+// oldestEnqueuedAt returns the enqueued time of the oldest request that is in
+// the queue and not yet acquired, or zero time if there is no such request. The
+// caller must hold the lock of the queue.
+func (q *requestQueue) oldestEnqueuedAt() time.Time {
+	var oldest time.Time
+	for _, request := range q.heap {
+		if request.acquired {
+			continue
+		}
+		if oldest.IsZero() || request.enqueuedAt.Before(oldest) {
+			oldest = request.enqueuedAt
+		}
+	}
+	return oldest
+}
+
 // acquireNext acquires the next sync request. The acquired request must be removed from
 // the queue when the request finishes (independent of success or failure). This is to
 // prevent enqueuing a new request while an earlier and identical one is being processed.
@@ -169,6 +286,7 @@ func (q *requestQueue) acquireNext() *syncRequest {
 
 	request.acquired = true
 	heap.Fix(q, request.index)
+	heap.Remove(&q.evictable, request.evictIndex)
 	return request
 }
 
@@ -183,12 +301,13 @@ func (q *requestQueue) release(typ requestType, id int32) {
 		id:  id,
 	}
 	request := q.index[key]
-	if request == nil {
+	if request == nil || !request.acquired {
 		return
 	}
 
 	request.acquired = false
 	heap.Fix(q, request.index)
+	heap.Push(&q.evictable, request)
 }
 
 // The following methods implement heap.Interface based on the priority queue example:
@@ -208,17 +327,33 @@ func (q *requestQueue) Less(i, j int) bool {
 		return qj.acquired
 	}
 
-	if qi.Priority != qj.Priority {
+	return syncsBefore(qi.requestMeta, qj.requestMeta)
+}
+
+// syncsBefore returns true if the request of m1 should be synced before the
+// request of m2.
+func syncsBefore(m1, m2 *requestMeta) bool {
+	if m1.Priority != m2.Priority {
 		// We want Pop to give us the highest, not lowest, priority so we use greater than here.
-		return qi.Priority > qj.Priority
+		return m1.Priority > m2.Priority
 	}
 
-	if qi.Type != qj.Type {
-		return qi.Type.higherPriorityThan(qj.Type)
+	if m1.Type != m2.Type {
+		return m1.Type.higherPriorityThan(m2.Type)
 	}
 
-	// Earlier scheduled next sync has higher priority.
-	return qi.NextSyncAt.Before(qj.NextSyncAt)
+	// Earlier scheduled next sync has higher priority, a failed request that is
+	// backing off must not hold up requests that are ready to be synced.
+	return m1.syncAt().Before(m2.syncAt())
+}
+
+// syncAt returns the earliest time the request can be synced, which is the later
+// of the scheduled next sync and the next retry.
+func (m *requestMeta) syncAt() time.Time {
+	if m.NextRetryAt.After(m.NextSyncAt) {
+		return m.NextRetryAt
+	}
+	return m.NextSyncAt
 }
 
 func (q *requestQueue) Swap(i, j int) {
@@ -232,6 +367,10 @@ func (q *requestQueue) Push(x interface{}) {
 	request := x.(*syncRequest)
 	request.index = n
 	q.heap = append(q.heap, request)
+	request.evictIndex = -1
+	if !request.acquired {
+		heap.Push(&q.evictable, request)
+	}
 
 	key := requestQueueKey{
 		typ: request.Type,
@@ -245,6 +384,9 @@ func (q *requestQueue) Pop() interface{} {
 	request := q.heap[n-1]
 	request.index = -1 // for safety
 	q.heap = q.heap[0 : n-1]
+	if request.evictIndex >= 0 {
+		heap.Remove(&q.evictable, request.evictIndex)
+	}
 
 	key := requestQueueKey{
 		typ: request.Type,
@@ -253,3 +395,35 @@ func (q *requestQueue) Pop() interface{} {
 	delete(q.index, key)
 	return request
 }
+
+// evictableHeap implements heap.Interface for requests that are not acquired, the
+// request that would be synced last is at the top so that it can be evicted from
+// a full queue without scanning all requests.
+type evictableHeap []*syncRequest
+
+func (h evictableHeap) Len() int { return len(h) }
+
+func (h evictableHeap) Less(i, j int) bool {
+	return syncsBefore(h[j].requestMeta, h[i].requestMeta)
+}
+
+func (h evictableHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].evictIndex = i
+	h[j].evictIndex = j
+}
+
+func (h *evictableHeap) Push(x interface{}) {
+	request := x.(*syncRequest)
+	request.evictIndex = len(*h)
+	*h = append(*h, request)
+}
+
+func (h *evictableHeap) Pop() interface{} {
+	old := *h
+	n := len(old)
+	request := old[n-1]
+	request.evictIndex = -1
+	*h = old[0 : n-1]
+	return request
+}
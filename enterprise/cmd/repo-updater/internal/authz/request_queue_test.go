@@ -5,21 +5,27 @@ import (
 	"time"
 
 	"github.com/google/go-cmp/cmp"
+	"github.com/google/go-cmp/cmp/cmpopts"
+	"github.com/prometheus/client_golang/prometheus/testutil"
 )
 
-// The options to allow cmp to compare unexported fields.
-var cmpOpts = cmp.AllowUnexported(syncRequest{}, requestMeta{}, requestQueueKey{})
+// The options to allow cmp to compare unexported fields, the enqueued time is
+// ignored as it is stamped by the queue.
+var cmpOpts = cmp.Options{
+	cmp.AllowUnexported(syncRequest{}, requestMeta{}, requestQueueKey{}),
+	cmpopts.IgnoreFields(syncRequest{}, "enqueuedAt", "evictIndex"),
+}
 
 func Test_requestQueue_enqueue(t *testing.T) {
-	lowRepo1 := &requestMeta{Priority: priorityLow, Type: requestTypeRepo, ID: 1}
-	highRepo1 := &requestMeta{Priority: priorityHigh, Type: requestTypeRepo, ID: 1}
-	lowRepo2 := &requestMeta{Priority: priorityLow, Type: requestTypeRepo, ID: 2}
-	highRepo2 := &requestMeta{Priority: priorityHigh, Type: requestTypeRepo, ID: 2}
-	lowRepo3 := &requestMeta{Priority: priorityLow, Type: requestTypeRepo, ID: 3}
-	highRepo3 := &requestMeta{Priority: priorityHigh, Type: requestTypeRepo, ID: 3}
-	lowRepo4 := &requestMeta{Priority: priorityLow, Type: requestTypeRepo, ID: 3, NextSyncAt: time.Now()}
+	lowRepo1 := &requestMeta{Priority: PriorityLow, Type: requestTypeRepo, ID: 1}
+	highRepo1 := &requestMeta{Priority: PriorityHigh, Type: requestTypeRepo, ID: 1}
+	lowRepo2 := &requestMeta{Priority: PriorityLow, Type: requestTypeRepo, ID: 2}
+	highRepo2 := &requestMeta{Priority: PriorityHigh, Type: requestTypeRepo, ID: 2}
+	lowRepo3 := &requestMeta{Priority: PriorityLow, Type: requestTypeRepo, ID: 3}
+	highRepo3 := &requestMeta{Priority: PriorityHigh, Type: requestTypeRepo, ID: 3}
+	lowRepo4 := &requestMeta{Priority: PriorityLow, Type: requestTypeRepo, ID: 3, NextSyncAt: time.Now()}
 
-	lowUser1 := &requestMeta{Priority: priorityLow, Type: requestTypeUser, ID: 1}
+	lowUser1 := &requestMeta{Priority: PriorityLow, Type: requestTypeUser, ID: 1}
 
 	tests := []struct {
 		name             string
@@ -231,6 +237,147 @@ func Test_requestQueue_enqueue(t *testing.T) {
 	}
 }
 
+func Test_requestQueue_maxSize(t *testing.T) {
+	now := time.Now()
+	lowRepo := func(id int32, nextSyncAt time.Time) *requestMeta {
+		return &requestMeta{Priority: PriorityLow, Type: requestTypeRepo, ID: id, NextSyncAt: nextSyncAt}
+	}
+	highUser := func(id int32) *requestMeta {
+		return &requestMeta{Priority: PriorityHigh, Type: requestTypeUser, ID: id}
+	}
+
+	tests := []struct {
+		name          string
+		metas         []*requestMeta
+		acquire       int
+		wantKeys      []requestQueueKey
+		wantEvictions float64
+	}{
+		{
+			name:     "within the limit",
+			metas:    []*requestMeta{lowRepo(1, now), lowRepo(2, now)},
+			wantKeys: []requestQueueKey{{requestTypeRepo, 1}, {requestTypeRepo, 2}},
+		},
+		{
+			name:          "evicts the furthest-out request",
+			metas:         []*requestMeta{lowRepo(1, now.Add(time.Hour)), lowRepo(2, now), lowRepo(3, now.Add(time.Minute))},
+			wantKeys:      []requestQueueKey{{requestTypeRepo, 2}, {requestTypeRepo, 3}},
+			wantEvictions: 1,
+		},
+		{
+			name:          "drops the new request if it would be synced last",
+			metas:         []*requestMeta{lowRepo(1, now), lowRepo(2, now), lowRepo(3, now.Add(time.Hour))},
+			wantKeys:      []requestQueueKey{{requestTypeRepo, 1}, {requestTypeRepo, 2}},
+			wantEvictions: 1,
+		},
+		{
+			name:          "high priority evicts low priority",
+			metas:         []*requestMeta{lowRepo(1, now), lowRepo(2, now.Add(time.Minute)), highUser(3)},
+			wantKeys:      []requestQueueKey{{requestTypeRepo, 1}, {requestTypeUser, 3}},
+			wantEvictions: 1,
+		},
+		{
+			name:     "high priority is admitted when nothing can be evicted",
+			metas:    []*requestMeta{highUser(1), highUser(2), highUser(3)},
+			wantKeys: []requestQueueKey{{requestTypeUser, 1}, {requestTypeUser, 2}, {requestTypeUser, 3}},
+		},
+		{
+			name:          "acquired requests are not evicted",
+			metas:         []*requestMeta{lowRepo(1, now.Add(time.Hour)), lowRepo(2, now), lowRepo(3, now.Add(time.Minute))},
+			acquire:       1,
+			wantKeys:      []requestQueueKey{{requestTypeRepo, 2}, {requestTypeRepo, 3}},
+			wantEvictions: 1,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			q := newRequestQueue()
+			q.maxSize = 2
+
+			before := testutil.ToFloat64(metricsQueueEvictions.WithLabelValues("repo", "low"))
+			for i, meta := range test.metas {
+				q.enqueue(meta)
+				if i == 1 {
+					for j := 0; j < test.acquire; j++ {
+						q.acquireNext()
+					}
+				}
+			}
+			evictions := testutil.ToFloat64(metricsQueueEvictions.WithLabelValues("repo", "low")) - before
+
+			var keys []requestQueueKey
+			for key := range q.index {
+				keys = append(keys, key)
+			}
+			sortKeys := cmpopts.SortSlices(func(a, b requestQueueKey) bool {
+				if a.typ != b.typ {
+					return a.typ < b.typ
+				}
+				return a.id < b.id
+			})
+			if diff := cmp.Diff(test.wantKeys, keys, cmp.AllowUnexported(requestQueueKey{}), sortKeys); diff != "" {
+				t.Fatalf("keys mismatch (-want +got):\n%s", diff)
+			}
+			if evictions != test.wantEvictions {
+				t.Fatalf("evictions: want %v but got %v", test.wantEvictions, evictions)
+			}
+		})
+	}
+}
+
+func Test_requestQueue_evictable(t *testing.T) {
+	now := time.Now()
+	q := newRequestQueue()
+
+	// check verifies that the evictable heap tracks exactly the requests that are
+	// not acquired, with the one that would be synced last at the top.
+	check := func(t *testing.T) {
+		t.Helper()
+
+		var last *syncRequest
+		evictable := 0
+		for _, request := range q.heap {
+			if request.acquired {
+				if request.evictIndex != -1 {
+					t.Fatalf("acquired request %d: want evictIndex -1 but got %d", request.ID, request.evictIndex)
+				}
+				continue
+			}
+			evictable++
+			if q.evictable[request.evictIndex] != request {
+				t.Fatalf("request %d is not at its evictIndex %d", request.ID, request.evictIndex)
+			}
+			if last == nil || syncsBefore(last.requestMeta, request.requestMeta) {
+				last = request
+			}
+		}
+		if len(q.evictable) != evictable {
+			t.Fatalf("evictable: want %d but got %d", evictable, len(q.evictable))
+		}
+		if last != nil && syncsBefore(q.evictable[0].requestMeta, last.requestMeta) {
+			t.Fatalf("top of evictable: want %d but got %d", last.ID, q.evictable[0].ID)
+		}
+	}
+
+	for i := int32(1); i <= 20; i++ {
+		q.enqueue(&requestMeta{Priority: PriorityLow, Type: requestTypeRepo, ID: i, NextSyncAt: now.Add(time.Duration(i%7) * time.Minute)})
+	}
+	check(t)
+
+	q.enqueue(&requestMeta{Priority: PriorityHigh, Type: requestTypeRepo, ID: 5})
+	check(t)
+
+	first, second := q.acquireNext(), q.acquireNext()
+	check(t)
+
+	q.release(first.Type, first.ID)
+	check(t)
+
+	q.remove(second.Type, second.ID, true)
+	q.remove(requestTypeRepo, 10, false)
+	check(t)
+}
+
 func Test_requestQueue_remove(t *testing.T) {
 	repo1 := &requestMeta{Type: requestTypeRepo, ID: 1}
 	repo1Key := requestQueueKey{typ: requestTypeRepo, id: 1}
@@ -535,19 +682,51 @@ func Test_requestQueue_Less(t *testing.T) {
 		{
 			name: "i has high priority",
 			heap: []*syncRequest{
-				{requestMeta: &requestMeta{Priority: priorityHigh}},
-				{requestMeta: &requestMeta{Priority: priorityLow}},
+				{requestMeta: &requestMeta{Priority: PriorityHigh}},
+				{requestMeta: &requestMeta{Priority: PriorityLow}},
 			},
 			expVal: true,
 		},
 		{
 			name: "j has high priority",
 			heap: []*syncRequest{
-				{requestMeta: &requestMeta{Priority: priorityLow}},
-				{requestMeta: &requestMeta{Priority: priorityHigh}},
+				{requestMeta: &requestMeta{Priority: PriorityLow}},
+				{requestMeta: &requestMeta{Priority: PriorityHigh}},
 			},
 			expVal: false,
 		},
+		{
+			name: "i has medium priority",
+			heap: []*syncRequest{
+				{requestMeta: &requestMeta{Priority: PriorityMedium}},
+				{requestMeta: &requestMeta{Priority: PriorityLow}},
+			},
+			expVal: true,
+		},
+		{
+			name: "j has medium priority",
+			heap: []*syncRequest{
+				{requestMeta: &requestMeta{Priority: PriorityMedium}},
+				{requestMeta: &requestMeta{Priority: PriorityHigh}},
+			},
+			expVal: false,
+		},
+		{
+			name: "i has older nextSyncAt with same medium priority",
+			heap: []*syncRequest{
+				{requestMeta: &requestMeta{Priority: PriorityMedium}},
+				{requestMeta: &requestMeta{Priority: PriorityMedium, NextSyncAt: time.Now()}},
+			},
+			expVal: true,
+		},
+		{
+			name: "j is backing off after nextSyncAt of i",
+			heap: []*syncRequest{
+				{requestMeta: &requestMeta{NextSyncAt: time.Unix(2, 0)}},
+				{requestMeta: &requestMeta{NextSyncAt: time.Unix(1, 0), NextRetryAt: time.Unix(3, 0)}},
+			},
+			expVal: true,
+		},
 		{
 			name: "i is a user request",
 			heap: []*syncRequest{
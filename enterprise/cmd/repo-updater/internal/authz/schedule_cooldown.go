@@ -0,0 +1,57 @@
+package authz
+
+import (
+	"sync"
+	"time"
+)
+
+// scheduleCooldown tracks when users and repositories were last scheduled with
+// low priority, so that the scheduler does not keep re-enqueueing the same
+// entities whose permissions have not been updated yet on every pass.
+type scheduleCooldown struct {
+	mu sync.Mutex
+	// The mockable function to return the current time.
+	clock func() time.Time
+	// The minimum time duration between two low priority schedules of the same
+	// entity.
+	interval        time.Duration
+	lastScheduledAt map[requestQueueKey]time.Time
+}
+
+func newScheduleCooldown(clock func() time.Time, interval time.Duration) *scheduleCooldown {
+	return &scheduleCooldown{
+		clock:           clock,
+		interval:        interval,
+		lastScheduledAt: make(map[requestQueueKey]time.Time),
+	}
+}
+
+// allow returns true and records the schedule if given entity has not been
+// scheduled within the interval.
+func (c *scheduleCooldown) allow(typ requestType, id int32) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	key := requestQueueKey{typ: typ, id: id}
+	now := c.clock()
+	if last, ok := c.lastScheduledAt[key]; ok && now.Sub(last) < c.interval {
+		return false
+	}
+	c.lastScheduledAt[key] = now
+	return true
+}
+
+// prune removes entities that have not been scheduled within the interval, which
+// keeps entities that are no longer scheduled (e.g. deleted repositories) from
+// piling up.
+func (c *scheduleCooldown) prune() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := c.clock()
+	for key, last := range c.lastScheduledAt {
+		if now.Sub(last) >= c.interval {
+			delete(c.lastScheduledAt, key)
+		}
+	}
+}
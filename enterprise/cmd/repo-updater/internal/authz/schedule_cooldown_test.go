@@ -0,0 +1,49 @@
+package authz
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestPermsSyncer_scheduleCooldown(t *testing.T) {
+	now := time.Date(2021, 6, 1, 10, 0, 0, 0, time.UTC)
+	clock := func() time.Time { return now }
+	s := NewPermsSyncer(nil, nil, clock, nil, PermsSyncerOptions{MinScheduleInterval: 10 * time.Minute})
+
+	scheduleLow := func() {
+		s.scheduleUsers(context.Background(), scheduledUser{priority: PriorityLow, userID: 1})
+	}
+	assertQueued := func(t *testing.T, want []int32) {
+		t.Helper()
+		if diff := cmp.Diff(want, s.queue.queuedIDs(requestTypeUser)); diff != "" {
+			t.Fatalf("queued users mismatch (-want +got):\n%s", diff)
+		}
+	}
+
+	scheduleLow()
+	assertQueued(t, []int32{1})
+
+	// The request is synced, then scheduled again within the cooldown.
+	s.queue.remove(requestTypeUser, 1, false)
+	now = now.Add(5 * time.Minute)
+	scheduleLow()
+	assertQueued(t, nil)
+
+	// User-triggered schedules bypass the cooldown.
+	s.scheduleUsers(context.Background(), scheduledUser{priority: PriorityHigh, userID: 1})
+	assertQueued(t, []int32{1})
+	s.queue.remove(requestTypeUser, 1, false)
+
+	// Entities not scheduled within the cooldown are pruned.
+	now = now.Add(6 * time.Minute)
+	s.scheduleCooldown.prune()
+	if got := len(s.scheduleCooldown.lastScheduledAt); got != 0 {
+		t.Fatalf("want no entries after pruning but got %d", got)
+	}
+
+	scheduleLow()
+	assertQueued(t, []int32{1})
+}
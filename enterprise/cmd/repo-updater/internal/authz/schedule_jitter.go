@@ -0,0 +1,59 @@
+package authz
+
+import (
+	"encoding/binary"
+	"hash/fnv"
+	"math/rand"
+	"time"
+)
+
+// scheduleJitter spreads the next sync time of users and repositories with
+// oldest permissions, so that entities whose permissions expired around the
+// same time (e.g. after a token rotation) are not synced in lockstep.
+type scheduleJitter struct {
+	// The maximum jitter as a percentage of the time since the last sync.
+	percent float64
+	// The optional seed that makes the jitter deterministic per entity, only
+	// used when seeded is true.
+	seed   int64
+	seeded bool
+}
+
+func newScheduleJitter(percent float64) *scheduleJitter {
+	return &scheduleJitter{percent: percent}
+}
+
+// apply returns the given next sync time moved by a random offset within the
+// percentage of the time elapsed since then. Zero time is returned as-is, as it
+// must stay ahead of everything else in the queue.
+func (j *scheduleJitter) apply(typ requestType, id int32, nextSyncAt, now time.Time) time.Time {
+	if j.percent == 0 || nextSyncAt.IsZero() {
+		return nextSyncAt
+	}
+
+	age := now.Sub(nextSyncAt)
+	if age <= 0 {
+		return nextSyncAt
+	}
+
+	offset := j.fraction(typ, id) * j.percent / 100 * float64(age)
+	return nextSyncAt.Add(time.Duration(offset))
+}
+
+// fraction returns a number in [-1, 1) for the given entity, which is always
+// the same for the same entity when the jitter is seeded.
+func (j *scheduleJitter) fraction(typ requestType, id int32) float64 {
+	if !j.seeded {
+		return rand.Float64()*2 - 1
+	}
+
+	var buf [16]byte
+	binary.LittleEndian.PutUint64(buf[:8], uint64(j.seed))
+	binary.LittleEndian.PutUint32(buf[8:12], uint32(typ))
+	binary.LittleEndian.PutUint32(buf[12:], uint32(id))
+	h := fnv.New64a()
+	_, _ = h.Write(buf[:])
+
+	// Use the top 53 bits to get a uniformly distributed float64 in [0, 1).
+	return float64(h.Sum64()>>11)/(1<<53)*2 - 1
+}
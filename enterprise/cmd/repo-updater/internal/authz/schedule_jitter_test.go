@@ -0,0 +1,58 @@
+package authz
+
+import (
+	"testing"
+	"time"
+)
+
+func TestScheduleJitter(t *testing.T) {
+	now := time.Date(2021, 6, 1, 10, 0, 0, 0, time.UTC)
+	syncedAt := now.Add(-100 * time.Minute)
+
+	t.Run("within the percentage", func(t *testing.T) {
+		j := newScheduleJitter(10)
+		for id := int32(1); id <= 100; id++ {
+			got := j.apply(requestTypeUser, id, syncedAt, now)
+			if offset := got.Sub(syncedAt); offset < -10*time.Minute || offset > 10*time.Minute {
+				t.Fatalf("id %d: want offset within 10m but got %v", id, offset)
+			}
+		}
+	})
+
+	t.Run("zero time is not jittered", func(t *testing.T) {
+		j := newScheduleJitter(10)
+		if got := j.apply(requestTypeUser, 1, time.Time{}, now); !got.IsZero() {
+			t.Fatalf("want zero time but got %v", got)
+		}
+	})
+
+	t.Run("disabled", func(t *testing.T) {
+		j := newScheduleJitter(0)
+		if got := j.apply(requestTypeRepo, 1, syncedAt, now); !got.Equal(syncedAt) {
+			t.Fatalf("want %v but got %v", syncedAt, got)
+		}
+	})
+
+	t.Run("deterministic with seed", func(t *testing.T) {
+		j1 := &scheduleJitter{percent: 10, seed: 42, seeded: true}
+		j2 := &scheduleJitter{percent: 10, seed: 42, seeded: true}
+
+		spread := make(map[time.Time]struct{})
+		for id := int32(1); id <= 10; id++ {
+			got1 := j1.apply(requestTypeRepo, id, syncedAt, now)
+			got2 := j2.apply(requestTypeRepo, id, syncedAt, now)
+			if !got1.Equal(got2) {
+				t.Fatalf("id %d: want the same time but got %v and %v", id, got1, got2)
+			}
+			spread[got1] = struct{}{}
+		}
+		if len(spread) < 2 {
+			t.Fatal("want different entities to be jittered differently")
+		}
+
+		// The same ID of different types is jittered independently.
+		if j1.fraction(requestTypeUser, 1) == j1.fraction(requestTypeRepo, 1) {
+			t.Fatal("want different fractions for different types")
+		}
+	})
+}
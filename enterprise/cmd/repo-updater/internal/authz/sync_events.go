@@ -0,0 +1,50 @@
+package authz
+
+import (
+	"context"
+
+	"github.com/inconshreveable/log15"
+)
+
+// SyncEvent is published after permissions of a user or a repository have been
+// synced successfully.
+type SyncEvent struct {
+	// The type of the synced entity, either "user" or "repo".
+	Type string `json:"type"`
+	// The ID of the synced user or repository.
+	ID int32 `json:"id"`
+	// The time the sync was completed.
+	Timestamp int64 `json:"timestamp"`
+	// The number of repositories the user has access to, or the number of users
+	// who have access to the repository.
+	ResultSize int `json:"resultSize"`
+}
+
+// SyncEventPublisher publishes sync events to an external sink (e.g. a message
+// queue) for other services to react on permissions changes.
+type SyncEventPublisher interface {
+	Publish(ctx context.Context, event SyncEvent) error
+}
+
+// newEventQueue returns the queue of sync events to be published by the given
+// publisher. Events are published asynchronously so that a slow or failing sink
+// never blocks syncing.
+func newEventQueue(publisher SyncEventPublisher) *asyncQueue {
+	return newAsyncQueue("events", func(ctx context.Context, item interface{}) {
+		event := item.(SyncEvent)
+		if err := publisher.Publish(ctx, event); err != nil {
+			log15.Error("Failed to publish sync event", "type", event.Type, "id", event.ID, "err", err)
+		}
+	})
+}
+
+// enqueueEvent buffers a sync event to be published, the event is dropped if
+// the buffer is full.
+func (s *PermsSyncer) enqueueEvent(typ requestType, id int32, resultSize int) {
+	s.events.enqueue(SyncEvent{
+		Type:       typ.label(),
+		ID:         id,
+		Timestamp:  s.clock().Unix(),
+		ResultSize: resultSize,
+	}, typ, id)
+}
@@ -0,0 +1,163 @@
+package authz
+
+import (
+	"context"
+	"database/sql"
+	"testing"
+	"time"
+
+	"github.com/cockroachdb/errors"
+	"github.com/google/go-cmp/cmp"
+
+	edb "github.com/sourcegraph/sourcegraph/enterprise/internal/database"
+	"github.com/sourcegraph/sourcegraph/internal/api"
+	"github.com/sourcegraph/sourcegraph/internal/authz"
+	"github.com/sourcegraph/sourcegraph/internal/database"
+	"github.com/sourcegraph/sourcegraph/internal/database/dbtesting"
+	"github.com/sourcegraph/sourcegraph/internal/extsvc"
+	"github.com/sourcegraph/sourcegraph/internal/repos"
+	"github.com/sourcegraph/sourcegraph/internal/types"
+)
+
+type mockEventPublisher struct {
+	events chan SyncEvent
+	err    error
+}
+
+func (p *mockEventPublisher) Publish(_ context.Context, event SyncEvent) error {
+	p.events <- event
+	return p.err
+}
+
+func TestPermsSyncer_syncPerms_publishEvents(t *testing.T) {
+	p := &mockProvider{
+		id:          1,
+		serviceType: extsvc.TypeGitLab,
+		serviceID:   "https://gitlab.com/",
+		fetchUserPerms: func(context.Context, *extsvc.Account) (*authz.ExternalUserPermissions, error) {
+			return &authz.ExternalUserPermissions{
+				Exacts: []extsvc.RepoID{"1", "2"},
+			}, nil
+		},
+		fetchRepoPerms: func(context.Context, *extsvc.Repository) ([]extsvc.AccountID, error) {
+			return []extsvc.AccountID{"alice", "bob", "cindy"}, nil
+		},
+	}
+	authz.SetProviders(false, []authz.Provider{p})
+	defer authz.SetProviders(true, nil)
+
+	extAccount := extsvc.Account{
+		AccountSpec: extsvc.AccountSpec{
+			ServiceType: p.ServiceType(),
+			ServiceID:   p.ServiceID(),
+		},
+	}
+
+	database.Mocks.Users.GetByID = func(ctx context.Context, id int32) (*types.User, error) {
+		return &types.User{ID: id}, nil
+	}
+	database.Mocks.ExternalAccounts.TouchLastValid = func(ctx context.Context, id int32) error {
+		return nil
+	}
+	edb.Mocks.Perms.ListExternalAccounts = func(context.Context, int32) ([]*extsvc.Account, error) {
+		return []*extsvc.Account{&extAccount}, nil
+	}
+	database.Mocks.Repos.ListRepoNames = func(v0 context.Context, args database.ReposListOptions) ([]types.RepoName, error) {
+		return []types.RepoName{{ID: 1}, {ID: 2}}, nil
+	}
+	database.Mocks.UserEmails.ListByUser = func(ctx context.Context, opt database.UserEmailsListOptions) ([]*database.UserEmail, error) {
+		return nil, nil
+	}
+	database.Mocks.ExternalServices.List = func(opt database.ExternalServicesListOptions) ([]*types.ExternalService, error) {
+		return []*types.ExternalService{}, nil
+	}
+	database.Mocks.Repos.ListExternalServiceRepoIDsByUserID = func(ctx context.Context, userID int32) ([]api.RepoID, error) {
+		return []api.RepoID{}, nil
+	}
+	edb.Mocks.Perms.SetUserPermissionsWithDiff = func(context.Context, *authz.UserPermissions) (*edb.UserPermissionsDiff, error) {
+		return &edb.UserPermissionsDiff{}, nil
+	}
+	database.Mocks.Repos.List = func(context.Context, database.ReposListOptions) ([]*types.Repo, error) {
+		return []*types.Repo{
+			{
+				ID:      1,
+				Private: true,
+				ExternalRepo: api.ExternalRepoSpec{
+					ServiceID: p.ServiceID(),
+				},
+				Sources: map[string]*types.SourceInfo{
+					p.URN(): {},
+				},
+			},
+		}, nil
+	}
+	database.Mocks.Repos.ListExternalServiceUserIDsByRepoID = func(ctx context.Context, repoID api.RepoID) ([]int32, error) {
+		return []int32{}, nil
+	}
+	edb.Mocks.Perms.Transact = func(context.Context) (*edb.PermsStore, error) {
+		return &edb.PermsStore{}, nil
+	}
+	edb.Mocks.Perms.GetUserIDsByExternalAccounts = func(context.Context, *extsvc.Accounts) (map[string]int32, error) {
+		return map[string]int32{"alice": 1, "bob": 2, "cindy": 3}, nil
+	}
+	edb.Mocks.Perms.SetRepoPermissions = func(context.Context, *authz.RepoPermissions) error {
+		return nil
+	}
+	edb.Mocks.Perms.SetRepoPendingPermissions = func(context.Context, *extsvc.Accounts, *authz.RepoPermissions) error {
+		return nil
+	}
+	defer func() {
+		database.Mocks = database.MockStores{}
+		edb.Mocks.Perms = edb.MockPerms{}
+	}()
+
+	now := time.Date(2021, 6, 1, 10, 0, 0, 0, time.UTC)
+	clock := func() time.Time { return now }
+
+	// Failures of publishing must not affect syncing nor publishing of other events.
+	publisher := &mockEventPublisher{
+		events: make(chan SyncEvent, 2),
+		err:    errors.New("queue unavailable"),
+	}
+	s := NewPermsSyncer(repos.NewStore(&dbtesting.MockDB{}, sql.TxOptions{}), edb.Perms(nil, clock), clock, nil, PermsSyncerOptions{EventPublisher: publisher})
+
+	// Failed syncs are not published.
+	database.Mocks.Users.GetByID = func(ctx context.Context, id int32) (*types.User, error) {
+		return nil, errors.New("boom")
+	}
+	err := s.syncPerms(context.Background(), &syncRequest{
+		requestMeta: &requestMeta{Type: requestTypeUser, ID: 2},
+		acquired:    true,
+	})
+	if err == nil {
+		t.Fatal("want error but got nil")
+	}
+	if s.events.len() != 0 {
+		t.Fatalf("want no events but got %d", s.events.len())
+	}
+	database.Mocks.Users.GetByID = func(ctx context.Context, id int32) (*types.User, error) {
+		return &types.User{ID: id}, nil
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go s.events.run(ctx)
+
+	for _, request := range []*syncRequest{
+		{requestMeta: &requestMeta{Type: requestTypeUser, ID: 1}, acquired: true},
+		{requestMeta: &requestMeta{Type: requestTypeRepo, ID: 1}, acquired: true},
+	} {
+		if err := s.syncPerms(context.Background(), request); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	want := []SyncEvent{
+		{Type: "user", ID: 1, Timestamp: now.Unix(), ResultSize: 2},
+		{Type: "repo", ID: 1, Timestamp: now.Unix(), ResultSize: 3},
+	}
+	got := []SyncEvent{<-publisher.events, <-publisher.events}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Fatalf("events mismatch (-want +got):\n%s", diff)
+	}
+}
@@ -0,0 +1,46 @@
+package authz
+
+import (
+	"context"
+	"time"
+)
+
+// SyncResult is the outcome of syncing permissions of a user or a repository,
+// successful or not.
+type SyncResult struct {
+	// The type of the synced entity, either "user" or "repo".
+	Type string
+	// The ID of the synced user or repository.
+	ID int32
+	// The time duration the sync took.
+	Duration time.Duration
+	// The number of repositories the user has access to, or the number of users
+	// who have access to the repository.
+	ResultSize int
+	// Whether the sync proceeded with partial results from the code host.
+	Partial bool
+	// The error of the sync, nil if it succeeded.
+	Err error
+}
+
+// newSyncResultQueue returns the queue of sync results to be passed to the given
+// callback. The callback is invoked from a single goroutine so that a slow
+// callback never blocks syncing.
+func newSyncResultQueue(fn func(SyncResult)) *asyncQueue {
+	return newAsyncQueue("sync_results", func(_ context.Context, item interface{}) {
+		fn(item.(SyncResult))
+	})
+}
+
+// enqueueSyncResult buffers the result of the sync of given request, the result
+// is dropped if the buffer is full.
+func (s *PermsSyncer) enqueueSyncResult(ctx context.Context, request *syncRequest, duration time.Duration, err error) {
+	s.syncResults.enqueue(SyncResult{
+		Type:       request.Type.label(),
+		ID:         request.ID,
+		Duration:   duration,
+		ResultSize: s.inflight.resultSize(ctx),
+		Partial:    s.inflight.partial(ctx),
+		Err:        err,
+	}, request.Type, request.ID)
+}
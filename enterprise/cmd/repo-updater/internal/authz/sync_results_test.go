@@ -0,0 +1,135 @@
+package authz
+
+import (
+	"context"
+	"database/sql"
+	"testing"
+	"time"
+
+	"github.com/cockroachdb/errors"
+	"github.com/google/go-cmp/cmp"
+	"github.com/google/go-cmp/cmp/cmpopts"
+
+	edb "github.com/sourcegraph/sourcegraph/enterprise/internal/database"
+	"github.com/sourcegraph/sourcegraph/internal/api"
+	"github.com/sourcegraph/sourcegraph/internal/authz"
+	"github.com/sourcegraph/sourcegraph/internal/database"
+	"github.com/sourcegraph/sourcegraph/internal/database/dbtesting"
+	"github.com/sourcegraph/sourcegraph/internal/extsvc"
+	"github.com/sourcegraph/sourcegraph/internal/repos"
+	"github.com/sourcegraph/sourcegraph/internal/types"
+)
+
+func TestPermsSyncer_syncPerms_onSyncComplete(t *testing.T) {
+	p := &mockProvider{
+		id:          1,
+		serviceType: extsvc.TypeGitLab,
+		serviceID:   "https://gitlab.com/",
+		fetchRepoPerms: func(context.Context, *extsvc.Repository) ([]extsvc.AccountID, error) {
+			return []extsvc.AccountID{"alice", "bob"}, errors.New("rate limited")
+		},
+	}
+	authz.SetProviders(false, []authz.Provider{p})
+	defer authz.SetProviders(true, nil)
+
+	database.Mocks.Users.GetByID = func(ctx context.Context, id int32) (*types.User, error) {
+		return nil, errors.New("boom")
+	}
+	database.Mocks.Repos.ListExternalServiceRepoIDsByUserID = func(ctx context.Context, userID int32) ([]api.RepoID, error) {
+		return []api.RepoID{}, nil
+	}
+	database.Mocks.Repos.List = func(context.Context, database.ReposListOptions) ([]*types.Repo, error) {
+		return []*types.Repo{
+			{
+				ID:      1,
+				Private: true,
+				ExternalRepo: api.ExternalRepoSpec{
+					ServiceID: p.ServiceID(),
+				},
+				Sources: map[string]*types.SourceInfo{
+					p.URN(): {},
+				},
+			},
+		}, nil
+	}
+	database.Mocks.Repos.ListExternalServiceUserIDsByRepoID = func(ctx context.Context, repoID api.RepoID) ([]int32, error) {
+		return []int32{}, nil
+	}
+	edb.Mocks.Perms.Transact = func(context.Context) (*edb.PermsStore, error) {
+		return &edb.PermsStore{}, nil
+	}
+	edb.Mocks.Perms.GetUserIDsByExternalAccounts = func(context.Context, *extsvc.Accounts) (map[string]int32, error) {
+		return map[string]int32{"alice": 1, "bob": 2}, nil
+	}
+	edb.Mocks.Perms.SetRepoPermissions = func(context.Context, *authz.RepoPermissions) error {
+		return nil
+	}
+	edb.Mocks.Perms.SetRepoPendingPermissions = func(context.Context, *extsvc.Accounts, *authz.RepoPermissions) error {
+		return nil
+	}
+	defer func() {
+		database.Mocks = database.MockStores{}
+		edb.Mocks.Perms = edb.MockPerms{}
+	}()
+
+	now := time.Date(2021, 6, 1, 10, 0, 0, 0, time.UTC)
+	// Every call advances the clock so that syncs take a positive duration.
+	clock := func() time.Time {
+		now = now.Add(time.Second)
+		return now
+	}
+	results := make(chan SyncResult, 2)
+	s := NewPermsSyncer(repos.NewStore(&dbtesting.MockDB{}, sql.TxOptions{}), edb.Perms(nil, clock), clock, nil, PermsSyncerOptions{
+		OnSyncComplete: func(result SyncResult) {
+			results <- result
+		},
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go s.syncResults.run(ctx)
+
+	err := s.syncPerms(ctx, &syncRequest{
+		requestMeta: &requestMeta{Type: requestTypeUser, ID: 2},
+		acquired:    true,
+	})
+	if err == nil {
+		t.Fatal("want error but got nil")
+	}
+	err = s.syncPerms(ctx, &syncRequest{
+		requestMeta: &requestMeta{Type: requestTypeRepo, ID: 1, NoPerms: true},
+		acquired:    true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var got []SyncResult
+	for i := 0; i < 2; i++ {
+		select {
+		case result := <-results:
+			got = append(got, result)
+		case <-time.After(5 * time.Second):
+			t.Fatal("timed out waiting for sync results")
+		}
+	}
+
+	want := []SyncResult{
+		{Type: "user", ID: 2},
+		{Type: "repo", ID: 1, ResultSize: 2, Partial: true},
+	}
+	if diff := cmp.Diff(want, got, cmpopts.IgnoreFields(SyncResult{}, "Duration", "Err")); diff != "" {
+		t.Fatalf("results mismatch (-want +got):\n%s", diff)
+	}
+	for _, result := range got {
+		if result.Duration <= 0 {
+			t.Fatalf("want positive duration of the %s sync but got %v", result.Type, result.Duration)
+		}
+	}
+	if got[0].Err == nil {
+		t.Fatal("want error of the user sync but got nil")
+	}
+	if got[1].Err != nil {
+		t.Fatalf("want no error of the repo sync but got %v", got[1].Err)
+	}
+}
@@ -0,0 +1,64 @@
+package authz
+
+import (
+	"context"
+	"time"
+
+	"github.com/cockroachdb/errors"
+	"github.com/inconshreveable/log15"
+
+	"github.com/sourcegraph/sourcegraph/internal/errcode"
+)
+
+const (
+	// The backoff before the first retry of a failed request, doubled on every
+	// following attempt.
+	retryBackoffBase = 30 * time.Second
+	// The maximum backoff between retries of a failed request.
+	retryBackoffMax = 30 * time.Minute
+)
+
+// retryBackoff returns the backoff before retrying a request that has failed the
+// given number of attempts.
+func retryBackoff(attempts int) time.Duration {
+	backoff := retryBackoffBase
+	for i := 1; i < attempts; i++ {
+		backoff *= 2
+		if backoff >= retryBackoffMax {
+			return retryBackoffMax
+		}
+	}
+	return backoff
+}
+
+// retry re-enqueues the failed request with exponential backoff, unless the
+// error is permanent or the request has run out of attempts.
+func (s *PermsSyncer) retry(ctx context.Context, request *syncRequest, err error) {
+	// The sync was canceled, e.g. the syncer is shutting down or the code host
+	// is being canceled.
+	if errors.Is(err, context.Canceled) {
+		return
+	}
+	if errcode.IsUnauthorized(err) || errcode.IsForbidden(err) {
+		log15.Debug("PermsSyncer.retry.permanentError", "type", request.Type, "id", request.ID, "err", err)
+		return
+	}
+
+	attempts := request.Attempts + 1
+	if attempts >= s.maxSyncAttempts {
+		log15.Warn("PermsSyncer.retry.maxAttemptsReached", "type", request.Type, "id", request.ID, "attempts", attempts)
+		return
+	}
+
+	nextRetryAt := s.clock().Add(retryBackoff(attempts))
+	s.enqueue(ctx, &requestMeta{
+		Priority:    request.Priority,
+		Type:        request.Type,
+		ID:          request.ID,
+		NextSyncAt:  request.NextSyncAt,
+		NoPerms:     request.NoPerms,
+		Attempts:    attempts,
+		NextRetryAt: nextRetryAt,
+	})
+	log15.Debug("PermsSyncer.retry.enqueued", "type", request.Type, "id", request.ID, "attempts", attempts, "nextRetryAt", nextRetryAt)
+}
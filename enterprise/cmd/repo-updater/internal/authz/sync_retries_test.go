@@ -0,0 +1,143 @@
+package authz
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/cockroachdb/errors"
+	"github.com/google/go-cmp/cmp"
+
+	edb "github.com/sourcegraph/sourcegraph/enterprise/internal/database"
+	"github.com/sourcegraph/sourcegraph/internal/api"
+	"github.com/sourcegraph/sourcegraph/internal/database"
+	"github.com/sourcegraph/sourcegraph/internal/database/dbtesting"
+	"github.com/sourcegraph/sourcegraph/internal/repos"
+	"github.com/sourcegraph/sourcegraph/internal/types"
+)
+
+func TestRetryBackoff(t *testing.T) {
+	tests := []struct {
+		attempts int
+		want     time.Duration
+	}{
+		{attempts: 1, want: 30 * time.Second},
+		{attempts: 2, want: time.Minute},
+		{attempts: 3, want: 2 * time.Minute},
+		{attempts: 7, want: 30 * time.Minute},
+		{attempts: 100, want: 30 * time.Minute},
+	}
+	for _, test := range tests {
+		if got := retryBackoff(test.attempts); got != test.want {
+			t.Errorf("attempts %d: want %v but got %v", test.attempts, test.want, got)
+		}
+	}
+}
+
+type unauthorizedError struct{}
+
+func (unauthorizedError) Error() string      { return "unauthorized" }
+func (unauthorizedError) Unauthorized() bool { return true }
+
+func TestPermsSyncer_syncPerms_retry(t *testing.T) {
+	var getUserErr error
+	database.Mocks.Users.GetByID = func(ctx context.Context, id int32) (*types.User, error) {
+		return nil, getUserErr
+	}
+	database.Mocks.Repos.ListExternalServiceRepoIDsByUserID = func(ctx context.Context, userID int32) ([]api.RepoID, error) {
+		return []api.RepoID{}, nil
+	}
+	defer func() {
+		database.Mocks = database.MockStores{}
+	}()
+
+	now := time.Date(2021, 6, 1, 10, 0, 0, 0, time.UTC)
+	clock := func() time.Time { return now }
+	s := NewPermsSyncer(repos.NewStore(&dbtesting.MockDB{}, sql.TxOptions{}), edb.Perms(nil, clock), clock, nil, PermsSyncerOptions{MaxSyncAttempts: 3})
+
+	syncNext := func() error {
+		request := s.queue.acquireNext()
+		if request == nil {
+			t.Fatal("want a queued request but got nil")
+		}
+		return s.syncPerms(context.Background(), request)
+	}
+
+	t.Run("transient errors are retried with backoff", func(t *testing.T) {
+		getUserErr = errors.New("code host unavailable")
+		s.queue.enqueue(&requestMeta{Priority: PriorityLow, Type: requestTypeUser, ID: 1})
+
+		for _, retry := range []struct {
+			attempts    int
+			nextRetryAt time.Time
+		}{
+			{attempts: 1, nextRetryAt: now.Add(30 * time.Second)},
+			{attempts: 2, nextRetryAt: now.Add(time.Minute)},
+		} {
+			if err := syncNext(); err == nil {
+				t.Fatal("want error but got nil")
+			}
+
+			want := []*syncRequest{{
+				requestMeta: &requestMeta{
+					Priority:    PriorityLow,
+					Type:        requestTypeUser,
+					ID:          1,
+					Attempts:    retry.attempts,
+					NextRetryAt: retry.nextRetryAt,
+				},
+			}}
+			if diff := cmp.Diff(want, s.queue.heap, cmpOpts); diff != "" {
+				t.Fatalf("heap mismatch (-want +got):\n%s", diff)
+			}
+		}
+
+		// Attempts are exposed for debugging.
+		dump, err := json.Marshal(s.DebugDump())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !strings.Contains(string(dump), `"Attempts":2`) {
+			t.Fatalf("want attempts in debug dump but got %s", dump)
+		}
+
+		// The request is given up after the maximum number of attempts.
+		if err := syncNext(); err == nil {
+			t.Fatal("want error but got nil")
+		}
+		if s.queue.Len() != 0 {
+			t.Fatalf("want empty queue but got %d requests", s.queue.Len())
+		}
+	})
+
+	t.Run("ready requests are synced before backing-off ones", func(t *testing.T) {
+		getUserErr = errors.New("code host unavailable")
+		s.queue.enqueue(&requestMeta{Priority: PriorityLow, Type: requestTypeUser, ID: 3})
+		if err := syncNext(); err == nil {
+			t.Fatal("want error but got nil")
+		}
+		s.queue.enqueue(&requestMeta{Priority: PriorityLow, Type: requestTypeUser, ID: 4, NextSyncAt: now})
+
+		request := s.queue.acquireNext()
+		if request == nil || request.ID != 4 {
+			t.Fatalf("want the ready request 4 but got %+v", request)
+		}
+		s.queue.remove(request.Type, request.ID, true)
+		s.queue.remove(requestTypeUser, 3, false)
+	})
+
+	t.Run("permanent errors are not retried", func(t *testing.T) {
+		getUserErr = unauthorizedError{}
+		s.queue.enqueue(&requestMeta{Priority: PriorityLow, Type: requestTypeUser, ID: 2})
+
+		if err := syncNext(); err == nil {
+			t.Fatal("want error but got nil")
+		}
+		if s.queue.Len() != 0 {
+			t.Fatalf("want empty queue but got %d requests", s.queue.Len())
+		}
+	})
+}
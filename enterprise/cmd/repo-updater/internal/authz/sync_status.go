@@ -0,0 +1,73 @@
+package authz
+
+import (
+	"context"
+	"time"
+
+	"github.com/cockroachdb/errors"
+
+	"github.com/sourcegraph/sourcegraph/internal/api"
+	"github.com/sourcegraph/sourcegraph/internal/authz"
+)
+
+// SyncStatus is the permissions syncing status of a single user or repository.
+type SyncStatus struct {
+	// LastSyncedAt is the last time the permissions were synced, zero value
+	// indicates they have never been synced.
+	LastSyncedAt time.Time
+	// Queued is true if there is a request in the queue, including the one
+	// being processed.
+	Queued bool
+	// Acquired is true if the queued request is being processed.
+	Acquired bool
+	// Priority and NextSyncAt of the queued request, only set when Queued is
+	// true.
+	Priority   Priority
+	NextSyncAt time.Time
+}
+
+// UserSyncStatus returns the permissions syncing status of the given user.
+func (s *PermsSyncer) UserSyncStatus(ctx context.Context, userID int32) (SyncStatus, error) {
+	p := &authz.UserPermissions{
+		UserID: userID,
+		Perm:   authz.Read,
+		Type:   authz.PermRepos,
+	}
+	err := s.permsStore.LoadUserPermissions(ctx, p)
+	if err != nil && err != authz.ErrPermsNotFound {
+		return SyncStatus{}, errors.Wrap(err, "load user permissions")
+	}
+
+	return s.syncStatus(requestTypeUser, userID, p.SyncedAt), nil
+}
+
+// RepoSyncStatus returns the permissions syncing status of the given repository.
+func (s *PermsSyncer) RepoSyncStatus(ctx context.Context, repoID api.RepoID) (SyncStatus, error) {
+	p := &authz.RepoPermissions{
+		RepoID: int32(repoID),
+		Perm:   authz.Read,
+	}
+	err := s.permsStore.LoadRepoPermissions(ctx, p)
+	if err != nil && err != authz.ErrPermsNotFound {
+		return SyncStatus{}, errors.Wrap(err, "load repository permissions")
+	}
+
+	return s.syncStatus(requestTypeRepo, int32(repoID), p.SyncedAt), nil
+}
+
+// syncStatus combines the last synced time with the status of the request of
+// given type and ID in the queue.
+func (s *PermsSyncer) syncStatus(typ requestType, id int32, syncedAt time.Time) SyncStatus {
+	status := SyncStatus{
+		LastSyncedAt: syncedAt,
+	}
+
+	meta, acquired, ok := s.queue.lookup(typ, id)
+	if ok {
+		status.Queued = true
+		status.Acquired = acquired
+		status.Priority = meta.Priority
+		status.NextSyncAt = meta.NextSyncAt
+	}
+	return status
+}
@@ -0,0 +1,118 @@
+package authz
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/cockroachdb/errors"
+	"github.com/google/go-cmp/cmp"
+
+	edb "github.com/sourcegraph/sourcegraph/enterprise/internal/database"
+	"github.com/sourcegraph/sourcegraph/internal/authz"
+	"github.com/sourcegraph/sourcegraph/internal/timeutil"
+)
+
+func TestPermsSyncer_SyncStatus(t *testing.T) {
+	syncedAt := time.Date(2021, 6, 1, 10, 0, 0, 0, time.UTC)
+	nextSyncAt := syncedAt.Add(time.Hour)
+	edb.Mocks.Perms.LoadUserPermissions = func(_ context.Context, p *authz.UserPermissions) error {
+		if p.UserID != 1 {
+			return authz.ErrPermsNotFound
+		}
+		p.SyncedAt = syncedAt
+		return nil
+	}
+	edb.Mocks.Perms.LoadRepoPermissions = func(_ context.Context, p *authz.RepoPermissions) error {
+		if p.RepoID != 2 {
+			return authz.ErrPermsNotFound
+		}
+		p.SyncedAt = syncedAt
+		return nil
+	}
+	defer func() {
+		edb.Mocks.Perms = edb.MockPerms{}
+	}()
+
+	s := NewPermsSyncer(nil, edb.Perms(nil, timeutil.Now), timeutil.Now, nil, PermsSyncerOptions{})
+	s.queue.enqueue(&requestMeta{
+		Priority:   PriorityHigh,
+		Type:       requestTypeUser,
+		ID:         1,
+		NextSyncAt: nextSyncAt,
+	})
+	s.queue.enqueue(&requestMeta{
+		Priority: PriorityLow,
+		Type:     requestTypeRepo,
+		ID:       3,
+	})
+	if request := s.queue.acquireNext(); request == nil || request.ID != 1 {
+		t.Fatalf("want to acquire user 1 but got %+v", request)
+	}
+
+	ctx := context.Background()
+	t.Run("user", func(t *testing.T) {
+		got, err := s.UserSyncStatus(ctx, 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := SyncStatus{
+			LastSyncedAt: syncedAt,
+			Queued:       true,
+			Acquired:     true,
+			Priority:     PriorityHigh,
+			NextSyncAt:   nextSyncAt,
+		}
+		if diff := cmp.Diff(want, got); diff != "" {
+			t.Fatalf("status mismatch (-want +got):\n%s", diff)
+		}
+
+		got, err = s.UserSyncStatus(ctx, 2)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if diff := cmp.Diff(SyncStatus{}, got); diff != "" {
+			t.Fatalf("status mismatch (-want +got):\n%s", diff)
+		}
+	})
+
+	t.Run("repo", func(t *testing.T) {
+		got, err := s.RepoSyncStatus(ctx, 2)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if diff := cmp.Diff(SyncStatus{LastSyncedAt: syncedAt}, got); diff != "" {
+			t.Fatalf("status mismatch (-want +got):\n%s", diff)
+		}
+
+		got, err = s.RepoSyncStatus(ctx, 3)
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := SyncStatus{
+			Queued:   true,
+			Priority: PriorityLow,
+		}
+		if diff := cmp.Diff(want, got); diff != "" {
+			t.Fatalf("status mismatch (-want +got):\n%s", diff)
+		}
+	})
+
+	t.Run("does not modify the queue", func(t *testing.T) {
+		if n := len(s.queue.heap); n != 2 {
+			t.Fatalf("want 2 requests in the queue but got %d", n)
+		}
+		if request := s.queue.acquireNext(); request == nil || request.ID != 3 {
+			t.Fatalf("want to acquire repo 3 but got %+v", request)
+		}
+	})
+
+	t.Run("error", func(t *testing.T) {
+		edb.Mocks.Perms.LoadUserPermissions = func(context.Context, *authz.UserPermissions) error {
+			return errors.New("boom")
+		}
+		if _, err := s.UserSyncStatus(ctx, 1); err == nil {
+			t.Fatal("want error but got nil")
+		}
+	})
+}
@@ -8,6 +8,8 @@ import (
 	"strconv"
 	"time"
 
+	"github.com/inconshreveable/log15"
+
 	"github.com/sourcegraph/sourcegraph/cmd/frontend/envvar"
 	"github.com/sourcegraph/sourcegraph/cmd/frontend/globals"
 	"github.com/sourcegraph/sourcegraph/cmd/repo-updater/repoupdater"
@@ -18,6 +20,7 @@ import (
 	codemonitorsBackground "github.com/sourcegraph/sourcegraph/enterprise/internal/codemonitors/background"
 	edb "github.com/sourcegraph/sourcegraph/enterprise/internal/database"
 	"github.com/sourcegraph/sourcegraph/internal/actor"
+	"github.com/sourcegraph/sourcegraph/internal/api"
 	ossAuthz "github.com/sourcegraph/sourcegraph/internal/authz"
 	"github.com/sourcegraph/sourcegraph/internal/conf"
 	ossDB "github.com/sourcegraph/sourcegraph/internal/database"
@@ -29,8 +32,22 @@ import (
 	"github.com/sourcegraph/sourcegraph/internal/ratelimit"
 	"github.com/sourcegraph/sourcegraph/internal/repos"
 	"github.com/sourcegraph/sourcegraph/internal/timeutil"
+	"github.com/sourcegraph/sourcegraph/schema"
 )
 
+// repoTouchInterval is how often repositories without an authz provider, or
+// whose permissions are denied by the code host, are touched in a single batch.
+const repoTouchInterval = time.Minute
+
+// maxSyncAttempts is the number of times a permissions syncing request that
+// failed with a transient error is attempted before giving up until the next
+// schedule.
+const maxSyncAttempts = 5
+
+// repoIndexInterval is how often the in-memory index of private repositories
+// used by user-centric permissions syncing is rebuilt.
+const repoIndexInterval = 10 * time.Minute
+
 func main() {
 	debug, _ := strconv.ParseBool(os.Getenv("DEBUG"))
 	if debug {
@@ -64,7 +81,16 @@ func enterpriseInit(
 	// TODO(jchen): This is an unfortunate compromise to not rewrite ossDB.ExternalServices for now.
 	dbconn.Global = db
 	permsStore := edb.Perms(db, timeutil.Now)
-	permsSyncer := authz.NewPermsSyncer(repoStore, permsStore, timeutil.Now, ratelimit.DefaultRegistry)
+	permsSyncer := authz.NewPermsSyncer(repoStore, permsStore, timeutil.Now, ratelimit.DefaultRegistry, authz.PermsSyncerOptions{
+		RepoIndexInterval:    repoIndexInterval,
+		RecordUserSyncErrors: true,
+		RepoTouchInterval:    repoTouchInterval,
+		IncrementalRepoSync:  true,
+		MaxSyncAttempts:      maxSyncAttempts,
+	})
+	conf.Watch(func() {
+		setPermsSyncExclusions(permsSyncer, conf.Get().PermissionsSyncExclusions)
+	})
 	go startBackgroundPermsSync(ctx, permsSyncer, db)
 	debugDumpers = append(debugDumpers, permsSyncer)
 	if server != nil {
@@ -74,6 +100,28 @@ func enterpriseInit(
 	return debugDumpers
 }
 
+// setPermsSyncExclusions applies the exclusions of permissions syncing in the
+// site configuration. Invalid exclusions are logged and leave the previous ones
+// in effect.
+func setPermsSyncExclusions(syncer *authz.PermsSyncer, exclusions *schema.PermissionsSyncExclusions) {
+	if exclusions == nil {
+		exclusions = &schema.PermissionsSyncExclusions{}
+	}
+
+	userIDs := make([]int32, len(exclusions.UserIDs))
+	for i, id := range exclusions.UserIDs {
+		userIDs[i] = int32(id)
+	}
+	repoIDs := make([]api.RepoID, len(exclusions.RepoIDs))
+	for i, id := range exclusions.RepoIDs {
+		repoIDs[i] = api.RepoID(id)
+	}
+
+	if err := syncer.SetExclusions(userIDs, repoIDs, exclusions.RepoNamePatterns); err != nil {
+		log15.Error("Invalid permissions.syncExclusions in site configuration", "error", err)
+	}
+}
+
 // startBackgroundPermsSync sets up background permissions syncing.
 func startBackgroundPermsSync(ctx context.Context, syncer *authz.PermsSyncer, db dbutil.DB) {
 	globals.WatchPermissionsUserMapping()
@@ -30,6 +30,7 @@ func TestIntegration_PermsStore(t *testing.T) {
 		{"LoadUserPendingPermissions", testPermsStore_LoadUserPendingPermissions(db)},
 		{"SetRepoPendingPermissions", testPermsStore_SetRepoPendingPermissions(db)},
 		{"ListPendingUsers", testPermsStore_ListPendingUsers(db)},
+		{"ExplainRepoPermissions", testPermsStore_ExplainRepoPermissions(db)},
 		{"GrantPendingPermissions", testPermsStore_GrantPendingPermissions(db)},
 		{"SetPendingPermissionsAfterGrant", testPermsStore_SetPendingPermissionsAfterGrant(db)},
 		{"DeleteAllUserPermissions", testPermsStore_DeleteAllUserPermissions(db)},
@@ -43,6 +44,7 @@ func TestIntegration_PermsStore(t *testing.T) {
 		{"RepoIDsWithNoPerms", testPermsStore_RepoIDsWithNoPerms(db)},
 		{"UserIDsWithOldestPerms", testPermsStore_UserIDsWithOldestPerms(db)},
 		{"ReposIDsWithOldestPerms", testPermsStore_ReposIDsWithOldestPerms(db)},
+		{"UsersWithSyncErrors", testPermsStore_UsersWithSyncErrors(db)},
 		{"Metrics", testPermsStore_Metrics(db)},
 	} {
 		t.Run(tc.name, tc.test)
@@ -170,10 +170,39 @@ func (s *PermsStore) SetUserPermissions(ctx context.Context, p *authz.UserPermis
 	ctx, save := s.observe(ctx, "SetUserPermissions", "")
 	defer func() { save(&err, p.TracingFields()...) }()
 
+	_, err = s.setUserPermissions(ctx, p)
+	return err
+}
+
+// UserPermissionsDiff contains the object IDs that were granted to and revoked from
+// a user by a call to SetUserPermissionsWithDiff.
+type UserPermissionsDiff struct {
+	Added   []uint32
+	Removed []uint32
+	// SyncedAt is the time recorded as "updated_at" and "synced_at" of the user
+	// permissions by the update.
+	SyncedAt time.Time
+}
+
+// SetUserPermissionsWithDiff does the same thing as SetUserPermissions but also returns
+// the object IDs that were added and removed by the update, computed against the
+// previously stored permissions within the same transaction.
+func (s *PermsStore) SetUserPermissionsWithDiff(ctx context.Context, p *authz.UserPermissions) (diff *UserPermissionsDiff, err error) {
+	if Mocks.Perms.SetUserPermissionsWithDiff != nil {
+		return Mocks.Perms.SetUserPermissionsWithDiff(ctx, p)
+	}
+
+	ctx, save := s.observe(ctx, "SetUserPermissionsWithDiff", "")
+	defer func() { save(&err, p.TracingFields()...) }()
+
+	return s.setUserPermissions(ctx, p)
+}
+
+func (s *PermsStore) setUserPermissions(ctx context.Context, p *authz.UserPermissions) (diff *UserPermissionsDiff, err error) {
 	// Open a transaction for update consistency.
 	txs, err := s.Transact(ctx)
 	if err != nil {
-		return err
+		return nil, err
 	}
 	defer func() { err = txs.Done(err) }()
 
@@ -184,7 +213,7 @@ func (s *PermsStore) SetUserPermissions(ctx context.Context, p *authz.UserPermis
 		if err == authz.ErrPermsNotFound {
 			oldIDs = roaring.NewBitmap()
 		} else {
-			return errors.Wrap(err, "load user permissions")
+			return nil, errors.Wrap(err, "load user permissions")
 		}
 	} else {
 		oldIDs = vals.ids
@@ -201,9 +230,9 @@ func (s *PermsStore) SetUserPermissions(ctx context.Context, p *authz.UserPermis
 	updatedAt := txs.clock()
 	if !added.IsEmpty() || !removed.IsEmpty() {
 		if q, err := upsertRepoPermissionsBatchQuery(added.ToArray(), removed.ToArray(), []uint32{uint32(p.UserID)}, p.Perm, updatedAt); err != nil {
-			return err
+			return nil, err
 		} else if err = txs.execute(ctx, q); err != nil {
-			return errors.Wrap(err, "execute upsert repo permissions batch query")
+			return nil, errors.Wrap(err, "execute upsert repo permissions batch query")
 		}
 	}
 
@@ -213,12 +242,16 @@ func (s *PermsStore) SetUserPermissions(ctx context.Context, p *authz.UserPermis
 	p.UpdatedAt = updatedAt
 	p.SyncedAt = updatedAt
 	if q, err := upsertUserPermissionsQuery(p); err != nil {
-		return err
+		return nil, err
 	} else if err = txs.execute(ctx, q); err != nil {
-		return errors.Wrap(err, "execute upsert user permissions query")
+		return nil, errors.Wrap(err, "execute upsert user permissions query")
 	}
 
-	return nil
+	return &UserPermissionsDiff{
+		Added:    added.ToArray(),
+		Removed:  removed.ToArray(),
+		SyncedAt: updatedAt,
+	}, nil
 }
 
 // upsertUserPermissionsQuery upserts single row of user permissions, it does the
@@ -472,6 +505,44 @@ DO UPDATE SET
 	return nil
 }
 
+// TouchRepoPermissionsBatch does the same thing as TouchRepoPermissions but for
+// multiple repositories with a single query.
+func (s *PermsStore) TouchRepoPermissionsBatch(ctx context.Context, repoIDs []int32) (err error) {
+	if Mocks.Perms.TouchRepoPermissionsBatch != nil {
+		return Mocks.Perms.TouchRepoPermissionsBatch(ctx, repoIDs)
+	}
+
+	if len(repoIDs) == 0 {
+		return nil
+	}
+
+	ctx, save := s.observe(ctx, "TouchRepoPermissionsBatch", "")
+	defer func() { save(&err, otlog.Int("repoIDs.count", len(repoIDs))) }()
+
+	touchedAt := s.clock().UTC()
+	perm := authz.Read.String() // Note: We currently only support read for repository permissions.
+	// The repository IDs are passed as a single array parameter, so that the
+	// number of repositories is not limited by the maximum number of parameters
+	// of a statement.
+	q := sqlf.Sprintf(`
+-- source: enterprise/internal/database/perms_store.go:TouchRepoPermissionsBatch
+INSERT INTO repo_permissions
+	(repo_id, permission, updated_at, synced_at)
+SELECT
+  repo_id, %s, %s, %s
+FROM unnest(%s::int[]) AS repo_id
+ON CONFLICT ON CONSTRAINT
+  repo_permissions_perm_unique
+DO UPDATE SET
+  updated_at = excluded.updated_at,
+  synced_at = excluded.synced_at
+`, perm, touchedAt, touchedAt, pq.Array(repoIDs))
+	if err = s.execute(ctx, q); err != nil {
+		return errors.Wrap(err, "execute upsert repo permissions query")
+	}
+	return nil
+}
+
 // LoadUserPendingPermissions returns pending permissions found by given parameters.
 // An ErrPermsNotFound is returned when there are no pending permissions available.
 func (s *PermsStore) LoadUserPendingPermissions(ctx context.Context, p *authz.UserPendingPermissions) (err error) {
@@ -975,6 +1046,75 @@ AND service_id = %s
 	return bindIDs, nil
 }
 
+// RepoPermissionsExplanation contains the users and the pending external accounts
+// that have been granted access to a repository.
+type RepoPermissionsExplanation struct {
+	// UserIDs are the IDs of users who have access to the repository.
+	UserIDs []int32
+	// PendingAccounts are the external accounts that have access to the repository
+	// on the code host but are not yet associated with any user (e.g. the user has
+	// not signed in yet). Each AccountID is the bind ID of the account.
+	PendingAccounts []extsvc.AccountSpec
+}
+
+// ExplainRepoPermissions returns the users and the pending external accounts that
+// have been granted the given permission to the repository.
+func (s *PermsStore) ExplainRepoPermissions(ctx context.Context, repoID int32, perm authz.Perms) (_ *RepoPermissionsExplanation, err error) {
+	if Mocks.Perms.ExplainRepoPermissions != nil {
+		return Mocks.Perms.ExplainRepoPermissions(ctx, repoID, perm)
+	}
+
+	ctx, save := s.observe(ctx, "ExplainRepoPermissions", "")
+	defer func() { save(&err, otlog.Int32("repoID", repoID), otlog.String("perm", perm.String())) }()
+
+	e := &RepoPermissionsExplanation{}
+
+	p := &authz.RepoPermissions{
+		RepoID: repoID,
+		Perm:   perm,
+	}
+	vals, err := s.load(ctx, loadRepoPermissionsQuery(p, ""))
+	if err != nil && err != authz.ErrPermsNotFound {
+		return nil, errors.Wrap(err, "load repo permissions")
+	} else if vals != nil && vals.ids != nil {
+		for _, id := range vals.ids.ToArray() {
+			e.UserIDs = append(e.UserIDs, int32(id))
+		}
+	}
+
+	q := sqlf.Sprintf(`
+-- source: enterprise/internal/database/perms_store.go:PermsStore.ExplainRepoPermissions
+SELECT service_type, service_id, bind_id
+FROM user_pending_permissions
+WHERE id = ANY(
+	SELECT unnest(user_ids_ints)
+	FROM repo_pending_permissions
+	WHERE repo_id = %s
+	AND permission = %s
+)
+ORDER BY service_type, service_id, bind_id
+`, repoID, perm.String())
+
+	rows, err := s.Query(ctx, q)
+	if err != nil {
+		return nil, errors.Wrap(err, "list pending accounts")
+	}
+	defer func() { _ = rows.Close() }()
+
+	for rows.Next() {
+		var spec extsvc.AccountSpec
+		if err = rows.Scan(&spec.ServiceType, &spec.ServiceID, &spec.AccountID); err != nil {
+			return nil, err
+		}
+		e.PendingAccounts = append(e.PendingAccounts, spec)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return e, nil
+}
+
 // DeleteAllUserPermissions deletes all rows with given user ID from the "user_permissions" table,
 // which effectively removes access to all repositories for the user.
 func (s *PermsStore) DeleteAllUserPermissions(ctx context.Context, userID int32) (err error) {
@@ -1236,6 +1376,10 @@ AND account_id IN (%s)
 // UserIDsWithNoPerms returns a list of user IDs with no permissions found in
 // the database.
 func (s *PermsStore) UserIDsWithNoPerms(ctx context.Context) ([]int32, error) {
+	if Mocks.Perms.UserIDsWithNoPerms != nil {
+		return Mocks.Perms.UserIDsWithNoPerms(ctx)
+	}
+
 	// By default, site admins can access any repo
 	filterSiteAdmins := sqlf.Sprintf("users.site_admin = FALSE")
 	// Unless we enforce it in config
@@ -1264,18 +1408,24 @@ AND users.id NOT IN
 }
 
 // RepoIDsWithNoPerms returns a list of private repository IDs with no permissions
-// found in the database.
-func (s *PermsStore) RepoIDsWithNoPerms(ctx context.Context) ([]api.RepoID, error) {
+// found in the database. Archived repositories are only included when
+// includeArchived is true.
+func (s *PermsStore) RepoIDsWithNoPerms(ctx context.Context, includeArchived bool) ([]api.RepoID, error) {
+	if Mocks.Perms.RepoIDsWithNoPerms != nil {
+		return Mocks.Perms.RepoIDsWithNoPerms(ctx, includeArchived)
+	}
+
 	q := sqlf.Sprintf(`
 -- source: enterprise/internal/database/perms_store.go:PermsStore.RepoIDsWithNoPerms
 SELECT repo.id, NULL FROM repo
 WHERE repo.deleted_at IS NULL
 AND repo.private = TRUE
+AND (%s OR repo.archived = FALSE)
 AND repo.id NOT IN
 	(SELECT perms.repo_id FROM repo_permissions AS perms
 	 UNION
 	 SELECT pending.repo_id FROM repo_pending_permissions AS pending)
-`)
+`, includeArchived)
 
 	results, err := s.loadIDsWithTime(ctx, q)
 	if err != nil {
@@ -1292,6 +1442,10 @@ AND repo.id NOT IN
 // UserIDsWithOldestPerms returns a list of user ID and last updated pairs for users who
 // have the least recent synced permissions in the database and capped results by the limit.
 func (s *PermsStore) UserIDsWithOldestPerms(ctx context.Context, limit int) (map[int32]time.Time, error) {
+	if Mocks.Perms.UserIDsWithOldestPerms != nil {
+		return Mocks.Perms.UserIDsWithOldestPerms(ctx, limit)
+	}
+
 	q := sqlf.Sprintf(`
 -- source: enterprise/internal/database/perms_store.go:PermsStore.UserIDsWithOldestPerms
 SELECT perms.user_id, perms.synced_at FROM user_permissions AS perms
@@ -1306,17 +1460,23 @@ LIMIT %s
 
 // ReposIDsWithOldestPerms returns a list of repository ID and last updated pairs for
 // repositories that have the least recent synced permissions in the database and caps
-// results by the limit.
-func (s *PermsStore) ReposIDsWithOldestPerms(ctx context.Context, limit int) (map[api.RepoID]time.Time, error) {
+// results by the limit. Archived repositories are only included when includeArchived
+// is true.
+func (s *PermsStore) ReposIDsWithOldestPerms(ctx context.Context, limit int, includeArchived bool) (map[api.RepoID]time.Time, error) {
+	if Mocks.Perms.ReposIDsWithOldestPerms != nil {
+		return Mocks.Perms.ReposIDsWithOldestPerms(ctx, limit, includeArchived)
+	}
+
 	q := sqlf.Sprintf(`
 -- source: enterprise/internal/database/perms_store.go:PermsStore.ReposIDsWithOldestPerms
 SELECT perms.repo_id, perms.synced_at FROM repo_permissions AS perms
 WHERE perms.repo_id IN
 	(SELECT repo.id FROM repo
-	 WHERE repo.deleted_at IS NULL)
+	 WHERE repo.deleted_at IS NULL
+	 AND (%s OR repo.archived = FALSE))
 ORDER BY perms.synced_at ASC NULLS FIRST
 LIMIT %s
-`, limit)
+`, includeArchived, limit)
 
 	pairs, err := s.loadIDsWithTime(ctx, q)
 	if err != nil {
@@ -1355,6 +1515,95 @@ func (s *PermsStore) loadIDsWithTime(ctx context.Context, q *sqlf.Query) (map[in
 	return results, nil
 }
 
+// SetUserSyncError records the error of the most recent permissions sync of the
+// user, replacing any previously recorded error.
+func (s *PermsStore) SetUserSyncError(ctx context.Context, userID int32, syncErr string) (err error) {
+	if Mocks.Perms.SetUserSyncError != nil {
+		return Mocks.Perms.SetUserSyncError(ctx, userID, syncErr)
+	}
+
+	ctx, save := s.observe(ctx, "SetUserSyncError", "")
+	defer func() { save(&err, otlog.Int32("userID", userID)) }()
+
+	q := sqlf.Sprintf(`
+-- source: enterprise/internal/database/perms_store.go:PermsStore.SetUserSyncError
+INSERT INTO user_permissions_sync_errors
+	(user_id, error, errored_at)
+VALUES
+	(%s, %s, %s)
+ON CONFLICT (user_id)
+DO UPDATE SET
+	error = excluded.error,
+	errored_at = excluded.errored_at
+`, userID, syncErr, s.clock().UTC())
+	if err = s.execute(ctx, q); err != nil {
+		return errors.Wrap(err, "execute upsert user sync error query")
+	}
+	return nil
+}
+
+// ClearUserSyncError deletes the recorded sync error of the user, which is
+// expected to be called after a successful permissions sync of the user.
+func (s *PermsStore) ClearUserSyncError(ctx context.Context, userID int32) (err error) {
+	if Mocks.Perms.ClearUserSyncError != nil {
+		return Mocks.Perms.ClearUserSyncError(ctx, userID)
+	}
+
+	ctx, save := s.observe(ctx, "ClearUserSyncError", "")
+	defer func() { save(&err, otlog.Int32("userID", userID)) }()
+
+	if err = s.execute(ctx, sqlf.Sprintf(`DELETE FROM user_permissions_sync_errors WHERE user_id = %s`, userID)); err != nil {
+		return errors.Wrap(err, "execute delete user sync error query")
+	}
+	return nil
+}
+
+// UserSyncError is the error of the most recent permissions sync of a user.
+type UserSyncError struct {
+	UserID    int32
+	Error     string
+	ErroredAt time.Time
+}
+
+// UsersWithSyncErrors returns users whose most recent permissions sync failed,
+// along with the errors. Results are ordered by the most recent failures first
+// and capped by the limit.
+func (s *PermsStore) UsersWithSyncErrors(ctx context.Context, limit int) (errs []*UserSyncError, err error) {
+	if Mocks.Perms.UsersWithSyncErrors != nil {
+		return Mocks.Perms.UsersWithSyncErrors(ctx, limit)
+	}
+
+	ctx, save := s.observe(ctx, "UsersWithSyncErrors", "")
+	defer func() { save(&err, otlog.Int("limit", limit)) }()
+
+	q := sqlf.Sprintf(`
+-- source: enterprise/internal/database/perms_store.go:PermsStore.UsersWithSyncErrors
+SELECT errs.user_id, errs.error, errs.errored_at
+FROM user_permissions_sync_errors AS errs
+JOIN users ON users.id = errs.user_id
+WHERE users.deleted_at IS NULL
+ORDER BY errs.errored_at DESC, errs.user_id ASC
+LIMIT %s
+`, limit)
+	rows, err := s.Query(ctx, q)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = rows.Close() }()
+
+	for rows.Next() {
+		e := &UserSyncError{}
+		if err = rows.Scan(&e.UserID, &e.Error, &e.ErroredAt); err != nil {
+			return nil, err
+		}
+		errs = append(errs, e)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	return errs, nil
+}
+
 // PermsMetrics contains metrics values calculated by querying the database.
 type PermsMetrics struct {
 	// The number of users with stale permissions.
@@ -2,7 +2,9 @@ package database
 
 import (
 	"context"
+	"time"
 
+	"github.com/sourcegraph/sourcegraph/internal/api"
 	"github.com/sourcegraph/sourcegraph/internal/authz"
 	"github.com/sourcegraph/sourcegraph/internal/extsvc"
 )
@@ -13,10 +15,20 @@ type MockPerms struct {
 	LoadUserPermissions          func(ctx context.Context, p *authz.UserPermissions) error
 	LoadUserPendingPermissions   func(ctx context.Context, p *authz.UserPendingPermissions) error
 	SetUserPermissions           func(ctx context.Context, p *authz.UserPermissions) error
+	SetUserPermissionsWithDiff   func(ctx context.Context, p *authz.UserPermissions) (*UserPermissionsDiff, error)
 	SetRepoPermissions           func(ctx context.Context, p *authz.RepoPermissions) error
 	SetRepoPendingPermissions    func(ctx context.Context, accounts *extsvc.Accounts, p *authz.RepoPermissions) error
 	TouchRepoPermissions         func(ctx context.Context, repoID int32) error
+	TouchRepoPermissionsBatch    func(ctx context.Context, repoIDs []int32) error
 	ListPendingUsers             func(ctx context.Context) ([]string, error)
+	ExplainRepoPermissions       func(ctx context.Context, repoID int32, perm authz.Perms) (*RepoPermissionsExplanation, error)
 	ListExternalAccounts         func(ctx context.Context, userID int32) ([]*extsvc.Account, error)
 	GetUserIDsByExternalAccounts func(ctx context.Context, accounts *extsvc.Accounts) (map[string]int32, error)
+	SetUserSyncError             func(ctx context.Context, userID int32, syncErr string) error
+	ClearUserSyncError           func(ctx context.Context, userID int32) error
+	UsersWithSyncErrors          func(ctx context.Context, limit int) ([]*UserSyncError, error)
+	UserIDsWithNoPerms           func(ctx context.Context) ([]int32, error)
+	RepoIDsWithNoPerms           func(ctx context.Context, includeArchived bool) ([]api.RepoID, error)
+	UserIDsWithOldestPerms       func(ctx context.Context, limit int) (map[int32]time.Time, error)
+	ReposIDsWithOldestPerms      func(ctx context.Context, limit int, includeArchived bool) (map[api.RepoID]time.Time, error)
 }
@@ -431,6 +431,81 @@ func testPermsStore_SetUserPermissions(db *sql.DB) func(*testing.T) {
 			}
 		})
 
+		t.Run("update with diff should report added and removed IDs", func(t *testing.T) {
+			s := Perms(db, clock)
+			t.Cleanup(func() {
+				cleanupPermsTables(t, s)
+			})
+
+			diff, err := s.SetUserPermissionsWithDiff(context.Background(), &authz.UserPermissions{
+				UserID: 1,
+				Perm:   authz.Read,
+				Type:   authz.PermRepos,
+				IDs:    toBitmap(1, 2),
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			want := &UserPermissionsDiff{
+				Added:    []uint32{1, 2},
+				Removed:  []uint32{},
+				SyncedAt: clock(),
+			}
+			if d := cmp.Diff(want, diff); d != "" {
+				t.Fatalf("diff mismatch (-want +got):\n%s", d)
+			}
+
+			diff, err = s.SetUserPermissionsWithDiff(context.Background(), &authz.UserPermissions{
+				UserID: 1,
+				Perm:   authz.Read,
+				Type:   authz.PermRepos,
+				IDs:    toBitmap(2, 3),
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			want = &UserPermissionsDiff{
+				Added:    []uint32{3},
+				Removed:  []uint32{1},
+				SyncedAt: clock(),
+			}
+			if d := cmp.Diff(want, diff); d != "" {
+				t.Fatalf("diff mismatch (-want +got):\n%s", d)
+			}
+		})
+
+		t.Run("update with diff should report the persisted synced_at", func(t *testing.T) {
+			s := Perms(db, clock)
+			t.Cleanup(func() {
+				cleanupPermsTables(t, s)
+			})
+
+			diff, err := s.SetUserPermissionsWithDiff(context.Background(), &authz.UserPermissions{
+				UserID: 1,
+				Perm:   authz.Read,
+				Type:   authz.PermRepos,
+				IDs:    toBitmap(1),
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			up := &authz.UserPermissions{
+				UserID: 1,
+				Perm:   authz.Read,
+				Type:   authz.PermRepos,
+			}
+			if err := s.LoadUserPermissions(context.Background(), up); err != nil {
+				t.Fatal(err)
+			}
+			if !diff.SyncedAt.Equal(up.SyncedAt) {
+				t.Fatalf("SyncedAt: want %v but got %v", up.SyncedAt, diff.SyncedAt)
+			}
+			if !diff.SyncedAt.Equal(up.UpdatedAt) {
+				t.Fatalf("UpdatedAt: want %v but got %v", up.UpdatedAt, diff.SyncedAt)
+			}
+		})
+
 		for _, test := range tests {
 			t.Run(test.name, func(t *testing.T) {
 				s := Perms(db, clock)
@@ -694,6 +769,56 @@ func testPermsStore_TouchRepoPermissions(db *sql.DB) func(*testing.T) {
 		if rp.UpdatedAt.Unix() != now || rp.SyncedAt.Unix() != now {
 			t.Fatal("UpdatedAt or SyncedAt was not updated but supposed to")
 		}
+
+		t.Run("batch", func(t *testing.T) {
+			// Touch repositories 1 and 2 in an hour late
+			now += 3600
+			if err := s.TouchRepoPermissionsBatch(context.Background(), []int32{1, 2}); err != nil {
+				t.Fatal(err)
+			}
+
+			for _, repoID := range []int32{1, 2} {
+				rp := &authz.RepoPermissions{
+					RepoID: repoID,
+					Perm:   authz.Read,
+				}
+				if err := s.LoadRepoPermissions(context.Background(), rp); err != nil {
+					t.Fatal(err)
+				}
+				if rp.UpdatedAt.Unix() != now || rp.SyncedAt.Unix() != now {
+					t.Fatalf("repo %d: UpdatedAt or SyncedAt was not updated but supposed to", repoID)
+				}
+			}
+
+			// Permissions bits shouldn't be affected
+			rp := &authz.RepoPermissions{
+				RepoID: 1,
+				Perm:   authz.Read,
+			}
+			if err := s.LoadRepoPermissions(context.Background(), rp); err != nil {
+				t.Fatal(err)
+			}
+			equal(t, "rp.UserIDs", []int{2}, bitmapToArray(rp.UserIDs))
+		})
+
+		t.Run("batch larger than the parameter limit", func(t *testing.T) {
+			// A statement can have at most 65,535 parameters.
+			repoIDs := make([]int32, 70000)
+			for i := range repoIDs {
+				repoIDs[i] = int32(i + 1)
+			}
+			if err := s.TouchRepoPermissionsBatch(context.Background(), repoIDs); err != nil {
+				t.Fatal(err)
+			}
+
+			rp := &authz.RepoPermissions{
+				RepoID: 70000,
+				Perm:   authz.Read,
+			}
+			if err := s.LoadRepoPermissions(context.Background(), rp); err != nil {
+				t.Fatal(err)
+			}
+		})
 	}
 }
 
@@ -1709,6 +1834,78 @@ func testPermsStore_SetPendingPermissionsAfterGrant(db *sql.DB) func(*testing.T)
 	}
 }
 
+func testPermsStore_ExplainRepoPermissions(db *sql.DB) func(*testing.T) {
+	return func(t *testing.T) {
+		s := Perms(db, clock)
+		t.Cleanup(func() {
+			cleanupPermsTables(t, s)
+		})
+
+		ctx := context.Background()
+
+		// Users 1 and 2 are mapped to real users.
+		err := s.SetRepoPermissions(ctx, &authz.RepoPermissions{
+			RepoID:  1,
+			Perm:    authz.Read,
+			UserIDs: toBitmap(1, 2),
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// Alice and bob have not signed in yet.
+		err = s.SetRepoPendingPermissions(ctx, &extsvc.Accounts{
+			ServiceType: extsvc.TypeGitHub,
+			ServiceID:   "https://github.com/",
+			AccountIDs:  []string{"bob", "alice"},
+		}, &authz.RepoPermissions{
+			RepoID: 1,
+			Perm:   authz.Read,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// Cindy only has access to another repository.
+		err = s.SetRepoPendingPermissions(ctx, &extsvc.Accounts{
+			ServiceType: extsvc.TypeGitHub,
+			ServiceID:   "https://github.com/",
+			AccountIDs:  []string{"cindy"},
+		}, &authz.RepoPermissions{
+			RepoID: 2,
+			Perm:   authz.Read,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		got, err := s.ExplainRepoPermissions(ctx, 1, authz.Read)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		want := &RepoPermissionsExplanation{
+			UserIDs: []int32{1, 2},
+			PendingAccounts: []extsvc.AccountSpec{
+				{ServiceType: extsvc.TypeGitHub, ServiceID: "https://github.com/", AccountID: "alice"},
+				{ServiceType: extsvc.TypeGitHub, ServiceID: "https://github.com/", AccountID: "bob"},
+			},
+		}
+		if diff := cmp.Diff(want, got); diff != "" {
+			t.Fatalf("explanation mismatch (-want +got):\n%s", diff)
+		}
+
+		// A repository without any permissions has nothing to explain.
+		got, err = s.ExplainRepoPermissions(ctx, 3, authz.Read)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if diff := cmp.Diff(&RepoPermissionsExplanation{}, got); diff != "" {
+			t.Fatalf("explanation mismatch (-want +got):\n%s", diff)
+		}
+	}
+}
+
 func testPermsStore_DeleteAllUserPermissions(db *sql.DB) func(*testing.T) {
 	return func(t *testing.T) {
 		s := Perms(db, clock)
@@ -2165,6 +2362,7 @@ func testPermsStore_RepoIDsWithNoPerms(db *sql.DB) func(*testing.T) {
 			sqlf.Sprintf(`INSERT INTO repo(name) VALUES('public_repo')`),                                      // ID=2
 			sqlf.Sprintf(`INSERT INTO repo(name, private) VALUES('private_repo_2', TRUE)`),                    // ID=3
 			sqlf.Sprintf(`INSERT INTO repo(name, private, deleted_at) VALUES('private_repo_3', TRUE, NOW())`), // ID=4
+			sqlf.Sprintf(`INSERT INTO repo(name, private, archived) VALUES('private_repo_4', TRUE, TRUE)`),    // ID=5
 		}
 		for _, q := range qs {
 			if err := s.execute(ctx, q); err != nil {
@@ -2172,14 +2370,26 @@ func testPermsStore_RepoIDsWithNoPerms(db *sql.DB) func(*testing.T) {
 			}
 		}
 
-		// Should get back two private repos that are not deleted
-		ids, err := s.RepoIDsWithNoPerms(ctx)
+		// Should get back three private repos that are not deleted, including the archived one
+		ids, err := s.RepoIDsWithNoPerms(ctx, true)
+		if err != nil {
+			t.Fatal(err)
+		}
+		sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+
+		expIDs := []api.RepoID{1, 3, 5}
+		if diff := cmp.Diff(expIDs, ids); diff != "" {
+			t.Fatal(diff)
+		}
+
+		// Should not get back the archived repo when archived repos are not included
+		ids, err = s.RepoIDsWithNoPerms(ctx, false)
 		if err != nil {
 			t.Fatal(err)
 		}
 		sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
 
-		expIDs := []api.RepoID{1, 3}
+		expIDs = []api.RepoID{1, 3}
 		if diff := cmp.Diff(expIDs, ids); diff != "" {
 			t.Fatal(diff)
 		}
@@ -2208,8 +2418,18 @@ func testPermsStore_RepoIDsWithNoPerms(db *sql.DB) func(*testing.T) {
 			t.Fatal(err)
 		}
 
-		// No private repositories have any permissions at this point
-		ids, err = s.RepoIDsWithNoPerms(ctx)
+		// Only the archived private repository has no permissions at this point
+		ids, err = s.RepoIDsWithNoPerms(ctx, true)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		expIDs = []api.RepoID{5}
+		if diff := cmp.Diff(expIDs, ids); diff != "" {
+			t.Fatal(diff)
+		}
+
+		ids, err = s.RepoIDsWithNoPerms(ctx, false)
 		if err != nil {
 			t.Fatal(err)
 		}
@@ -2375,7 +2595,7 @@ WHERE repo_id = 2`, clock().AddDate(1, 0, 0))
 		}
 
 		// Should only get repo 1 back
-		results, err := s.ReposIDsWithOldestPerms(ctx, 1)
+		results, err := s.ReposIDsWithOldestPerms(ctx, 1, true)
 		if err != nil {
 			t.Fatal(err)
 		}
@@ -2386,7 +2606,7 @@ WHERE repo_id = 2`, clock().AddDate(1, 0, 0))
 		}
 
 		// Should get both repos back
-		results, err = s.ReposIDsWithOldestPerms(ctx, 2)
+		results, err = s.ReposIDsWithOldestPerms(ctx, 2, true)
 		if err != nil {
 			t.Fatal(err)
 		}
@@ -2405,7 +2625,7 @@ WHERE repo_id = 2`, clock().AddDate(1, 0, 0))
 		}
 
 		// Should only get repo 1 back with limit=2
-		results, err = s.ReposIDsWithOldestPerms(ctx, 2)
+		results, err = s.ReposIDsWithOldestPerms(ctx, 2, true)
 		if err != nil {
 			t.Fatal(err)
 		}
@@ -2414,6 +2634,107 @@ WHERE repo_id = 2`, clock().AddDate(1, 0, 0))
 		if diff := cmp.Diff(wantResults, results); diff != "" {
 			t.Fatalf("Results mismatch (-want +got):\n%s", diff)
 		}
+
+		// Archive repo 1
+		if err := s.execute(ctx, sqlf.Sprintf(`UPDATE repo SET archived = TRUE WHERE id = 1`)); err != nil {
+			t.Fatal(err)
+		}
+
+		// Should only get repo 1 back when archived repos are included
+		results, err = s.ReposIDsWithOldestPerms(ctx, 2, true)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		wantResults = map[api.RepoID]time.Time{1: clock()}
+		if diff := cmp.Diff(wantResults, results); diff != "" {
+			t.Fatalf("Results mismatch (-want +got):\n%s", diff)
+		}
+
+		results, err = s.ReposIDsWithOldestPerms(ctx, 2, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		wantResults = map[api.RepoID]time.Time{}
+		if diff := cmp.Diff(wantResults, results); diff != "" {
+			t.Fatalf("Results mismatch (-want +got):\n%s", diff)
+		}
+	}
+}
+
+func testPermsStore_UsersWithSyncErrors(db *sql.DB) func(*testing.T) {
+	return func(t *testing.T) {
+		now := time.Now().Truncate(time.Microsecond).UTC()
+		clock := func() time.Time { return now }
+		s := Perms(db, clock)
+		t.Cleanup(func() {
+			cleanupUsersTable(t, s)
+		})
+
+		ctx := context.Background()
+
+		// Create test users "alice", "bob" and "cindy"
+		qs := []*sqlf.Query{
+			sqlf.Sprintf(`INSERT INTO users(username) VALUES('alice')`),                    // ID=1
+			sqlf.Sprintf(`INSERT INTO users(username) VALUES('bob')`),                      // ID=2
+			sqlf.Sprintf(`INSERT INTO users(username, deleted_at) VALUES('cindy', NOW())`), // ID=3
+		}
+		for _, q := range qs {
+			if err := s.execute(ctx, q); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		for _, userID := range []int32{1, 3} {
+			if err := s.SetUserSyncError(ctx, userID, "first error"); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		// The latest error replaces the previous one
+		now = now.Add(time.Minute)
+		if err := s.SetUserSyncError(ctx, 2, "second error"); err != nil {
+			t.Fatal(err)
+		}
+		now = now.Add(time.Minute)
+		if err := s.SetUserSyncError(ctx, 1, "third error"); err != nil {
+			t.Fatal(err)
+		}
+
+		// Deleted users are not included
+		errs, err := s.UsersWithSyncErrors(ctx, 10)
+		if err != nil {
+			t.Fatal(err)
+		}
+		wantErrs := []*UserSyncError{
+			{UserID: 1, Error: "third error", ErroredAt: now},
+			{UserID: 2, Error: "second error", ErroredAt: now.Add(-time.Minute)},
+		}
+		if diff := cmp.Diff(wantErrs, errs); diff != "" {
+			t.Fatalf("errs mismatch (-want +got):\n%s", diff)
+		}
+
+		// Results are capped by the limit
+		errs, err = s.UsersWithSyncErrors(ctx, 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if diff := cmp.Diff(wantErrs[:1], errs); diff != "" {
+			t.Fatalf("errs mismatch (-want +got):\n%s", diff)
+		}
+
+		// The error is cleared after a successful sync
+		if err = s.ClearUserSyncError(ctx, 1); err != nil {
+			t.Fatal(err)
+		}
+		errs, err = s.UsersWithSyncErrors(ctx, 10)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if diff := cmp.Diff(wantErrs[1:], errs); diff != "" {
+			t.Fatalf("errs mismatch (-want +got):\n%s", diff)
+		}
 	}
 }
 
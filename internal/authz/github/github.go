@@ -143,7 +143,7 @@ func (p *Provider) FetchRepoPerms(ctx context.Context, repo *extsvc.Repository)
 
 	// 100 matches the maximum page size, thus a good default to avoid multiple allocations
 	// when appending the first 100 results to the slice.
-	userIDs := make([]extsvc.AccountID, 0, 100)
+	userIDs := make([]extsvc.AccountID, 0, collaboratorsPageSize)
 	hasNextPage := true
 	for page := 1; hasNextPage; page++ {
 		var err error
@@ -160,3 +160,25 @@ func (p *Provider) FetchRepoPerms(ctx context.Context, repo *extsvc.Repository)
 
 	return userIDs, nil
 }
+
+// affiliatedReposPageSize is the number of repositories returned per page when
+// listing affiliated repositories of a user.
+const affiliatedReposPageSize = 100
+
+// EstimateUserPermsCalls returns the number of pages FetchUserPerms requests for
+// the given number of affiliated private repositories, including the trailing
+// empty page that indicates the end of the listing.
+func (p *Provider) EstimateUserPermsCalls(knownRepos int) int {
+	return (knownRepos+affiliatedReposPageSize-1)/affiliatedReposPageSize + 1
+}
+
+// collaboratorsPageSize is the number of collaborators returned per page when
+// listing collaborators of a repository.
+const collaboratorsPageSize = 100
+
+// EstimateRepoPermsCalls returns the number of pages FetchRepoPerms requests for
+// the given number of collaborators, including the trailing empty page that
+// indicates the end of the listing.
+func (p *Provider) EstimateRepoPermsCalls(knownAccounts int) int {
+	return (knownAccounts+collaboratorsPageSize-1)/collaboratorsPageSize + 1
+}
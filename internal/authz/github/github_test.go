@@ -195,3 +195,42 @@ func TestProvider_FetchRepoPerms(t *testing.T) {
 		t.Fatalf("AccountIDs mismatch (-want +got):\n%s", diff)
 	}
 }
+
+func TestProvider_EstimateUserPermsCalls(t *testing.T) {
+	p := NewProvider("", mustURL(t, "https://github.com"), "admin_token", nil)
+	tests := []struct {
+		knownRepos int
+		want       int
+	}{
+		{knownRepos: 0, want: 1},
+		{knownRepos: 1, want: 2},
+		{knownRepos: 100, want: 2},
+		{knownRepos: 101, want: 3},
+	}
+	for _, test := range tests {
+		got := p.EstimateUserPermsCalls(test.knownRepos)
+		if got != test.want {
+			t.Errorf("knownRepos %d: want %d but got %d", test.knownRepos, test.want, got)
+		}
+	}
+}
+
+func TestProvider_EstimateRepoPermsCalls(t *testing.T) {
+	p := NewProvider("", mustURL(t, "https://github.com"), "admin_token", nil)
+	tests := []struct {
+		knownAccounts int
+		want          int
+	}{
+		{knownAccounts: 0, want: 1},
+		{knownAccounts: 1, want: 2},
+		{knownAccounts: 100, want: 2},
+		{knownAccounts: 101, want: 3},
+		{knownAccounts: 250, want: 4},
+	}
+	for _, test := range tests {
+		got := p.EstimateRepoPermsCalls(test.knownAccounts)
+		if got != test.want {
+			t.Errorf("knownAccounts %d: want %d but got %d", test.knownAccounts, test.want, got)
+		}
+	}
+}
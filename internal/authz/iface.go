@@ -4,6 +4,7 @@ package authz
 
 import (
 	"context"
+	"sort"
 
 	"github.com/sourcegraph/sourcegraph/internal/extsvc"
 	"github.com/sourcegraph/sourcegraph/internal/types"
@@ -21,6 +22,63 @@ type ExternalUserPermissions struct {
 	ExcludeContains []extsvc.RepoID
 }
 
+// MergeExternalUserPermissions merges permissions of the same code host that are
+// returned by multiple providers into one. Exact IDs and prefixes are deduplicated
+// and sorted so that the result is deterministic regardless of the order of
+// arguments. A prefix that is both included and excluded is only kept as
+// excluded because exclusions always take precedence over inclusions. Exact IDs
+// are not affected by exclusions. Nil arguments are skipped, and it returns nil
+// if all arguments are nil.
+func MergeExternalUserPermissions(perms ...*ExternalUserPermissions) *ExternalUserPermissions {
+	var merged *ExternalUserPermissions
+	exacts := make(map[extsvc.RepoID]struct{})
+	includes := make(map[extsvc.RepoID]struct{})
+	excludes := make(map[extsvc.RepoID]struct{})
+	for _, p := range perms {
+		if p == nil {
+			continue
+		}
+		merged = &ExternalUserPermissions{}
+
+		for _, id := range p.Exacts {
+			exacts[id] = struct{}{}
+		}
+		for _, id := range p.IncludeContains {
+			includes[id] = struct{}{}
+		}
+		for _, id := range p.ExcludeContains {
+			excludes[id] = struct{}{}
+		}
+	}
+	if merged == nil {
+		return nil
+	}
+
+	for id := range excludes {
+		delete(includes, id)
+	}
+
+	merged.Exacts = sortedRepoIDs(exacts)
+	merged.IncludeContains = sortedRepoIDs(includes)
+	merged.ExcludeContains = sortedRepoIDs(excludes)
+	return merged
+}
+
+// sortedRepoIDs returns the set of IDs as a sorted list, or nil if the set is
+// empty.
+func sortedRepoIDs(set map[extsvc.RepoID]struct{}) []extsvc.RepoID {
+	if len(set) == 0 {
+		return nil
+	}
+
+	ids := make([]extsvc.RepoID, 0, len(set))
+	for id := range set {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	return ids
+}
+
 // Provider defines a source of truth of which repositories a user is authorized to view. The
 // user is identified by an extsvc.Account instance. Examples of authz providers include the
 // following:
@@ -88,3 +146,23 @@ type Provider interface {
 	// problems.
 	Validate() (problems []string)
 }
+
+// RepoPermsCallsEstimator is an optional interface implemented by authz providers
+// whose FetchRepoPerms makes more than one API call (e.g. paginated listing), so
+// callers are able to reserve enough rate limit budget before fetching.
+type RepoPermsCallsEstimator interface {
+	// EstimateRepoPermsCalls returns the estimated number of API calls FetchRepoPerms
+	// makes for a repository that the given number of accounts had read access to
+	// as of the last sync.
+	EstimateRepoPermsCalls(knownAccounts int) int
+}
+
+// UserPermsCallsEstimator is an optional interface implemented by authz providers
+// whose FetchUserPerms makes more than one API call (e.g. paginated listing), so
+// callers are able to reserve enough rate limit budget before fetching.
+type UserPermsCallsEstimator interface {
+	// EstimateUserPermsCalls returns the estimated number of API calls
+	// FetchUserPerms makes for a user who had read access to the given number of
+	// repositories as of the last sync.
+	EstimateUserPermsCalls(knownRepos int) int
+}
@@ -0,0 +1,93 @@
+package authz
+
+import (
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+
+	"github.com/sourcegraph/sourcegraph/internal/extsvc"
+)
+
+func TestMergeExternalUserPermissions(t *testing.T) {
+	tests := []struct {
+		name  string
+		perms []*ExternalUserPermissions
+		want  *ExternalUserPermissions
+	}{
+		{
+			name:  "no permissions",
+			perms: []*ExternalUserPermissions{nil, nil},
+			want:  nil,
+		},
+		{
+			name: "single",
+			perms: []*ExternalUserPermissions{
+				nil,
+				{
+					Exacts:          []extsvc.RepoID{"2", "1"},
+					IncludeContains: []extsvc.RepoID{"//Sourcegraph/%"},
+				},
+			},
+			want: &ExternalUserPermissions{
+				Exacts:          []extsvc.RepoID{"1", "2"},
+				IncludeContains: []extsvc.RepoID{"//Sourcegraph/%"},
+			},
+		},
+		{
+			name: "overlapping",
+			perms: []*ExternalUserPermissions{
+				{
+					Exacts:          []extsvc.RepoID{"1", "2"},
+					IncludeContains: []extsvc.RepoID{"//Sourcegraph/Engineering/%"},
+					ExcludeContains: []extsvc.RepoID{"//Sourcegraph/Engineering/Security/%"},
+				},
+				{
+					Exacts:          []extsvc.RepoID{"3", "2"},
+					IncludeContains: []extsvc.RepoID{"//Sourcegraph/Engineering/%", "//Sourcegraph/Marketing/%"},
+					ExcludeContains: []extsvc.RepoID{"//Sourcegraph/Engineering/Security/%"},
+				},
+			},
+			want: &ExternalUserPermissions{
+				Exacts:          []extsvc.RepoID{"1", "2", "3"},
+				IncludeContains: []extsvc.RepoID{"//Sourcegraph/Engineering/%", "//Sourcegraph/Marketing/%"},
+				ExcludeContains: []extsvc.RepoID{"//Sourcegraph/Engineering/Security/%"},
+			},
+		},
+		{
+			name: "exclude overrides include across providers",
+			perms: []*ExternalUserPermissions{
+				{
+					Exacts:          []extsvc.RepoID{"1"},
+					IncludeContains: []extsvc.RepoID{"//Sourcegraph/Engineering/%", "//Sourcegraph/Security/%"},
+				},
+				{
+					Exacts:          []extsvc.RepoID{"1"},
+					ExcludeContains: []extsvc.RepoID{"//Sourcegraph/Security/%", "1"},
+				},
+			},
+			want: &ExternalUserPermissions{
+				Exacts:          []extsvc.RepoID{"1"},
+				IncludeContains: []extsvc.RepoID{"//Sourcegraph/Engineering/%"},
+				ExcludeContains: []extsvc.RepoID{"//Sourcegraph/Security/%", "1"},
+			},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got := MergeExternalUserPermissions(test.perms...)
+			if diff := cmp.Diff(test.want, got); diff != "" {
+				t.Fatalf("mismatch (-want +got):\n%s", diff)
+			}
+
+			// The result must not depend on the order of arguments.
+			reversed := make([]*ExternalUserPermissions, len(test.perms))
+			for i := range test.perms {
+				reversed[len(test.perms)-1-i] = test.perms[i]
+			}
+			got = MergeExternalUserPermissions(reversed...)
+			if diff := cmp.Diff(test.want, got); diff != "" {
+				t.Fatalf("reversed mismatch (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
@@ -2,6 +2,9 @@ package perforce
 
 import (
 	"fmt"
+	"time"
+
+	"github.com/cockroachdb/errors"
 
 	"github.com/sourcegraph/sourcegraph/internal/authz"
 	"github.com/sourcegraph/sourcegraph/internal/types"
@@ -41,7 +44,12 @@ func newAuthzProvider(
 		return nil, nil
 	}
 
-	return NewProvider(urn, host, user, password), nil
+	p, err := NewProvider(urn, host, user, password, time.Duration(a.CommandTimeoutSeconds)*time.Second, defaultUserEmailsTTL)
+	if err != nil {
+		return nil, errors.Wrap(err, "new Perforce authz provider")
+	}
+	p.SetMaxConcurrentP4Exec(a.MaxConcurrentP4Exec)
+	return p, nil
 }
 
 // ValidateAuthz validates the authorization fields of the given Perforce
@@ -7,14 +7,21 @@ import (
 	"io"
 	"net/http"
 	"net/url"
+	"sort"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/cockroachdb/errors"
 	"github.com/inconshreveable/log15"
 	jsoniter "github.com/json-iterator/go"
 	otlog "github.com/opentracing/opentracing-go/log"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
 
+	"github.com/sourcegraph/sourcegraph/internal/api"
 	"github.com/sourcegraph/sourcegraph/internal/authz"
+	"github.com/sourcegraph/sourcegraph/internal/database"
 	"github.com/sourcegraph/sourcegraph/internal/extsvc"
 	"github.com/sourcegraph/sourcegraph/internal/extsvc/perforce"
 	"github.com/sourcegraph/sourcegraph/internal/gitserver"
@@ -34,13 +41,23 @@ type Provider struct {
 	password string
 
 	p4Execer p4Execer
-
-	// NOTE: We do not need mutex because there is no concurrent access to these
-	// 	fields in the current implementation.
+	// The maximum time duration a single p4 command is allowed to take, zero
+	// value indicates no timeout.
+	commandTimeout time.Duration
+	// The time duration after which cachedAllUserEmails is refreshed.
+	userEmailsTTL time.Duration
+	clock         func() time.Time
+
+	// cacheMu guards the caches below, p4 commands are not run while holding the
+	// lock so concurrent fetches may race to fill the same entry.
+	cacheMu             sync.RWMutex
 	cachedAllUserEmails map[string]string   // username <-> email
 	cachedGroupMembers  map[string][]string // group <-> members
+	userEmailsFetchedAt time.Time           // when cachedAllUserEmails was fetched
 }
 
+const defaultUserEmailsTTL = 5 * time.Minute
+
 type p4Execer interface {
 	P4Exec(ctx context.Context, host, user, password string, args ...string) (io.ReadCloser, http.Header, error)
 }
@@ -49,8 +66,27 @@ type p4Execer interface {
 // host, user and password to talk to a Perforce Server that is the source of
 // truth for permissions. It assumes emails of Sourcegraph accounts match 1-1
 // with emails of Perforce Server users. It uses our default gitserver client.
-func NewProvider(urn, host, user, password string) *Provider {
-	baseURL, _ := url.Parse(host)
+// Every p4 command, including reading its output, fails with a timeout error
+// after the commandTimeout, zero value indicates no timeout. Emails of all users
+// are cached for the userEmailsTTL, zero or negative value indicates the default
+// of 5 minutes. It returns an error if the host, user or password is malformed,
+// without contacting the Perforce Server.
+func NewProvider(urn, host, user, password string, commandTimeout, userEmailsTTL time.Duration) (*Provider, error) {
+	if host == "" {
+		return nil, errors.New("host must not be empty")
+	} else if user == "" {
+		return nil, errors.New("user must not be empty")
+	} else if password == "" {
+		return nil, errors.New("password must not be empty")
+	}
+	baseURL, err := url.Parse(host)
+	if err != nil {
+		return nil, errors.Wrapf(err, "parse host %q", host)
+	}
+
+	if userEmailsTTL <= 0 {
+		userEmailsTTL = defaultUserEmailsTTL
+	}
 	return &Provider{
 		urn:                urn,
 		codeHost:           extsvc.NewCodeHost(baseURL, extsvc.TypePerforce),
@@ -58,10 +94,162 @@ func NewProvider(urn, host, user, password string) *Provider {
 		user:               user,
 		password:           password,
 		p4Execer:           gitserver.DefaultClient,
+		commandTimeout:     commandTimeout,
+		userEmailsTTL:      userEmailsTTL,
+		clock:              time.Now,
 		cachedGroupMembers: make(map[string][]string),
+	}, nil
+}
+
+// SetMaxConcurrentP4Exec limits the number of concurrent P4Exec calls made by the
+// provider to protect gitserver from too many concurrent subprocesses. A slot is
+// held until the output of the call is closed. Zero or negative value indicates
+// no limit.
+func (p *Provider) SetMaxConcurrentP4Exec(max int) {
+	if l, ok := p.p4Execer.(*limitedP4Execer); ok {
+		p.p4Execer = l.p4Execer
+	}
+	if max <= 0 {
+		return
+	}
+
+	p.p4Execer = &limitedP4Execer{
+		p4Execer: p.p4Execer,
+		slots:    make(chan struct{}, max),
+	}
+}
+
+var p4ExecWaitDuration = promauto.NewHistogram(prometheus.HistogramOpts{
+	Name:    "src_perforce_authz_p4_exec_wait_seconds",
+	Help:    "Time (in seconds) spent on waiting for a slot to run P4Exec.",
+	Buckets: prometheus.DefBuckets,
+})
+
+// limitedP4Execer wraps a p4Execer to limit the number of concurrent P4Exec calls.
+type limitedP4Execer struct {
+	p4Execer
+	slots chan struct{}
+}
+
+func (e *limitedP4Execer) P4Exec(ctx context.Context, host, user, password string, args ...string) (io.ReadCloser, http.Header, error) {
+	began := time.Now()
+	select {
+	case e.slots <- struct{}{}:
+	case <-ctx.Done():
+		return nil, nil, ctx.Err()
+	}
+	p4ExecWaitDuration.Observe(time.Since(began).Seconds())
+
+	rc, header, err := e.p4Execer.P4Exec(ctx, host, user, password, args...)
+	if err != nil {
+		<-e.slots
+		return nil, nil, err
+	}
+
+	// The subprocess keeps running until its output is consumed, so the slot is
+	// held until the output is closed.
+	return &slotReadCloser{
+		ReadCloser: rc,
+		release:    func() { <-e.slots },
+	}, header, nil
+}
+
+// slotReadCloser releases the slot of a limitedP4Execer when it is closed.
+type slotReadCloser struct {
+	io.ReadCloser
+	once    sync.Once
+	release func()
+}
+
+func (rc *slotReadCloser) Close() error {
+	err := rc.ReadCloser.Close()
+	rc.once.Do(rc.release)
+	return err
+}
+
+// p4Exec runs the p4 command with given arguments against the Perforce Server,
+// within the command timeout of the provider if it is set.
+func (p *Provider) p4Exec(ctx context.Context, args ...string) (io.ReadCloser, http.Header, error) {
+	return p.p4ExecAs(ctx, p.user, p.password, args...)
+}
+
+// p4ExecAs is like p4Exec but authenticates as the given user instead of the
+// user of the provider.
+func (p *Provider) p4ExecAs(ctx context.Context, user, password string, args ...string) (io.ReadCloser, http.Header, error) {
+	if p.commandTimeout <= 0 {
+		return p.p4Execer.P4Exec(ctx, p.host, user, password, args...)
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, p.commandTimeout)
+	rc, header, err := p.p4Execer.P4Exec(ctx, p.host, user, password, args...)
+	if err != nil {
+		cancel()
+		return nil, nil, p.timeoutError(ctx, args, err)
+	}
+
+	// The output is streamed from the running command, so the deadline must last
+	// until the output is closed.
+	return &timeoutReadCloser{
+		ReadCloser: rc,
+		cancel:     cancel,
+		wrap: func(err error) error {
+			return p.timeoutError(ctx, args, err)
+		},
+	}, header, nil
+}
+
+// timeoutError returns a commandTimeoutError if the error is caused by the
+// command timeout, otherwise the error is returned as-is.
+func (p *Provider) timeoutError(ctx context.Context, args []string, err error) error {
+	if err == nil || ctx.Err() != context.DeadlineExceeded {
+		return err
+	}
+	return &commandTimeoutError{
+		command: strings.Join(args, " "),
+		timeout: p.commandTimeout,
+		err:     err,
 	}
 }
 
+// commandTimeoutError is returned when a p4 command did not finish within the
+// command timeout, it is recognized by errcode.IsTimeout so that the caller can
+// retry later.
+type commandTimeoutError struct {
+	command string
+	timeout time.Duration
+	err     error
+}
+
+func (e *commandTimeoutError) Error() string {
+	return "p4 " + e.command + " timed out after " + e.timeout.String() + ": " + e.err.Error()
+}
+
+func (e *commandTimeoutError) Unwrap() error { return e.err }
+
+func (e *commandTimeoutError) Timeout() bool { return true }
+
+// timeoutReadCloser reports read errors caused by the command timeout as such,
+// and releases the deadline when it is closed.
+type timeoutReadCloser struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+	wrap   func(error) error
+}
+
+func (rc *timeoutReadCloser) Read(b []byte) (int, error) {
+	n, err := rc.ReadCloser.Read(b)
+	if err != nil && err != io.EOF {
+		err = rc.wrap(err)
+	}
+	return n, err
+}
+
+func (rc *timeoutReadCloser) Close() error {
+	err := rc.ReadCloser.Close()
+	rc.cancel()
+	return err
+}
+
 // FetchAccount uses given user's verified emails to match users on the Perforce
 // Server. It returns when any of the verified email has matched and the match
 // result is not deterministic.
@@ -89,7 +277,7 @@ func (p *Provider) FetchAccount(ctx context.Context, user *types.User, _ []*exts
 		emailSet[email] = struct{}{}
 	}
 
-	rc, _, err := p.p4Execer.P4Exec(ctx, p.host, p.user, p.password, "users")
+	rc, _, err := p.p4Exec(ctx, "users")
 	if err != nil {
 		return nil, errors.Wrap(err, "list users")
 	}
@@ -140,13 +328,20 @@ func (p *Provider) FetchAccount(ctx context.Context, user *types.User, _ []*exts
 
 // canRevokeReadAccess returns true if the given access level is able to revoke
 // read account for a depot prefix.
+//
+// It is intentionally a superset of the levels in canGrantReadAccess: strictly
+// speaking, an exclusionary "=open" or "=write" line only takes away the named
+// right in Perforce, but we would rather drop access that might be stale than
+// keep access that any grantable level has tried to revoke.
 func (p *Provider) canRevokeReadAccess(level string) bool {
 	_, canRevokeReadAccess := map[string]struct{}{
 		"list":   {},
 		"read":   {},
 		"=read":  {},
 		"open":   {},
+		"=open":  {},
 		"write":  {},
+		"=write": {},
 		"review": {},
 		"owner":  {},
 		"admin":  {},
@@ -173,6 +368,13 @@ func (p *Provider) canGrantReadAccess(level string) bool {
 	return canGrantReadAccess
 }
 
+// isExactLevel returns true if the given access level is the "=" exact form (e.g.
+// "=read"), which only applies to the exact depot path of the rule and does not
+// propagate to paths under it as a prefix.
+func isExactLevel(level string) bool {
+	return strings.HasPrefix(level, "=")
+}
+
 // FetchUserPerms returns a list of depot prefixes that the given user has
 // access to on the Perforce Server.
 func (p *Provider) FetchUserPerms(ctx context.Context, account *extsvc.Account) (*authz.ExternalUserPermissions, error) {
@@ -190,66 +392,40 @@ func (p *Provider) FetchUserPerms(ctx context.Context, account *extsvc.Account)
 		return nil, errors.New("no user found in the external account data")
 	}
 
-	// -u User : Displays protection lines that apply to the named user. This option
-	// requires super access.
-	rc, _, err := p.p4Execer.P4Exec(ctx, p.host, p.user, p.password, "protects", "-u", user.Username)
+	// -u User : Displays protection lines that apply to the named user, including
+	// the ones granted through groups of the user, in their original order. This
+	// option requires super access.
+	rc, _, err := p.p4Exec(ctx, "protects", "-u", user.Username)
 	if err != nil {
 		return nil, errors.Wrap(err, "list ACLs by user")
 	}
 	defer func() { _ = rc.Close() }()
 
-	const (
-		wildcardMatchAll       = "%"     // for Perforce '...'
-		wildcardMatchDirectory = "[^/]+" // for Perforce '*'
-	)
+	return p.scanUserPerms(rc)
+}
 
+// scanUserPerms parses the output of `p4 protects` into permissions of the user,
+// all protection lines in the output are expected to apply to the user.
+func (p *Provider) scanUserPerms(rc io.Reader) (*authz.ExternalUserPermissions, error) {
 	var includeContains, excludeContains []extsvc.RepoID
+	// Whether the corresponding entry in includeContains and excludeContains is
+	// granted or revoked by an exact level, thus should not be treated as a prefix.
+	var includeExact, excludeExact []bool
 	scanner := bufio.NewScanner(rc)
 	for scanner.Scan() {
-		line := scanner.Text()
-
-		// Skip comments
-		if strings.HasPrefix(line, "##") {
+		rule, ok := parseProtectsLine(scanner.Text())
+		if !ok {
 			continue
 		}
+		level := rule.level // e.g. read
+		// An exact level with a trailing '...' still explicitly matches everything
+		// under the path, so only the ones without it are not treated as prefixes.
+		exact := isExactLevel(level) && !strings.HasSuffix(rule.depot, "...")
 
-		// Trim comments
-		i := strings.Index(line, "##")
-		if i > -1 {
-			line = line[:i]
-		}
-
-		// e.g. read user alice * //Sourcegraph/...
-		fields := strings.Fields(line)
-		if len(fields) < 5 {
-			continue
-		}
-		level := fields[0]      // e.g. read
-		depotMatch := fields[4] // e.g. //Sourcegraph/*/dir/...
-
-		// NOTE: Manipulations made to `depotContains` will affect the behaviour of
-		// `(*RepoStore).ListRepoNames` - make sure to test new changes there as well.
-		depotContains := depotMatch
-
-		// '...' matches all files under the current working directory and all subdirectories.
-		// Matches anything, including slashes, and does so across subdirectories.
-		// Replace with '%' for PostgreSQL's LIKE and SIMILAR TO.
-		//
-		// At first, we drop trailing '...' so that we can check for prefixes (see below).
-		// We assume all paths are prefixes, so add 'wildcardMatchAll' to all contains
-		// later on.
-		depotContains = strings.TrimRight(depotContains, ".")
-		depotContains = strings.ReplaceAll(depotContains, "...", wildcardMatchAll)
-
-		// '*' matches all characters except slashes within one directory.
-		// Replace with character class that matches anything except another '/' supported
-		// by PostgreSQL's SIMILAR TO.
-		depotContains = strings.ReplaceAll(depotContains, "*", wildcardMatchDirectory)
+		depotContains := convertToPostgresMatch(rule.depot)
 
 		// Rule that starts with a "-" in depot prefix means exclusion (i.e. revoke access)
-		if strings.HasPrefix(depotContains, "-") {
-			depotContains = depotContains[1:]
-
+		if rule.exclude {
 			if !p.canRevokeReadAccess(level) {
 				continue
 			}
@@ -259,6 +435,7 @@ func (p *Provider) FetchUserPerms(ctx context.Context, account *extsvc.Account)
 				// Always include wildcard matches, because we don't know what they might
 				// be matching on.
 				excludeContains = append(excludeContains, extsvc.RepoID(depotContains))
+				excludeExact = append(excludeExact, exact)
 			} else {
 				// Otherwise, only include an exclude if a corresponding include exists.
 				for i, prefix := range includeContains {
@@ -270,10 +447,12 @@ func (p *Provider) FetchUserPerms(ctx context.Context, account *extsvc.Account)
 					// an exact match for an include prefix, we take it out.
 					if depotContains == string(prefix) {
 						includeContains = append(includeContains[:i], includeContains[i+1:]...)
+						includeExact = append(includeExact[:i], includeExact[i+1:]...)
 						break
 					}
 
 					excludeContains = append(excludeContains, extsvc.RepoID(depotContains))
+					excludeExact = append(excludeExact, exact)
 					break
 				}
 			}
@@ -284,15 +463,21 @@ func (p *Provider) FetchUserPerms(ctx context.Context, account *extsvc.Account)
 			}
 
 			includeContains = append(includeContains, extsvc.RepoID(depotContains))
+			includeExact = append(includeExact, exact)
 		}
 	}
 
-	// Treat all paths as prefixes.
+	// Treat all paths as prefixes, except the ones of exact levels which only match
+	// their explicit wildcards.
 	for i, include := range includeContains {
-		includeContains[i] = extsvc.RepoID(string(include) + wildcardMatchAll)
+		if !includeExact[i] {
+			includeContains[i] = extsvc.RepoID(string(include) + wildcardMatchAll)
+		}
 	}
 	for i, exclude := range excludeContains {
-		excludeContains[i] = extsvc.RepoID(string(exclude) + wildcardMatchAll)
+		if !excludeExact[i] {
+			excludeContains[i] = extsvc.RepoID(string(exclude) + wildcardMatchAll)
+		}
 	}
 
 	// As per interface definition for this method, implementation should return
@@ -303,20 +488,148 @@ func (p *Provider) FetchUserPerms(ctx context.Context, account *extsvc.Account)
 	}, errors.Wrap(scanner.Err(), "scanner.Err")
 }
 
-// FetchUserPermsByToken is currently only required for syncing permissions for
-// GitHub and GitLab on sourcegraph.com
+// Perforce wildcards are mapped to PostgreSQL's SIMILAR TO patterns as follows,
+// and every path is then treated as a prefix unless it is of an exact level:
+//
+//	//depot/...          => //depot/%
+//	//depot/*/src/...    => //depot/[^/]+/src/%
+//	//depot/.../src/...  => //depot/%/src/%
+//	//depot/dir*         => //depot/dir[^/]+%
+//	-//depot/secret/...  => //depot/secret/% (as an exclusion)
+const (
+	wildcardMatchAll       = "%"     // for Perforce '...'
+	wildcardMatchDirectory = "[^/]+" // for Perforce '*'
+)
+
+// convertToPostgresMatch converts the depot match of a Perforce protection line
+// (e.g. //Sourcegraph/*/dir/...) to a pattern supported by PostgreSQL's SIMILAR
+// TO. The trailing '...' is dropped so that the result can be checked for
+// prefixes, callers are responsible for appending 'wildcardMatchAll' to the ones
+// that should be treated as prefixes.
+//
+// NOTE: Manipulations made to the result will affect the behaviour of
+// `(*RepoStore).ListRepoNames` - make sure to test new changes there as well.
+func convertToPostgresMatch(depotMatch string) string {
+	// '...' matches all files under the current working directory and all subdirectories.
+	// Matches anything, including slashes, and does so across subdirectories.
+	// Replace with '%' for PostgreSQL's LIKE and SIMILAR TO.
+	//
+	// At first, we drop the trailing '...' so that we can check for prefixes. Only
+	// the wildcard itself is dropped, dots that precede it belong to the path
+	// (e.g. //depot/v1.0....).
+	match := strings.TrimSuffix(depotMatch, "...")
+	match = strings.ReplaceAll(match, "...", wildcardMatchAll)
+
+	// '*' matches all characters except slashes within one directory.
+	// Replace with character class that matches anything except another '/' supported
+	// by PostgreSQL's SIMILAR TO.
+	return strings.ReplaceAll(match, "*", wildcardMatchDirectory)
+}
+
+// DepotMatchDiagnosis is the result of diagnosing a depot match of a Perforce
+// protection line.
+type DepotMatchDiagnosis struct {
+	// Pattern is the PostgreSQL SIMILAR TO pattern the depot match is converted
+	// to when syncing user permissions, as a prefix.
+	Pattern string
+	// Exclude is true if the depot match revokes access (i.e. starts with "-").
+	Exclude bool
+	// RepoNames are names of private repositories of the code host that are
+	// currently matched by the pattern.
+	RepoNames []api.RepoName
+}
+
+// DiagnoseDepotMatch returns the pattern the given depot match is converted to
+// by FetchUserPerms, along with names of repositories it currently matches. It
+// is read-only and intended for verifying that depot paths line up with names of
+// imported repositories.
+func (p *Provider) DiagnoseDepotMatch(ctx context.Context, repos *database.RepoStore, depotMatch string) (*DepotMatchDiagnosis, error) {
+	diagnosis := &DepotMatchDiagnosis{
+		Exclude: strings.HasPrefix(depotMatch, "-"),
+	}
+	diagnosis.Pattern = convertToPostgresMatch(strings.TrimPrefix(depotMatch, "-")) + wildcardMatchAll
+
+	rs, err := repos.ListRepoNames(ctx, database.ReposListOptions{
+		ExternalRepoIncludeContains: []api.ExternalRepoSpec{
+			{
+				ID:          diagnosis.Pattern,
+				ServiceType: p.codeHost.ServiceType,
+				ServiceID:   p.codeHost.ServiceID,
+			},
+		},
+		OnlyPrivate: true,
+	})
+	if err != nil {
+		return nil, errors.Wrap(err, "list repositories by contains matching")
+	}
+
+	for _, r := range rs {
+		diagnosis.RepoNames = append(diagnosis.RepoNames, r.Name)
+	}
+	return diagnosis, nil
+}
+
+// FetchUserPermsByToken returns a list of depot prefixes that the user of the
+// given P4 ticket has access to on the Perforce Server. Because a ticket is only
+// valid for the user it was issued to, the token must be in the form of entries
+// in P4TICKETS without the host, i.e. "<username>:<ticket>". It returns an error
+// that errcode.IsUnauthorized recognizes when the ticket is invalid or expired.
 func (p *Provider) FetchUserPermsByToken(ctx context.Context, token string) (*authz.ExternalUserPermissions, error) {
-	return nil, errors.New("not implemented")
+	i := strings.LastIndex(token, ":")
+	if i <= 0 || i == len(token)-1 {
+		return nil, errors.New(`token is not in the form of "<username>:<ticket>"`)
+	}
+	username, ticket := token[:i], token[i+1:]
+
+	// Without "-u", the output only contains protection lines that apply to the
+	// authenticated user, including the ones granted through groups, and does
+	// not require super access.
+	rc, _, err := p.p4ExecAs(ctx, username, ticket, "protects")
+	if err != nil {
+		if isInvalidTicket(err) {
+			return nil, &unauthorizedError{err: err}
+		}
+		return nil, errors.Wrap(err, "list ACLs by ticket")
+	}
+	defer func() { _ = rc.Close() }()
+
+	return p.scanUserPerms(rc)
 }
 
+// isInvalidTicket returns true if the error is caused by the P4 ticket being
+// invalid or expired.
+func isInvalidTicket(err error) bool {
+	msg := err.Error()
+	return strings.Contains(msg, "Perforce password (P4PASSWD) invalid or unset.") ||
+		strings.Contains(msg, "Your session has expired, please login again.")
+}
+
+// unauthorizedError is returned when the P4 ticket is invalid or expired, it is
+// recognized by errcode.IsUnauthorized.
+type unauthorizedError struct {
+	err error
+}
+
+func (e *unauthorizedError) Error() string {
+	return "invalid or expired ticket: " + e.err.Error()
+}
+
+func (e *unauthorizedError) Unwrap() error { return e.err }
+
+func (e *unauthorizedError) Unauthorized() bool { return true }
+
 // getAllUserEmails returns a set of username <-> email pairs of all users in the Perforce server.
 func (p *Provider) getAllUserEmails(ctx context.Context) (map[string]string, error) {
-	if p.cachedAllUserEmails != nil {
-		return p.cachedAllUserEmails, nil
+	p.cacheMu.RLock()
+	cached := p.cachedAllUserEmails
+	fresh := p.clock().Sub(p.userEmailsFetchedAt) < p.userEmailsTTL
+	p.cacheMu.RUnlock()
+	if cached != nil && fresh {
+		return cached, nil
 	}
 
 	userEmails := make(map[string]string)
-	rc, _, err := p.p4Execer.P4Exec(ctx, p.host, p.user, p.password, "users")
+	rc, _, err := p.p4Exec(ctx, "users")
 	if err != nil {
 		return nil, errors.Wrap(err, "list users")
 	}
@@ -338,7 +651,10 @@ func (p *Provider) getAllUserEmails(ctx context.Context) (map[string]string, err
 		return nil, errors.Wrap(err, "scanner.Err")
 	}
 
+	p.cacheMu.Lock()
+	defer p.cacheMu.Unlock()
 	p.cachedAllUserEmails = userEmails
+	p.userEmailsFetchedAt = p.clock()
 	return p.cachedAllUserEmails, nil
 }
 
@@ -358,11 +674,14 @@ func (p *Provider) getAllUsers(ctx context.Context) ([]string, error) {
 
 // getGroupMembers returns all members of the given group in the Perforce server.
 func (p *Provider) getGroupMembers(ctx context.Context, group string) ([]string, error) {
-	if p.cachedGroupMembers[group] != nil {
-		return p.cachedGroupMembers[group], nil
+	p.cacheMu.RLock()
+	cached := p.cachedGroupMembers[group]
+	p.cacheMu.RUnlock()
+	if cached != nil {
+		return cached, nil
 	}
 
-	rc, _, err := p.p4Execer.P4Exec(ctx, p.host, p.user, p.password, "group", "-o", group)
+	rc, _, err := p.p4Exec(ctx, "group", "-o", group)
 	if err != nil {
 		return nil, errors.Wrap(err, "list group members")
 	}
@@ -396,7 +715,11 @@ func (p *Provider) getGroupMembers(ctx context.Context, group string) ([]string,
 	// Drain remaining body
 	_, _ = io.Copy(io.Discard, rc)
 
-	p.cachedGroupMembers[group] = members
+	p.cacheMu.Lock()
+	defer p.cacheMu.Unlock()
+	if p.cachedGroupMembers[group] == nil {
+		p.cachedGroupMembers[group] = members
+	}
 	return p.cachedGroupMembers[group], nil
 }
 
@@ -412,12 +735,10 @@ func (p *Provider) FetchRepoPerms(ctx context.Context, repo *extsvc.Repository)
 
 	// -a : Displays protection lines for all users. This option requires super
 	// access.
-	rc, _, err := p.p4Execer.P4Exec(ctx, p.host, p.user, p.password, "protects", "-a", repo.ID)
+	rc, _, err := p.p4Exec(ctx, "protects", "-a", repo.ID)
 	if err != nil {
 		return nil, errors.Wrap(err, "list ACLs by depot")
 	}
-	defer func() { _ = rc.Close() }()
-
 	users, err := p.scanAllUsers(ctx, rc)
 	if err != nil {
 		return nil, errors.Wrap(err, "scanning protects")
@@ -438,40 +759,258 @@ func (p *Provider) FetchRepoPerms(ctx context.Context, repo *extsvc.Repository)
 	return extIDs, nil
 }
 
-// scanAllUsers is intended to scan the output of `protects -a` and will
-// return a map of users
-func (p *Provider) scanAllUsers(ctx context.Context, rc io.ReadCloser) (map[string]struct{}, error) {
-	users := make(map[string]struct{})
+// UserGrant describes a user who has been granted read access to a depot, and
+// which protection line is responsible for the grant.
+type UserGrant struct {
+	// Username is the username on the Perforce Server.
+	Username string
+	// Email is the email of the user on the Perforce Server, it is empty if the
+	// user is not found in the output of `p4 users`.
+	Email string
+	// RuleIndex is the zero-based index of the protection line (excluding comments
+	// and blank lines) in the output of `p4 protects -a` that granted the access.
+	RuleIndex int
+}
+
+// ExplainRepoPerms returns the list of users that have access to the given
+// repository on the Perforce Server, along with the protection line that
+// granted each user access. It is read-only and intended for debugging.
+func (p *Provider) ExplainRepoPerms(ctx context.Context, repo *extsvc.Repository) ([]UserGrant, error) {
+	if repo == nil {
+		return nil, errors.New("no repository provided")
+	} else if !extsvc.IsHostOfRepo(p.codeHost, &repo.ExternalRepoSpec) {
+		return nil, errors.Errorf("not a code host of the repository: want %q but have %q",
+			repo.ServiceID, p.codeHost.ServiceID)
+	}
+
+	rc, _, err := p.p4Exec(ctx, "protects", "-a", repo.ID)
+	if err != nil {
+		return nil, errors.Wrap(err, "list ACLs by depot")
+	}
+	grants, err := p.scanAllUserGrants(ctx, rc)
+	if err != nil {
+		return nil, errors.Wrap(err, "scanning protects")
+	}
+
+	userEmails, err := p.getAllUserEmails(ctx)
+	if err != nil {
+		return nil, errors.Wrap(err, "get all user emails")
+	}
+
+	explained := make([]UserGrant, 0, len(grants))
+	for user, index := range grants {
+		explained = append(explained, UserGrant{
+			Username:  user,
+			Email:     userEmails[user],
+			RuleIndex: index,
+		})
+	}
+	sort.Slice(explained, func(i, j int) bool {
+		return explained[i].Username < explained[j].Username
+	})
+	return explained, nil
+}
+
+// ProtectsProblemKind is the kind of a problem found in the protections table.
+type ProtectsProblemKind string
+
+const (
+	// ProtectsProblemShadowed is a protection line whose effect on read access is
+	// fully overridden by a later line for the same user or group.
+	ProtectsProblemShadowed ProtectsProblemKind = "shadowed"
+	// ProtectsProblemContradictory is a protection line that grants read access
+	// to a depot path which a later line revokes for the same user or group.
+	ProtectsProblemContradictory ProtectsProblemKind = "contradictory"
+)
+
+// ProtectsProblem describes a redundant protection line in the output of
+// `p4 protects -a`.
+type ProtectsProblem struct {
+	Kind ProtectsProblemKind
+	// RuleIndex is the zero-based index of the problematic protection line
+	// (excluding comments and blank lines).
+	RuleIndex int
+	// Line is the problematic protection line.
+	Line string
+	// OverriddenBy is the zero-based index of the later protection line that
+	// overrides the problematic one.
+	OverriddenBy int
+}
+
+// protectsRule is a parsed protection line.
+type protectsRule struct {
+	line    string
+	level   string // e.g. read
+	typ     string // e.g. user
+	name    string // e.g. alice
+	host    string // e.g. *
+	depot   string // e.g. //Sourcegraph/..., without the leading "-"
+	exclude bool
+}
+
+// parseProtectsLine parses a line of the output of `p4 protects`, it returns
+// false if the line is blank, a comment, or not a protection line. Leading and
+// trailing whitespace (including tabs) and trailing comments are ignored, and the
+// line of the returned rule is normalized to have fields separated by a single
+// space.
+func parseProtectsLine(line string) (protectsRule, bool) {
+	// Trim comments, including the ones that take up the whole line
+	if i := strings.Index(line, "##"); i > -1 {
+		line = line[:i]
+	}
+
+	// e.g. write user alice * //Sourcegraph/...
+	fields := strings.Fields(line)
+	if len(fields) < 5 {
+		return protectsRule{}, false
+	}
+	return protectsRule{
+		line:    strings.Join(fields, " "),
+		level:   fields[0],
+		typ:     fields[1],
+		name:    fields[2],
+		host:    fields[3],
+		depot:   strings.TrimPrefix(fields[4], "-"),
+		exclude: strings.HasPrefix(fields[4], "-"),
+	}, true
+}
+
+// covers returns true if the depot path of the rule matches everything matched
+// by the depot path of the other rule. Only exact paths and trailing '...' are
+// understood, other wildcards have to match exactly.
+func (r protectsRule) covers(other protectsRule) bool {
+	if r.depot == other.depot {
+		return true
+	}
+	prefix := strings.TrimSuffix(r.depot, "...")
+	if prefix == r.depot || strings.Contains(prefix, "*") || strings.Contains(prefix, "...") {
+		return false
+	}
+	return strings.HasPrefix(other.depot, prefix)
+}
+
+// appliesToAll returns true if the rule applies to everyone the other rule
+// applies to.
+func (r protectsRule) appliesToAll(other protectsRule) bool {
+	if r.host != "*" && r.host != other.host {
+		return false
+	}
+	if r.typ == "user" && r.name == "*" {
+		return true
+	}
+	return r.typ == other.typ && r.name == other.name
+}
+
+// DiagnoseProtects returns protection lines of the Perforce Server that have no
+// effect on read access because they are overridden by later lines, which are
+// good candidates for cleaning up the protections table. It is read-only and
+// does not affect permissions.
+func (p *Provider) DiagnoseProtects(ctx context.Context) ([]ProtectsProblem, error) {
+	rc, _, err := p.p4Exec(ctx, "protects", "-a")
+	if err != nil {
+		return nil, errors.Wrap(err, "list ACLs")
+	}
+	defer func() { _ = rc.Close() }()
+
+	var rules []protectsRule
 	scanner := bufio.NewScanner(rc)
 	for scanner.Scan() {
-		line := scanner.Text()
+		rule, ok := parseProtectsLine(scanner.Text())
+		if !ok {
+			continue
+		}
+		rules = append(rules, rule)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, errors.Wrap(err, "scanner.Err")
+	}
 
-		// Skip comments
-		if strings.HasPrefix(line, "##") {
+	var problems []ProtectsProblem
+	for i, rule := range rules {
+		if rule.exclude && !p.canRevokeReadAccess(rule.level) ||
+			!rule.exclude && !p.canGrantReadAccess(rule.level) {
 			continue
 		}
 
-		// Trim trailing comments
-		i := strings.Index(line, "##")
-		if i > -1 {
-			line = line[:i]
+		for j := i + 1; j < len(rules); j++ {
+			later := rules[j]
+			if !later.appliesToAll(rule) || !later.covers(rule) {
+				continue
+			}
+
+			var kind ProtectsProblemKind
+			switch {
+			case !rule.exclude && later.exclude && p.canRevokeReadAccess(later.level):
+				kind = ProtectsProblemShadowed
+				if later.depot == rule.depot {
+					kind = ProtectsProblemContradictory
+				}
+			case rule.exclude && !later.exclude && p.canGrantReadAccess(later.level):
+				kind = ProtectsProblemShadowed
+			case !rule.exclude && !later.exclude && later.level == rule.level:
+				kind = ProtectsProblemShadowed
+			default:
+				continue
+			}
+
+			problems = append(problems, ProtectsProblem{
+				Kind:         kind,
+				RuleIndex:    i,
+				Line:         rule.line,
+				OverriddenBy: j,
+			})
+			break
 		}
+	}
+	return problems, nil
+}
+
+// scanAllUsers is intended to scan the output of `protects -a` and will
+// return a map of users, the output is closed once it has been read.
+func (p *Provider) scanAllUsers(ctx context.Context, rc io.ReadCloser) (map[string]struct{}, error) {
+	grants, err := p.scanAllUserGrants(ctx, rc)
+	if err != nil {
+		return nil, err
+	}
 
-		// Trim whitespace
-		line = strings.TrimSpace(line)
+	users := make(map[string]struct{}, len(grants))
+	for user := range grants {
+		users[user] = struct{}{}
+	}
+	return users, nil
+}
 
-		// e.g. write user alice * //Sourcegraph/...
-		fields := strings.Fields(line)
-		if len(fields) < 5 {
+// scanAllUserGrants scans the output of `protects -a` and returns a map of
+// users to the index of the protection line that granted them access. The
+// output is closed before members of groups and all users are listed, so that
+// the command does not hold on to a slot of the limitedP4Execer while other
+// commands are run.
+func (p *Provider) scanAllUserGrants(ctx context.Context, rc io.ReadCloser) (map[string]int, error) {
+	var rules []protectsRule
+	scanner := bufio.NewScanner(rc)
+	for scanner.Scan() {
+		rule, ok := parseProtectsLine(scanner.Text())
+		if !ok {
 			continue
 		}
-		level := fields[0]                              // e.g. read
-		typ := fields[1]                                // e.g. user
-		name := fields[2]                               // e.g. alice
-		depotMatch := strings.TrimRight(fields[4], ".") // e.g. //Sourcegraph/
+		rules = append(rules, rule)
+	}
+	err := scanner.Err()
+	if closeErr := rc.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, "scanner.Err")
+	}
+
+	users := make(map[string]int)
+	for ruleIndex, rule := range rules {
+		level := rule.level // e.g. read
+		typ := rule.typ     // e.g. user
+		name := rule.name   // e.g. alice
 
 		// Rule that starts with a "-" in depot match means exclusion (i.e. revoke access)
-		if strings.HasPrefix(depotMatch, "-") {
+		if rule.exclude {
 			if !p.canRevokeReadAccess(level) {
 				continue
 			}
@@ -479,7 +1018,7 @@ func (p *Provider) scanAllUsers(ctx context.Context, rc io.ReadCloser) (map[stri
 			switch typ {
 			case "user":
 				if name == "*" {
-					users = make(map[string]struct{})
+					users = make(map[string]int)
 				} else {
 					delete(users, name)
 				}
@@ -508,10 +1047,10 @@ func (p *Provider) scanAllUsers(ctx context.Context, rc io.ReadCloser) (map[stri
 						return nil, errors.Wrap(err, "list all users")
 					}
 					for _, user := range all {
-						users[user] = struct{}{}
+						users[user] = ruleIndex
 					}
 				} else {
-					users[name] = struct{}{}
+					users[name] = ruleIndex
 				}
 			case "group":
 				members, err := p.getGroupMembers(ctx, name)
@@ -519,19 +1058,14 @@ func (p *Provider) scanAllUsers(ctx context.Context, rc io.ReadCloser) (map[stri
 					return nil, errors.Wrapf(err, "list members of group %q", name)
 				}
 				for _, member := range members {
-					users[member] = struct{}{}
+					users[member] = ruleIndex
 				}
 
 			default:
 				log15.Warn("authz.perforce.Provider.FetchRepoPerms.unrecognizedType", "type", typ)
 			}
 		}
-
 	}
-	if err := scanner.Err(); err != nil {
-		return nil, errors.Wrap(err, "scanner.Err")
-	}
-
 	return users, nil
 }
 
@@ -549,7 +1083,7 @@ func (p *Provider) URN() string {
 
 func (p *Provider) Validate() (problems []string) {
 	// Validate the user has "super" access with "-u" option, see https://www.perforce.com/perforce/r12.1/manuals/cmdref/protects.html
-	rc, _, err := p.p4Execer.P4Exec(context.Background(), p.host, p.user, p.password, "protects", "-u", p.user)
+	rc, _, err := p.p4Exec(context.Background(), "protects", "-u", p.user)
 	if err == nil {
 		_ = rc.Close()
 		return nil
@@ -8,19 +8,80 @@ import (
 	"io"
 	"net/http"
 	"os"
+	"sort"
 	"strings"
+	"sync"
 	"testing"
+	"time"
 
+	"github.com/cockroachdb/errors"
 	"github.com/google/go-cmp/cmp"
 	jsoniter "github.com/json-iterator/go"
 
 	"github.com/sourcegraph/sourcegraph/internal/api"
 	"github.com/sourcegraph/sourcegraph/internal/authz"
+	"github.com/sourcegraph/sourcegraph/internal/database"
+	"github.com/sourcegraph/sourcegraph/internal/database/dbtesting"
+	"github.com/sourcegraph/sourcegraph/internal/errcode"
 	"github.com/sourcegraph/sourcegraph/internal/extsvc"
 	"github.com/sourcegraph/sourcegraph/internal/extsvc/perforce"
 	"github.com/sourcegraph/sourcegraph/internal/types"
 )
 
+func TestNewProvider(t *testing.T) {
+	tests := []struct {
+		name     string
+		host     string
+		user     string
+		password string
+		wantErr  string
+	}{
+		{
+			name:     "valid",
+			host:     "ssl:111.222.333.444:1666",
+			user:     "admin",
+			password: "password",
+		},
+		{
+			name:     "empty host",
+			user:     "admin",
+			password: "password",
+			wantErr:  "host must not be empty",
+		},
+		{
+			name:     "malformed host",
+			host:     "ssl:111.222.333.444:1666\n",
+			user:     "admin",
+			password: "password",
+			wantErr:  `parse host "ssl:111.222.333.444:1666\n": parse "ssl:111.222.333.444:1666\n": net/url: invalid control character in URL`,
+		},
+		{
+			name:     "empty user",
+			host:     "ssl:111.222.333.444:1666",
+			password: "password",
+			wantErr:  "user must not be empty",
+		},
+		{
+			name:    "empty password",
+			host:    "ssl:111.222.333.444:1666",
+			user:    "admin",
+			wantErr: "password must not be empty",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, err := NewProvider("", test.host, test.user, test.password, 0, 0)
+			got := ""
+			if err != nil {
+				got = err.Error()
+			}
+			if got != test.wantErr {
+				t.Fatalf("err: want %q but got %q", test.wantErr, got)
+			}
+		})
+	}
+}
+
 func TestProvider_FetchAccount(t *testing.T) {
 	ctx := context.Background()
 	user := &types.User{
@@ -86,7 +147,7 @@ func TestProvider_FetchUserPerms(t *testing.T) {
 	ctx := context.Background()
 
 	t.Run("nil account", func(t *testing.T) {
-		p := NewProvider("", "ssl:111.222.333.444:1666", "admin", "password")
+		p := NewTestProvider("", "ssl:111.222.333.444:1666", "admin", "password", nil)
 		_, err := p.FetchUserPerms(ctx, nil)
 		want := "no account provided"
 		got := fmt.Sprintf("%v", err)
@@ -96,7 +157,7 @@ func TestProvider_FetchUserPerms(t *testing.T) {
 	})
 
 	t.Run("not the code host of the account", func(t *testing.T) {
-		p := NewProvider("", "ssl:111.222.333.444:1666", "admin", "password")
+		p := NewTestProvider("", "ssl:111.222.333.444:1666", "admin", "password", nil)
 		_, err := p.FetchUserPerms(context.Background(),
 			&extsvc.Account{
 				AccountSpec: extsvc.AccountSpec{
@@ -113,7 +174,7 @@ func TestProvider_FetchUserPerms(t *testing.T) {
 	})
 
 	t.Run("no user found in account data", func(t *testing.T) {
-		p := NewProvider("", "ssl:111.222.333.444:1666", "admin", "password")
+		p := NewTestProvider("", "ssl:111.222.333.444:1666", "admin", "password", nil)
 		_, err := p.FetchUserPerms(ctx,
 			&extsvc.Account{
 				AccountSpec: extsvc.AccountSpec{
@@ -219,6 +280,44 @@ open user alice * -//Sourcegraph/*/Handbook/...                      ## sub-matc
 				},
 			},
 		},
+		{
+			name: "read vs =read",
+			response: `
+read user alice * //Sourcegraph/Engineering/
+=read user alice * //Sourcegraph/Handbook/
+=open user alice * //Sourcegraph/Security/
+=write user alice * //Sourcegraph/*/Frontend/
+=read user alice * //Sourcegraph/Marketing/...
+`,
+			wantPerms: &authz.ExternalUserPermissions{
+				IncludeContains: []extsvc.RepoID{
+					"//Sourcegraph/Engineering/%",
+					"//Sourcegraph/Handbook/",
+					"//Sourcegraph/Security/",
+					"//Sourcegraph/[^/]+/Frontend/",
+					"//Sourcegraph/Marketing/%",
+				},
+			},
+		},
+		{
+			name: "exclude with =read",
+			response: `
+read user alice * //Sourcegraph/...
+=read user alice * -//Sourcegraph/Security/
+read user alice * -//Sourcegraph/Handbook/
+=read user alice * -//Sourcegraph/*/Credentials/
+`,
+			wantPerms: &authz.ExternalUserPermissions{
+				IncludeContains: []extsvc.RepoID{
+					"//Sourcegraph/%",
+				},
+				ExcludeContains: []extsvc.RepoID{
+					"//Sourcegraph/Security/",
+					"//Sourcegraph/Handbook/%",
+					"//Sourcegraph/[^/]+/Credentials/",
+				},
+			},
+		},
 	}
 	for _, test := range tests {
 		t.Run(test.name, func(t *testing.T) {
@@ -247,13 +346,311 @@ open user alice * -//Sourcegraph/*/Handbook/...                      ## sub-matc
 			}
 		})
 	}
+
+	t.Run("granted through groups", func(t *testing.T) {
+		var calls [][]string
+		execer := p4ExecFunc(func(ctx context.Context, host, user, password string, args ...string) (io.ReadCloser, http.Header, error) {
+			calls = append(calls, args)
+			// The Perforce Server resolves the groups of the user, and only outputs
+			// the protection lines that apply to the user.
+			return io.NopCloser(strings.NewReader(`
+read group All-Staff * //Sourcegraph/Handbook/...
+read group Engineering * //Sourcegraph/Engineering/...
+read user * * //Sourcegraph/Public/...
+read user alice * //Sourcegraph/Design/...
+read group Engineering * -//Sourcegraph/Engineering/Credentials/... ## sub-match of a group include
+read group All-Staff * -//Sourcegraph/Handbook/...                   ## exact match of a group include
+read group Engineering * //Sourcegraph/Handbook/...                  ## later line wins
+`)), nil, nil
+		})
+
+		p := NewTestProvider("", "ssl:111.222.333.444:1666", "admin", "password", execer)
+		account := &extsvc.Account{
+			AccountSpec: extsvc.AccountSpec{
+				ServiceType: extsvc.TypePerforce,
+				ServiceID:   "ssl:111.222.333.444:1666",
+			},
+			AccountData: extsvc.AccountData{
+				Data: (*json.RawMessage)(&accountData),
+			},
+		}
+		got, err := p.FetchUserPerms(ctx, account)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		want := &authz.ExternalUserPermissions{
+			IncludeContains: []extsvc.RepoID{
+				"//Sourcegraph/Engineering/%",
+				"//Sourcegraph/Public/%",
+				"//Sourcegraph/Design/%",
+				"//Sourcegraph/Handbook/%",
+			},
+			ExcludeContains: []extsvc.RepoID{
+				"//Sourcegraph/Engineering/Credentials/%",
+			},
+		}
+		if diff := cmp.Diff(want, got); diff != "" {
+			t.Fatalf("Mismatch (-want +got):\n%s", diff)
+		}
+
+		// Only the protection lines of the user are listed, never the whole table.
+		wantCalls := [][]string{{"protects", "-u", "alice"}}
+		if diff := cmp.Diff(wantCalls, calls); diff != "" {
+			t.Fatalf("calls mismatch (-want +got):\n%s", diff)
+		}
+	})
+}
+
+func TestProvider_FetchUserPerms_wildcards(t *testing.T) {
+	accountData, err := jsoniter.Marshal(
+		perforce.AccountData{
+			Username: "alice",
+			Email:    "alice@example.com",
+		},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name      string
+		response  string
+		wantPerms *authz.ExternalUserPermissions
+	}{
+		{
+			name:     "trailing '...'",
+			response: "read user alice * //depot/...",
+			wantPerms: &authz.ExternalUserPermissions{
+				IncludeContains: []extsvc.RepoID{"//depot/%"},
+			},
+		},
+		{
+			name:     "'*' before a literal directory",
+			response: "read user alice * //depot/*/src/...",
+			wantPerms: &authz.ExternalUserPermissions{
+				IncludeContains: []extsvc.RepoID{"//depot/[^/]+/src/%"},
+			},
+		},
+		{
+			name:     "'...' before a literal directory",
+			response: "read user alice * //depot/.../src/...",
+			wantPerms: &authz.ExternalUserPermissions{
+				IncludeContains: []extsvc.RepoID{"//depot/%/src/%"},
+			},
+		},
+		{
+			name:     "partial '*'",
+			response: "read user alice * //depot/dir*",
+			wantPerms: &authz.ExternalUserPermissions{
+				IncludeContains: []extsvc.RepoID{"//depot/dir[^/]+%"},
+			},
+		},
+		{
+			name:     "dots preceding trailing '...'",
+			response: "read user alice * //depot/v1.0....",
+			wantPerms: &authz.ExternalUserPermissions{
+				IncludeContains: []extsvc.RepoID{"//depot/v1.0.%"},
+			},
+		},
+		{
+			name: "exclusion of a sub-path",
+			response: `
+read user alice * //depot/...
+read user alice * -//depot/secret/...
+`,
+			wantPerms: &authz.ExternalUserPermissions{
+				IncludeContains: []extsvc.RepoID{"//depot/%"},
+				ExcludeContains: []extsvc.RepoID{"//depot/secret/%"},
+			},
+		},
+		{
+			name: "exclusion of the whole include",
+			response: `
+read user alice * //depot/...
+read user alice * -//depot/...
+`,
+			wantPerms: &authz.ExternalUserPermissions{
+				IncludeContains: []extsvc.RepoID{},
+			},
+		},
+		{
+			name: "exclusion with wildcards",
+			response: `
+read user alice * //depot/*/src/...
+read user alice * -//depot/*/src/.../internal/...
+`,
+			wantPerms: &authz.ExternalUserPermissions{
+				IncludeContains: []extsvc.RepoID{"//depot/[^/]+/src/%"},
+				ExcludeContains: []extsvc.RepoID{"//depot/[^/]+/src/%/internal/%"},
+			},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			execer := p4ExecFunc(func(ctx context.Context, host, user, password string, args ...string) (io.ReadCloser, http.Header, error) {
+				return io.NopCloser(strings.NewReader(test.response)), nil, nil
+			})
+
+			p := NewTestProvider("", "ssl:111.222.333.444:1666", "admin", "password", execer)
+			got, err := p.FetchUserPerms(context.Background(),
+				&extsvc.Account{
+					AccountSpec: extsvc.AccountSpec{
+						ServiceType: extsvc.TypePerforce,
+						ServiceID:   "ssl:111.222.333.444:1666",
+					},
+					AccountData: extsvc.AccountData{
+						Data: (*json.RawMessage)(&accountData),
+					},
+				},
+			)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if diff := cmp.Diff(test.wantPerms, got); diff != "" {
+				t.Fatalf("Mismatch (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestProvider_FetchUserPermsByToken(t *testing.T) {
+	ctx := context.Background()
+
+	t.Run("malformed token", func(t *testing.T) {
+		p := NewTestProvider("", "ssl:111.222.333.444:1666", "admin", "password", nil)
+		_, err := p.FetchUserPermsByToken(ctx, "ABCDEF0123456789")
+		want := `token is not in the form of "<username>:<ticket>"`
+		got := fmt.Sprintf("%v", err)
+		if got != want {
+			t.Fatalf("err: want %q but got %q", want, got)
+		}
+	})
+
+	t.Run("valid ticket", func(t *testing.T) {
+		execer := p4ExecFunc(func(ctx context.Context, host, user, password string, args ...string) (io.ReadCloser, http.Header, error) {
+			if user != "alice" || password != "ABCDEF0123456789" {
+				return nil, nil, errors.Errorf("unexpected credentials: %s:%s", user, password)
+			}
+			if diff := cmp.Diff([]string{"protects"}, args); diff != "" {
+				return nil, nil, errors.Errorf("unexpected args: %s", diff)
+			}
+			return io.NopCloser(strings.NewReader(`
+read user alice * //Sourcegraph/...
+read group Backend * -//Sourcegraph/Security/...
+`)), nil, nil
+		})
+
+		p := NewTestProvider("", "ssl:111.222.333.444:1666", "admin", "password", execer)
+		got, err := p.FetchUserPermsByToken(ctx, "alice:ABCDEF0123456789")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		want := &authz.ExternalUserPermissions{
+			IncludeContains: []extsvc.RepoID{"//Sourcegraph/%"},
+			ExcludeContains: []extsvc.RepoID{"//Sourcegraph/Security/%"},
+		}
+		if diff := cmp.Diff(want, got); diff != "" {
+			t.Fatalf("Mismatch (-want +got):\n%s", diff)
+		}
+	})
+
+	for _, output := range []string{
+		"Perforce password (P4PASSWD) invalid or unset.",
+		"Your session has expired, please login again.",
+	} {
+		t.Run("invalid ticket: "+output, func(t *testing.T) {
+			execer := p4ExecFunc(func(ctx context.Context, host, user, password string, args ...string) (io.ReadCloser, http.Header, error) {
+				return nil, nil, errors.Errorf("unexpected status code: 400 - %s", output)
+			})
+
+			p := NewTestProvider("", "ssl:111.222.333.444:1666", "admin", "password", execer)
+			_, err := p.FetchUserPermsByToken(ctx, "alice:ABCDEF0123456789")
+			if !errcode.IsUnauthorized(err) {
+				t.Fatalf("err: want an unauthorized error but got %v", err)
+			}
+		})
+	}
+
+	t.Run("other errors", func(t *testing.T) {
+		execer := p4ExecFunc(func(ctx context.Context, host, user, password string, args ...string) (io.ReadCloser, http.Header, error) {
+			return nil, nil, errors.New("connection refused")
+		})
+
+		p := NewTestProvider("", "ssl:111.222.333.444:1666", "admin", "password", execer)
+		_, err := p.FetchUserPermsByToken(ctx, "alice:ABCDEF0123456789")
+		if err == nil || errcode.IsUnauthorized(err) {
+			t.Fatalf("err: want a non-unauthorized error but got %v", err)
+		}
+	})
+}
+
+func TestProvider_exactLevels(t *testing.T) {
+	accountData, err := jsoniter.Marshal(
+		perforce.AccountData{
+			Username: "alice",
+			Email:    "alice@example.com",
+		},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, level := range []string{"=open", "=write"} {
+		t.Run(level, func(t *testing.T) {
+			execer := p4ExecFunc(func(ctx context.Context, host, user, password string, args ...string) (io.ReadCloser, http.Header, error) {
+				return io.NopCloser(strings.NewReader(fmt.Sprintf(`
+%[1]s user alice * //Sourcegraph/...
+%[1]s user alice * -//Sourcegraph/Security/...
+`, level))), nil, nil
+			})
+
+			p := NewTestProvider("", "ssl:111.222.333.444:1666", "admin", "password", execer)
+			got, err := p.FetchUserPerms(context.Background(),
+				&extsvc.Account{
+					AccountSpec: extsvc.AccountSpec{
+						ServiceType: extsvc.TypePerforce,
+						ServiceID:   "ssl:111.222.333.444:1666",
+					},
+					AccountData: extsvc.AccountData{
+						Data: (*json.RawMessage)(&accountData),
+					},
+				},
+			)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			want := &authz.ExternalUserPermissions{
+				IncludeContains: []extsvc.RepoID{"//Sourcegraph/%"},
+				ExcludeContains: []extsvc.RepoID{"//Sourcegraph/Security/%"},
+			}
+			if diff := cmp.Diff(want, got); diff != "" {
+				t.Fatalf("Mismatch (-want +got):\n%s", diff)
+			}
+		})
+	}
+
+	t.Run("every grantable level is revocable", func(t *testing.T) {
+		p := NewTestProvider("", "ssl:111.222.333.444:1666", "admin", "password", nil)
+		for _, level := range []string{
+			"list", "read", "=read", "open", "=open", "write", "=write",
+			"=branch", "review", "owner", "admin", "super",
+		} {
+			if p.canGrantReadAccess(level) && !p.canRevokeReadAccess(level) {
+				t.Errorf("%q: can grant but cannot revoke read access", level)
+			}
+		}
+	})
 }
 
 func TestProvider_FetchRepoPerms(t *testing.T) {
 	ctx := context.Background()
 
 	t.Run("nil repository", func(t *testing.T) {
-		p := NewProvider("", "ssl:111.222.333.444:1666", "admin", "password")
+		p := NewTestProvider("", "ssl:111.222.333.444:1666", "admin", "password", nil)
 		_, err := p.FetchRepoPerms(ctx, nil)
 		want := "no repository provided"
 		got := fmt.Sprintf("%v", err)
@@ -263,7 +660,7 @@ func TestProvider_FetchRepoPerms(t *testing.T) {
 	})
 
 	t.Run("not the code host of the repository", func(t *testing.T) {
-		p := NewProvider("", "ssl:111.222.333.444:1666", "admin", "password")
+		p := NewTestProvider("", "ssl:111.222.333.444:1666", "admin", "password", nil)
 		_, err := p.FetchRepoPerms(ctx,
 			&extsvc.Repository{
 				URI: "gitlab.com/user/repo",
@@ -346,39 +743,287 @@ Users:
 	}
 }
 
-func TestScanAllUsers(t *testing.T) {
-	ctx := context.Background()
-	f, err := os.Open("testdata/sample-protects.txt")
-	if err != nil {
-		t.Fatal(err)
-	}
-
-	data, err := io.ReadAll(f)
-	if err != nil {
-		t.Fatal(err)
-	}
-	if err := f.Close(); err != nil {
-		t.Fatal(err)
-	}
-
-	rc := io.NopCloser(bytes.NewReader(data))
-
+func TestProvider_FetchRepoPerms_resets(t *testing.T) {
 	execer := p4ExecFunc(func(ctx context.Context, host, user, password string, args ...string) (io.ReadCloser, http.Header, error) {
-		return rc, nil, nil
-	})
-
-	p := NewTestProvider("", "ssl:111.222.333.444:1666", "admin", "password", execer)
-	p.cachedGroupMembers = map[string][]string{
-		"dev": {"user1", "user2"},
-	}
-	p.cachedAllUserEmails = map[string]string{
-		"user1": "user1@example.com",
-		"user2": "user2@example.com",
-	}
-
-	users, err := p.scanAllUsers(ctx, rc)
-	if err != nil {
-		t.Fatal(err)
+		var data string
+		switch args[0] {
+		case "protects":
+			data = `
+read user alice * //Sourcegraph/...
+read user bob * //Sourcegraph/...
+read user * * -//Sourcegraph/...    ## resets everyone granted so far
+read user cindy * //Sourcegraph/...
+read group Backend * //Sourcegraph/...
+read user david * -//Sourcegraph/... ## later rule wins over the group
+`
+		case "users":
+			data = `
+alice <alice@example.com> (Alice) accessed 2020/12/04
+bob <bob@example.com> (Bob) accessed 2020/12/04
+cindy <cindy@example.com> (Cindy) accessed 2020/12/04
+david <david@example.com> (David) accessed 2020/12/04
+frank <frank@example.com> (Frank) accessed 2020/12/04
+`
+		case "group":
+			data = `
+Users:
+	david
+	frank
+`
+		}
+		return io.NopCloser(strings.NewReader(data)), nil, nil
+	})
+
+	p := NewTestProvider("", "ssl:111.222.333.444:1666", "admin", "password", execer)
+	got, err := p.FetchRepoPerms(context.Background(),
+		&extsvc.Repository{
+			URI: "gitlab.com/user/repo",
+			ExternalRepoSpec: api.ExternalRepoSpec{
+				ServiceType: extsvc.TypePerforce,
+				ServiceID:   "ssl:111.222.333.444:1666",
+			},
+		},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := []extsvc.AccountID{"cindy@example.com", "frank@example.com"}
+	sort.Slice(got, func(i, j int) bool { return got[i] < got[j] })
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Fatalf("Mismatch (-want +got):\n%s", diff)
+	}
+}
+
+func TestProvider_ExplainRepoPerms(t *testing.T) {
+	ctx := context.Background()
+
+	execer := p4ExecFunc(func(ctx context.Context, host, user, password string, args ...string) (io.ReadCloser, http.Header, error) {
+		var data string
+
+		switch args[0] {
+
+		case "protects":
+			data = `
+## Comments and blank lines are not counted as rules
+write user alice * //Sourcegraph/...
+read group Backend * //Sourcegraph/...    ## includes "bob" and "cindy"
+
+read user cindy * -//Sourcegraph/...
+`
+		case "users":
+			data = `
+alice <alice@example.com> (Alice) accessed 2020/12/04
+bob <bob@example.com> (Bob) accessed 2020/12/04
+cindy <cindy@example.com> (Cindy) accessed 2020/12/04
+`
+		case "group":
+			data = `
+Users:
+	bob
+	cindy
+`
+		}
+
+		return io.NopCloser(strings.NewReader(data)), nil, nil
+	})
+
+	p := NewTestProvider("", "ssl:111.222.333.444:1666", "admin", "password", execer)
+	got, err := p.ExplainRepoPerms(ctx,
+		&extsvc.Repository{
+			URI: "gitlab.com/user/repo",
+			ExternalRepoSpec: api.ExternalRepoSpec{
+				ServiceType: extsvc.TypePerforce,
+				ServiceID:   "ssl:111.222.333.444:1666",
+			},
+		},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := []UserGrant{
+		{Username: "alice", Email: "alice@example.com", RuleIndex: 0},
+		{Username: "bob", Email: "bob@example.com", RuleIndex: 1},
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Fatalf("Mismatch (-want +got):\n%s", diff)
+	}
+}
+
+func TestProvider_DiagnoseProtects(t *testing.T) {
+	execer := p4ExecFunc(func(ctx context.Context, host, user, password string, args ...string) (io.ReadCloser, http.Header, error) {
+		data := `
+## Comments and blank lines are not counted as rules
+read user alice * //Sourcegraph/Engineering/...
+read user alice * //Sourcegraph/...
+write group Backend * //Sourcegraph/Backend/...
+
+read user alice * -//Sourcegraph/Security/...
+read group Backend * -//Sourcegraph/Backend/...   ## revokes what was granted above
+read user bob * //Sourcegraph/Docs/...
+list user * * -//Sourcegraph/Secret/...
+`
+		return io.NopCloser(strings.NewReader(data)), nil, nil
+	})
+
+	p := NewTestProvider("", "ssl:111.222.333.444:1666", "admin", "password", execer)
+	got, err := p.DiagnoseProtects(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := []ProtectsProblem{
+		{
+			Kind:         ProtectsProblemShadowed,
+			RuleIndex:    0,
+			Line:         "read user alice * //Sourcegraph/Engineering/...",
+			OverriddenBy: 1,
+		},
+		{
+			Kind:         ProtectsProblemContradictory,
+			RuleIndex:    2,
+			Line:         "write group Backend * //Sourcegraph/Backend/...",
+			OverriddenBy: 4,
+		},
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Fatalf("Mismatch (-want +got):\n%s", diff)
+	}
+}
+
+func TestProvider_DiagnoseDepotMatch(t *testing.T) {
+	ctx := context.Background()
+
+	accountData, err := jsoniter.Marshal(perforce.AccountData{Username: "alice"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	account := &extsvc.Account{
+		AccountSpec: extsvc.AccountSpec{
+			ServiceType: extsvc.TypePerforce,
+			ServiceID:   "ssl:111.222.333.444:1666",
+		},
+		AccountData: extsvc.AccountData{
+			Data: (*json.RawMessage)(&accountData),
+		},
+	}
+
+	var gotOpt database.ReposListOptions
+	database.Mocks.Repos.ListRepoNames = func(_ context.Context, opt database.ReposListOptions) ([]types.RepoName, error) {
+		gotOpt = opt
+		return []types.RepoName{{ID: 1, Name: "perforce/Sourcegraph/Handbook"}}, nil
+	}
+	defer func() { database.Mocks.Repos = database.MockRepos{} }()
+
+	tests := []struct {
+		depotMatch string
+		// The protects line to make FetchUserPerms convert the depot match.
+		protects    string
+		wantExclude bool
+	}{
+		{
+			depotMatch: "//Sourcegraph/Engineering/...",
+			protects:   "read user alice * //Sourcegraph/Engineering/...",
+		},
+		{
+			depotMatch: "//Sourcegraph/Engineering/",
+			protects:   "read user alice * //Sourcegraph/Engineering/",
+		},
+		{
+			depotMatch: "//Sourcegraph/*/Handbook/...",
+			protects:   "read user alice * //Sourcegraph/*/Handbook/...",
+		},
+		{
+			depotMatch: "//Sourcegraph/.../Handbook/...",
+			protects:   "read user alice * //Sourcegraph/.../Handbook/...",
+		},
+		{
+			depotMatch:  "-//Sourcegraph/*/Credentials/...",
+			protects:    "read user alice * -//Sourcegraph/*/Credentials/...",
+			wantExclude: true,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.depotMatch, func(t *testing.T) {
+			execer := p4ExecFunc(func(ctx context.Context, host, user, password string, args ...string) (io.ReadCloser, http.Header, error) {
+				return io.NopCloser(strings.NewReader(test.protects)), nil, nil
+			})
+			p := NewTestProvider("", "ssl:111.222.333.444:1666", "admin", "password", execer)
+
+			perms, err := p.FetchUserPerms(ctx, account)
+			if err != nil {
+				t.Fatal(err)
+			}
+			contains := perms.IncludeContains
+			if test.wantExclude {
+				contains = perms.ExcludeContains
+			}
+			if len(contains) != 1 {
+				t.Fatalf("want 1 converted depot match but got %v", contains)
+			}
+
+			got, err := p.DiagnoseDepotMatch(ctx, database.Repos(&dbtesting.MockDB{}), test.depotMatch)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			want := &DepotMatchDiagnosis{
+				Pattern:   string(contains[0]),
+				Exclude:   test.wantExclude,
+				RepoNames: []api.RepoName{"perforce/Sourcegraph/Handbook"},
+			}
+			if diff := cmp.Diff(want, got); diff != "" {
+				t.Fatalf("Mismatch (-want +got):\n%s", diff)
+			}
+
+			wantSpecs := []api.ExternalRepoSpec{
+				{
+					ID:          want.Pattern,
+					ServiceType: extsvc.TypePerforce,
+					ServiceID:   "ssl:111.222.333.444:1666",
+				},
+			}
+			if diff := cmp.Diff(wantSpecs, gotOpt.ExternalRepoIncludeContains); diff != "" {
+				t.Fatalf("ExternalRepoIncludeContains mismatch (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestScanAllUsers(t *testing.T) {
+	ctx := context.Background()
+	f, err := os.Open("testdata/sample-protects.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := io.ReadAll(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	rc := io.NopCloser(bytes.NewReader(data))
+
+	execer := p4ExecFunc(func(ctx context.Context, host, user, password string, args ...string) (io.ReadCloser, http.Header, error) {
+		return rc, nil, nil
+	})
+
+	p := NewTestProvider("", "ssl:111.222.333.444:1666", "admin", "password", execer)
+	p.cachedGroupMembers = map[string][]string{
+		"dev": {"user1", "user2"},
+	}
+	p.cachedAllUserEmails = map[string]string{
+		"user1": "user1@example.com",
+		"user2": "user2@example.com",
+	}
+
+	users, err := p.scanAllUsers(ctx, rc)
+	if err != nil {
+		t.Fatal(err)
 	}
 	want := map[string]struct{}{
 		"user1": {},
@@ -390,7 +1035,10 @@ func TestScanAllUsers(t *testing.T) {
 }
 
 func NewTestProvider(urn, host, user, password string, execer p4Execer) *Provider {
-	p := NewProvider(urn, host, user, password)
+	p, err := NewProvider(urn, host, user, password, 0, 0)
+	if err != nil {
+		panic(err)
+	}
 	p.p4Execer = execer
 	return p
 }
@@ -400,3 +1048,463 @@ type p4ExecFunc func(ctx context.Context, host, user, password string, args ...s
 func (p p4ExecFunc) P4Exec(ctx context.Context, host, user, password string, args ...string) (io.ReadCloser, http.Header, error) {
 	return p(ctx, host, user, password, args...)
 }
+
+func TestProvider_SetMaxConcurrentP4Exec(t *testing.T) {
+	const max = 2
+
+	var mu sync.Mutex
+	active, maxActive := 0, 0
+	execer := p4ExecFunc(func(ctx context.Context, host, user, password string, args ...string) (io.ReadCloser, http.Header, error) {
+		mu.Lock()
+		active++
+		if active > maxActive {
+			maxActive = active
+		}
+		mu.Unlock()
+
+		// Give other calls a chance to run concurrently.
+		time.Sleep(10 * time.Millisecond)
+
+		return &closeFuncReader{
+			Reader: strings.NewReader("alice <alice@example.com> (Alice) accessed 2020/12/04\n"),
+			close: func() {
+				mu.Lock()
+				active--
+				mu.Unlock()
+			},
+		}, nil, nil
+	})
+
+	p := NewTestProvider("", "ssl:111.222.333.444:1666", "admin", "password", execer)
+	p.SetMaxConcurrentP4Exec(max)
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 10)
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := p.FetchAccount(context.Background(), &types.User{ID: 1, Username: "alice"}, nil, []string{"alice@example.com"})
+			errs <- err
+		}()
+	}
+	wg.Wait()
+	close(errs)
+
+	for err := range errs {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if maxActive != max {
+		t.Fatalf("maxActive: want %d but got %d", max, maxActive)
+	}
+
+	t.Run("canceled while waiting for a slot", func(t *testing.T) {
+		started, unblock := make(chan struct{}), make(chan struct{})
+		blockingExecer := p4ExecFunc(func(ctx context.Context, host, user, password string, args ...string) (io.ReadCloser, http.Header, error) {
+			close(started)
+			<-unblock
+			return io.NopCloser(strings.NewReader("")), nil, nil
+		})
+		p := NewTestProvider("", "ssl:111.222.333.444:1666", "admin", "password", blockingExecer)
+		p.SetMaxConcurrentP4Exec(1)
+
+		// Hold the only slot.
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			rc, _, err := p.p4Execer.P4Exec(context.Background(), "", "", "", "users")
+			if err == nil {
+				_ = rc.Close()
+			}
+		}()
+		<-started
+		defer func() {
+			close(unblock)
+			<-done
+		}()
+
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		_, err := p.FetchAccount(ctx, &types.User{ID: 1, Username: "alice"}, nil, []string{"alice@example.com"})
+		if !errors.Is(err, context.Canceled) {
+			t.Fatalf("err: want %v but got %v", context.Canceled, err)
+		}
+	})
+
+	t.Run("resolving groups with a single slot", func(t *testing.T) {
+		execer := p4ExecFunc(func(ctx context.Context, host, user, password string, args ...string) (io.ReadCloser, http.Header, error) {
+			var data string
+			switch args[0] {
+			case "protects":
+				data = `
+read group Backend * //Sourcegraph/...
+read user * * //Sourcegraph/Frontend/...
+`
+			case "users":
+				data = `
+alice <alice@example.com> (Alice) accessed 2020/12/04
+bob <bob@example.com> (Bob) accessed 2020/12/04
+`
+			case "group":
+				data = `
+Users:
+	alice
+`
+			}
+			return io.NopCloser(strings.NewReader(data)), nil, nil
+		})
+		p := NewTestProvider("", "ssl:111.222.333.444:1666", "admin", "password", execer)
+		p.SetMaxConcurrentP4Exec(1)
+
+		// Members of groups and all users are listed after the output of protects
+		// is closed, which must not wait for the slot held by protects.
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+
+		var wg sync.WaitGroup
+		errs := make(chan error, 10)
+		for i := 0; i < 10; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				_, err := p.FetchRepoPerms(ctx, &extsvc.Repository{
+					URI: "gitlab.com/user/repo",
+					ExternalRepoSpec: api.ExternalRepoSpec{
+						ServiceType: extsvc.TypePerforce,
+						ServiceID:   "ssl:111.222.333.444:1666",
+						ID:          "//Sourcegraph/",
+					},
+				})
+				errs <- err
+			}()
+		}
+		wg.Wait()
+		close(errs)
+
+		for err := range errs {
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+	})
+}
+
+type closeFuncReader struct {
+	io.Reader
+	close func()
+}
+
+func (r *closeFuncReader) Close() error {
+	r.close()
+	return nil
+}
+
+func TestProvider_commandTimeout(t *testing.T) {
+	// blockingExecer blocks until the context is done.
+	blockingExecer := p4ExecFunc(func(ctx context.Context, host, user, password string, args ...string) (io.ReadCloser, http.Header, error) {
+		<-ctx.Done()
+		return nil, nil, ctx.Err()
+	})
+
+	t.Run("command does not start in time", func(t *testing.T) {
+		p := NewTestProvider("", "ssl:111.222.333.444:1666", "admin", "password", blockingExecer)
+		p.commandTimeout = 10 * time.Millisecond
+
+		_, err := p.FetchRepoPerms(context.Background(), &extsvc.Repository{
+			URI: "gitlab.com/user/repo",
+			ExternalRepoSpec: api.ExternalRepoSpec{
+				ServiceType: extsvc.TypePerforce,
+				ServiceID:   "ssl:111.222.333.444:1666",
+				ID:          "//depot/",
+			},
+		})
+		var e *commandTimeoutError
+		if !errors.As(err, &e) || !errcode.IsTimeout(err) {
+			t.Fatalf("err: want a command timeout error but got %v", err)
+		}
+	})
+
+	t.Run("output is not read in time", func(t *testing.T) {
+		execer := p4ExecFunc(func(ctx context.Context, host, user, password string, args ...string) (io.ReadCloser, http.Header, error) {
+			return &closeFuncReader{
+				Reader: readerFunc(func([]byte) (int, error) {
+					<-ctx.Done()
+					return 0, ctx.Err()
+				}),
+				close: func() {},
+			}, nil, nil
+		})
+		p := NewTestProvider("", "ssl:111.222.333.444:1666", "admin", "password", execer)
+		p.commandTimeout = 10 * time.Millisecond
+
+		_, err := p.FetchAccount(context.Background(), &types.User{ID: 1, Username: "alice"}, nil, []string{"alice@example.com"})
+		var e *commandTimeoutError
+		if !errors.As(err, &e) || !errcode.IsTimeout(err) {
+			t.Fatalf("err: want a command timeout error but got %v", err)
+		}
+	})
+
+	t.Run("zero means no timeout", func(t *testing.T) {
+		p := NewTestProvider("", "ssl:111.222.333.444:1666", "admin", "password", blockingExecer)
+
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+		defer cancel()
+		_, _, err := p.p4Exec(ctx, "users")
+		var e *commandTimeoutError
+		if errors.As(err, &e) {
+			t.Fatalf("err: want the caller's error but got %v", err)
+		}
+		if !errors.Is(err, context.DeadlineExceeded) {
+			t.Fatalf("err: want %v but got %v", context.DeadlineExceeded, err)
+		}
+	})
+}
+
+type readerFunc func([]byte) (int, error)
+
+func (f readerFunc) Read(p []byte) (int, error) { return f(p) }
+
+func TestProvider_concurrentFetches(t *testing.T) {
+	execer := p4ExecFunc(func(ctx context.Context, host, user, password string, args ...string) (io.ReadCloser, http.Header, error) {
+		var data string
+		switch args[0] {
+		case "protects":
+			data = `
+read group Backend * //Sourcegraph/...
+read user alice * //Sourcegraph/Design/...
+`
+		case "users":
+			data = `
+alice <alice@example.com> (Alice) accessed 2020/12/04
+bob <bob@example.com> (Bob) accessed 2020/12/04
+`
+		case "group":
+			data = `
+Users:
+	alice
+	bob
+`
+		}
+		return io.NopCloser(strings.NewReader(data)), nil, nil
+	})
+
+	accountData, err := jsoniter.Marshal(
+		perforce.AccountData{
+			Username: "alice",
+			Email:    "alice@example.com",
+		},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	account := &extsvc.Account{
+		AccountSpec: extsvc.AccountSpec{
+			ServiceType: extsvc.TypePerforce,
+			ServiceID:   "ssl:111.222.333.444:1666",
+		},
+		AccountData: extsvc.AccountData{
+			Data: (*json.RawMessage)(&accountData),
+		},
+	}
+	repo := &extsvc.Repository{
+		URI: "gitlab.com/user/repo",
+		ExternalRepoSpec: api.ExternalRepoSpec{
+			ServiceType: extsvc.TypePerforce,
+			ServiceID:   "ssl:111.222.333.444:1666",
+		},
+	}
+
+	// The test is meant to be run with -race to detect unguarded access to the
+	// caches of the provider.
+	p := NewTestProvider("", "ssl:111.222.333.444:1666", "admin", "password", execer)
+	ctx := context.Background()
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 20)
+	for i := 0; i < 10; i++ {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			_, err := p.FetchUserPerms(ctx, account)
+			errs <- err
+		}()
+		go func() {
+			defer wg.Done()
+			_, err := p.FetchRepoPerms(ctx, repo)
+			errs <- err
+		}()
+	}
+	wg.Wait()
+	close(errs)
+
+	for err := range errs {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	got, err := p.FetchRepoPerms(ctx, repo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []extsvc.AccountID{"alice@example.com", "bob@example.com"}
+	sort.Slice(got, func(i, j int) bool { return got[i] < got[j] })
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Fatalf("Mismatch (-want +got):\n%s", diff)
+	}
+}
+
+func TestProvider_getAllUserEmails_TTL(t *testing.T) {
+	users := "alice <alice@example.com> (Alice) accessed 2020/12/04\n"
+	calls := 0
+	execer := p4ExecFunc(func(ctx context.Context, host, user, password string, args ...string) (io.ReadCloser, http.Header, error) {
+		calls++
+		return io.NopCloser(strings.NewReader(users)), nil, nil
+	})
+
+	now := time.Now()
+	p, err := NewProvider("", "ssl:111.222.333.444:1666", "admin", "password", 0, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.p4Execer = execer
+	p.clock = func() time.Time { return now }
+
+	fetch := func() map[string]string {
+		t.Helper()
+		emails, err := p.getAllUserEmails(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		return emails
+	}
+
+	want := map[string]string{"alice": "alice@example.com"}
+	if diff := cmp.Diff(want, fetch()); diff != "" {
+		t.Fatalf("Mismatch (-want +got):\n%s", diff)
+	}
+
+	// A newly onboarded user is not visible until the TTL has passed.
+	users += "bob <bob@example.com> (Bob) accessed 2020/12/04\n"
+	now = now.Add(59 * time.Second)
+	if diff := cmp.Diff(want, fetch()); diff != "" {
+		t.Fatalf("Mismatch (-want +got):\n%s", diff)
+	}
+	if calls != 1 {
+		t.Fatalf("calls: want 1 but got %d", calls)
+	}
+
+	now = now.Add(time.Second)
+	want = map[string]string{"alice": "alice@example.com", "bob": "bob@example.com"}
+	if diff := cmp.Diff(want, fetch()); diff != "" {
+		t.Fatalf("Mismatch (-want +got):\n%s", diff)
+	}
+	if calls != 2 {
+		t.Fatalf("calls: want 2 but got %d", calls)
+	}
+}
+
+func TestParseProtectsLine(t *testing.T) {
+	want := protectsRule{
+		line:    "read user alice * -//Sourcegraph/...",
+		level:   "read",
+		typ:     "user",
+		name:    "alice",
+		host:    "*",
+		depot:   "//Sourcegraph/...",
+		exclude: true,
+	}
+	for _, line := range []string{
+		"read user alice * -//Sourcegraph/...",
+		"   read user alice * -//Sourcegraph/...",
+		"\tread user alice * -//Sourcegraph/...\t",
+		"read\tuser  alice *   -//Sourcegraph/...   ",
+		"read user alice * -//Sourcegraph/... ## inline comment",
+		"  read user alice * -//Sourcegraph/...## inline comment without space",
+	} {
+		got, ok := parseProtectsLine(line)
+		if !ok {
+			t.Fatalf("%q: want a protection line", line)
+		}
+		if diff := cmp.Diff(want, got, cmp.AllowUnexported(protectsRule{})); diff != "" {
+			t.Fatalf("%q: Mismatch (-want +got):\n%s", line, diff)
+		}
+	}
+
+	for _, line := range []string{
+		"",
+		"   ",
+		"\t",
+		"## comment",
+		"   ## indented comment",
+		"\t## tab-indented comment",
+		"read user alice *", // Missing depot path
+	} {
+		if _, ok := parseProtectsLine(line); ok {
+			t.Fatalf("%q: want not a protection line", line)
+		}
+	}
+}
+
+func TestProvider_messyProtects(t *testing.T) {
+	clean := `
+read user alice * //Sourcegraph/...
+read user bob * //Sourcegraph/...
+read user bob * -//Sourcegraph/Security/...
+read user cindy * //Sourcegraph/...
+`
+	messy := `
+## Protections table
+
+   read user alice * //Sourcegraph/...    ## leading and trailing spaces
+	read user bob * //Sourcegraph/...	## tab-indented
+   ## indented comment
+
+read	user	bob	*	-//Sourcegraph/Security/...
+  read user cindy * //Sourcegraph/...##no space before comment
+`
+	newProvider := func(protects string) *Provider {
+		return NewTestProvider("", "ssl:111.222.333.444:1666", "admin", "password",
+			p4ExecFunc(func(ctx context.Context, host, user, password string, args ...string) (io.ReadCloser, http.Header, error) {
+				return io.NopCloser(strings.NewReader(protects)), nil, nil
+			}),
+		)
+	}
+
+	t.Run("scanUserPerms", func(t *testing.T) {
+		want, err := newProvider(clean).scanUserPerms(strings.NewReader(clean))
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := newProvider(messy).scanUserPerms(strings.NewReader(messy))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if diff := cmp.Diff(want, got); diff != "" {
+			t.Fatalf("Mismatch (-want +got):\n%s", diff)
+		}
+		if len(got.IncludeContains) == 0 || len(got.ExcludeContains) == 0 {
+			t.Fatalf("want both includes and excludes but got %+v", got)
+		}
+	})
+
+	t.Run("scanAllUserGrants", func(t *testing.T) {
+		ctx := context.Background()
+		want, err := newProvider(clean).scanAllUserGrants(ctx, io.NopCloser(strings.NewReader(clean)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := newProvider(messy).scanAllUserGrants(ctx, io.NopCloser(strings.NewReader(messy)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if diff := cmp.Diff(want, got); diff != "" {
+			t.Fatalf("Mismatch (-want +got):\n%s", diff)
+		}
+		if diff := cmp.Diff(map[string]int{"alice": 0, "cindy": 3}, got); diff != "" {
+			t.Fatalf("Mismatch (-want +got):\n%s", diff)
+		}
+	})
+}
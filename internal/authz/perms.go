@@ -14,6 +14,10 @@ import (
 
 var ErrPermsNotFound = errors.New("permissions not found")
 
+// ErrNoProvider is returned when no authz provider is configured for the code
+// host of a user or repository, meaning permissions are not enforced for it.
+var ErrNoProvider = errors.New("no authz provider configured")
+
 // RepoPerms contains a repo and the permissions a given user
 // has associated with it.
 type RepoPerms struct {
@@ -147,6 +147,9 @@ type ExternalServicesListOptions struct {
 	NoNamespace bool
 	// When specified, only include external services under given user namespace.
 	NamespaceUserID int32
+	// When specified, only include external services under any of given user
+	// namespaces, and value of NamespaceUserID is ignored.
+	NamespaceUserIDs []int32
 	// When specified, only include external services with given list of kinds.
 	Kinds []string
 	// When specified, only include external services with ID below this number
@@ -172,6 +175,8 @@ func (o ExternalServicesListOptions) sqlConditions() []*sqlf.Query {
 	}
 	if o.NoNamespace {
 		conds = append(conds, sqlf.Sprintf(`namespace_user_id IS NULL`))
+	} else if len(o.NamespaceUserIDs) > 0 {
+		conds = append(conds, sqlf.Sprintf(`namespace_user_id = ANY(%s)`, pq.Array(o.NamespaceUserIDs)))
 	} else if o.NamespaceUserID > 0 {
 		conds = append(conds, sqlf.Sprintf(`namespace_user_id = %d`, o.NamespaceUserID))
 	}
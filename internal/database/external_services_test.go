@@ -12,6 +12,7 @@ import (
 	"github.com/google/go-cmp/cmp"
 	"github.com/google/go-cmp/cmp/cmpopts"
 	"github.com/keegancsmith/sqlf"
+	"github.com/lib/pq"
 
 	"github.com/sourcegraph/sourcegraph/cmd/frontend/envvar"
 	"github.com/sourcegraph/sourcegraph/internal/actor"
@@ -31,6 +32,7 @@ func TestExternalServicesListOptions_sqlConditions(t *testing.T) {
 		name             string
 		noNamespace      bool
 		namespaceUserID  int32
+		namespaceUserIDs []int32
 		kinds            []string
 		afterID          int64
 		wantQuery        string
@@ -59,6 +61,13 @@ func TestExternalServicesListOptions_sqlConditions(t *testing.T) {
 			wantQuery:       "deleted_at IS NULL AND namespace_user_id = $1",
 			wantArgs:        []interface{}{int32(1)},
 		},
+		{
+			name:             "has namespace user IDs",
+			namespaceUserID:  1,
+			namespaceUserIDs: []int32{2, 3},
+			wantQuery:        "deleted_at IS NULL AND namespace_user_id = ANY($1)",
+			wantArgs:         []interface{}{pq.Array([]int32{2, 3})},
+		},
 		{
 			name:            "want no namespace",
 			noNamespace:     true,
@@ -82,6 +91,7 @@ func TestExternalServicesListOptions_sqlConditions(t *testing.T) {
 			opts := ExternalServicesListOptions{
 				NoNamespace:      test.noNamespace,
 				NamespaceUserID:  test.namespaceUserID,
+				NamespaceUserIDs: test.namespaceUserIDs,
 				Kinds:            test.kinds,
 				AfterID:          test.afterID,
 				OnlyCloudDefault: test.onlyCloudDefault,
@@ -287,15 +287,38 @@ func (s *RepoStore) Count(ctx context.Context, opt ReposListOptions) (ct int, er
 	return ct, err
 }
 
+// RepoMetadataFields is a bitmask of optional fields of types.SearchedRepo to be
+// loaded by MetadataWithFields. The ID and Name are always loaded.
+type RepoMetadataFields uint
+
+const (
+	RepoMetadataDescription RepoMetadataFields = 1 << iota
+	RepoMetadataFork
+	RepoMetadataArchived
+	RepoMetadataPrivate
+	RepoMetadataStars
+	RepoMetadataLastFetched
+
+	// RepoMetadataAll loads all fields of types.SearchedRepo.
+	RepoMetadataAll = RepoMetadataDescription | RepoMetadataFork | RepoMetadataArchived |
+		RepoMetadataPrivate | RepoMetadataStars | RepoMetadataLastFetched
+)
+
 // Metadata returns repo metadata used to decorate search results. The returned slice may be smaller than the
 // number of IDs given if a repo with the given ID does not exist.
 func (s *RepoStore) Metadata(ctx context.Context, ids ...api.RepoID) (_ []*types.SearchedRepo, err error) {
+	return s.MetadataWithFields(ctx, RepoMetadataAll, ids...)
+}
+
+// MetadataWithFields is like Metadata but only loads the given fields in addition to the ID and Name, leaving
+// others with their zero values.
+func (s *RepoStore) MetadataWithFields(ctx context.Context, fields RepoMetadataFields, ids ...api.RepoID) (_ []*types.SearchedRepo, err error) {
 	if Mocks.Repos.Metadata != nil {
 		return Mocks.Repos.Metadata(ctx, ids...)
 	}
 	s.ensureStore()
 
-	tr, ctx := trace.New(ctx, "repos.Metadata", "")
+	tr, ctx := trace.New(ctx, "repos.MetadataWithFields", "")
 	defer func() {
 		tr.SetError(err)
 		tr.Finish()
@@ -304,33 +327,15 @@ func (s *RepoStore) Metadata(ctx context.Context, ids ...api.RepoID) (_ []*types
 	opts := ReposListOptions{
 		IDs: ids,
 		// Return a limited subset of fields
-		Select: []string{
-			"repo.id",
-			"repo.name",
-			"repo.description",
-			"repo.fork",
-			"repo.archived",
-			"repo.private",
-			"repo.stars",
-			"gr.last_fetched",
-		},
+		Select: repoMetadataColumns(fields, &types.SearchedRepo{}).columns,
 		// Required so gr.last_fetched is select-able
-		joinGitserverRepos: true,
+		joinGitserverRepos: fields&RepoMetadataLastFetched != 0,
 	}
 
 	res := make([]*types.SearchedRepo, 0, len(ids))
 	scanMetadata := func(rows *sql.Rows) error {
 		var r types.SearchedRepo
-		if err := rows.Scan(
-			&r.ID,
-			&r.Name,
-			&dbutil.NullString{S: &r.Description},
-			&r.Fork,
-			&r.Archived,
-			&r.Private,
-			&dbutil.NullInt{N: &r.Stars},
-			&r.LastFetched,
-		); err != nil {
+		if err := rows.Scan(repoMetadataColumns(fields, &r).dests...); err != nil {
 			return err
 		}
 
@@ -341,6 +346,33 @@ func (s *RepoStore) Metadata(ctx context.Context, ids ...api.RepoID) (_ []*types
 	return res, errors.Wrap(s.list(ctx, tr, opts, scanMetadata), "fetch metadata")
 }
 
+type repoMetadataSelect struct {
+	columns []string
+	dests   []interface{}
+}
+
+// repoMetadataColumns returns the columns to select for the given fields, and the
+// scan destinations in r for each of them.
+func repoMetadataColumns(fields RepoMetadataFields, r *types.SearchedRepo) repoMetadataSelect {
+	sel := repoMetadataSelect{
+		columns: []string{"repo.id", "repo.name"},
+		dests:   []interface{}{&r.ID, &r.Name},
+	}
+	add := func(field RepoMetadataFields, column string, dest interface{}) {
+		if fields&field != 0 {
+			sel.columns = append(sel.columns, column)
+			sel.dests = append(sel.dests, dest)
+		}
+	}
+	add(RepoMetadataDescription, "repo.description", &dbutil.NullString{S: &r.Description})
+	add(RepoMetadataFork, "repo.fork", &r.Fork)
+	add(RepoMetadataArchived, "repo.archived", &r.Archived)
+	add(RepoMetadataPrivate, "repo.private", &r.Private)
+	add(RepoMetadataStars, "repo.stars", &dbutil.NullInt{N: &r.Stars})
+	add(RepoMetadataLastFetched, "gr.last_fetched", &r.LastFetched)
+	return sel
+}
+
 const listReposQueryFmtstr = `
 %%s -- Populates "queryPrefix", i.e. CTEs
 SELECT %s
@@ -2028,6 +2028,20 @@ func TestRepos_ListRepoNames_externalRepoContains(t *testing.T) {
 			// Only match this specific nested folder, and not the other Backends
 			want: repoNamesFromRepos([]*types.Repo{perforceEngineeringBackend}),
 		},
+		{
+			name: "only apply transformed '*' Perforce wildcard before a literal directory ExternalRepoIncludeContains",
+			opt: ReposListOptions{
+				ExternalRepoIncludeContains: []api.ExternalRepoSpec{
+					{
+						ID:          "//[^/]+/Handbook/%",
+						ServiceType: extsvc.TypePerforce,
+						ServiceID:   "ssl:111.222.333.444:1666",
+					},
+				},
+			},
+			// Only match folders under the literal directory of any depot
+			want: repoNamesFromRepos([]*types.Repo{perforceEngineeringHandbookFrontend, perforceEngineeringHandbookBackend}),
+		},
 		{
 			name: "only apply ExternalRepoExcludeContains",
 			opt: ReposListOptions{
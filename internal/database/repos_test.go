@@ -595,6 +595,57 @@ func TestRepoStore_Metadata(t *testing.T) {
 	md, err := r.Metadata(ctx, 1, 2)
 	require.NoError(t, err)
 	require.ElementsMatch(t, expected, md)
+
+	md, err = r.MetadataWithFields(ctx, RepoMetadataPrivate, 1, 2)
+	require.NoError(t, err)
+	require.ElementsMatch(t, []*types.SearchedRepo{
+		{ID: 1, Name: "foo", Private: false},
+		{ID: 2, Name: "bar", Private: true},
+	}, md)
+}
+
+func TestRepoMetadataColumns(t *testing.T) {
+	tests := []struct {
+		name   string
+		fields RepoMetadataFields
+		want   []string
+	}{
+		{
+			name:   "name only",
+			fields: 0,
+			want:   []string{"repo.id", "repo.name"},
+		},
+		{
+			name:   "private and stars",
+			fields: RepoMetadataPrivate | RepoMetadataStars,
+			want:   []string{"repo.id", "repo.name", "repo.private", "repo.stars"},
+		},
+		{
+			name:   "all",
+			fields: RepoMetadataAll,
+			want: []string{
+				"repo.id",
+				"repo.name",
+				"repo.description",
+				"repo.fork",
+				"repo.archived",
+				"repo.private",
+				"repo.stars",
+				"gr.last_fetched",
+			},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			sel := repoMetadataColumns(test.fields, &types.SearchedRepo{})
+			if diff := cmp.Diff(test.want, sel.columns); diff != "" {
+				t.Fatalf("columns mismatch (-want +got):\n%s", diff)
+			}
+			if len(sel.dests) != len(sel.columns) {
+				t.Fatalf("got %d scan destinations for %d columns", len(sel.dests), len(sel.columns))
+			}
+		})
+	}
 }
 
 func TestRepoStore_Blocking(t *testing.T) {
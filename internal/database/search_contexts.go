@@ -3,10 +3,14 @@ package database
 import (
 	"context"
 	"database/sql"
+	"encoding/json"
 	"fmt"
 	"sort"
+	"strings"
+	"time"
 
 	"github.com/cockroachdb/errors"
+	"github.com/jackc/pgconn"
 	"github.com/keegancsmith/sqlf"
 
 	"github.com/sourcegraph/sourcegraph/internal/actor"
@@ -18,13 +22,83 @@ import (
 
 var ErrSearchContextNotFound = errors.New("search context not found")
 
+// ErrSearchContextDuplicateName is returned when another search context in the
+// same namespace already has the name.
+var ErrSearchContextDuplicateName = errors.New("search context with the same name already exists in the namespace")
+
+// ErrSearchContextNameAlreadyExists is returned when a search context is created
+// or updated with a name that another search context in the same namespace
+// already has. It matches ErrSearchContextDuplicateName with errors.Is.
+type ErrSearchContextNameAlreadyExists struct {
+	Name      string
+	Namespace SearchContextNamespace
+}
+
+func (e *ErrSearchContextNameAlreadyExists) Error() string {
+	return fmt.Sprintf("search context %q already exists in %s", e.Name, e.Namespace)
+}
+
+func (e *ErrSearchContextNameAlreadyExists) Is(target error) bool {
+	return target == ErrSearchContextDuplicateName
+}
+
+// isUniqueViolation returns true if the error is a violation of a unique index,
+// such as the ones on the names of search contexts within a namespace.
+func isUniqueViolation(err error) bool {
+	var e *pgconn.PgError
+	return errors.As(err, &e) && e.Code == "23505"
+}
+
 func SearchContexts(db dbutil.DB) *SearchContextsStore {
 	store := basestore.NewWithDB(db, sql.TxOptions{})
-	return &SearchContextsStore{store}
+	return &SearchContextsStore{Store: store}
 }
 
 type SearchContextsStore struct {
 	*basestore.Store
+
+	auditSink SearchContextAuditSink
+	// The changes of repository revisions written in the transaction, which are
+	// delivered to the audit sink once the outermost transaction is committed. It
+	// is shared by nested transactions and nil outside of transactions.
+	pendingChanges *[]pendingSearchContextRevisionsChange
+	// The number of pending changes when the transaction started, the changes
+	// after it are discarded when the transaction is rolled back.
+	pendingChangesStart int
+	// Whether the transaction is the outermost one started by the store.
+	outermost bool
+}
+
+type pendingSearchContextRevisionsChange struct {
+	ctx    context.Context
+	change *SearchContextRevisionsChange
+}
+
+// SearchContextRevisionsChange describes a change of repository revisions searched
+// by a search context, i.e. without the excluded ones.
+type SearchContextRevisionsChange struct {
+	SearchContextID int64
+	// ActorUserID is the ID of the user who made the change, zero value indicates
+	// the change was not made by a user.
+	ActorUserID int32
+	Added       []*types.SearchContextRepositoryRevisions
+	Removed     []*types.SearchContextRepositoryRevisions
+}
+
+// SearchContextAuditSink receives changes of repository revisions of search
+// contexts for auditing purposes.
+type SearchContextAuditSink func(ctx context.Context, change *SearchContextRevisionsChange)
+
+// WithAuditSink returns a copy of the store that delivers changes of repository
+// revisions of search contexts to the given sink.
+func (s *SearchContextsStore) WithAuditSink(sink SearchContextAuditSink) *SearchContextsStore {
+	return &SearchContextsStore{
+		Store:               s.Store,
+		auditSink:           sink,
+		pendingChanges:      s.pendingChanges,
+		pendingChangesStart: s.pendingChangesStart,
+		outermost:           s.outermost,
+	}
 }
 
 func (s *SearchContextsStore) Transact(ctx context.Context) (*SearchContextsStore, error) {
@@ -32,7 +106,42 @@ func (s *SearchContextsStore) Transact(ctx context.Context) (*SearchContextsStor
 	if err != nil {
 		return nil, err
 	}
-	return &SearchContextsStore{Store: txBase}, nil
+
+	// A transaction of another store that this one is part of is treated as
+	// committed when the outermost transaction started by this store is.
+	pendingChanges, outermost := s.pendingChanges, false
+	if pendingChanges == nil {
+		pendingChanges, outermost = &[]pendingSearchContextRevisionsChange{}, true
+	}
+	return &SearchContextsStore{
+		Store:               txBase,
+		auditSink:           s.auditSink,
+		pendingChanges:      pendingChanges,
+		pendingChangesStart: len(*pendingChanges),
+		outermost:           outermost,
+	}, nil
+}
+
+// Done finishes the transaction. Changes of repository revisions are delivered
+// to the audit sink once the outermost transaction is committed, and discarded
+// when the transaction they were written in is rolled back.
+func (s *SearchContextsStore) Done(err error) error {
+	err = s.Store.Done(err)
+	if s.pendingChanges == nil {
+		return err
+	}
+
+	if err != nil {
+		*s.pendingChanges = (*s.pendingChanges)[:s.pendingChangesStart]
+		return err
+	}
+	if s.outermost {
+		for _, p := range *s.pendingChanges {
+			s.auditSink(p.ctx, p.change)
+		}
+		*s.pendingChanges = nil
+	}
+	return nil
 }
 
 const searchContextsPermissionsConditionFmtStr = `(
@@ -64,12 +173,11 @@ func searchContextsPermissionsCondition(ctx context.Context, db dbutil.DB) (*sql
 }
 
 const listSearchContextsFmtStr = `
-SELECT sc.id, sc.name, sc.description, sc.public, sc.namespace_user_id, sc.namespace_org_id, sc.updated_at, u.username, o.name
+SELECT sc.id, sc.name, sc.description, sc.public, sc.namespace_user_id, sc.namespace_org_id, sc.updated_at, sc.deleted_at, u.username, o.name
 FROM search_contexts sc
 LEFT JOIN users u on sc.namespace_user_id = u.id
 LEFT JOIN orgs o on sc.namespace_org_id = o.id
-WHERE sc.deleted_at IS NULL
-	AND (%s) -- permission conditions
+WHERE (%s) -- permission conditions
 	AND (%s) -- query conditions
 ORDER BY %s
 LIMIT %d
@@ -81,8 +189,7 @@ SELECT COUNT(*)
 FROM search_contexts sc
 LEFT JOIN users u on sc.namespace_user_id = u.id
 LEFT JOIN orgs o on sc.namespace_org_id = o.id
-WHERE sc.deleted_at IS NULL
-	AND (%s) -- permission conditions
+WHERE (%s) -- permission conditions
 	AND (%s) -- query conditions
 `
 
@@ -105,6 +212,8 @@ type ListSearchContextsPageOptions struct {
 type ListSearchContextsOptions struct {
 	// Name is used for partial matching of search contexts by name (case-insensitvely).
 	Name string
+	// NamePrefix matches search contexts whose name starts with the prefix (case-insensitively).
+	NamePrefix string
 	// NamespaceName is used for partial matching of search context namespaces (user or org) by name (case-insensitvely).
 	NamespaceName string
 	// NamespaceUserIDs matches search contexts by user namespace. If multiple IDs are specified, then a union of all matching results is returned.
@@ -120,6 +229,8 @@ type ListSearchContextsOptions struct {
 	OrderBy SearchContextsOrderByOption
 	// OrderByDescending specifies the sort direction for the OrderBy option.
 	OrderByDescending bool
+	// IncludeDeleted includes soft-deleted search contexts.
+	IncludeDeleted bool
 }
 
 func getSearchContextOrderByClause(orderBy SearchContextsOrderByOption, descending bool) *sqlf.Query {
@@ -173,6 +284,9 @@ func getSearchContextsQueryConditions(opts ListSearchContextsOptions) ([]*sqlf.Q
 	}
 
 	conds := []*sqlf.Query{}
+	if !opts.IncludeDeleted {
+		conds = append(conds, sqlf.Sprintf("sc.deleted_at IS NULL"))
+	}
 	if len(namespaceConds) > 0 {
 		conds = append(conds, sqlf.Sprintf("(%s)", sqlf.Join(namespaceConds, " OR ")))
 	}
@@ -182,6 +296,11 @@ func getSearchContextsQueryConditions(opts ListSearchContextsOptions) ([]*sqlf.Q
 		conds = append(conds, sqlf.Sprintf("sc.name LIKE %s", "%"+opts.Name+"%"))
 	}
 
+	if opts.NamePrefix != "" {
+		// The prefix is matched literally, e.g. a typed "_" does not match any character.
+		conds = append(conds, sqlf.Sprintf("sc.name LIKE %s", likeEscaper.Replace(opts.NamePrefix)+"%"))
+	}
+
 	if opts.NamespaceName != "" {
 		conds = append(conds, sqlf.Sprintf("COALESCE(u.username, o.name, '') ILIKE %s", "%"+opts.NamespaceName+"%"))
 	}
@@ -194,6 +313,9 @@ func getSearchContextsQueryConditions(opts ListSearchContextsOptions) ([]*sqlf.Q
 	return conds, nil
 }
 
+// likeEscaper escapes the characters that have a special meaning in LIKE patterns.
+var likeEscaper = strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`)
+
 func (s *SearchContextsStore) listSearchContexts(ctx context.Context, cond *sqlf.Query, orderBy *sqlf.Query, limit int32, offset int32) ([]*types.SearchContext, error) {
 	permissionsCond, err := searchContextsPermissionsCondition(ctx, s.Handle().DB())
 	if err != nil {
@@ -220,6 +342,74 @@ func (s *SearchContextsStore) ListSearchContexts(ctx context.Context, pageOpts L
 	return s.listSearchContexts(ctx, sqlf.Join(conds, "\n AND "), orderBy, pageOpts.First, pageOpts.After)
 }
 
+// SearchContextsCursor is the position of a search context in the listing of
+// ListSearchContextsPaged, which is ordered by name and then ID.
+type SearchContextsCursor struct {
+	Name string
+	ID   int64
+}
+
+const listSearchContextsPagedFmtStr = `
+SELECT sc.id, sc.name, sc.description, sc.public, sc.namespace_user_id, sc.namespace_org_id, sc.updated_at, sc.deleted_at, u.username, o.name
+FROM search_contexts sc
+LEFT JOIN users u on sc.namespace_user_id = u.id
+LEFT JOIN orgs o on sc.namespace_org_id = o.id
+WHERE (%s) -- permission conditions
+	AND (%s) -- query conditions
+	AND (%s) -- cursor conditions
+ORDER BY sc.name ASC, sc.id ASC
+LIMIT %d
+`
+
+// ListSearchContextsPaged returns at most first search contexts matching the
+// options that come after the given cursor, along with the cursor of the next
+// page. The next cursor is nil on the last page, and a nil after starts at the
+// first page. Unlike the offset of ListSearchContexts, the cursor does not skip
+// or repeat search contexts when others are created or deleted between pages.
+// The OrderBy options are ignored, search contexts are ordered by name and then
+// ID.
+func (s *SearchContextsStore) ListSearchContextsPaged(ctx context.Context, first int32, after *SearchContextsCursor, opts ListSearchContextsOptions) ([]*types.SearchContext, *SearchContextsCursor, error) {
+	if first <= 0 {
+		return nil, nil, errors.New("first must be positive")
+	}
+
+	conds, err := getSearchContextsQueryConditions(opts)
+	if err != nil {
+		return nil, nil, err
+	}
+	cursorCond := sqlf.Sprintf("TRUE")
+	if after != nil {
+		// name column has type citext, the cursor has to be compared the same way
+		// the rows are ordered.
+		cursorCond = sqlf.Sprintf("(sc.name, sc.id) > (%s::citext, %d)", after.Name, after.ID)
+	}
+	permissionsCond, err := searchContextsPermissionsCondition(ctx, s.Handle().DB())
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// Fetch one more search context to know whether there is a next page.
+	rows, err := s.Query(ctx, sqlf.Sprintf(listSearchContextsPagedFmtStr, permissionsCond, sqlf.Join(conds, "\n AND "), cursorCond, first+1))
+	if err != nil {
+		return nil, nil, err
+	}
+	defer rows.Close()
+
+	searchContexts, err := scanSearchContexts(rows)
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(searchContexts) <= int(first) {
+		return searchContexts, nil, nil
+	}
+	searchContexts = searchContexts[:first]
+	last := searchContexts[len(searchContexts)-1]
+	return searchContexts, &SearchContextsCursor{Name: last.Name, ID: last.ID}, nil
+}
+
+// CountSearchContexts returns the number of search contexts that
+// ListSearchContexts would list with the options across all pages. Like the
+// listing, only search contexts visible to the current actor are counted.
 func (s *SearchContextsStore) CountSearchContexts(ctx context.Context, opts ListSearchContextsOptions) (int32, error) {
 	if Mocks.SearchContexts.CountSearchContexts != nil {
 		return Mocks.SearchContexts.CountSearchContexts(ctx, opts)
@@ -241,10 +431,96 @@ func (s *SearchContextsStore) CountSearchContexts(ctx context.Context, opts List
 	return count, err
 }
 
+// SearchContextNamespaceCount is the number of search contexts owned by a user
+// or an org.
+type SearchContextNamespaceCount struct {
+	Namespace SearchContextNamespace
+	Count     int32
+}
+
+const listSearchContextNamespacesFmtStr = `
+SELECT COALESCE(sc.namespace_user_id, 0), COALESCE(sc.namespace_org_id, 0), COUNT(*)
+FROM search_contexts sc
+LEFT JOIN users u on sc.namespace_user_id = u.id
+LEFT JOIN orgs o on sc.namespace_org_id = o.id
+WHERE (sc.namespace_user_id IS NOT NULL OR sc.namespace_org_id IS NOT NULL)
+	AND (%s) -- permission conditions
+	AND (%s) -- query conditions
+GROUP BY sc.namespace_user_id, sc.namespace_org_id
+ORDER BY COUNT(*) DESC, sc.namespace_user_id ASC NULLS LAST, sc.namespace_org_id ASC NULLS LAST
+`
+
+// ListSearchContextNamespaces returns the distinct users and orgs that own search
+// contexts matching the options, along with the number of search contexts each
+// of them owns, ordered by the number of search contexts. Instance-level search
+// contexts do not have a namespace and are not counted. The OrderBy options are
+// ignored.
+func (s *SearchContextsStore) ListSearchContextNamespaces(ctx context.Context, opts ListSearchContextsOptions) ([]*SearchContextNamespaceCount, error) {
+	conds, err := getSearchContextsQueryConditions(opts)
+	if err != nil {
+		return nil, err
+	}
+	permissionsCond, err := searchContextsPermissionsCondition(ctx, s.Handle().DB())
+	if err != nil {
+		return nil, err
+	}
+	rows, err := s.Query(ctx, sqlf.Sprintf(listSearchContextNamespacesFmtStr, permissionsCond, sqlf.Join(conds, "\n AND ")))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var counts []*SearchContextNamespaceCount
+	for rows.Next() {
+		var c SearchContextNamespaceCount
+		if err := rows.Scan(&c.Namespace.UserID, &c.Namespace.OrgID, &c.Count); err != nil {
+			return nil, err
+		}
+		counts = append(counts, &c)
+	}
+	return counts, rows.Err()
+}
+
+const listSearchContextsModifiedSinceFmtStr = `
+SELECT sc.id, sc.name, sc.description, sc.public, sc.namespace_user_id, sc.namespace_org_id, sc.updated_at, sc.deleted_at, u.username, o.name
+FROM search_contexts sc
+LEFT JOIN users u on sc.namespace_user_id = u.id
+LEFT JOIN orgs o on sc.namespace_org_id = o.id
+WHERE (%s) -- permission conditions
+	AND (%s) -- query conditions
+	AND GREATEST(sc.updated_at, sc.repositories_updated_at) > %s
+ORDER BY GREATEST(sc.updated_at, sc.repositories_updated_at) ASC, sc.id ASC
+`
+
+// ListSearchContextsModifiedSince returns search contexts matching the options whose
+// properties or repository revisions have been modified after the given time,
+// ordered by the time of their last modification. Deleting and restoring a search
+// context counts as a modification, deleted search contexts are only returned
+// with the IncludeDeleted option. The OrderBy options are ignored.
+func (s *SearchContextsStore) ListSearchContextsModifiedSince(ctx context.Context, since time.Time, opts ListSearchContextsOptions) ([]*types.SearchContext, error) {
+	conds, err := getSearchContextsQueryConditions(opts)
+	if err != nil {
+		return nil, err
+	}
+	permissionsCond, err := searchContextsPermissionsCondition(ctx, s.Handle().DB())
+	if err != nil {
+		return nil, err
+	}
+	rows, err := s.Query(ctx, sqlf.Sprintf(listSearchContextsModifiedSinceFmtStr, permissionsCond, sqlf.Join(conds, "\n AND "), since))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	return scanSearchContexts(rows)
+}
+
 type GetSearchContextOptions struct {
 	Name            string
 	NamespaceUserID int32
 	NamespaceOrgID  int32
+	// IncludeDeleted includes soft-deleted search contexts, the search context
+	// that is not deleted or else the most recently deleted one is returned.
+	IncludeDeleted bool
 }
 
 func (s *SearchContextsStore) GetSearchContext(ctx context.Context, opts GetSearchContextOptions) (*types.SearchContext, error) {
@@ -264,6 +540,13 @@ func (s *SearchContextsStore) GetSearchContext(ctx context.Context, opts GetSear
 	}
 	conds = append(conds, sqlf.Sprintf("sc.name = %s", opts.Name))
 
+	orderBy := getSearchContextOrderByClause(SearchContextsOrderByID, false)
+	if opts.IncludeDeleted {
+		orderBy = sqlf.Sprintf("sc.deleted_at DESC NULLS FIRST, sc.id DESC")
+	} else {
+		conds = append(conds, sqlf.Sprintf("sc.deleted_at IS NULL"))
+	}
+
 	permissionsCond, err := searchContextsPermissionsCondition(ctx, s.Handle().DB())
 	if err != nil {
 		return nil, err
@@ -274,7 +557,7 @@ func (s *SearchContextsStore) GetSearchContext(ctx context.Context, opts GetSear
 			listSearchContextsFmtStr,
 			permissionsCond,
 			sqlf.Join(conds, "\n AND "),
-			getSearchContextOrderByClause(SearchContextsOrderByID, false),
+			orderBy,
 			1, // limit
 			0, // offset
 		),
@@ -289,17 +572,126 @@ func (s *SearchContextsStore) GetSearchContext(ctx context.Context, opts GetSear
 const deleteSearchContextFmtStr = `
 UPDATE search_contexts
 SET
-    -- Soft-delete the search context and update the name to prevent violating the unique constraint in the future
-    deleted_at = TRANSACTION_TIMESTAMP(),
-    name = soft_deleted_repository_name(name)
+	deleted_at = TRANSACTION_TIMESTAMP(),
+	-- Let ListSearchContextsModifiedSince report the deletion
+	updated_at = TRANSACTION_TIMESTAMP()
 WHERE id = %d AND deleted_at IS NULL
 `
 
+// DeleteSearchContext soft-deletes the search context, which can be undone with
+// RestoreSearchContext. The name of a soft-deleted search context can be used by
+// another search context in the same namespace.
+//
 // 🚨 SECURITY: The caller must ensure that the actor is a site admin or has permission to delete the search context.
 func (s *SearchContextsStore) DeleteSearchContext(ctx context.Context, searchContextID int64) error {
 	return s.Exec(ctx, sqlf.Sprintf(deleteSearchContextFmtStr, searchContextID))
 }
 
+const restoreSearchContextFmtStr = `
+UPDATE search_contexts
+SET
+	deleted_at = NULL,
+	updated_at = now()
+WHERE id = %d AND deleted_at IS NOT NULL
+`
+
+// RestoreSearchContext restores a soft-deleted search context. It returns
+// ErrSearchContextNameAlreadyExists if another search context in the same
+// namespace has taken the name in the meantime, and ErrSearchContextNotFound if
+// there is no soft-deleted search context with the ID.
+//
+// 🚨 SECURITY: The caller must ensure that the actor is a site admin or has permission to delete the search context.
+func (s *SearchContextsStore) RestoreSearchContext(ctx context.Context, searchContextID int64) error {
+	// The name and namespace are fetched upfront for the error, since the query
+	// fails the transaction (if any) on a unique violation.
+	searchContext, err := s.getSearchContextNameAndNamespace(ctx, searchContextID)
+	if err != nil {
+		return err
+	}
+
+	res, err := s.ExecResult(ctx, sqlf.Sprintf(restoreSearchContextFmtStr, searchContextID))
+	if err != nil {
+		if isUniqueViolation(err) {
+			return searchContextNameAlreadyExists(searchContext)
+		}
+		return err
+	}
+
+	affected, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if affected == 0 {
+		return ErrSearchContextNotFound
+	}
+	return nil
+}
+
+const getSearchContextNameAndNamespaceFmtStr = `
+SELECT name, namespace_user_id, namespace_org_id
+FROM search_contexts
+WHERE id = %d
+`
+
+// getSearchContextNameAndNamespace returns the search context with the ID,
+// deleted or not, with only its name and namespace populated.
+func (s *SearchContextsStore) getSearchContextNameAndNamespace(ctx context.Context, searchContextID int64) (*types.SearchContext, error) {
+	searchContext := &types.SearchContext{ID: searchContextID}
+	err := s.QueryRow(ctx, sqlf.Sprintf(getSearchContextNameAndNamespaceFmtStr, searchContextID)).Scan(
+		&searchContext.Name,
+		&dbutil.NullInt32{N: &searchContext.NamespaceUserID},
+		&dbutil.NullInt32{N: &searchContext.NamespaceOrgID},
+	)
+	if err == sql.ErrNoRows {
+		return nil, ErrSearchContextNotFound
+	}
+	return searchContext, err
+}
+
+const renameSearchContextFmtStr = `
+UPDATE search_contexts
+SET
+	name = %s,
+	updated_at = now()
+WHERE id = %d AND deleted_at IS NULL
+`
+
+// RenameSearchContext updates the name of the search context in place, keeping
+// its ID, repository revisions and history. It returns
+// ErrSearchContextNameAlreadyExists if another search context in the same
+// namespace already has the new name, and ErrSearchContextNotFound if the search
+// context does not exist.
+//
+// 🚨 SECURITY: The caller must ensure that the actor is a site admin or has permission to update the search context.
+func (s *SearchContextsStore) RenameSearchContext(ctx context.Context, searchContextID int64, newName string) error {
+	// The namespace is fetched upfront for the error, since the query fails the
+	// transaction (if any) on a unique violation.
+	searchContext, err := s.getSearchContextNameAndNamespace(ctx, searchContextID)
+	if err != nil {
+		return err
+	}
+	searchContext.Name = newName
+
+	res, err := s.ExecResult(ctx, sqlf.Sprintf(renameSearchContextFmtStr, newName, searchContextID))
+	if err != nil {
+		// The uniqueness of names within a namespace is enforced by the unique
+		// indexes, which makes the check atomic with the rename.
+		if isUniqueViolation(err) {
+			return searchContextNameAlreadyExists(searchContext)
+		}
+		return err
+	}
+
+	affected, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if affected == 0 {
+		return ErrSearchContextNotFound
+	}
+	return nil
+}
+
 const insertSearchContextFmtStr = `
 INSERT INTO search_contexts
 (name, description, public, namespace_user_id, namespace_org_id)
@@ -356,17 +748,30 @@ func (s *SearchContextsStore) UpdateSearchContextWithRepositoryRevisions(ctx con
 	return updatedSearchContext, nil
 }
 
+// SetSearchContextRepositoryRevisions replaces the repository revisions of the
+// search context. Duplicate repositories and revisions are stored once, and a
+// repository without revisions is rejected.
 func (s *SearchContextsStore) SetSearchContextRepositoryRevisions(ctx context.Context, searchContextID int64, repositoryRevisions []*types.SearchContextRepositoryRevisions) (err error) {
 	if len(repositoryRevisions) == 0 {
 		return nil
 	}
 
+	repositoryRevisions, err = normalizeSearchContextRepositoryRevisions(repositoryRevisions)
+	if err != nil {
+		return err
+	}
+
 	tx, err := s.Transact(ctx)
 	if err != nil {
 		return err
 	}
 	defer func() { err = tx.Done(err) }()
 
+	previous, err := tx.getAuditedSearchContextRepositoryRevisions(ctx, searchContextID)
+	if err != nil {
+		return errors.Wrap(err, "get previous repository revisions")
+	}
+
 	err = tx.Exec(ctx, sqlf.Sprintf("DELETE FROM search_context_repos WHERE search_context_id = %d", searchContextID))
 	if err != nil {
 		return err
@@ -382,10 +787,159 @@ func (s *SearchContextsStore) SetSearchContextRepositoryRevisions(ctx context.Co
 		}
 	}
 
-	return tx.Exec(ctx, sqlf.Sprintf(
+	err = tx.Exec(ctx, sqlf.Sprintf(
 		"INSERT INTO search_context_repos (search_context_id, repo_id, revision) VALUES %s",
 		sqlf.Join(values, ","),
 	))
+	if err != nil {
+		return err
+	}
+
+	return tx.recordSearchContextRepositoryRevisionsChange(ctx, searchContextID, previous)
+}
+
+// getAuditedSearchContextRepositoryRevisions returns the repository revisions
+// searched by the search context regardless of the permissions of the current
+// actor, so that the audit record covers all repositories. It returns nil if the
+// store has no audit sink.
+func (s *SearchContextsStore) getAuditedSearchContextRepositoryRevisions(ctx context.Context, searchContextID int64) ([]*types.SearchContextRepositoryRevisions, error) {
+	if s.auditSink == nil {
+		return nil, nil
+	}
+	return s.getSearchContextRepositoryRevisions(actor.WithInternalActor(ctx), searchContextID, time.Time{}, true)
+}
+
+// recordSearchContextRepositoryRevisionsChange records the repository revisions
+// searched by the search context in the history and marks them as updated, after
+// its repository revisions or exclusions have been written in the transaction.
+// The change from the previous repository revisions is delivered to the audit
+// sink once it has been committed, see Done.
+func (s *SearchContextsStore) recordSearchContextRepositoryRevisionsChange(ctx context.Context, searchContextID int64, previous []*types.SearchContextRepositoryRevisions) error {
+	err := s.Exec(ctx, sqlf.Sprintf(recordSearchContextRepositoryRevisionsFmtStr, searchContextID, searchContextID))
+	if err != nil {
+		return errors.Wrap(err, "record repository revisions history")
+	}
+
+	err = s.Exec(ctx, sqlf.Sprintf("UPDATE search_contexts SET repositories_updated_at = now() WHERE id = %d", searchContextID))
+	if err != nil {
+		return err
+	}
+
+	if s.auditSink == nil {
+		return nil
+	}
+	next, err := s.getAuditedSearchContextRepositoryRevisions(ctx, searchContextID)
+	if err != nil {
+		return errors.Wrap(err, "get next repository revisions")
+	}
+
+	added, removed := diffSearchContextRepositoryRevisions(previous, next)
+	if len(added) > 0 || len(removed) > 0 {
+		*s.pendingChanges = append(*s.pendingChanges, pendingSearchContextRevisionsChange{
+			ctx: ctx,
+			change: &SearchContextRevisionsChange{
+				SearchContextID: searchContextID,
+				ActorUserID:     actor.FromContext(ctx).UID,
+				Added:           added,
+				Removed:         removed,
+			},
+		})
+	}
+	return nil
+}
+
+// normalizeSearchContextRepositoryRevisions merges the revisions of repositories
+// that occur more than once and removes duplicate revisions, keeping the order of
+// their first occurrence. It returns an error if a repository has no revisions.
+func normalizeSearchContextRepositoryRevisions(repositoryRevisions []*types.SearchContextRepositoryRevisions) ([]*types.SearchContextRepositoryRevisions, error) {
+	type repoRevision struct {
+		repoID   api.RepoID
+		revision string
+	}
+	byRepoID := make(map[api.RepoID]*types.SearchContextRepositoryRevisions, len(repositoryRevisions))
+	seen := make(map[repoRevision]struct{})
+	out := make([]*types.SearchContextRepositoryRevisions, 0, len(repositoryRevisions))
+	for _, repoRev := range repositoryRevisions {
+		if len(repoRev.Revisions) == 0 {
+			return nil, errors.Errorf("repository %q (ID %d) has no revisions", repoRev.Repo.Name, repoRev.Repo.ID)
+		}
+
+		normalized, ok := byRepoID[repoRev.Repo.ID]
+		if !ok {
+			normalized = &types.SearchContextRepositoryRevisions{Repo: repoRev.Repo}
+			byRepoID[repoRev.Repo.ID] = normalized
+			out = append(out, normalized)
+		}
+		for _, revision := range repoRev.Revisions {
+			key := repoRevision{repoID: repoRev.Repo.ID, revision: revision}
+			if _, ok := seen[key]; ok {
+				continue
+			}
+			seen[key] = struct{}{}
+			normalized.Revisions = append(normalized.Revisions, revision)
+		}
+	}
+	return out, nil
+}
+
+// recordSearchContextRepositoryRevisionsFmtStr records the current repository
+// revisions of a search context without the excluded ones as a snapshot in the
+// history. A snapshot that has been recorded earlier in the same transaction is
+// replaced.
+var recordSearchContextRepositoryRevisionsFmtStr = `
+WITH deleted AS (
+	DELETE FROM search_context_repos_history
+	WHERE search_context_id = %d AND recorded_at = now()
+)
+INSERT INTO search_context_repos_history (search_context_id, repo_id, revision, recorded_at)
+SELECT sc.search_context_id, sc.repo_id, sc.revision, now()
+FROM search_context_repos sc
+WHERE sc.search_context_id = %d
+AND ` + searchContextRepositoryExclusionsCond
+
+// diffSearchContextRepositoryRevisions returns the repository revisions that are in
+// next but not in previous as added, and the ones in previous but not in next as
+// removed. Both results are ordered by repository ID and revision.
+func diffSearchContextRepositoryRevisions(previous, next []*types.SearchContextRepositoryRevisions) (added, removed []*types.SearchContextRepositoryRevisions) {
+	type repoRevision struct {
+		repoID   api.RepoID
+		revision string
+	}
+	repoNames := make(map[api.RepoID]api.RepoName)
+	toSet := func(repoRevs []*types.SearchContextRepositoryRevisions) map[repoRevision]struct{} {
+		set := make(map[repoRevision]struct{})
+		for _, repoRev := range repoRevs {
+			if repoRev.Repo.Name != "" {
+				repoNames[repoRev.Repo.ID] = repoRev.Repo.Name
+			}
+			for _, revision := range repoRev.Revisions {
+				set[repoRevision{repoID: repoRev.Repo.ID, revision: revision}] = struct{}{}
+			}
+		}
+		return set
+	}
+	subtract := func(a, b map[repoRevision]struct{}) []*types.SearchContextRepositoryRevisions {
+		byRepo := make(map[api.RepoID][]string)
+		for rr := range a {
+			if _, ok := b[rr]; !ok {
+				byRepo[rr.repoID] = append(byRepo[rr.repoID], rr.revision)
+			}
+		}
+
+		out := make([]*types.SearchContextRepositoryRevisions, 0, len(byRepo))
+		for repoID, revisions := range byRepo {
+			sort.Strings(revisions)
+			out = append(out, &types.SearchContextRepositoryRevisions{
+				Repo:      types.RepoName{ID: repoID, Name: repoNames[repoID]},
+				Revisions: revisions,
+			})
+		}
+		sort.Slice(out, func(i, j int) bool { return out[i].Repo.ID < out[j].Repo.ID })
+		return out
+	}
+
+	previousSet, nextSet := toSet(previous), toSet(next)
+	return subtract(nextSet, previousSet), subtract(previousSet, nextSet)
 }
 
 func (s *SearchContextsStore) createSearchContext(ctx context.Context, searchContext *types.SearchContext) (*types.SearchContext, error) {
@@ -397,6 +951,9 @@ func (s *SearchContextsStore) createSearchContext(ctx context.Context, searchCon
 		nullInt32Column(searchContext.NamespaceUserID),
 		nullInt32Column(searchContext.NamespaceOrgID),
 	))
+	if isUniqueViolation(err) {
+		return nil, searchContextNameAlreadyExists(searchContext)
+	}
 	if err != nil {
 		return nil, err
 	}
@@ -415,6 +972,9 @@ func (s *SearchContextsStore) updateSearchContext(ctx context.Context, searchCon
 		searchContext.Public,
 		searchContext.ID,
 	))
+	if isUniqueViolation(err) {
+		return nil, searchContextNameAlreadyExists(searchContext)
+	}
 	if err != nil {
 		return nil, err
 	}
@@ -425,6 +985,16 @@ func (s *SearchContextsStore) updateSearchContext(ctx context.Context, searchCon
 	})
 }
 
+func searchContextNameAlreadyExists(searchContext *types.SearchContext) error {
+	return &ErrSearchContextNameAlreadyExists{
+		Name: searchContext.Name,
+		Namespace: SearchContextNamespace{
+			UserID: searchContext.NamespaceUserID,
+			OrgID:  searchContext.NamespaceOrgID,
+		},
+	}
+}
+
 func scanSingleSearchContext(rows *sql.Rows) (*types.SearchContext, error) {
 	searchContexts, err := scanSearchContexts(rows)
 	if err != nil {
@@ -448,6 +1018,7 @@ func scanSearchContexts(rows *sql.Rows) ([]*types.SearchContext, error) {
 			&dbutil.NullInt32{N: &sc.NamespaceUserID},
 			&dbutil.NullInt32{N: &sc.NamespaceOrgID},
 			&sc.UpdatedAt,
+			&dbutil.NullTime{Time: &sc.DeletedAt},
 			&dbutil.NullString{S: &sc.NamespaceUserName},
 			&dbutil.NullString{S: &sc.NamespaceOrgName},
 		)
@@ -466,23 +1037,79 @@ JOIN
 	(SELECT id, name FROM repo WHERE deleted_at IS NULL AND (%s)) r -- populates authzConds
 	ON r.id = sc.repo_id
 WHERE sc.search_context_id = %d
+AND (%s) -- populates exclusionsCond
+`
+
+// searchContextRepositoryExclusionsCond excludes rows of search_context_repos
+// that match an exclusion of the search context.
+const searchContextRepositoryExclusionsCond = `
+NOT EXISTS (
+	SELECT FROM search_context_repo_exclusions e
+	WHERE e.search_context_id = sc.search_context_id
+	AND e.repo_id = sc.repo_id
+	AND (e.revision IS NULL OR e.revision = sc.revision)
+)
+`
+
+var getSearchContextRepositoryRevisionsAsOfFmtStr = `
+SELECT h.repo_id, h.revision, r.name
+FROM search_context_repos_history h
+JOIN
+	(SELECT id, name FROM repo WHERE deleted_at IS NULL AND (%s)) r -- populates authzConds
+	ON r.id = h.repo_id
+WHERE h.search_context_id = %d
+AND h.recorded_at = (
+	SELECT MAX(recorded_at) FROM search_context_repos_history
+	WHERE search_context_id = %d AND recorded_at <= %s
+)
 `
 
+// GetSearchContextRepositoryRevisions returns the current repository revisions of
+// the search context, without the repository revisions that are excluded from it.
 func (s *SearchContextsStore) GetSearchContextRepositoryRevisions(ctx context.Context, searchContextID int64) ([]*types.SearchContextRepositoryRevisions, error) {
 	if Mocks.SearchContexts.GetSearchContextRepositoryRevisions != nil {
 		return Mocks.SearchContexts.GetSearchContextRepositoryRevisions(ctx, searchContextID)
 	}
+	return s.GetSearchContextRepositoryRevisionsAsOf(ctx, searchContextID, time.Time{})
+}
+
+// GetSearchContextRepositoryRevisionsAsOf returns the repository revisions of the
+// search context as of the given time, which allows reproducing searches that ran
+// against an earlier membership of the search context. A zero asOf returns the
+// current repository revisions. Excluded repository revisions are left out, as of
+// the given time for earlier ones. An empty list is returned if no repository
+// revisions were recorded at or before asOf.
+func (s *SearchContextsStore) GetSearchContextRepositoryRevisionsAsOf(ctx context.Context, searchContextID int64, asOf time.Time) ([]*types.SearchContextRepositoryRevisions, error) {
+	return s.getSearchContextRepositoryRevisions(ctx, searchContextID, asOf, true)
+}
 
+func (s *SearchContextsStore) getSearchContextRepositoryRevisions(ctx context.Context, searchContextID int64, asOf time.Time, applyExclusions bool) ([]*types.SearchContextRepositoryRevisions, error) {
 	authzConds, err := AuthzQueryConds(ctx, s.Handle().DB())
 	if err != nil {
 		return nil, err
 	}
 
-	rows, err := s.Query(ctx, sqlf.Sprintf(
+	exclusionsCond := sqlf.Sprintf("TRUE")
+	if applyExclusions {
+		exclusionsCond = sqlf.Sprintf(searchContextRepositoryExclusionsCond)
+	}
+	q := sqlf.Sprintf(
 		getSearchContextRepositoryRevisionsFmtStr,
 		authzConds,
 		searchContextID,
-	))
+		exclusionsCond,
+	)
+	if !asOf.IsZero() {
+		q = sqlf.Sprintf(
+			getSearchContextRepositoryRevisionsAsOfFmtStr,
+			authzConds,
+			searchContextID,
+			searchContextID,
+			asOf,
+		)
+	}
+
+	rows, err := s.Query(ctx, q)
 	if err != nil {
 		return nil, err
 	}
@@ -518,6 +1145,111 @@ func (s *SearchContextsStore) GetSearchContextRepositoryRevisions(ctx context.Co
 	return out, nil
 }
 
+// SetSearchContextRepositoryExclusions replaces the repository revisions that are
+// excluded from the search context. Exclusions with no revisions exclude all
+// revisions of the repository. Like changing the repository revisions, it is
+// recorded in the history and delivered to the audit sink.
+//
+// 🚨 SECURITY: The caller must ensure that the actor is a site admin or has permission to update the search context.
+func (s *SearchContextsStore) SetSearchContextRepositoryExclusions(ctx context.Context, searchContextID int64, exclusions []*types.SearchContextRepositoryRevisions) (err error) {
+	tx, err := s.Transact(ctx)
+	if err != nil {
+		return err
+	}
+	defer func() { err = tx.Done(err) }()
+
+	previous, err := tx.getAuditedSearchContextRepositoryRevisions(ctx, searchContextID)
+	if err != nil {
+		return errors.Wrap(err, "get previous repository revisions")
+	}
+
+	err = tx.Exec(ctx, sqlf.Sprintf("DELETE FROM search_context_repo_exclusions WHERE search_context_id = %d", searchContextID))
+	if err != nil {
+		return err
+	}
+	if len(exclusions) == 0 {
+		return tx.recordSearchContextRepositoryRevisionsChange(ctx, searchContextID, previous)
+	}
+
+	values := make([]*sqlf.Query, 0, len(exclusions))
+	for _, exclusion := range exclusions {
+		if len(exclusion.Revisions) == 0 {
+			values = append(values, sqlf.Sprintf("(%s, %s, NULL)", searchContextID, exclusion.Repo.ID))
+			continue
+		}
+		for _, revision := range exclusion.Revisions {
+			values = append(values, sqlf.Sprintf("(%s, %s, %s)", searchContextID, exclusion.Repo.ID, revision))
+		}
+	}
+
+	err = tx.Exec(ctx, sqlf.Sprintf(
+		"INSERT INTO search_context_repo_exclusions (search_context_id, repo_id, revision) VALUES %s",
+		sqlf.Join(values, ","),
+	))
+	if err != nil {
+		return err
+	}
+
+	return tx.recordSearchContextRepositoryRevisionsChange(ctx, searchContextID, previous)
+}
+
+var getSearchContextRepositoryExclusionsFmtStr = `
+SELECT e.repo_id, e.revision, r.name
+FROM search_context_repo_exclusions e
+JOIN
+	(SELECT id, name FROM repo WHERE deleted_at IS NULL AND (%s)) r -- populates authzConds
+	ON r.id = e.repo_id
+WHERE e.search_context_id = %d
+`
+
+// GetSearchContextRepositoryExclusions returns the repository revisions that are
+// excluded from the search context. Exclusions of all revisions of a repository
+// have no revisions.
+func (s *SearchContextsStore) GetSearchContextRepositoryExclusions(ctx context.Context, searchContextID int64) ([]*types.SearchContextRepositoryRevisions, error) {
+	authzConds, err := AuthzQueryConds(ctx, s.Handle().DB())
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := s.Query(ctx, sqlf.Sprintf(getSearchContextRepositoryExclusionsFmtStr, authzConds, searchContextID))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	exclusionsByRepoID := map[api.RepoID]*types.SearchContextRepositoryRevisions{}
+	for rows.Next() {
+		var repoID int32
+		var repoName string
+		var revision sql.NullString
+		if err := rows.Scan(&repoID, &revision, &repoName); err != nil {
+			return nil, err
+		}
+
+		exclusion, ok := exclusionsByRepoID[api.RepoID(repoID)]
+		if !ok {
+			exclusion = &types.SearchContextRepositoryRevisions{
+				Repo: types.RepoName{ID: api.RepoID(repoID), Name: api.RepoName(repoName)},
+			}
+			exclusionsByRepoID[api.RepoID(repoID)] = exclusion
+		}
+		if revision.Valid {
+			exclusion.Revisions = append(exclusion.Revisions, revision.String)
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	out := make([]*types.SearchContextRepositoryRevisions, 0, len(exclusionsByRepoID))
+	for _, exclusion := range exclusionsByRepoID {
+		sort.Strings(exclusion.Revisions)
+		out = append(out, exclusion)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Repo.ID < out[j].Repo.ID })
+	return out, nil
+}
+
 var getAllRevisionsForRepoFmtStr = `
 SELECT DISTINCT scr.revision
 FROM search_context_repos scr
@@ -558,3 +1290,183 @@ func (s *SearchContextsStore) GetAllRevisionsForRepo(ctx context.Context, repoID
 
 	return revs, nil
 }
+
+// SearchContextExport is the serialized representation of a search context produced by
+// ExportSearchContext and consumed by ImportSearchContext. Repositories are referenced by
+// name so the representation can be imported into another instance.
+type SearchContextExport struct {
+	Name         string                                   `json:"name"`
+	Description  string                                   `json:"description"`
+	Public       bool                                     `json:"public"`
+	Repositories []SearchContextExportRepositoryRevisions `json:"repositories"`
+	// Exclusions are the repository revisions excluded from the search context, an
+	// exclusion with no revisions excludes all revisions of the repository.
+	Exclusions []SearchContextExportRepositoryRevisions `json:"exclusions,omitempty"`
+}
+
+// SearchContextExportRepositoryRevisions is a repository and its revisions contained in
+// an exported search context.
+type SearchContextExportRepositoryRevisions struct {
+	Name      string   `json:"name"`
+	Revisions []string `json:"revisions"`
+}
+
+// SearchContextNamespace is the namespace a search context belongs to. Both fields are
+// zero for instance-level search contexts.
+type SearchContextNamespace struct {
+	UserID int32
+	OrgID  int32
+}
+
+func (n SearchContextNamespace) String() string {
+	switch {
+	case n.UserID != 0:
+		return fmt.Sprintf("the namespace of user %d", n.UserID)
+	case n.OrgID != 0:
+		return fmt.Sprintf("the namespace of org %d", n.OrgID)
+	default:
+		return "the instance-level namespace"
+	}
+}
+
+// ExportSearchContext returns a stable JSON representation of the search context with
+// the given ID, including its repository revisions and exclusions referenced by
+// repository name. Repositories are sorted by name, and revisions are sorted within
+// each repository.
+func (s *SearchContextsStore) ExportSearchContext(ctx context.Context, searchContextID int64) ([]byte, error) {
+	searchContexts, err := s.listSearchContexts(
+		ctx,
+		sqlf.Sprintf("sc.id = %d AND sc.deleted_at IS NULL", searchContextID),
+		getSearchContextOrderByClause(SearchContextsOrderByID, false),
+		1, // limit
+		0, // offset
+	)
+	if err != nil {
+		return nil, err
+	}
+	if len(searchContexts) != 1 {
+		return nil, ErrSearchContextNotFound
+	}
+	searchContext := searchContexts[0]
+
+	// Excluded repository revisions are exported as they are stored along with the
+	// exclusions, so that the exclusions can be lifted after importing.
+	repositoryRevisions, err := s.getSearchContextRepositoryRevisions(ctx, searchContextID, time.Time{}, false)
+	if err != nil {
+		return nil, err
+	}
+	exclusions, err := s.GetSearchContextRepositoryExclusions(ctx, searchContextID)
+	if err != nil {
+		return nil, err
+	}
+
+	export := SearchContextExport{
+		Name:         searchContext.Name,
+		Description:  searchContext.Description,
+		Public:       searchContext.Public,
+		Repositories: exportSearchContextRepositoryRevisions(repositoryRevisions),
+	}
+	if len(exclusions) > 0 {
+		export.Exclusions = exportSearchContextRepositoryRevisions(exclusions)
+	}
+	return json.MarshalIndent(export, "", "  ")
+}
+
+// exportSearchContextRepositoryRevisions returns the exported representation of
+// the repository revisions, sorted by repository name.
+func exportSearchContextRepositoryRevisions(repositoryRevisions []*types.SearchContextRepositoryRevisions) []SearchContextExportRepositoryRevisions {
+	exported := make([]SearchContextExportRepositoryRevisions, 0, len(repositoryRevisions))
+	for _, repoRev := range repositoryRevisions {
+		revisions := append([]string{}, repoRev.Revisions...)
+		sort.Strings(revisions)
+		exported = append(exported, SearchContextExportRepositoryRevisions{
+			Name:      string(repoRev.Repo.Name),
+			Revisions: revisions,
+		})
+	}
+	sort.Slice(exported, func(i, j int) bool { return exported[i].Name < exported[j].Name })
+	return exported
+}
+
+// ImportSearchContext creates a search context in the given namespace from the JSON
+// representation produced by ExportSearchContext, resolving repository names to IDs.
+// It returns an error if any of the repositories does not exist.
+//
+// 🚨 SECURITY: The caller must ensure that the actor is a site admin or has permission to create the search context.
+func (s *SearchContextsStore) ImportSearchContext(ctx context.Context, data []byte, namespace SearchContextNamespace) (_ *types.SearchContext, err error) {
+	var export SearchContextExport
+	if err := json.Unmarshal(data, &export); err != nil {
+		return nil, errors.Wrap(err, "unmarshal search context")
+	}
+
+	names := make([]string, 0, len(export.Repositories)+len(export.Exclusions))
+	for _, repo := range export.Repositories {
+		names = append(names, repo.Name)
+	}
+	for _, repo := range export.Exclusions {
+		names = append(names, repo.Name)
+	}
+
+	repoNames := make(map[string]types.RepoName, len(names))
+	if len(names) > 0 {
+		repos, err := ReposWith(s).ListRepoNames(ctx, ReposListOptions{Names: names})
+		if err != nil {
+			return nil, errors.Wrap(err, "list repositories")
+		}
+		for _, repo := range repos {
+			repoNames[string(repo.Name)] = repo
+		}
+	}
+	resolve := func(exported []SearchContextExportRepositoryRevisions) ([]*types.SearchContextRepositoryRevisions, error) {
+		repositoryRevisions := make([]*types.SearchContextRepositoryRevisions, 0, len(exported))
+		for _, repo := range exported {
+			repoName, ok := repoNames[repo.Name]
+			if !ok {
+				return nil, errors.Errorf("repository %q not found", repo.Name)
+			}
+			repositoryRevisions = append(repositoryRevisions, &types.SearchContextRepositoryRevisions{
+				Repo:      repoName,
+				Revisions: repo.Revisions,
+			})
+		}
+		return repositoryRevisions, nil
+	}
+
+	repositoryRevisions, err := resolve(export.Repositories)
+	if err != nil {
+		return nil, err
+	}
+	exclusions, err := resolve(export.Exclusions)
+	if err != nil {
+		return nil, err
+	}
+
+	tx, err := s.Transact(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { err = tx.Done(err) }()
+
+	searchContext, err := tx.CreateSearchContextWithRepositoryRevisions(
+		ctx,
+		&types.SearchContext{
+			Name:            export.Name,
+			Description:     export.Description,
+			Public:          export.Public,
+			NamespaceUserID: namespace.UserID,
+			NamespaceOrgID:  namespace.OrgID,
+		},
+		repositoryRevisions,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(exclusions) > 0 {
+		err = tx.SetSearchContextRepositoryExclusions(ctx, searchContext.ID, exclusions)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return searchContext, nil
+}
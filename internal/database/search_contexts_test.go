@@ -2,10 +2,14 @@ package database
 
 import (
 	"context"
+	"fmt"
 	"reflect"
+	"sort"
 	"strings"
 	"testing"
+	"time"
 
+	"github.com/cockroachdb/errors"
 	"github.com/google/go-cmp/cmp"
 
 	"github.com/sourcegraph/sourcegraph/internal/actor"
@@ -291,6 +295,338 @@ func TestSearchContexts_PaginationAndCount(t *testing.T) {
 			if !reflect.DeepEqual(tt.wantSearchContexts, gotSearchContexts) {
 				t.Fatalf("wanted %+v search contexts, got %+v", tt.wantSearchContexts, gotSearchContexts)
 			}
+
+			gotCount, err := sc.CountSearchContexts(ctx, tt.options)
+			if err != nil {
+				t.Fatalf("Expected no error, got %s", err)
+			}
+			if gotCount != tt.totalCount {
+				t.Fatalf("wanted %d search contexts in total, got %d", tt.totalCount, gotCount)
+			}
+		})
+	}
+}
+
+func TestSearchContexts_CountByNamespace(t *testing.T) {
+	db := dbtest.NewDB(t, "")
+	t.Parallel()
+	internalCtx := actor.WithInternalActor(context.Background())
+	u := Users(db)
+	o := Orgs(db)
+	sc := SearchContexts(db)
+
+	user1, err := u.Create(internalCtx, NewUser{Username: "u1", Password: "p"})
+	if err != nil {
+		t.Fatalf("Expected no error, got %s", err)
+	}
+	err = u.SetIsSiteAdmin(internalCtx, user1.ID, false)
+	if err != nil {
+		t.Fatalf("Expected no error, got %s", err)
+	}
+	user2, err := u.Create(internalCtx, NewUser{Username: "u2", Password: "p"})
+	if err != nil {
+		t.Fatalf("Expected no error, got %s", err)
+	}
+	displayName := "My Org"
+	org, err := o.Create(internalCtx, "myorg", &displayName)
+	if err != nil {
+		t.Fatalf("Expected no error, got %s", err)
+	}
+
+	created, err := createSearchContexts(internalCtx, sc, []*types.SearchContext{
+		{Name: "instance-1", Public: true},
+		{Name: "instance-2", Public: false},
+		{Name: "user1-1", Public: true, NamespaceUserID: user1.ID},
+		{Name: "user1-2", Public: false, NamespaceUserID: user1.ID},
+		{Name: "user1-3", Public: false, NamespaceUserID: user1.ID},
+		{Name: "user2-1", Public: false, NamespaceUserID: user2.ID},
+		{Name: "org-1", Public: true, NamespaceOrgID: org.ID},
+		{Name: "org-2", Public: false, NamespaceOrgID: org.ID},
+		{Name: "deleted", Public: true, NamespaceUserID: user1.ID},
+	})
+	if err != nil {
+		t.Fatalf("Expected no error, got %s", err)
+	}
+	err = sc.DeleteSearchContext(internalCtx, created[8].ID)
+	if err != nil {
+		t.Fatalf("Expected no error, got %s", err)
+	}
+
+	user1Ctx := actor.WithActor(context.Background(), &actor.Actor{UID: user1.ID})
+	tests := []struct {
+		name    string
+		ctx     context.Context
+		options ListSearchContextsOptions
+		want    int32
+	}{
+		{name: "all", ctx: internalCtx, options: ListSearchContextsOptions{}, want: 8},
+		{name: "instance-level", ctx: internalCtx, options: ListSearchContextsOptions{NoNamespace: true}, want: 2},
+		{name: "user-level", ctx: internalCtx, options: ListSearchContextsOptions{NamespaceUserIDs: []int32{user1.ID}}, want: 3},
+		{name: "org-level", ctx: internalCtx, options: ListSearchContextsOptions{NamespaceOrgIDs: []int32{org.ID}}, want: 2},
+		{name: "user-level including deleted", ctx: internalCtx, options: ListSearchContextsOptions{NamespaceUserIDs: []int32{user1.ID}, IncludeDeleted: true}, want: 4},
+		{name: "user-level by name prefix", ctx: internalCtx, options: ListSearchContextsOptions{NamespaceUserIDs: []int32{user1.ID}, NamePrefix: "user1-"}, want: 3},
+		{name: "by name prefix across namespaces", ctx: internalCtx, options: ListSearchContextsOptions{NamePrefix: "user"}, want: 4},
+		{name: "visible to user1", ctx: user1Ctx, options: ListSearchContextsOptions{}, want: 5},
+		{name: "instance-level visible to user1", ctx: user1Ctx, options: ListSearchContextsOptions{NoNamespace: true}, want: 1},
+		{name: "user-level visible to user1", ctx: user1Ctx, options: ListSearchContextsOptions{NamespaceUserIDs: []int32{user1.ID, user2.ID}}, want: 3},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := sc.CountSearchContexts(tt.ctx, tt.options)
+			if err != nil {
+				t.Fatalf("Expected no error, got %s", err)
+			}
+			if got != tt.want {
+				t.Fatalf("wanted %d search contexts, got %d", tt.want, got)
+			}
+		})
+	}
+}
+
+func TestSearchContexts_ListPaged(t *testing.T) {
+	db := dbtest.NewDB(t, "")
+	t.Parallel()
+	ctx := actor.WithInternalActor(context.Background())
+	u := Users(db)
+	sc := SearchContexts(db)
+
+	user, err := u.Create(ctx, NewUser{Username: "u", Password: "p"})
+	if err != nil {
+		t.Fatalf("Expected no error, got %s", err)
+	}
+
+	// Create the search contexts in reverse order of their names, and use the same
+	// names in different namespaces so that the ID breaks ties.
+	var searchContexts []*types.SearchContext
+	for i := 12; i >= 0; i-- {
+		name := fmt.Sprintf("ctx-%02d", i)
+		searchContexts = append(searchContexts, &types.SearchContext{Name: name, Public: true, NamespaceUserID: user.ID})
+		if i > 0 {
+			searchContexts = append(searchContexts, &types.SearchContext{Name: name, Public: true})
+		}
+	}
+	createdSearchContexts, err := createSearchContexts(ctx, sc, searchContexts)
+	if err != nil {
+		t.Fatalf("Expected no error, got %s", err)
+	}
+	if len(createdSearchContexts) != 25 {
+		t.Fatalf("wanted 25 search contexts, got %d", len(createdSearchContexts))
+	}
+
+	wantSearchContexts := append([]*types.SearchContext{}, createdSearchContexts...)
+	sort.Slice(wantSearchContexts, func(i, j int) bool {
+		if wantSearchContexts[i].Name != wantSearchContexts[j].Name {
+			return wantSearchContexts[i].Name < wantSearchContexts[j].Name
+		}
+		return wantSearchContexts[i].ID < wantSearchContexts[j].ID
+	})
+
+	var (
+		gotSearchContexts []*types.SearchContext
+		pageSizes         []int
+		after             *SearchContextsCursor
+	)
+	for {
+		page, next, err := sc.ListSearchContextsPaged(ctx, 10, after, ListSearchContextsOptions{})
+		if err != nil {
+			t.Fatalf("Expected no error, got %s", err)
+		}
+		gotSearchContexts = append(gotSearchContexts, page...)
+		pageSizes = append(pageSizes, len(page))
+		if next == nil {
+			break
+		}
+		if len(pageSizes) > 3 {
+			t.Fatalf("wanted 3 pages, got more with page sizes %v", pageSizes)
+		}
+		after = next
+	}
+
+	if diff := cmp.Diff([]int{10, 10, 5}, pageSizes); diff != "" {
+		t.Errorf("page sizes mismatch (-want +got):\n%s", diff)
+	}
+	if diff := cmp.Diff(wantSearchContexts, gotSearchContexts); diff != "" {
+		t.Errorf("search contexts mismatch (-want +got):\n%s", diff)
+	}
+
+	// The options filter the pages the same way as ListSearchContexts.
+	page, next, err := sc.ListSearchContextsPaged(ctx, 10, nil, ListSearchContextsOptions{NoNamespace: true, Name: "ctx-1"})
+	if err != nil {
+		t.Fatalf("Expected no error, got %s", err)
+	}
+	if next != nil {
+		t.Errorf("wanted no next cursor, got %+v", next)
+	}
+	if diff := cmp.Diff([]string{"ctx-01", "ctx-10", "ctx-11", "ctx-12"}, getSearchContextNames(page)); diff != "" {
+		t.Errorf("search context names mismatch (-want +got):\n%s", diff)
+	}
+
+	if _, _, err := sc.ListSearchContextsPaged(ctx, 0, nil, ListSearchContextsOptions{}); err == nil {
+		t.Error("Expected an error for a non-positive page size")
+	}
+}
+
+func TestSearchContexts_ListByNamePrefix(t *testing.T) {
+	db := dbtest.NewDB(t, "")
+	t.Parallel()
+	internalCtx := actor.WithInternalActor(context.Background())
+	u := Users(db)
+	sc := SearchContexts(db)
+
+	user1, err := u.Create(internalCtx, NewUser{Username: "u1", Password: "p"})
+	if err != nil {
+		t.Fatalf("Expected no error, got %s", err)
+	}
+	user2, err := u.Create(internalCtx, NewUser{Username: "u2", Password: "p"})
+	if err != nil {
+		t.Fatalf("Expected no error, got %s", err)
+	}
+
+	_, err = createSearchContexts(internalCtx, sc, []*types.SearchContext{
+		{Name: "frontend", Public: true},
+		{Name: "frontend-e2e", Public: true, NamespaceUserID: user1.ID},
+		{Name: "backend", Public: true},
+		{Name: "my-frontend", Public: true},
+		{Name: "Frontend-private", Public: false, NamespaceUserID: user2.ID},
+		{Name: "front_end", Public: true},
+	})
+	if err != nil {
+		t.Fatalf("Expected no error, got %s", err)
+	}
+
+	tests := []struct {
+		name      string
+		ctx       context.Context
+		options   ListSearchContextsOptions
+		wantNames []string
+	}{
+		{
+			name:      "prefix",
+			ctx:       actor.WithActor(context.Background(), &actor.Actor{UID: user1.ID}),
+			options:   ListSearchContextsOptions{NamePrefix: "front"},
+			wantNames: []string{"front_end", "frontend", "frontend-e2e"},
+		},
+		{
+			name:      "prefix is case-insensitive",
+			ctx:       actor.WithActor(context.Background(), &actor.Actor{UID: user1.ID}),
+			options:   ListSearchContextsOptions{NamePrefix: "FRONTEND"},
+			wantNames: []string{"frontend", "frontend-e2e"},
+		},
+		{
+			name:      "private contexts of the user are included",
+			ctx:       actor.WithActor(context.Background(), &actor.Actor{UID: user2.ID}),
+			options:   ListSearchContextsOptions{NamePrefix: "frontend"},
+			wantNames: []string{"Frontend-private", "frontend", "frontend-e2e"},
+		},
+		{
+			name:      "prefix with namespace",
+			ctx:       actor.WithActor(context.Background(), &actor.Actor{UID: user1.ID}),
+			options:   ListSearchContextsOptions{NamePrefix: "front", NoNamespace: true},
+			wantNames: []string{"front_end", "frontend"},
+		},
+		{
+			name:      "special characters are matched literally",
+			ctx:       actor.WithActor(context.Background(), &actor.Actor{UID: user1.ID}),
+			options:   ListSearchContextsOptions{NamePrefix: "front_"},
+			wantNames: []string{"front_end"},
+		},
+		{
+			name:      "no match",
+			ctx:       actor.WithActor(context.Background(), &actor.Actor{UID: user1.ID}),
+			options:   ListSearchContextsOptions{NamePrefix: "end"},
+			wantNames: []string{},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			page, _, err := sc.ListSearchContextsPaged(tt.ctx, 10, nil, tt.options)
+			if err != nil {
+				t.Fatalf("Expected no error, got %s", err)
+			}
+			// The order of names with punctuation depends on the collation of the database.
+			gotNames := getSearchContextNames(page)
+			sort.Strings(gotNames)
+			if diff := cmp.Diff(tt.wantNames, gotNames); diff != "" {
+				t.Errorf("search context names mismatch (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestSearchContexts_ListNamespaces(t *testing.T) {
+	db := dbtest.NewDB(t, "")
+	t.Parallel()
+	ctx := actor.WithInternalActor(context.Background())
+	u := Users(db)
+	o := Orgs(db)
+	sc := SearchContexts(db)
+
+	user1, err := u.Create(ctx, NewUser{Username: "u1", Password: "p"})
+	if err != nil {
+		t.Fatalf("Expected no error, got %s", err)
+	}
+	user2, err := u.Create(ctx, NewUser{Username: "u2", Password: "p"})
+	if err != nil {
+		t.Fatalf("Expected no error, got %s", err)
+	}
+	org, err := o.Create(ctx, "myorg", nil)
+	if err != nil {
+		t.Fatalf("Expected no error, got %s", err)
+	}
+
+	createdSearchContexts, err := createSearchContexts(ctx, sc, []*types.SearchContext{
+		{Name: "instance", Public: true},
+		{Name: "user1-v1", Public: true, NamespaceUserID: user1.ID},
+		{Name: "user2-v1", Public: true, NamespaceUserID: user2.ID},
+		{Name: "user2-v2", Public: false, NamespaceUserID: user2.ID},
+		{Name: "user2-v3", Public: true, NamespaceUserID: user2.ID},
+		{Name: "org-v1", Public: true, NamespaceOrgID: org.ID},
+		{Name: "org-v2", Public: true, NamespaceOrgID: org.ID},
+	})
+	if err != nil {
+		t.Fatalf("Expected no error, got %s", err)
+	}
+
+	// Deleted search contexts are not counted.
+	err = sc.DeleteSearchContext(ctx, createdSearchContexts[4].ID)
+	if err != nil {
+		t.Fatalf("Expected no error, got %s", err)
+	}
+
+	tests := []struct {
+		name    string
+		options ListSearchContextsOptions
+		want    []*SearchContextNamespaceCount
+	}{
+		{
+			name: "all namespaces",
+			want: []*SearchContextNamespaceCount{
+				{Namespace: SearchContextNamespace{UserID: user2.ID}, Count: 2},
+				{Namespace: SearchContextNamespace{OrgID: org.ID}, Count: 2},
+				{Namespace: SearchContextNamespace{UserID: user1.ID}, Count: 1},
+			},
+		},
+		{
+			name:    "filtered by name",
+			options: ListSearchContextsOptions{Name: "-v1"},
+			want: []*SearchContextNamespaceCount{
+				{Namespace: SearchContextNamespace{UserID: user1.ID}, Count: 1},
+				{Namespace: SearchContextNamespace{UserID: user2.ID}, Count: 1},
+				{Namespace: SearchContextNamespace{OrgID: org.ID}, Count: 1},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := sc.ListSearchContextNamespaces(ctx, tt.options)
+			if err != nil {
+				t.Fatalf("Expected no error, got %s", err)
+			}
+			if diff := cmp.Diff(tt.want, got); diff != "" {
+				t.Fatalf("namespaces mismatch (-want +got):\n%s", diff)
+			}
 		})
 	}
 }
@@ -349,72 +685,726 @@ func TestSearchContexts_CaseInsensitiveNames(t *testing.T) {
 			if expectErr && err == nil {
 				t.Fatalf("wanted error, got none")
 			}
-			if expectErr && err != nil && !strings.Contains(err.Error(), tt.wantErr) {
-				t.Fatalf("wanted error containing %s, got %s", tt.wantErr, err)
+			if expectErr && err != nil && !strings.Contains(err.Error(), tt.wantErr) {
+				t.Fatalf("wanted error containing %s, got %s", tt.wantErr, err)
+			}
+		})
+	}
+}
+
+func TestSearchContexts_CreateAndSetRepositoryRevisions(t *testing.T) {
+	db := dbtest.NewDB(t, "")
+	t.Parallel()
+	ctx := actor.WithInternalActor(context.Background())
+	sc := SearchContexts(db)
+	r := Repos(db)
+
+	err := r.Create(ctx, &types.Repo{Name: "testA", URI: "https://example.com/a"}, &types.Repo{Name: "testB", URI: "https://example.com/b"})
+	if err != nil {
+		t.Fatalf("Expected no error, got %s", err)
+	}
+	repoA, err := r.GetByName(ctx, "testA")
+	if err != nil {
+		t.Fatalf("Expected no error, got %s", err)
+	}
+	repoB, err := r.GetByName(ctx, "testB")
+	if err != nil {
+		t.Fatalf("Expected no error, got %s", err)
+	}
+
+	repoAName := types.RepoName{ID: repoA.ID, Name: repoA.Name}
+	repoBName := types.RepoName{ID: repoB.ID, Name: repoB.Name}
+
+	// Create a search context with initial repository revisions
+	initialRepositoryRevisions := []*types.SearchContextRepositoryRevisions{
+		{Repo: repoAName, Revisions: []string{"branch-1", "branch-6"}},
+		{Repo: repoBName, Revisions: []string{"branch-2"}},
+	}
+	searchContext, err := sc.CreateSearchContextWithRepositoryRevisions(
+		ctx,
+		&types.SearchContext{Name: "sc", Description: "sc", Public: true},
+		initialRepositoryRevisions,
+	)
+	if err != nil {
+		t.Fatalf("Expected no error, got %s", err)
+	}
+	gotRepositoryRevisions, err := sc.GetSearchContextRepositoryRevisions(ctx, searchContext.ID)
+	if err != nil {
+		t.Fatalf("Expected no error, got %s", err)
+	}
+	if !reflect.DeepEqual(initialRepositoryRevisions, gotRepositoryRevisions) {
+		t.Fatalf("wanted %v repository revisions, got %v", initialRepositoryRevisions, gotRepositoryRevisions)
+	}
+
+	// Modify the repository revisions for the search context
+	modifiedRepositoryRevisions := []*types.SearchContextRepositoryRevisions{
+		{Repo: repoAName, Revisions: []string{"branch-1", "branch-3"}},
+		{Repo: repoBName, Revisions: []string{"branch-0", "branch-2", "branch-4"}},
+	}
+	err = sc.SetSearchContextRepositoryRevisions(ctx, searchContext.ID, modifiedRepositoryRevisions)
+	if err != nil {
+		t.Fatalf("Expected no error, got %s", err)
+	}
+	gotRepositoryRevisions, err = sc.GetSearchContextRepositoryRevisions(ctx, searchContext.ID)
+	if err != nil {
+		t.Fatalf("Expected no error, got %s", err)
+	}
+	if !reflect.DeepEqual(modifiedRepositoryRevisions, gotRepositoryRevisions) {
+		t.Fatalf("wanted %v repository revisions, got %v", modifiedRepositoryRevisions, gotRepositoryRevisions)
+	}
+
+	// Duplicate repositories and revisions are stored once
+	err = sc.SetSearchContextRepositoryRevisions(ctx, searchContext.ID, []*types.SearchContextRepositoryRevisions{
+		{Repo: repoAName, Revisions: []string{"branch-1", "branch-1"}},
+		{Repo: repoBName, Revisions: []string{"branch-2"}},
+		{Repo: repoAName, Revisions: []string{"branch-5", "branch-1"}},
+	})
+	if err != nil {
+		t.Fatalf("Expected no error, got %s", err)
+	}
+	gotRepositoryRevisions, err = sc.GetSearchContextRepositoryRevisions(ctx, searchContext.ID)
+	if err != nil {
+		t.Fatalf("Expected no error, got %s", err)
+	}
+	wantRepositoryRevisions := []*types.SearchContextRepositoryRevisions{
+		{Repo: repoAName, Revisions: []string{"branch-1", "branch-5"}},
+		{Repo: repoBName, Revisions: []string{"branch-2"}},
+	}
+	if diff := cmp.Diff(wantRepositoryRevisions, gotRepositoryRevisions); diff != "" {
+		t.Fatalf("repository revisions mismatch (-want +got):\n%s", diff)
+	}
+
+	// A repository without revisions is rejected and the stored revisions are kept
+	err = sc.SetSearchContextRepositoryRevisions(ctx, searchContext.ID, []*types.SearchContextRepositoryRevisions{
+		{Repo: repoAName, Revisions: []string{"branch-1"}},
+		{Repo: repoBName},
+	})
+	if err == nil {
+		t.Fatal("Expected an error for a repository without revisions")
+	}
+	gotRepositoryRevisions, err = sc.GetSearchContextRepositoryRevisions(ctx, searchContext.ID)
+	if err != nil {
+		t.Fatalf("Expected no error, got %s", err)
+	}
+	if diff := cmp.Diff(wantRepositoryRevisions, gotRepositoryRevisions); diff != "" {
+		t.Fatalf("repository revisions mismatch (-want +got):\n%s", diff)
+	}
+}
+
+func TestSearchContexts_RepositoryExclusions(t *testing.T) {
+	db := dbtest.NewDB(t, "")
+	t.Parallel()
+	ctx := actor.WithInternalActor(context.Background())
+	sc := SearchContexts(db)
+	r := Repos(db)
+
+	err := r.Create(ctx, &types.Repo{Name: "testA", URI: "https://example.com/a"}, &types.Repo{Name: "testB", URI: "https://example.com/b"})
+	if err != nil {
+		t.Fatalf("Expected no error, got %s", err)
+	}
+	repoA, err := r.GetByName(ctx, "testA")
+	if err != nil {
+		t.Fatalf("Expected no error, got %s", err)
+	}
+	repoB, err := r.GetByName(ctx, "testB")
+	if err != nil {
+		t.Fatalf("Expected no error, got %s", err)
+	}
+
+	repoAName := types.RepoName{ID: repoA.ID, Name: repoA.Name}
+	repoBName := types.RepoName{ID: repoB.ID, Name: repoB.Name}
+
+	repositoryRevisions := []*types.SearchContextRepositoryRevisions{
+		{Repo: repoAName, Revisions: []string{"branch-1", "branch-2", "branch-3"}},
+		{Repo: repoBName, Revisions: []string{"branch-1"}},
+	}
+	searchContext, err := sc.CreateSearchContextWithRepositoryRevisions(
+		ctx,
+		&types.SearchContext{Name: "sc", Description: "sc", Public: true},
+		repositoryRevisions,
+	)
+	if err != nil {
+		t.Fatalf("Expected no error, got %s", err)
+	}
+
+	// Exclude a single revision of repo A and all revisions of repo B
+	exclusions := []*types.SearchContextRepositoryRevisions{
+		{Repo: repoAName, Revisions: []string{"branch-2"}},
+		{Repo: repoBName},
+	}
+	err = sc.SetSearchContextRepositoryExclusions(ctx, searchContext.ID, exclusions)
+	if err != nil {
+		t.Fatalf("Expected no error, got %s", err)
+	}
+
+	gotExclusions, err := sc.GetSearchContextRepositoryExclusions(ctx, searchContext.ID)
+	if err != nil {
+		t.Fatalf("Expected no error, got %s", err)
+	}
+	if !reflect.DeepEqual(exclusions, gotExclusions) {
+		t.Fatalf("wanted %v exclusions, got %v", exclusions, gotExclusions)
+	}
+
+	wantRepositoryRevisions := []*types.SearchContextRepositoryRevisions{
+		{Repo: repoAName, Revisions: []string{"branch-1", "branch-3"}},
+	}
+	gotRepositoryRevisions, err := sc.GetSearchContextRepositoryRevisions(ctx, searchContext.ID)
+	if err != nil {
+		t.Fatalf("Expected no error, got %s", err)
+	}
+	if !reflect.DeepEqual(wantRepositoryRevisions, gotRepositoryRevisions) {
+		t.Fatalf("wanted %v repository revisions, got %v", wantRepositoryRevisions, gotRepositoryRevisions)
+	}
+
+	// Removing the exclusions restores the full set of repository revisions
+	err = sc.SetSearchContextRepositoryExclusions(ctx, searchContext.ID, nil)
+	if err != nil {
+		t.Fatalf("Expected no error, got %s", err)
+	}
+	gotRepositoryRevisions, err = sc.GetSearchContextRepositoryRevisions(ctx, searchContext.ID)
+	if err != nil {
+		t.Fatalf("Expected no error, got %s", err)
+	}
+	if !reflect.DeepEqual(repositoryRevisions, gotRepositoryRevisions) {
+		t.Fatalf("wanted %v repository revisions, got %v", repositoryRevisions, gotRepositoryRevisions)
+	}
+}
+
+func TestSearchContexts_ExportAndImport(t *testing.T) {
+	db := dbtest.NewDB(t, "")
+	t.Parallel()
+	ctx := actor.WithInternalActor(context.Background())
+	u := Users(db)
+	sc := SearchContexts(db)
+	r := Repos(db)
+
+	user, err := u.Create(ctx, NewUser{Username: "u", Password: "p"})
+	if err != nil {
+		t.Fatalf("Expected no error, got %s", err)
+	}
+
+	err = r.Create(ctx, &types.Repo{Name: "testA", URI: "https://example.com/a"}, &types.Repo{Name: "testB", URI: "https://example.com/b"})
+	if err != nil {
+		t.Fatalf("Expected no error, got %s", err)
+	}
+	repoA, err := r.GetByName(ctx, "testA")
+	if err != nil {
+		t.Fatalf("Expected no error, got %s", err)
+	}
+	repoB, err := r.GetByName(ctx, "testB")
+	if err != nil {
+		t.Fatalf("Expected no error, got %s", err)
+	}
+
+	repositoryRevisions := []*types.SearchContextRepositoryRevisions{
+		{Repo: types.RepoName{ID: repoA.ID, Name: repoA.Name}, Revisions: []string{"branch-1", "branch-6"}},
+		{Repo: types.RepoName{ID: repoB.ID, Name: repoB.Name}, Revisions: []string{"branch-2"}},
+	}
+	exported, err := sc.CreateSearchContextWithRepositoryRevisions(
+		ctx,
+		&types.SearchContext{Name: "sc", Description: "sc description", Public: true},
+		repositoryRevisions,
+	)
+	if err != nil {
+		t.Fatalf("Expected no error, got %s", err)
+	}
+	exclusions := []*types.SearchContextRepositoryRevisions{
+		{Repo: types.RepoName{ID: repoA.ID, Name: repoA.Name}, Revisions: []string{"branch-6"}},
+		{Repo: types.RepoName{ID: repoB.ID, Name: repoB.Name}},
+	}
+	err = sc.SetSearchContextRepositoryExclusions(ctx, exported.ID, exclusions)
+	if err != nil {
+		t.Fatalf("Expected no error, got %s", err)
+	}
+
+	data, err := sc.ExportSearchContext(ctx, exported.ID)
+	if err != nil {
+		t.Fatalf("Expected no error, got %s", err)
+	}
+
+	imported, err := sc.ImportSearchContext(ctx, data, SearchContextNamespace{UserID: user.ID})
+	if err != nil {
+		t.Fatalf("Expected no error, got %s", err)
+	}
+
+	if imported.Name != exported.Name || imported.Description != exported.Description || imported.Public != exported.Public {
+		t.Fatalf("wanted imported search context to equal %+v, got %+v", exported, imported)
+	}
+	if imported.NamespaceUserID != user.ID {
+		t.Fatalf("wanted imported search context in namespace of user %d, got %d", user.ID, imported.NamespaceUserID)
+	}
+
+	gotRepositoryRevisions, err := sc.GetSearchContextRepositoryRevisions(ctx, imported.ID)
+	if err != nil {
+		t.Fatalf("Expected no error, got %s", err)
+	}
+	wantRepositoryRevisions := []*types.SearchContextRepositoryRevisions{
+		{Repo: types.RepoName{ID: repoA.ID, Name: repoA.Name}, Revisions: []string{"branch-1"}},
+	}
+	if diff := cmp.Diff(wantRepositoryRevisions, gotRepositoryRevisions); diff != "" {
+		t.Fatalf("repository revisions mismatch (-want +got):\n%s", diff)
+	}
+
+	gotExclusions, err := sc.GetSearchContextRepositoryExclusions(ctx, imported.ID)
+	if err != nil {
+		t.Fatalf("Expected no error, got %s", err)
+	}
+	if diff := cmp.Diff(exclusions, gotExclusions); diff != "" {
+		t.Fatalf("exclusions mismatch (-want +got):\n%s", diff)
+	}
+
+	// Exporting the imported search context should produce the same representation.
+	reexported, err := sc.ExportSearchContext(ctx, imported.ID)
+	if err != nil {
+		t.Fatalf("Expected no error, got %s", err)
+	}
+	if diff := cmp.Diff(string(data), string(reexported)); diff != "" {
+		t.Fatalf("exported search context mismatch (-want +got):\n%s", diff)
+	}
+
+	t.Run("unknown repository", func(t *testing.T) {
+		data := []byte(`{"name":"unknown","repositories":[{"name":"testC","revisions":["main"]}]}`)
+		_, err := sc.ImportSearchContext(ctx, data, SearchContextNamespace{})
+		if err == nil || !strings.Contains(err.Error(), `repository "testC" not found`) {
+			t.Fatalf("wanted repository not found error, got %v", err)
+		}
+	})
+}
+
+func TestSearchContexts_ListModifiedSince(t *testing.T) {
+	db := dbtest.NewDB(t, "")
+	t.Parallel()
+	ctx := actor.WithInternalActor(context.Background())
+	sc := SearchContexts(db)
+	r := Repos(db)
+
+	err := r.Create(ctx, &types.Repo{Name: "testA", URI: "https://example.com/a"})
+	if err != nil {
+		t.Fatalf("Expected no error, got %s", err)
+	}
+	repoA, err := r.GetByName(ctx, "testA")
+	if err != nil {
+		t.Fatalf("Expected no error, got %s", err)
+	}
+
+	searchContexts, err := createSearchContexts(ctx, sc, []*types.SearchContext{
+		{Name: "A", Public: true},
+		{Name: "B", Public: true},
+		{Name: "C", Public: true},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	since := searchContexts[2].UpdatedAt
+
+	// Only modify the properties of B and repository revisions of A.
+	_, err = sc.UpdateSearchContextWithRepositoryRevisions(ctx, &types.SearchContext{ID: searchContexts[1].ID, Name: "B", Description: "modified", Public: true}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = sc.SetSearchContextRepositoryRevisions(ctx, searchContexts[0].ID, []*types.SearchContextRepositoryRevisions{
+		{Repo: types.RepoName{ID: repoA.ID, Name: repoA.Name}, Revisions: []string{"main"}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	gotSearchContexts, err := sc.ListSearchContextsModifiedSince(ctx, since, ListSearchContextsOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff([]string{"B", "A"}, getSearchContextNames(gotSearchContexts)); diff != "" {
+		t.Fatalf("search contexts mismatch (-want +got):\n%s", diff)
+	}
+
+	gotSearchContexts, err = sc.ListSearchContextsModifiedSince(ctx, since, ListSearchContextsOptions{Name: "A"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff([]string{"A"}, getSearchContextNames(gotSearchContexts)); diff != "" {
+		t.Fatalf("search contexts mismatch (-want +got):\n%s", diff)
+	}
+
+	// Deleting C is a modification that is reported along with the deleted search
+	// contexts.
+	err = sc.DeleteSearchContext(ctx, searchContexts[2].ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	gotSearchContexts, err = sc.ListSearchContextsModifiedSince(ctx, since, ListSearchContextsOptions{IncludeDeleted: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff([]string{"B", "A", "C"}, getSearchContextNames(gotSearchContexts)); diff != "" {
+		t.Fatalf("search contexts mismatch (-want +got):\n%s", diff)
+	}
+	if gotSearchContexts[2].DeletedAt.IsZero() {
+		t.Fatalf("wanted C to be reported as deleted, got %+v", gotSearchContexts[2])
+	}
+
+	gotSearchContexts, err = sc.ListSearchContextsModifiedSince(ctx, since, ListSearchContextsOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff([]string{"B", "A"}, getSearchContextNames(gotSearchContexts)); diff != "" {
+		t.Fatalf("search contexts mismatch (-want +got):\n%s", diff)
+	}
+
+	// Changing the exclusions of B is a modification of its repository revisions.
+	err = db.QueryRowContext(ctx, "SELECT GREATEST(updated_at, repositories_updated_at) FROM search_contexts WHERE id = $1", searchContexts[0].ID).Scan(&since)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = sc.SetSearchContextRepositoryExclusions(ctx, searchContexts[1].ID, []*types.SearchContextRepositoryRevisions{
+		{Repo: types.RepoName{ID: repoA.ID, Name: repoA.Name}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	gotSearchContexts, err = sc.ListSearchContextsModifiedSince(ctx, since, ListSearchContextsOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff([]string{"B"}, getSearchContextNames(gotSearchContexts)); diff != "" {
+		t.Fatalf("search contexts mismatch (-want +got):\n%s", diff)
+	}
+}
+
+func TestSearchContexts_GetRepositoryRevisionsAsOf(t *testing.T) {
+	db := dbtest.NewDB(t, "")
+	t.Parallel()
+	ctx := actor.WithInternalActor(context.Background())
+	sc := SearchContexts(db)
+	r := Repos(db)
+
+	err := r.Create(ctx, &types.Repo{Name: "testA", URI: "https://example.com/a"}, &types.Repo{Name: "testB", URI: "https://example.com/b"})
+	if err != nil {
+		t.Fatalf("Expected no error, got %s", err)
+	}
+	repoA, err := r.GetByName(ctx, "testA")
+	if err != nil {
+		t.Fatalf("Expected no error, got %s", err)
+	}
+	repoB, err := r.GetByName(ctx, "testB")
+	if err != nil {
+		t.Fatalf("Expected no error, got %s", err)
+	}
+
+	searchContexts, err := createSearchContexts(ctx, sc, []*types.SearchContext{{Name: "A", Public: true}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	searchContextID := searchContexts[0].ID
+
+	lastRecordedAt := func(t *testing.T) time.Time {
+		t.Helper()
+
+		var recordedAt time.Time
+		err := db.QueryRowContext(ctx, "SELECT MAX(recorded_at) FROM search_context_repos_history WHERE search_context_id = $1", searchContextID).Scan(&recordedAt)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return recordedAt
+	}
+
+	v1 := []*types.SearchContextRepositoryRevisions{
+		{Repo: types.RepoName{ID: repoA.ID, Name: repoA.Name}, Revisions: []string{"main"}},
+	}
+	if err = sc.SetSearchContextRepositoryRevisions(ctx, searchContextID, v1); err != nil {
+		t.Fatal(err)
+	}
+	v1RecordedAt := lastRecordedAt(t)
+
+	v2 := []*types.SearchContextRepositoryRevisions{
+		{Repo: types.RepoName{ID: repoA.ID, Name: repoA.Name}, Revisions: []string{"branch-1", "main"}},
+		{Repo: types.RepoName{ID: repoB.ID, Name: repoB.Name}, Revisions: []string{"main"}},
+	}
+	if err = sc.SetSearchContextRepositoryRevisions(ctx, searchContextID, v2); err != nil {
+		t.Fatal(err)
+	}
+	v2RecordedAt := lastRecordedAt(t)
+
+	// Exclusions are recorded in the history like changes of repository revisions.
+	err = sc.SetSearchContextRepositoryExclusions(ctx, searchContextID, []*types.SearchContextRepositoryRevisions{
+		{Repo: types.RepoName{ID: repoA.ID, Name: repoA.Name}, Revisions: []string{"branch-1"}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	v3RecordedAt := lastRecordedAt(t)
+	v3 := []*types.SearchContextRepositoryRevisions{
+		{Repo: types.RepoName{ID: repoA.ID, Name: repoA.Name}, Revisions: []string{"main"}},
+		{Repo: types.RepoName{ID: repoB.ID, Name: repoB.Name}, Revisions: []string{"main"}},
+	}
+
+	tests := []struct {
+		name string
+		asOf time.Time
+		want []*types.SearchContextRepositoryRevisions
+	}{
+		{
+			name: "before any membership",
+			asOf: v1RecordedAt.Add(-time.Microsecond),
+			want: []*types.SearchContextRepositoryRevisions{},
+		},
+		{
+			name: "first membership",
+			asOf: v1RecordedAt,
+			want: v1,
+		},
+		{
+			name: "between modifications",
+			asOf: v2RecordedAt.Add(-time.Microsecond),
+			want: v1,
+		},
+		{
+			name: "before exclusions",
+			asOf: v3RecordedAt.Add(-time.Microsecond),
+			want: v2,
+		},
+		{
+			name: "latest membership",
+			asOf: v3RecordedAt.Add(time.Hour),
+			want: v3,
+		},
+		{
+			name: "zero time returns current membership",
+			want: v3,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, err := sc.GetSearchContextRepositoryRevisionsAsOf(ctx, searchContextID, test.asOf)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if diff := cmp.Diff(test.want, got); diff != "" {
+				t.Fatalf("repository revisions mismatch (-want +got):\n%s", diff)
 			}
 		})
 	}
 }
 
-func TestSearchContexts_CreateAndSetRepositoryRevisions(t *testing.T) {
+func TestNormalizeSearchContextRepositoryRevisions(t *testing.T) {
+	repoA := types.RepoName{ID: 1, Name: "testA"}
+	repoB := types.RepoName{ID: 2, Name: "testB"}
+
+	got, err := normalizeSearchContextRepositoryRevisions([]*types.SearchContextRepositoryRevisions{
+		{Repo: repoB, Revisions: []string{"branch-3", "branch-1", "branch-3"}},
+		{Repo: repoA, Revisions: []string{"branch-1", "branch-1"}},
+		{Repo: repoB, Revisions: []string{"branch-2", "branch-1"}},
+	})
+	if err != nil {
+		t.Fatalf("Expected no error, got %s", err)
+	}
+	want := []*types.SearchContextRepositoryRevisions{
+		{Repo: repoB, Revisions: []string{"branch-3", "branch-1", "branch-2"}},
+		{Repo: repoA, Revisions: []string{"branch-1"}},
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Fatalf("normalized mismatch (-want +got):\n%s", diff)
+	}
+
+	_, err = normalizeSearchContextRepositoryRevisions([]*types.SearchContextRepositoryRevisions{
+		{Repo: repoA, Revisions: []string{"branch-1"}},
+		{Repo: repoB, Revisions: []string{}},
+	})
+	if err == nil {
+		t.Fatal("Expected an error for a repository without revisions")
+	}
+}
+
+func TestDiffSearchContextRepositoryRevisions(t *testing.T) {
+	repoA := types.RepoName{ID: 1, Name: "testA"}
+	repoB := types.RepoName{ID: 2, Name: "testB"}
+	repoC := types.RepoName{ID: 3, Name: "testC"}
+
+	previous := []*types.SearchContextRepositoryRevisions{
+		{Repo: repoA, Revisions: []string{"branch-1", "branch-2"}},
+		{Repo: repoB, Revisions: []string{"branch-3"}},
+	}
+	next := []*types.SearchContextRepositoryRevisions{
+		{Repo: repoA, Revisions: []string{"branch-2", "branch-4"}},
+		{Repo: repoC, Revisions: []string{"branch-5"}},
+	}
+
+	added, removed := diffSearchContextRepositoryRevisions(previous, next)
+
+	wantAdded := []*types.SearchContextRepositoryRevisions{
+		{Repo: repoA, Revisions: []string{"branch-4"}},
+		{Repo: repoC, Revisions: []string{"branch-5"}},
+	}
+	if diff := cmp.Diff(wantAdded, added); diff != "" {
+		t.Fatalf("added mismatch (-want +got):\n%s", diff)
+	}
+
+	wantRemoved := []*types.SearchContextRepositoryRevisions{
+		{Repo: repoA, Revisions: []string{"branch-1"}},
+		{Repo: repoB, Revisions: []string{"branch-3"}},
+	}
+	if diff := cmp.Diff(wantRemoved, removed); diff != "" {
+		t.Fatalf("removed mismatch (-want +got):\n%s", diff)
+	}
+
+	added, removed = diffSearchContextRepositoryRevisions(previous, previous)
+	if len(added) > 0 || len(removed) > 0 {
+		t.Fatalf("wanted no changes, got added %v and removed %v", added, removed)
+	}
+}
+
+func TestSearchContexts_AuditRepositoryRevisionsChange(t *testing.T) {
 	db := dbtest.NewDB(t, "")
 	t.Parallel()
-	ctx := actor.WithInternalActor(context.Background())
-	sc := SearchContexts(db)
+	internalCtx := actor.WithInternalActor(context.Background())
+	u := Users(db)
 	r := Repos(db)
 
-	err := r.Create(ctx, &types.Repo{Name: "testA", URI: "https://example.com/a"}, &types.Repo{Name: "testB", URI: "https://example.com/b"})
+	user, err := u.Create(internalCtx, NewUser{Username: "u", Password: "p"})
 	if err != nil {
 		t.Fatalf("Expected no error, got %s", err)
 	}
-	repoA, err := r.GetByName(ctx, "testA")
+
+	err = r.Create(internalCtx, &types.Repo{Name: "testA", URI: "https://example.com/a"}, &types.Repo{Name: "testB", URI: "https://example.com/b"})
 	if err != nil {
 		t.Fatalf("Expected no error, got %s", err)
 	}
-	repoB, err := r.GetByName(ctx, "testB")
+	repoA, err := r.GetByName(internalCtx, "testA")
+	if err != nil {
+		t.Fatalf("Expected no error, got %s", err)
+	}
+	repoB, err := r.GetByName(internalCtx, "testB")
 	if err != nil {
 		t.Fatalf("Expected no error, got %s", err)
 	}
-
 	repoAName := types.RepoName{ID: repoA.ID, Name: repoA.Name}
 	repoBName := types.RepoName{ID: repoB.ID, Name: repoB.Name}
 
-	// Create a search context with initial repository revisions
-	initialRepositoryRevisions := []*types.SearchContextRepositoryRevisions{
-		{Repo: repoAName, Revisions: []string{"branch-1", "branch-6"}},
-		{Repo: repoBName, Revisions: []string{"branch-2"}},
-	}
+	var changes []*SearchContextRevisionsChange
+	sc := SearchContexts(db).WithAuditSink(func(_ context.Context, change *SearchContextRevisionsChange) {
+		changes = append(changes, change)
+	})
+
 	searchContext, err := sc.CreateSearchContextWithRepositoryRevisions(
-		ctx,
-		&types.SearchContext{Name: "sc", Description: "sc", Public: true},
-		initialRepositoryRevisions,
+		internalCtx,
+		&types.SearchContext{Name: "sc", Public: true},
+		[]*types.SearchContextRepositoryRevisions{
+			{Repo: repoAName, Revisions: []string{"branch-1", "branch-2"}},
+		},
 	)
 	if err != nil {
 		t.Fatalf("Expected no error, got %s", err)
 	}
-	gotRepositoryRevisions, err := sc.GetSearchContextRepositoryRevisions(ctx, searchContext.ID)
+	changes = nil
+
+	userCtx := actor.WithActor(context.Background(), actor.FromUser(user.ID))
+	err = sc.SetSearchContextRepositoryRevisions(userCtx, searchContext.ID, []*types.SearchContextRepositoryRevisions{
+		{Repo: repoAName, Revisions: []string{"branch-2"}},
+		{Repo: repoBName, Revisions: []string{"branch-3"}},
+	})
 	if err != nil {
 		t.Fatalf("Expected no error, got %s", err)
 	}
-	if !reflect.DeepEqual(initialRepositoryRevisions, gotRepositoryRevisions) {
-		t.Fatalf("wanted %v repository revisions, got %v", initialRepositoryRevisions, gotRepositoryRevisions)
+
+	want := []*SearchContextRevisionsChange{
+		{
+			SearchContextID: searchContext.ID,
+			ActorUserID:     user.ID,
+			Added: []*types.SearchContextRepositoryRevisions{
+				{Repo: repoBName, Revisions: []string{"branch-3"}},
+			},
+			Removed: []*types.SearchContextRepositoryRevisions{
+				{Repo: repoAName, Revisions: []string{"branch-1"}},
+			},
+		},
+	}
+	if diff := cmp.Diff(want, changes); diff != "" {
+		t.Fatalf("changes mismatch (-want +got):\n%s", diff)
 	}
 
-	// Modify the repository revisions for the search context
-	modifiedRepositoryRevisions := []*types.SearchContextRepositoryRevisions{
-		{Repo: repoAName, Revisions: []string{"branch-1", "branch-3"}},
-		{Repo: repoBName, Revisions: []string{"branch-0", "branch-2", "branch-4"}},
+	// Setting the same repository revisions again is not a change.
+	changes = nil
+	err = sc.SetSearchContextRepositoryRevisions(userCtx, searchContext.ID, []*types.SearchContextRepositoryRevisions{
+		{Repo: repoAName, Revisions: []string{"branch-2"}},
+		{Repo: repoBName, Revisions: []string{"branch-3"}},
+	})
+	if err != nil {
+		t.Fatalf("Expected no error, got %s", err)
 	}
-	err = sc.SetSearchContextRepositoryRevisions(ctx, searchContext.ID, modifiedRepositoryRevisions)
+	if len(changes) > 0 {
+		t.Fatalf("wanted no changes, got %v", changes)
+	}
+
+	// Changes are only delivered once the outermost transaction is committed.
+	tx, err := sc.Transact(internalCtx)
 	if err != nil {
 		t.Fatalf("Expected no error, got %s", err)
 	}
-	gotRepositoryRevisions, err = sc.GetSearchContextRepositoryRevisions(ctx, searchContext.ID)
+	err = tx.SetSearchContextRepositoryRevisions(userCtx, searchContext.ID, []*types.SearchContextRepositoryRevisions{
+		{Repo: repoAName, Revisions: []string{"branch-2"}},
+	})
 	if err != nil {
 		t.Fatalf("Expected no error, got %s", err)
 	}
-	if !reflect.DeepEqual(modifiedRepositoryRevisions, gotRepositoryRevisions) {
-		t.Fatalf("wanted %v repository revisions, got %v", modifiedRepositoryRevisions, gotRepositoryRevisions)
+	if len(changes) > 0 {
+		t.Fatalf("wanted no changes before the commit, got %v", changes)
+	}
+	if err := tx.Done(errors.New("rollback")); err == nil {
+		t.Fatal("Expected the transaction to be rolled back")
+	}
+	if len(changes) > 0 {
+		t.Fatalf("wanted no changes after the rollback, got %v", changes)
+	}
+
+	tx, err = sc.Transact(internalCtx)
+	if err != nil {
+		t.Fatalf("Expected no error, got %s", err)
+	}
+	err = tx.SetSearchContextRepositoryRevisions(userCtx, searchContext.ID, []*types.SearchContextRepositoryRevisions{
+		{Repo: repoAName, Revisions: []string{"branch-2"}},
+	})
+	if err != nil {
+		t.Fatalf("Expected no error, got %s", err)
+	}
+	if len(changes) > 0 {
+		t.Fatalf("wanted no changes before the commit, got %v", changes)
+	}
+	if err := tx.Done(nil); err != nil {
+		t.Fatalf("Expected no error, got %s", err)
+	}
+	want = []*SearchContextRevisionsChange{
+		{
+			SearchContextID: searchContext.ID,
+			ActorUserID:     user.ID,
+			Added:           []*types.SearchContextRepositoryRevisions{},
+			Removed: []*types.SearchContextRepositoryRevisions{
+				{Repo: repoBName, Revisions: []string{"branch-3"}},
+			},
+		},
+	}
+	if diff := cmp.Diff(want, changes); diff != "" {
+		t.Fatalf("changes mismatch (-want +got):\n%s", diff)
+	}
+
+	// Excluding repository revisions removes them from the search context.
+	changes = nil
+	err = sc.SetSearchContextRepositoryExclusions(userCtx, searchContext.ID, []*types.SearchContextRepositoryRevisions{
+		{Repo: repoAName},
+	})
+	if err != nil {
+		t.Fatalf("Expected no error, got %s", err)
+	}
+	want = []*SearchContextRevisionsChange{
+		{
+			SearchContextID: searchContext.ID,
+			ActorUserID:     user.ID,
+			Added:           []*types.SearchContextRepositoryRevisions{},
+			Removed: []*types.SearchContextRepositoryRevisions{
+				{Repo: repoAName, Revisions: []string{"branch-2"}},
+			},
+		},
+	}
+	if diff := cmp.Diff(want, changes); diff != "" {
+		t.Fatalf("changes mismatch (-want +got):\n%s", diff)
 	}
 }
 
@@ -654,6 +1644,179 @@ func TestSearchContexts_Delete(t *testing.T) {
 	}
 }
 
+func TestSearchContexts_Restore(t *testing.T) {
+	db := dbtest.NewDB(t, "")
+	t.Parallel()
+	ctx := actor.WithInternalActor(context.Background())
+	sc := SearchContexts(db)
+
+	deleted, err := createSearchContexts(ctx, sc, []*types.SearchContext{
+		{Name: "ctx", Description: "deleted", Public: true},
+	})
+	if err != nil {
+		t.Fatalf("Expected no error, got %s", err)
+	}
+	err = sc.DeleteSearchContext(ctx, deleted[0].ID)
+	if err != nil {
+		t.Fatalf("Expected no error, got %s", err)
+	}
+
+	// The soft-deleted search context is only listed on request, with its name
+	gotSearchContexts, err := sc.ListSearchContexts(ctx, ListSearchContextsPageOptions{First: 10}, ListSearchContextsOptions{})
+	if err != nil {
+		t.Fatalf("Expected no error, got %s", err)
+	}
+	if len(gotSearchContexts) != 0 {
+		t.Fatalf("wanted no search contexts, got %+v", gotSearchContexts)
+	}
+	gotSearchContexts, err = sc.ListSearchContexts(ctx, ListSearchContextsPageOptions{First: 10}, ListSearchContextsOptions{IncludeDeleted: true})
+	if err != nil {
+		t.Fatalf("Expected no error, got %s", err)
+	}
+	if len(gotSearchContexts) != 1 || gotSearchContexts[0].Name != "ctx" || gotSearchContexts[0].DeletedAt.IsZero() {
+		t.Fatalf("wanted the deleted search context, got %+v", gotSearchContexts)
+	}
+
+	// The name is free for another search context
+	recreated, err := createSearchContexts(ctx, sc, []*types.SearchContext{
+		{Name: "ctx", Description: "recreated", Public: true},
+	})
+	if err != nil {
+		t.Fatalf("Expected no error, got %s", err)
+	}
+
+	// The search context that is not deleted takes precedence
+	got, err := sc.GetSearchContext(ctx, GetSearchContextOptions{Name: "ctx", IncludeDeleted: true})
+	if err != nil {
+		t.Fatalf("Expected no error, got %s", err)
+	}
+	if got.ID != recreated[0].ID {
+		t.Fatalf("wanted search context %d, got %d", recreated[0].ID, got.ID)
+	}
+
+	// Restoring conflicts with the recreated search context
+	err = sc.RestoreSearchContext(ctx, deleted[0].ID)
+	var e *ErrSearchContextNameAlreadyExists
+	if !errors.As(err, &e) {
+		t.Fatalf("Expected ErrSearchContextNameAlreadyExists, got %v", err)
+	}
+	if diff := cmp.Diff(&ErrSearchContextNameAlreadyExists{Name: "ctx"}, e); diff != "" {
+		t.Fatalf("error mismatch (-want +got):\n%s", diff)
+	}
+
+	// Restoring succeeds once the name is free again
+	err = sc.DeleteSearchContext(ctx, recreated[0].ID)
+	if err != nil {
+		t.Fatalf("Expected no error, got %s", err)
+	}
+	got, err = sc.GetSearchContext(ctx, GetSearchContextOptions{Name: "ctx", IncludeDeleted: true})
+	if err != nil {
+		t.Fatalf("Expected no error, got %s", err)
+	}
+	if got.ID != recreated[0].ID {
+		t.Fatalf("wanted the most recently deleted search context %d, got %d", recreated[0].ID, got.ID)
+	}
+
+	err = sc.RestoreSearchContext(ctx, deleted[0].ID)
+	if err != nil {
+		t.Fatalf("Expected no error, got %s", err)
+	}
+	got, err = sc.GetSearchContext(ctx, GetSearchContextOptions{Name: "ctx"})
+	if err != nil {
+		t.Fatalf("Expected no error, got %s", err)
+	}
+	if got.ID != deleted[0].ID || got.Description != "deleted" || !got.DeletedAt.IsZero() {
+		t.Fatalf("wanted the restored search context, got %+v", got)
+	}
+
+	// Only soft-deleted search contexts can be restored
+	err = sc.RestoreSearchContext(ctx, deleted[0].ID)
+	if err != ErrSearchContextNotFound {
+		t.Fatalf("Expected ErrSearchContextNotFound, got %v", err)
+	}
+}
+
+func TestSearchContexts_NameUniqueness(t *testing.T) {
+	db := dbtest.NewDB(t, "")
+	t.Parallel()
+	ctx := actor.WithInternalActor(context.Background())
+	u := Users(db)
+	o := Orgs(db)
+	sc := SearchContexts(db)
+
+	user1, err := u.Create(ctx, NewUser{Username: "u1", Password: "p"})
+	if err != nil {
+		t.Fatalf("Expected no error, got %s", err)
+	}
+	user2, err := u.Create(ctx, NewUser{Username: "u2", Password: "p"})
+	if err != nil {
+		t.Fatalf("Expected no error, got %s", err)
+	}
+	displayName := "My Org"
+	org, err := o.Create(ctx, "myorg", &displayName)
+	if err != nil {
+		t.Fatalf("Expected no error, got %s", err)
+	}
+
+	// The same name is allowed in different namespaces
+	created, err := createSearchContexts(ctx, sc, []*types.SearchContext{
+		{Name: "ctx", Public: true},
+		{Name: "ctx", Public: true, NamespaceUserID: user1.ID},
+		{Name: "ctx", Public: true, NamespaceUserID: user2.ID},
+		{Name: "ctx", Public: true, NamespaceOrgID: org.ID},
+		{Name: "other", Public: true, NamespaceUserID: user1.ID},
+	})
+	if err != nil {
+		t.Fatalf("Expected no error, got %s", err)
+	}
+
+	tests := []struct {
+		name          string
+		searchContext *types.SearchContext
+		wantNamespace SearchContextNamespace
+	}{
+		{
+			name:          "instance-level",
+			searchContext: &types.SearchContext{Name: "ctx"},
+		},
+		{
+			name:          "user-level",
+			searchContext: &types.SearchContext{Name: "CTX", NamespaceUserID: user1.ID},
+			wantNamespace: SearchContextNamespace{UserID: user1.ID},
+		},
+		{
+			name:          "org-level",
+			searchContext: &types.SearchContext{Name: "ctx", NamespaceOrgID: org.ID},
+			wantNamespace: SearchContextNamespace{OrgID: org.ID},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := sc.CreateSearchContextWithRepositoryRevisions(ctx, tt.searchContext, nil)
+			var e *ErrSearchContextNameAlreadyExists
+			if !errors.As(err, &e) {
+				t.Fatalf("Expected ErrSearchContextNameAlreadyExists, got %v", err)
+			}
+			want := &ErrSearchContextNameAlreadyExists{Name: tt.searchContext.Name, Namespace: tt.wantNamespace}
+			if diff := cmp.Diff(want, e); diff != "" {
+				t.Fatalf("error mismatch (-want +got):\n%s", diff)
+			}
+			if !errors.Is(err, ErrSearchContextDuplicateName) {
+				t.Fatalf("Expected error to match ErrSearchContextDuplicateName, got %v", err)
+			}
+		})
+	}
+
+	// Updating to a name that is taken in the namespace fails the same way
+	other := *created[4]
+	other.Name = "ctx"
+	_, err = sc.UpdateSearchContextWithRepositoryRevisions(ctx, &other, nil)
+	var e *ErrSearchContextNameAlreadyExists
+	if !errors.As(err, &e) || e.Namespace != (SearchContextNamespace{UserID: user1.ID}) {
+		t.Fatalf("Expected ErrSearchContextNameAlreadyExists in the namespace of user %d, got %v", user1.ID, err)
+	}
+}
+
 func reverseSearchContextsSlice(s []*types.SearchContext) []*types.SearchContext {
 	copySlice := make([]*types.SearchContext, len(s))
 	copy(copySlice, s)
@@ -782,3 +1945,85 @@ func TestSearchContexts_OrderBy(t *testing.T) {
 		})
 	}
 }
+
+func TestSearchContexts_Rename(t *testing.T) {
+	db := dbtest.NewDB(t, "")
+	t.Parallel()
+	ctx := context.Background()
+	sc := SearchContexts(db)
+
+	user, err := Users(db).Create(ctx, NewUser{Username: "u", Password: "p"})
+	if err != nil {
+		t.Fatalf("Expected no error, got %s", err)
+	}
+
+	searchContexts, err := createSearchContexts(ctx, sc, []*types.SearchContext{
+		{Name: "ctx", Public: true},
+		{Name: "taken", Public: true},
+		{Name: "user", Public: true, NamespaceUserID: user.ID},
+	})
+	if err != nil {
+		t.Fatalf("Expected no error, got %s", err)
+	}
+
+	t.Run("rename", func(t *testing.T) {
+		err := sc.RenameSearchContext(ctx, searchContexts[0].ID, "renamed")
+		if err != nil {
+			t.Fatalf("Expected no error, got %s", err)
+		}
+
+		renamed, err := sc.GetSearchContext(ctx, GetSearchContextOptions{Name: "renamed"})
+		if err != nil {
+			t.Fatalf("Expected no error, got %s", err)
+		}
+		if renamed.ID != searchContexts[0].ID {
+			t.Fatalf("Expected the search context ID %d to be kept, got %d", searchContexts[0].ID, renamed.ID)
+		}
+
+		_, err = sc.GetSearchContext(ctx, GetSearchContextOptions{Name: "ctx"})
+		if err != ErrSearchContextNotFound {
+			t.Fatalf("Expected not to find the search context by its previous name, got %v", err)
+		}
+	})
+
+	t.Run("conflicting rename", func(t *testing.T) {
+		err := sc.RenameSearchContext(ctx, searchContexts[0].ID, "taken")
+		var e *ErrSearchContextNameAlreadyExists
+		if !errors.As(err, &e) {
+			t.Fatalf("Expected ErrSearchContextNameAlreadyExists, got %v", err)
+		}
+		if diff := cmp.Diff(&ErrSearchContextNameAlreadyExists{Name: "taken"}, e); diff != "" {
+			t.Fatalf("error mismatch (-want +got):\n%s", diff)
+		}
+
+		// Renaming within a user namespace reports the namespace.
+		_, err = createSearchContexts(ctx, sc, []*types.SearchContext{
+			{Name: "user-taken", Public: true, NamespaceUserID: user.ID},
+		})
+		if err != nil {
+			t.Fatalf("Expected no error, got %s", err)
+		}
+		err = sc.RenameSearchContext(ctx, searchContexts[2].ID, "user-taken")
+		if !errors.As(err, &e) {
+			t.Fatalf("Expected ErrSearchContextNameAlreadyExists, got %v", err)
+		}
+		want := &ErrSearchContextNameAlreadyExists{Name: "user-taken", Namespace: SearchContextNamespace{UserID: user.ID}}
+		if diff := cmp.Diff(want, e); diff != "" {
+			t.Fatalf("error mismatch (-want +got):\n%s", diff)
+		}
+	})
+
+	t.Run("same name in another namespace", func(t *testing.T) {
+		err := sc.RenameSearchContext(ctx, searchContexts[2].ID, "taken")
+		if err != nil {
+			t.Fatalf("Expected no error, got %s", err)
+		}
+	})
+
+	t.Run("missing search context", func(t *testing.T) {
+		err := sc.RenameSearchContext(ctx, 1000, "missing")
+		if err != ErrSearchContextNotFound {
+			t.Fatalf("Expected error %v, got %v", ErrSearchContextNotFound, err)
+		}
+	})
+}
@@ -116,13 +116,13 @@ var ExternalClient, _ = ExternalClientFactory.Client()
 var InternalClientFactory = NewInternalClientFactory("internal")
 
 // NewInternalClientFactory returns a httpcli.Factory with common options
-// and middleware pre-set for communicating with internal services.
-func NewInternalClientFactory(subsystem string) *Factory {
-	return NewFactory(
-		NewMiddleware(
-			ContextErrorMiddleware,
-		),
-		NewMaxIdleConnsPerHostOpt(500),
+// and middleware pre-set for communicating with internal services. The given
+// transportOpts are applied to the underlying http.Transport after the common
+// ones, so they can be used to tune the transport of the subsystem.
+func NewInternalClientFactory(subsystem string, transportOpts ...Opt) *Factory {
+	opts := []Opt{NewMaxIdleConnsPerHostOpt(500)}
+	opts = append(opts, transportOpts...)
+	opts = append(opts,
 		NewErrorResilientTransportOpt(
 			NewRetryPolicy(MaxRetries()),
 			ExpJitterDelay(50*time.Millisecond, 5*time.Second),
@@ -130,6 +130,13 @@ func NewInternalClientFactory(subsystem string) *Factory {
 		MeteredTransportOpt(subsystem),
 		TracedTransportOpt,
 	)
+
+	return NewFactory(
+		NewMiddleware(
+			ContextErrorMiddleware,
+		),
+		opts...,
+	)
 }
 
 // InternalDoer is a shared client for external communication. This is a
@@ -524,6 +531,21 @@ func NewMaxIdleConnsPerHostOpt(max int) Opt {
 	}
 }
 
+// NewForceAttemptHTTP2Opt returns a Opt that sets the ForceAttemptHTTP2 field of an
+// http.Client's transport. It only has effect on TLS connections.
+func NewForceAttemptHTTP2Opt(force bool) Opt {
+	return func(cli *http.Client) error {
+		tr, err := getTransportForMutation(cli)
+		if err != nil {
+			return errors.Wrap(err, "httpcli.NewForceAttemptHTTP2Opt")
+		}
+
+		tr.ForceAttemptHTTP2 = force
+
+		return nil
+	}
+}
+
 // NewTimeoutOpt returns a Opt that sets the Timeout field of an http.Client.
 func NewTimeoutOpt(timeout time.Duration) Opt {
 	return func(cli *http.Client) error {
@@ -265,6 +265,25 @@ func TestNewIdleConnTimeoutOpt(t *testing.T) {
 	}
 }
 
+func TestNewForceAttemptHTTP2Opt(t *testing.T) {
+	for _, force := range []bool{true, false} {
+		cli := &http.Client{Transport: &http.Transport{ForceAttemptHTTP2: !force}}
+		if err := NewForceAttemptHTTP2Opt(force)(cli); err != nil {
+			t.Fatalf("unexpected error %v", err)
+		}
+
+		if have, want := cli.Transport.(*http.Transport).ForceAttemptHTTP2, force; have != want {
+			t.Errorf("have ForceAttemptHTTP2 %t, want %t", have, want)
+		}
+	}
+
+	err := NewForceAttemptHTTP2Opt(true)(&http.Client{Transport: bogusTransport{}})
+	want := "httpcli.NewForceAttemptHTTP2Opt: http.Client.Transport is not an *http.Transport: httpcli.bogusTransport"
+	if have := fmt.Sprint(err); have != want {
+		t.Fatalf("have error: %q\nwant error: %q", have, want)
+	}
+}
+
 func TestNewTimeoutOpt(t *testing.T) {
 	var cli http.Client
 
@@ -127,7 +127,7 @@ func ParseRepositoryRevisions(repoAndOptionalRev string) (string, []RevisionSpec
 		if part == "" {
 			continue
 		}
-		revs = append(revs, parseRev(part))
+		revs = append(revs, ParseRevisionSpecifier(part))
 	}
 	if len(revs) == 0 {
 		revs = []RevisionSpecifier{{RevSpec: ""}} // default branch
@@ -135,7 +135,9 @@ func ParseRepositoryRevisions(repoAndOptionalRev string) (string, []RevisionSpec
 	return repo, revs
 }
 
-func parseRev(spec string) RevisionSpecifier {
+// ParseRevisionSpecifier parses a single revspec or ref glob, using the same
+// syntax as a single revision of ParseRepositoryRevisions.
+func ParseRevisionSpecifier(spec string) RevisionSpecifier {
 	if strings.HasPrefix(spec, "*!") {
 		return RevisionSpecifier{ExcludeRefGlob: spec[2:]}
 	} else if strings.HasPrefix(spec, "*") {
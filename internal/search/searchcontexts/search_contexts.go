@@ -3,18 +3,23 @@ package searchcontexts
 import (
 	"context"
 	"regexp"
+	"sort"
 	"strings"
 
 	"github.com/cockroachdb/errors"
+	"github.com/inconshreveable/log15"
 
 	"github.com/sourcegraph/sourcegraph/cmd/frontend/backend"
 	"github.com/sourcegraph/sourcegraph/cmd/frontend/envvar"
 	"github.com/sourcegraph/sourcegraph/internal/actor"
+	"github.com/sourcegraph/sourcegraph/internal/api"
 	"github.com/sourcegraph/sourcegraph/internal/database"
 	"github.com/sourcegraph/sourcegraph/internal/database/dbutil"
+	"github.com/sourcegraph/sourcegraph/internal/goroutine"
 	"github.com/sourcegraph/sourcegraph/internal/lazyregexp"
 	"github.com/sourcegraph/sourcegraph/internal/search"
 	"github.com/sourcegraph/sourcegraph/internal/types"
+	"github.com/sourcegraph/sourcegraph/internal/vcs/git"
 	"github.com/sourcegraph/sourcegraph/schema"
 )
 
@@ -24,6 +29,10 @@ const (
 	maxSearchContextNameLength        = 32
 	maxSearchContextDescriptionLength = 1024
 	maxRevisionLength                 = 255
+
+	// maxConcurrentRefGlobExpansions is the maximum number of repositories whose
+	// ref globs are expanded concurrently when resolving a search context.
+	maxConcurrentRefGlobExpansions = 10
 )
 
 var (
@@ -142,11 +151,53 @@ func validateSearchContextRepositoryRevisions(repositoryRevisions []*types.Searc
 			if len(revision) > maxRevisionLength {
 				return errors.Errorf("revision %q exceeds maximum allowed length (%d)", revision, maxRevisionLength)
 			}
+			if err := validateRevision(revision); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// validateRevision validates a single revision of a search context, which is
+// either a revspec (e.g. "main", "v1.0..v2.0") or a ref glob (e.g.
+// "*refs/heads/release/*", "*!refs/heads/release/old").
+func validateRevision(revision string) error {
+	if strings.ContainsAny(revision, ": \t\n") {
+		return errors.Errorf("revision %q must not contain colons or whitespace", revision)
+	}
+	if strings.HasPrefix(revision, "-") {
+		return errors.Errorf("revision %q must not start with a dash", revision)
+	}
+
+	spec := search.ParseRevisionSpecifier(revision)
+	switch {
+	case strings.HasPrefix(revision, "*"):
+		if spec.RefGlob == "" && spec.ExcludeRefGlob == "" {
+			return errors.Errorf("revision %q is an empty ref glob", revision)
+		}
+		if _, err := git.CompileRefGlobs([]git.RefGlob{{Include: spec.RefGlob, Exclude: spec.ExcludeRefGlob}}); err != nil {
+			return errors.Wrapf(err, "invalid ref glob %q", revision)
+		}
+	case strings.Contains(revision, ".."):
+		from, to := splitRevisionRange(revision)
+		if from == "" || to == "" || strings.Contains(to, "..") {
+			return errors.Errorf("revision range %q must have exactly one start and one end", revision)
 		}
 	}
 	return nil
 }
 
+// splitRevisionRange splits a revision range of the form "a..b" or "a...b"
+// into its start and end.
+func splitRevisionRange(revision string) (from, to string) {
+	if i := strings.Index(revision, "..."); i >= 0 {
+		return revision[:i], revision[i+3:]
+	}
+	i := strings.Index(revision, "..")
+	return revision[:i], revision[i+2:]
+}
+
 func validateSearchContextDoesNotExist(ctx context.Context, db dbutil.DB, searchContext *types.SearchContext) error {
 	_, err := database.SearchContexts(db).GetSearchContext(ctx, database.GetSearchContextOptions{
 		Name:            searchContext.Name,
@@ -232,6 +283,26 @@ func UpdateSearchContextWithRepositoryRevisions(ctx context.Context, db dbutil.D
 	return searchContext, nil
 }
 
+// RenameSearchContext renames the search context in place. Links to the search
+// context by ID keep working, while links by its previous name do not.
+func RenameSearchContext(ctx context.Context, db dbutil.DB, searchContext *types.SearchContext, newName string) error {
+	if IsAutoDefinedSearchContext(searchContext) {
+		return errors.New("cannot rename auto-defined search context")
+	}
+
+	err := ValidateSearchContextWriteAccessForCurrentUser(ctx, db, searchContext.NamespaceUserID, searchContext.NamespaceOrgID, searchContext.Public)
+	if err != nil {
+		return err
+	}
+
+	err = validateSearchContextName(newName)
+	if err != nil {
+		return err
+	}
+
+	return database.SearchContexts(db).RenameSearchContext(ctx, searchContext.ID, newName)
+}
+
 func DeleteSearchContext(ctx context.Context, db dbutil.DB, searchContext *types.SearchContext) error {
 	if IsAutoDefinedSearchContext(searchContext) {
 		return errors.New("cannot delete auto-defined search context")
@@ -264,15 +335,99 @@ func GetRepositoryRevisions(ctx context.Context, db dbutil.DB, searchContextID i
 		return nil, err
 	}
 
-	repositoryRevisions := make([]*search.RepositoryRevisions, 0, len(searchContextRepositoryRevisions))
-	for _, searchContextRepositoryRevision := range searchContextRepositoryRevisions {
+	repositoryRevisions := make([]*search.RepositoryRevisions, len(searchContextRepositoryRevisions))
+	bounded := goroutine.NewBounded(maxConcurrentRefGlobExpansions)
+	for i, searchContextRepositoryRevision := range searchContextRepositoryRevisions {
 		revisionSpecs := make([]search.RevisionSpecifier, 0, len(searchContextRepositoryRevision.Revisions))
+		hasRefGlobs := false
 		for _, revision := range searchContextRepositoryRevision.Revisions {
-			revisionSpecs = append(revisionSpecs, search.RevisionSpecifier{RevSpec: revision})
+			spec := search.ParseRevisionSpecifier(revision)
+			if spec.RefGlob != "" || spec.ExcludeRefGlob != "" {
+				hasRefGlobs = true
+			}
+			revisionSpecs = append(revisionSpecs, spec)
+		}
+
+		repositoryRevision := &search.RepositoryRevisions{Repo: searchContextRepositoryRevision.Repo, Revs: revisionSpecs}
+		if !hasRefGlobs {
+			repositoryRevisions[i] = repositoryRevision
+			continue
+		}
+
+		i := i
+		bounded.Go(func() error {
+			expanded, err := expandRefGlobs(ctx, repositoryRevision)
+			if err != nil {
+				// A single repository failing to list its refs should not make the
+				// whole search context unusable, the repository is skipped instead.
+				log15.Warn("searchcontexts.GetRepositoryRevisions.expandRefGlobs", "repo", repositoryRevision.Repo.Name, "error", err)
+				return nil
+			}
+			if len(expanded.Revs) == 0 {
+				// None of the refs matched, the repository has nothing to be searched.
+				return nil
+			}
+			repositoryRevisions[i] = expanded
+			return nil
+		})
+	}
+	_ = bounded.Wait()
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	filtered := repositoryRevisions[:0]
+	for _, repositoryRevision := range repositoryRevisions {
+		if repositoryRevision == nil {
+			continue
 		}
-		repositoryRevisions = append(repositoryRevisions, &search.RepositoryRevisions{Repo: searchContextRepositoryRevision.Repo, Revs: revisionSpecs})
+		filtered = append(filtered, repositoryRevision)
 	}
-	return repositoryRevisions, nil
+	return filtered, nil
+}
+
+// listRefs lists all Git refs of a repository, it is mocked in tests.
+var listRefs = git.ListRefs
+
+// expandRefGlobs expands ref globs of the repository revisions to the concrete
+// revisions currently matching them, so that a search context pinned to e.g.
+// "*refs/heads/release/*" searches the release branches that exist at the time
+// the search context is resolved.
+func expandRefGlobs(ctx context.Context, repositoryRevision *search.RepositoryRevisions) (*search.RepositoryRevisions, error) {
+	repositoryRevision.ListRefs = listRefs
+	revSpecs, err := repositoryRevision.ExpandedRevSpecs(ctx)
+	if err != nil {
+		return nil, errors.Wrapf(err, "expanding ref globs of repository %q", repositoryRevision.Repo.Name)
+	}
+	sort.Strings(revSpecs)
+
+	revisionSpecs := make([]search.RevisionSpecifier, 0, len(revSpecs))
+	for _, revSpec := range revSpecs {
+		revisionSpecs = append(revisionSpecs, search.RevisionSpecifier{RevSpec: revSpec})
+	}
+	return &search.RepositoryRevisions{Repo: repositoryRevision.Repo, Revs: revisionSpecs}, nil
+}
+
+// ResolveSearchContextRepoCount returns the number of distinct repositories the
+// given repository revisions would include in a search context, without
+// persisting anything. Repositories that do not exist or are not visible to the
+// current user are not counted. It is meant for previewing a search context
+// before it is saved.
+func ResolveSearchContextRepoCount(ctx context.Context, db dbutil.DB, repositoryRevisions []*search.RepositoryRevisions) (int, error) {
+	seen := make(map[api.RepoID]struct{}, len(repositoryRevisions))
+	repoIDs := make([]api.RepoID, 0, len(repositoryRevisions))
+	for _, repositoryRevision := range repositoryRevisions {
+		if _, ok := seen[repositoryRevision.Repo.ID]; ok {
+			continue
+		}
+		seen[repositoryRevision.Repo.ID] = struct{}{}
+		repoIDs = append(repoIDs, repositoryRevision.Repo.ID)
+	}
+	if len(repoIDs) == 0 {
+		return 0, nil
+	}
+
+	return database.Repos(db).Count(ctx, database.ReposListOptions{IDs: repoIDs})
 }
 
 func IsAutoDefinedSearchContext(searchContext *types.SearchContext) bool {
@@ -12,9 +12,12 @@ import (
 	"github.com/stretchr/testify/require"
 
 	"github.com/sourcegraph/sourcegraph/internal/actor"
+	"github.com/sourcegraph/sourcegraph/internal/api"
 	"github.com/sourcegraph/sourcegraph/internal/database"
 	"github.com/sourcegraph/sourcegraph/internal/database/dbtesting"
+	"github.com/sourcegraph/sourcegraph/internal/search"
 	"github.com/sourcegraph/sourcegraph/internal/types"
+	"github.com/sourcegraph/sourcegraph/internal/vcs/git"
 	"github.com/sourcegraph/sourcegraph/schema"
 )
 
@@ -259,6 +262,35 @@ func TestResolvingSearchContextRepoNames(t *testing.T) {
 	}
 }
 
+func TestResolvingSearchContextRepoCount(t *testing.T) {
+	if testing.Short() {
+		t.Skip()
+	}
+
+	internalCtx := actor.WithInternalActor(context.Background())
+	db := dbtesting.GetDB(t)
+
+	repos, err := createRepos(internalCtx, database.Repos(db))
+	if err != nil {
+		t.Fatalf("Expected no error, got %s", err)
+	}
+
+	// Both revisions of the first repository count as one repository.
+	repositoryRevisions := []*search.RepositoryRevisions{
+		{Repo: repos[0], Revs: []search.RevisionSpecifier{{RevSpec: "branch-1"}}},
+		{Repo: repos[1], Revs: []search.RevisionSpecifier{{RevSpec: "branch-1"}}},
+		{Repo: repos[0], Revs: []search.RevisionSpecifier{{RevSpec: "branch-2"}}},
+	}
+
+	count, err := ResolveSearchContextRepoCount(internalCtx, db, repositoryRevisions)
+	if err != nil {
+		t.Fatalf("Expected no error, got %s", err)
+	}
+	if count != 2 {
+		t.Fatalf("wanted 2 repositories, got %d", count)
+	}
+}
+
 func TestSearchContextWriteAccessValidation(t *testing.T) {
 	if testing.Short() {
 		t.Skip()
@@ -590,3 +622,114 @@ func TestDeletingAutoDefinedSearchContext(t *testing.T) {
 		t.Fatalf("wanted error containing %s, got %s", wantErr, err)
 	}
 }
+
+func TestValidatingSearchContextRevisions(t *testing.T) {
+	tests := []struct {
+		name     string
+		revision string
+		wantErr  bool
+	}{
+		{name: "default branch", revision: ""},
+		{name: "literal revision", revision: "main"},
+		{name: "revision range", revision: "v1.0..v2.0"},
+		{name: "symmetric revision range", revision: "v1.0...v2.0"},
+		{name: "branch glob", revision: "*refs/heads/release/*"},
+		{name: "exclude branch glob", revision: "*!refs/heads/release/old"},
+		{name: "empty ref glob", revision: "*", wantErr: true},
+		{name: "exclude glob without refs prefix", revision: "*!release/*", wantErr: true},
+		{name: "open revision range", revision: "v1.0..", wantErr: true},
+		{name: "colon", revision: "main:dev", wantErr: true},
+		{name: "whitespace", revision: "main dev", wantErr: true},
+		{name: "leading dash", revision: "--all", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := validateSearchContextRepositoryRevisions([]*types.SearchContextRepositoryRevisions{
+				{Repo: types.RepoName{ID: 1, Name: "repo"}, Revisions: []string{tt.revision}},
+			})
+			if tt.wantErr && err == nil {
+				t.Fatal("expected error, got nil")
+			}
+			if !tt.wantErr && err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+		})
+	}
+}
+
+func TestGettingRepositoryRevisionsExpandsRefGlobs(t *testing.T) {
+	database.Mocks.SearchContexts.GetSearchContextRepositoryRevisions = func(ctx context.Context, searchContextID int64) ([]*types.SearchContextRepositoryRevisions, error) {
+		return []*types.SearchContextRepositoryRevisions{
+			{Repo: types.RepoName{ID: 1, Name: "literal"}, Revisions: []string{"main", "v1.0..v2.0"}},
+			{Repo: types.RepoName{ID: 2, Name: "glob"}, Revisions: []string{"main", "*refs/heads/release/*", "*!refs/heads/release/old"}},
+			{Repo: types.RepoName{ID: 3, Name: "unmatched"}, Revisions: []string{"*refs/heads/feature/*"}},
+		}, nil
+	}
+	listRefs = func(ctx context.Context, repo api.RepoName) ([]git.Ref, error) {
+		return []git.Ref{
+			{Name: "refs/heads/main"},
+			{Name: "refs/heads/release/new"},
+			{Name: "refs/heads/release/old"},
+			{Name: "refs/tags/v1.0"},
+		}, nil
+	}
+	t.Cleanup(func() {
+		database.Mocks.SearchContexts.GetSearchContextRepositoryRevisions = nil
+		listRefs = git.ListRefs
+	})
+
+	repositoryRevisions, err := GetRepositoryRevisions(context.Background(), nil, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got := make([]string, 0, len(repositoryRevisions))
+	for _, repositoryRevision := range repositoryRevisions {
+		got = append(got, repositoryRevision.String())
+	}
+	want := []string{
+		"literal@main:v1.0..v2.0",
+		"glob@main:release/new",
+	}
+	if !reflect.DeepEqual(want, got) {
+		t.Fatalf("wanted %v repository revisions, got %v", want, got)
+	}
+}
+
+func TestGettingRepositoryRevisionsSkipsFailingRefGlobExpansions(t *testing.T) {
+	database.Mocks.SearchContexts.GetSearchContextRepositoryRevisions = func(ctx context.Context, searchContextID int64) ([]*types.SearchContextRepositoryRevisions, error) {
+		return []*types.SearchContextRepositoryRevisions{
+			{Repo: types.RepoName{ID: 1, Name: "literal"}, Revisions: []string{"main"}},
+			{Repo: types.RepoName{ID: 2, Name: "failing"}, Revisions: []string{"*refs/heads/release/*"}},
+			{Repo: types.RepoName{ID: 3, Name: "glob"}, Revisions: []string{"*refs/heads/release/*"}},
+		}, nil
+	}
+	listRefs = func(ctx context.Context, repo api.RepoName) ([]git.Ref, error) {
+		if repo == "failing" {
+			return nil, errors.New("repository not cloned")
+		}
+		return []git.Ref{{Name: "refs/heads/release/new"}}, nil
+	}
+	t.Cleanup(func() {
+		database.Mocks.SearchContexts.GetSearchContextRepositoryRevisions = nil
+		listRefs = git.ListRefs
+	})
+
+	repositoryRevisions, err := GetRepositoryRevisions(context.Background(), nil, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got := make([]string, 0, len(repositoryRevisions))
+	for _, repositoryRevision := range repositoryRevisions {
+		got = append(got, repositoryRevision.String())
+	}
+	want := []string{
+		"literal@main",
+		"glob@release/new",
+	}
+	if !reflect.DeepEqual(want, got) {
+		t.Fatalf("wanted %v repository revisions, got %v", want, got)
+	}
+}
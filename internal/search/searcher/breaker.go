@@ -0,0 +1,216 @@
+package searcher
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/cockroachdb/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+
+	"github.com/sourcegraph/sourcegraph/internal/env"
+)
+
+var (
+	breakerThreshold = env.Get("SEARCHER_CLIENT_BREAKER_THRESHOLD", "5", "number of consecutive failures within the window after which a searcher instance is temporarily excluded, 0 disables the circuit breaker")
+	breakerWindow    = env.Get("SEARCHER_CLIENT_BREAKER_WINDOW", "1m", "time window in which consecutive failures of a searcher instance are counted")
+	breakerCooldown  = env.Get("SEARCHER_CLIENT_BREAKER_COOLDOWN", "30s", "time a searcher instance is excluded before it is probed again")
+
+	// breaker is shared by all searches, so that every search benefits from what
+	// the others learned about unhealthy searcher instances.
+	breaker = parseEndpointBreaker(breakerThreshold, breakerWindow, breakerCooldown)
+)
+
+var metricBreakerTransitions = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "src_searcher_client_breaker_transitions_total",
+	Help: "Number of state transitions of the circuit breaker of searcher instances.",
+}, []string{"endpoint", "state"})
+
+// ResetCircuitBreaker forgets all failures of searcher instances, so that every
+// instance is routed to again.
+func ResetCircuitBreaker() {
+	breaker.reset()
+}
+
+// endpointBreaker is a circuit breaker of searcher instances. An instance that
+// fails threshold times in a row within the window is excluded from routing
+// (open). After the cooldown, the next search routed to it is let through as a
+// probe (half-open), which either closes the breaker on success or opens it
+// again on failure.
+type endpointBreaker struct {
+	threshold int
+	window    time.Duration
+	cooldown  time.Duration
+	clock     func() time.Time
+
+	mu     sync.Mutex
+	states map[string]*endpointState
+}
+
+type endpointState struct {
+	// The number of consecutive failures since firstFailure.
+	failures     int
+	firstFailure time.Time
+	// The time the breaker was opened, zero if it is closed.
+	openedAt time.Time
+	// Whether a probe has been let through after the cooldown.
+	probing bool
+}
+
+// parseEndpointBreaker returns the circuit breaker from the given environment
+// values. The breaker is disabled if any of the values fails to parse.
+func parseEndpointBreaker(threshold, window, cooldown string) *endpointBreaker {
+	b := &endpointBreaker{
+		clock:  time.Now,
+		states: make(map[string]*endpointState),
+	}
+
+	n, err := strconv.Atoi(threshold)
+	if err != nil || n <= 0 {
+		return b
+	}
+	w, err := time.ParseDuration(window)
+	if err != nil || w <= 0 {
+		return b
+	}
+	c, err := time.ParseDuration(cooldown)
+	if err != nil || c <= 0 {
+		return b
+	}
+	b.threshold, b.window, b.cooldown = n, w, c
+	return b
+}
+
+func (b *endpointBreaker) enabled() bool {
+	return b.threshold > 0
+}
+
+// excluded returns the given set of excluded endpoints along with the ones that
+// should not be routed to, the given set is not modified. Endpoints past their
+// cooldown are not excluded so that they can be probed.
+func (b *endpointBreaker) excluded(exclude map[string]bool) map[string]bool {
+	if !b.enabled() {
+		return exclude
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	now := b.clock()
+	set := exclude
+	copied := false
+	for endpoint, s := range b.states {
+		if s.openedAt.IsZero() || (!s.probing && now.Sub(s.openedAt) >= b.cooldown) {
+			continue
+		}
+		if !copied {
+			set = make(map[string]bool, len(exclude)+1)
+			for k, v := range exclude {
+				set[k] = v
+			}
+			copied = true
+		}
+		set[endpoint] = true
+	}
+	return set
+}
+
+// chosen marks the start of a search routed to the endpoint, which is a probe if
+// the endpoint is past its cooldown.
+func (b *endpointBreaker) chosen(endpoint string) {
+	if !b.enabled() {
+		return
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	s, ok := b.states[endpoint]
+	if !ok || s.openedAt.IsZero() || s.probing || b.clock().Sub(s.openedAt) < b.cooldown {
+		return
+	}
+	s.probing = true
+	metricBreakerTransitions.WithLabelValues(endpoint, "half_open").Inc()
+}
+
+// record records the outcome of a search routed to the endpoint.
+func (b *endpointBreaker) record(endpoint string, err error) {
+	if !b.enabled() {
+		return
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	s, ok := b.states[endpoint]
+	if !isEndpointFailure(err) {
+		switch {
+		case !ok:
+		case s.probing && err == nil:
+			// Only a successful probe closes the breaker.
+			metricBreakerTransitions.WithLabelValues(endpoint, "closed").Inc()
+			delete(b.states, endpoint)
+		case s.probing:
+			// The probe failed for reasons unrelated to the endpoint (e.g. a bad
+			// request), let the next search probe it again.
+			s.probing = false
+		case !s.openedAt.IsZero():
+			// Outcomes unrelated to the endpoint, and late successes of searches
+			// that started before the breaker was opened, leave it open.
+		case err == nil:
+			delete(b.states, endpoint)
+		}
+		return
+	}
+
+	if !ok {
+		s = &endpointState{}
+		b.states[endpoint] = s
+	}
+	now := b.clock()
+	switch {
+	case s.probing:
+		// The probe failed, exclude the endpoint for another cooldown.
+		s.openedAt = now
+		s.probing = false
+		metricBreakerTransitions.WithLabelValues(endpoint, "open").Inc()
+		return
+	case !s.openedAt.IsZero():
+		// A search that started before the breaker was opened.
+		return
+	case s.failures == 0 || now.Sub(s.firstFailure) > b.window:
+		s.failures = 0
+		s.firstFailure = now
+	}
+
+	s.failures++
+	if s.failures >= b.threshold {
+		s.openedAt = now
+		metricBreakerTransitions.WithLabelValues(endpoint, "open").Inc()
+	}
+}
+
+func (b *endpointBreaker) reset() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.states = make(map[string]*endpointState)
+}
+
+// isEndpointFailure returns true if the error indicates that the searcher
+// instance is unhealthy, as opposed to a problem of the search itself (e.g. a
+// bad request or running out of time).
+func isEndpointFailure(err error) bool {
+	if err == nil || errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return false
+	}
+	var se *searcherError
+	if errors.As(err, &se) {
+		return se.StatusCode >= http.StatusInternalServerError && !se.IsStructuralSyntaxError()
+	}
+	var ne net.Error
+	return errors.As(err, &ne)
+}
@@ -0,0 +1,288 @@
+package searcher
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/cockroachdb/errors"
+	"github.com/google/go-cmp/cmp"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+
+	"github.com/sourcegraph/sourcegraph/internal/api"
+	"github.com/sourcegraph/sourcegraph/internal/endpoint"
+	"github.com/sourcegraph/sourcegraph/internal/search"
+)
+
+func newTestBreaker(now *time.Time) *endpointBreaker {
+	b := parseEndpointBreaker("3", "1m", "30s")
+	b.clock = func() time.Time { return *now }
+	return b
+}
+
+func TestEndpointBreaker(t *testing.T) {
+	const endpoint = "http://searcher-breaker-test"
+	unavailable := &searcherError{StatusCode: http.StatusServiceUnavailable, Message: "unavailable"}
+
+	transitions := func(state string) float64 {
+		return testutil.ToFloat64(metricBreakerTransitions.WithLabelValues(endpoint, state))
+	}
+	isExcluded := func(b *endpointBreaker) bool {
+		return b.excluded(nil)[endpoint]
+	}
+
+	t.Run("opens after threshold failures", func(t *testing.T) {
+		now := time.Now()
+		b := newTestBreaker(&now)
+		opened := transitions("open")
+
+		for i := 0; i < 2; i++ {
+			b.record(endpoint, unavailable)
+		}
+		if isExcluded(b) {
+			t.Fatal("want endpoint routed to below the threshold")
+		}
+
+		b.record(endpoint, unavailable)
+		if !isExcluded(b) {
+			t.Fatal("want endpoint excluded at the threshold")
+		}
+		if got := transitions("open") - opened; got != 1 {
+			t.Errorf("open transitions: want 1 but got %v", got)
+		}
+
+		// The given set is not modified.
+		given := map[string]bool{"http://other": true}
+		got := b.excluded(given)
+		if diff := cmp.Diff(map[string]bool{"http://other": true, endpoint: true}, got); diff != "" {
+			t.Errorf("excluded mismatch (-want +got):\n%s", diff)
+		}
+		if diff := cmp.Diff(map[string]bool{"http://other": true}, given); diff != "" {
+			t.Errorf("given set was modified (-want +got):\n%s", diff)
+		}
+	})
+
+	t.Run("success resets the failures", func(t *testing.T) {
+		now := time.Now()
+		b := newTestBreaker(&now)
+
+		b.record(endpoint, unavailable)
+		b.record(endpoint, unavailable)
+		b.record(endpoint, nil)
+		b.record(endpoint, unavailable)
+		if isExcluded(b) {
+			t.Fatal("want failures to be consecutive")
+		}
+	})
+
+	t.Run("failures of the search itself do not reset the failures", func(t *testing.T) {
+		now := time.Now()
+		b := newTestBreaker(&now)
+
+		b.record(endpoint, unavailable)
+		b.record(endpoint, unavailable)
+		b.record(endpoint, context.DeadlineExceeded)
+		b.record(endpoint, unavailable)
+		if !isExcluded(b) {
+			t.Fatal("want failures counted across failures of the search itself")
+		}
+	})
+
+	t.Run("failures outside the window", func(t *testing.T) {
+		now := time.Now()
+		b := newTestBreaker(&now)
+
+		b.record(endpoint, unavailable)
+		b.record(endpoint, unavailable)
+		now = now.Add(2 * time.Minute)
+		b.record(endpoint, unavailable)
+		if isExcluded(b) {
+			t.Fatal("want failures outside the window not counted")
+		}
+	})
+
+	t.Run("failures of the search itself", func(t *testing.T) {
+		now := time.Now()
+		b := newTestBreaker(&now)
+
+		for _, err := range []error{
+			&searcherError{StatusCode: http.StatusBadRequest, Message: "bad request"},
+			&searcherError{StatusCode: http.StatusServiceUnavailable, Message: "comby error: Invalid pattern"},
+			context.DeadlineExceeded,
+			errors.Wrap(context.Canceled, "search"),
+		} {
+			for i := 0; i < 3; i++ {
+				b.record(endpoint, err)
+			}
+			if isExcluded(b) {
+				t.Fatalf("want %v not counted as a failure of the endpoint", err)
+			}
+		}
+	})
+
+	t.Run("open breaker is only closed by a probe", func(t *testing.T) {
+		now := time.Now()
+		b := newTestBreaker(&now)
+
+		for i := 0; i < 3; i++ {
+			b.record(endpoint, unavailable)
+		}
+		for _, err := range []error{
+			nil, // a search that started before the breaker was opened
+			context.DeadlineExceeded,
+			&searcherError{StatusCode: http.StatusBadRequest, Message: "bad request"},
+		} {
+			b.record(endpoint, err)
+			if !isExcluded(b) {
+				t.Fatalf("want endpoint still excluded after %v", err)
+			}
+		}
+	})
+
+	t.Run("probe fails for reasons unrelated to the endpoint", func(t *testing.T) {
+		now := time.Now()
+		b := newTestBreaker(&now)
+
+		for i := 0; i < 3; i++ {
+			b.record(endpoint, unavailable)
+		}
+		now = now.Add(time.Minute)
+		b.chosen(endpoint)
+		b.record(endpoint, context.DeadlineExceeded)
+		if isExcluded(b) {
+			t.Fatal("want endpoint probed again")
+		}
+
+		b.chosen(endpoint)
+		if !isExcluded(b) {
+			t.Fatal("want endpoint excluded while it is probed")
+		}
+		b.record(endpoint, nil)
+		if isExcluded(b) {
+			t.Fatal("want endpoint routed to after a successful probe")
+		}
+	})
+
+	t.Run("probe succeeds", func(t *testing.T) {
+		now := time.Now()
+		b := newTestBreaker(&now)
+		halfOpened, closed := transitions("half_open"), transitions("closed")
+
+		for i := 0; i < 3; i++ {
+			b.record(endpoint, unavailable)
+		}
+		now = now.Add(10 * time.Second)
+		if !isExcluded(b) {
+			t.Fatal("want endpoint excluded during the cooldown")
+		}
+
+		now = now.Add(30 * time.Second)
+		if isExcluded(b) {
+			t.Fatal("want endpoint routed to after the cooldown")
+		}
+		b.chosen(endpoint)
+		if !isExcluded(b) {
+			t.Fatal("want endpoint excluded while it is probed")
+		}
+
+		b.record(endpoint, nil)
+		if isExcluded(b) {
+			t.Fatal("want endpoint routed to after a successful probe")
+		}
+		if got := transitions("half_open") - halfOpened; got != 1 {
+			t.Errorf("half_open transitions: want 1 but got %v", got)
+		}
+		if got := transitions("closed") - closed; got != 1 {
+			t.Errorf("closed transitions: want 1 but got %v", got)
+		}
+	})
+
+	t.Run("probe fails", func(t *testing.T) {
+		now := time.Now()
+		b := newTestBreaker(&now)
+
+		for i := 0; i < 3; i++ {
+			b.record(endpoint, unavailable)
+		}
+		now = now.Add(time.Minute)
+		b.chosen(endpoint)
+		b.record(endpoint, unavailable)
+		if !isExcluded(b) {
+			t.Fatal("want endpoint excluded after a failed probe")
+		}
+
+		now = now.Add(10 * time.Second)
+		if !isExcluded(b) {
+			t.Fatal("want endpoint excluded for another cooldown")
+		}
+	})
+
+	t.Run("reset", func(t *testing.T) {
+		now := time.Now()
+		b := newTestBreaker(&now)
+
+		for i := 0; i < 3; i++ {
+			b.record(endpoint, unavailable)
+		}
+		b.reset()
+		if isExcluded(b) {
+			t.Fatal("want endpoint routed to after a reset")
+		}
+	})
+
+	t.Run("disabled", func(t *testing.T) {
+		now := time.Now()
+		b := parseEndpointBreaker("0", "1m", "30s")
+		b.clock = func() time.Time { return now }
+
+		for i := 0; i < 10; i++ {
+			b.record(endpoint, unavailable)
+		}
+		if isExcluded(b) {
+			t.Fatal("want a disabled breaker to never exclude an endpoint")
+		}
+	})
+}
+
+func TestSearch_circuitBreaker(t *testing.T) {
+	defer ResetCircuitBreaker()
+
+	var badRequests, goodRequests int32
+	bad := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&badRequests, 1)
+		http.Error(w, "unavailable", http.StatusServiceUnavailable)
+	}))
+	defer bad.Close()
+	good := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&goodRequests, 1)
+		_, _ = w.Write([]byte(`{"Matches":[]}`))
+	}))
+	defer good.Close()
+
+	oldDoer := searchDoer
+	searchDoer = http.DefaultClient
+	defer func() { searchDoer = oldDoer }()
+
+	// Open the breaker of the bad instance.
+	for i := 0; i < breaker.threshold; i++ {
+		breaker.record(bad.URL, &searcherError{StatusCode: http.StatusServiceUnavailable})
+	}
+
+	// Use different commits so that consistent hashing picks both instances.
+	for _, commit := range []api.CommitID{"a", "b", "c", "d", "e", "f", "g", "h"} {
+		_, _, _, err := Search(context.Background(), endpoint.Static(bad.URL, good.URL), "foo", "", commit, false, &search.TextPatternInfo{}, 0, nil, nil, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if got := atomic.LoadInt32(&badRequests); got != 0 {
+		t.Errorf("requests to the excluded searcher: want 0 but got %d", got)
+	}
+	if got := atomic.LoadInt32(&goodRequests); got != 8 {
+		t.Errorf("requests to the healthy searcher: want 8 but got %d", got)
+	}
+}
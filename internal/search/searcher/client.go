@@ -3,34 +3,114 @@
 package searcher
 
 import (
+	"compress/gzip"
 	"context"
 	"encoding/json"
 	"fmt"
 	"io"
+	"net"
 	"net/http"
 	"net/url"
 	"strconv"
+	"strings"
 	"time"
 
 	"github.com/cockroachdb/errors"
+	"github.com/go-enry/go-enry/v2"
 	"github.com/opentracing-contrib/go-stdlib/nethttp"
+	otlog "github.com/opentracing/opentracing-go/log"
 
 	"github.com/sourcegraph/sourcegraph/cmd/searcher/protocol"
 	"github.com/sourcegraph/sourcegraph/internal/api"
 	"github.com/sourcegraph/sourcegraph/internal/endpoint"
+	"github.com/sourcegraph/sourcegraph/internal/env"
 	"github.com/sourcegraph/sourcegraph/internal/errcode"
 	"github.com/sourcegraph/sourcegraph/internal/httpcli"
+	"github.com/sourcegraph/sourcegraph/internal/lazyregexp"
 	"github.com/sourcegraph/sourcegraph/internal/search"
 	"github.com/sourcegraph/sourcegraph/internal/trace"
 	"github.com/sourcegraph/sourcegraph/internal/trace/ot"
 )
 
 var (
-	searchDoer, _ = httpcli.NewInternalClientFactory("search").Doer()
+	searchClientMaxIdleConnsPerHost = env.Get("SEARCHER_CLIENT_MAX_IDLE_CONNS_PER_HOST", "500", "maximum number of idle connections kept to each searcher instance")
+	searchClientForceHTTP2          = env.Get("SEARCHER_CLIENT_FORCE_HTTP2", "true", "attempt HTTP/2 on TLS connections to searcher")
+	fetchTimeoutScaleBytes          = env.Get("SEARCHER_FETCH_TIMEOUT_SCALE_BYTES", "0", "repository size in bytes that adds another multiple of the fetch timeout, 0 disables scaling by repository size")
+	fetchTimeoutMax                 = env.Get("SEARCHER_FETCH_TIMEOUT_MAX", "5m", "maximum fetch timeout after scaling by repository size")
+
+	fetchTimeoutScaling = parseFetchTimeoutScaling(fetchTimeoutScaleBytes, fetchTimeoutMax)
+
+	// RepoSizeHint returns the size in bytes of the repository, which is used to
+	// scale the fetch timeout when SEARCHER_FETCH_TIMEOUT_SCALE_BYTES is set. If it
+	// is nil or returns false, the fetch timeout is not scaled.
+	RepoSizeHint func(ctx context.Context, repo api.RepoName) (sizeBytes int64, ok bool)
+
+	searchDoer, _ = httpcli.NewInternalClientFactory("search", searchTransportOpts(searchClientMaxIdleConnsPerHost, searchClientForceHTTP2)...).Doer()
 	MockSearch    func(ctx context.Context, repo api.RepoName, commit api.CommitID, p *search.TextPatternInfo, fetchTimeout time.Duration) (matches []*protocol.FileMatch, limitHit bool, err error)
 )
 
-// Search searches repo@commit with p.
+// searchTransportOpts returns the opts tuning connection reuse of the transport to
+// searcher from the given environment values. Values that fail to parse keep the
+// defaults of the internal client.
+func searchTransportOpts(maxIdleConnsPerHost, forceHTTP2 string) []httpcli.Opt {
+	var opts []httpcli.Opt
+	if max, err := strconv.Atoi(maxIdleConnsPerHost); err == nil && max > 0 {
+		opts = append(opts, httpcli.NewMaxIdleConnsPerHostOpt(max))
+	}
+	if force, err := strconv.ParseBool(forceHTTP2); err == nil {
+		opts = append(opts, httpcli.NewForceAttemptHTTP2Opt(force))
+	}
+	return opts
+}
+
+// timeoutScaling configures how the fetch timeout is scaled by repository size.
+type timeoutScaling struct {
+	// The repository size in bytes that adds another multiple of the fetch
+	// timeout, zero disables scaling.
+	bytesPerStep int64
+	// The maximum fetch timeout after scaling.
+	max time.Duration
+}
+
+// parseFetchTimeoutScaling returns the fetch timeout scaling from the given
+// environment values. Scaling is disabled if any of the values fails to parse.
+func parseFetchTimeoutScaling(scaleBytes, max string) timeoutScaling {
+	bytesPerStep, err := strconv.ParseInt(scaleBytes, 10, 64)
+	if err != nil || bytesPerStep <= 0 {
+		return timeoutScaling{}
+	}
+	maxTimeout, err := time.ParseDuration(max)
+	if err != nil || maxTimeout <= 0 {
+		return timeoutScaling{}
+	}
+	return timeoutScaling{bytesPerStep: bytesPerStep, max: maxTimeout}
+}
+
+// scale returns the fetch timeout multiplied by one plus the number of steps in
+// the repository size, clamped to the maximum. A fetch timeout larger than the
+// maximum is never shortened.
+func (s timeoutScaling) scale(fetchTimeout time.Duration, sizeBytes int64) time.Duration {
+	if s.bytesPerStep <= 0 || sizeBytes <= 0 || fetchTimeout <= 0 || fetchTimeout >= s.max {
+		return fetchTimeout
+	}
+
+	steps := sizeBytes / s.bytesPerStep
+	if steps >= int64(s.max/fetchTimeout) {
+		return s.max
+	}
+	return fetchTimeout * time.Duration(1+steps)
+}
+
+// Search searches repo@commit with p. For structural searches, it also returns the
+// timing breakdown reported by searcher, which is nil otherwise. If
+// onEndpointChosen is not nil, it is called with the searcher endpoint right
+// before every attempt, including retries. By default, a search is attempted
+// twice within the deadline of ctx, see SearchOption for changing that.
+//
+// Matches are only returned when onMatches is nil, otherwise they are streamed
+// to it and the returned matches are always nil. When the search fails, no
+// matches are returned but limitHit still reports whether any attempt hit the
+// limit.
 func Search(
 	ctx context.Context,
 	searcherURLs *endpoint.Map,
@@ -42,17 +122,123 @@ func Search(
 	fetchTimeout time.Duration,
 	indexerEndpoints []string,
 	onMatches func([]*protocol.FileMatch),
-) (matches []*protocol.FileMatch, limitHit bool, err error) {
+	onEndpointChosen func(endpoint string, attempt int),
+	opts ...SearchOption,
+) (matches []*protocol.FileMatch, limitHit bool, structural *protocol.StructuralTimings, err error) {
+	if MockSearch != nil {
+		matches, limitHit, err = MockSearch(ctx, repo, commit, p, fetchTimeout)
+		return matches, limitHit, nil, err
+	}
+
+	var handler StreamHandler
+	if onMatches != nil {
+		handler = matchesHandler(onMatches)
+	}
+	return doSearch(ctx, searcherURLs, repo, branch, commit, indexed, p, fetchTimeout, indexerEndpoints, handler, onEndpointChosen, opts...)
+}
+
+// StreamHandler receives the events of a streaming search. A handler may also
+// implement UnknownEventHandler to receive events that are unknown to the
+// client, which are ignored otherwise.
+type StreamHandler interface {
+	// OnMatches is called with every batch of matches sent by searcher.
+	OnMatches([]*protocol.FileMatch)
+	// OnProgress is called after every batch of matches with the progress so far.
+	OnProgress(EventProgress)
+	// OnDone is called once with the done event of the attempt that the result
+	// of the search is returned from, if searcher sent one.
+	OnDone(EventDone)
+}
+
+// UnknownEventHandler is optionally implemented by a StreamHandler to receive
+// events that are unknown to the client, e.g. sent by a newer searcher.
+type UnknownEventHandler interface {
+	OnUnknown(event, data []byte)
+}
+
+// matchesHandler is a StreamHandler that is only interested in matches.
+type matchesHandler func([]*protocol.FileMatch)
+
+func (h matchesHandler) OnMatches(fm []*protocol.FileMatch) { h(fm) }
+func (h matchesHandler) OnProgress(EventProgress)           {}
+func (h matchesHandler) OnDone(EventDone)                   {}
+
+// SearchStream is like Search but streams the events of the search to the
+// handler, including progress and the done event.
+func SearchStream(
+	ctx context.Context,
+	searcherURLs *endpoint.Map,
+	repo api.RepoName,
+	branch string,
+	commit api.CommitID,
+	indexed bool,
+	p *search.TextPatternInfo,
+	fetchTimeout time.Duration,
+	indexerEndpoints []string,
+	handler StreamHandler,
+	onEndpointChosen func(endpoint string, attempt int),
+	opts ...SearchOption,
+) error {
 	if MockSearch != nil {
-		return MockSearch(ctx, repo, commit, p, fetchTimeout)
+		matches, limitHit, err := MockSearch(ctx, repo, commit, p, fetchTimeout)
+		if err != nil {
+			return err
+		}
+		handler.OnMatches(matches)
+		handler.OnProgress(progressOf(EventProgress{}, matches))
+		handler.OnDone(EventDone{LimitHit: limitHit})
+		return nil
+	}
+
+	_, _, _, err := doSearch(ctx, searcherURLs, repo, branch, commit, indexed, p, fetchTimeout, indexerEndpoints, handler, onEndpointChosen, opts...)
+	return err
+}
+
+// doSearch implements Search and SearchStream, the search is streamed to the
+// handler unless it is nil.
+func doSearch(
+	ctx context.Context,
+	searcherURLs *endpoint.Map,
+	repo api.RepoName,
+	branch string,
+	commit api.CommitID,
+	indexed bool,
+	p *search.TextPatternInfo,
+	fetchTimeout time.Duration,
+	indexerEndpoints []string,
+	handler StreamHandler,
+	onEndpointChosen func(endpoint string, attempt int),
+	opts ...SearchOption,
+) (matches []*protocol.FileMatch, limitHit bool, structural *protocol.StructuralTimings, err error) {
+	options := searchOptions{maxAttempts: 2}
+	for _, opt := range opts {
+		opt(&options)
 	}
 
 	tr, ctx := trace.New(ctx, "searcher.client", fmt.Sprintf("%s@%s", repo, commit))
 	defer func() {
+		if structural != nil {
+			tr.LogFields(
+				otlog.String("structural.parse", structural.Parse.String()),
+				otlog.String("structural.match", structural.Match.String()),
+			)
+		}
 		tr.SetError(err)
 		tr.Finish()
 	}()
 
+	// Fail fast on values that searcher would reject anyway.
+	if err := validatePatternInfo(p); err != nil {
+		return nil, false, nil, err
+	}
+
+	if fetchTimeoutScaling.bytesPerStep > 0 && RepoSizeHint != nil {
+		if sizeBytes, ok := RepoSizeHint(ctx, repo); ok {
+			fetchTimeout = fetchTimeoutScaling.scale(fetchTimeout, sizeBytes)
+			tr.LogFields(otlog.Int64("repo.size_bytes", sizeBytes), otlog.String("fetch_timeout", fetchTimeout.String()))
+		}
+	}
+
 	q := url.Values{
 		"Repo":            []string{string(repo)},
 		"Commit":          []string{string(commit)},
@@ -71,7 +257,7 @@ func Search(
 	if deadline, ok := ctx.Deadline(); ok {
 		t, err := deadline.MarshalText()
 		if err != nil {
-			return nil, false, err
+			return nil, false, nil, err
 		}
 		q.Set("Deadline", string(t))
 	}
@@ -97,7 +283,7 @@ func Search(
 	if p.IsNegated {
 		q.Set("IsNegated", "true")
 	}
-	if onMatches != nil {
+	if handler != nil {
 		q.Set("Stream", "true")
 	}
 	// TEMP BACKCOMPAT: always set even if false so that searcher can distinguish new frontends that send
@@ -116,14 +302,27 @@ func Search(
 		// When we retry do not use a host we already tried.
 		excludedSearchURLs = map[string]bool{}
 		attempt            = 0
-		maxAttempts        = 2
+		maxAttempts        = options.maxAttempts
+		// Whether any attempt has hit the limit, which is kept when a later
+		// attempt fails.
+		anyLimitHit = false
+		// The done event of the last attempt, which is only sent to the handler
+		// once we know that there is no retry.
+		done *EventDone
 	)
+	defer func() {
+		if done != nil {
+			handler.OnDone(*done)
+		}
+	}()
 	for {
 		attempt++
 
-		searcherURL, err := searcherURLs.Get(consistentHashKey, excludedSearchURLs)
+		// Instances the circuit breaker considers unhealthy are avoided as well,
+		// but only for this attempt.
+		searcherURL, err := searcherURLs.Get(consistentHashKey, breaker.excluded(excludedSearchURLs))
 		if err != nil {
-			return nil, false, err
+			return nil, false, nil, err
 		}
 
 		// Fallback to a bad host if nothing is left
@@ -131,46 +330,198 @@ func Search(
 			tr.LazyPrintf("failed to find endpoint, trying again without excludes")
 			searcherURL, err = searcherURLs.Get(consistentHashKey, nil)
 			if err != nil {
-				return nil, false, err
+				return nil, false, nil, err
 			}
 		}
 
-		url := searcherURL + "?" + rawQuery
-		tr.LazyPrintf("attempt %d: %s", attempt, url)
-		if onMatches != nil {
-			limitHit, err = textSearchURLStream(ctx, url, onMatches)
-			if err == nil || errcode.IsTimeout(err) {
-				return nil, limitHit, err
-			}
-		} else {
-			matches, limitHit, err = textSearchURL(ctx, url)
-			if err == nil || errcode.IsTimeout(err) {
-				return matches, limitHit, err
+		attemptCtx, cancel := ctx, context.CancelFunc(func() {})
+		attemptQuery := rawQuery
+		if options.perAttemptTimeout > 0 {
+			attemptCtx, cancel = context.WithTimeout(ctx, options.perAttemptTimeout)
+
+			// Let searcher know about the deadline of this attempt rather than the
+			// overall one.
+			deadline, _ := attemptCtx.Deadline()
+			t, err := deadline.MarshalText()
+			if err != nil {
+				cancel()
+				return nil, false, nil, err
 			}
+			q.Set("Deadline", string(t))
+			attemptQuery = q.Encode()
 		}
 
-		// If we are canceled, return that error.
-		if err := ctx.Err(); err != nil {
-			return nil, false, err
+		url := searcherURL + "?" + attemptQuery
+		tr.LazyPrintf("attempt %d: %s", attempt, url)
+		tr.LogFields(
+			otlog.String("event", "endpoint"),
+			otlog.String("searcher.endpoint", searcherURL),
+			otlog.Int("searcher.attempt", attempt),
+		)
+		// Tags are overwritten by every attempt, so the span is tagged with the
+		// endpoint of the last attempt.
+		tr.SetTag("searcher.endpoint", searcherURL)
+		tr.SetTag("searcher.attempt", attempt)
+		if onEndpointChosen != nil {
+			onEndpointChosen(searcherURL, attempt)
 		}
+		breaker.chosen(searcherURL)
 
-		// If not temporary or our last attempt then don't try again.
-		if !errcode.IsTemporary(err) || attempt == maxAttempts {
-			return nil, false, err
+		// Whether matches of this attempt have been sent already, which cannot be
+		// taken back by a retry.
+		streamed := false
+		if handler != nil {
+			sh := &attemptHandler{StreamHandler: handler}
+			limitHit, structural, err = textSearchURLStream(attemptCtx, url, sh)
+			streamed = sh.progress.FileMatchCount > 0
+			done = sh.done
+		} else {
+			matches, limitHit, structural, err = textSearchURL(attemptCtx, url)
+		}
+		anyLimitHit = anyLimitHit || limitHit
+		// Only this attempt ran out of time, the overall deadline still leaves room
+		// for another one.
+		attemptTimedOut := attemptCtx.Err() == context.DeadlineExceeded && ctx.Err() == nil
+		cancel()
+		breaker.record(searcherURL, err)
+
+		if !attemptTimedOut || streamed || attempt == maxAttempts {
+			if err == nil {
+				return matches, limitHit, structural, nil
+			}
+			if errcode.IsTimeout(err) {
+				return matches, anyLimitHit, structural, err
+			}
+
+			// If we are canceled, return that error.
+			if err := ctx.Err(); err != nil {
+				return nil, anyLimitHit, nil, err
+			}
+
+			// Comby fails the same way on every searcher for a malformed structural
+			// pattern, so there is no point in trying again.
+			if p.IsStructuralPat && isStructuralSyntaxError(err) {
+				tr.LazyPrintf("structural syntax error %s", err.Error())
+				return nil, anyLimitHit, nil, err
+			}
+
+			// If not temporary or our last attempt then don't try again. Matches
+			// that have been streamed would be sent twice by another attempt.
+			if !errcode.IsTemporary(err) || attempt == maxAttempts || streamed {
+				return nil, anyLimitHit, nil, err
+			}
+		} else {
+			err = context.DeadlineExceeded
 		}
 
 		tr.LazyPrintf("transient error %s", err.Error())
+		tr.LogFields(
+			otlog.String("event", "retry"),
+			otlog.Int("retry.attempt", attempt),
+			otlog.String("retry.excluded_url", searcherURL),
+			otlog.String("retry.error_class", retryErrorClass(err)),
+		)
 		// Retry search on another searcher instance (if possible)
 		excludedSearchURLs[searcherURL] = true
 	}
 }
 
-func textSearchURLStream(ctx context.Context, url string, cb func([]*protocol.FileMatch)) (bool, error) {
+// selectFieldPattern matches a single field of a select path. Only the structure
+// is validated so that new kinds of select supported by searcher don't need an
+// update of the client.
+var selectFieldPattern = lazyregexp.New(`^[a-z][a-z0-9-]*$`)
+
+// validatePatternInfo returns a bad request error if the select path or any of
+// the languages of p is malformed.
+func validatePatternInfo(p *search.TextPatternInfo) error {
+	for _, field := range p.Select {
+		if !selectFieldPattern.MatchString(field) {
+			return &searcherError{
+				StatusCode: http.StatusBadRequest,
+				Message:    fmt.Sprintf("invalid field %q on select path %q", field, p.Select.String()),
+			}
+		}
+	}
+	for _, lang := range p.Languages {
+		if _, ok := enry.GetLanguageByAlias(lang); !ok {
+			return &searcherError{
+				StatusCode: http.StatusBadRequest,
+				Message:    fmt.Sprintf("unknown language: %q", lang),
+			}
+		}
+	}
+	return nil
+}
+
+// SearchOption configures a call to Search.
+type SearchOption func(*searchOptions)
+
+type searchOptions struct {
+	maxAttempts       int
+	perAttemptTimeout time.Duration
+}
+
+// WithMaxAttempts sets the maximum number of attempts of a search, each on
+// another searcher instance if possible. It defaults to 2, values less than 1
+// are ignored.
+func WithMaxAttempts(n int) SearchOption {
+	return func(o *searchOptions) {
+		if n >= 1 {
+			o.maxAttempts = n
+		}
+	}
+}
+
+// WithPerAttemptTimeout sets the timeout of every single attempt of a search,
+// so that a slow searcher instance does not use up the overall deadline of the
+// context. Zero or negative value indicates no timeout, which is the default.
+func WithPerAttemptTimeout(d time.Duration) SearchOption {
+	return func(o *searchOptions) {
+		o.perAttemptTimeout = d
+	}
+}
+
+// attemptHandler forwards the events of an attempt of a streaming search to the
+// handler, except for the done event which is held back until the search
+// returns.
+type attemptHandler struct {
+	StreamHandler
+	progress EventProgress
+	done     *EventDone
+}
+
+func (h *attemptHandler) OnMatches(fm []*protocol.FileMatch) {
+	h.StreamHandler.OnMatches(fm)
+	h.progress = progressOf(h.progress, fm)
+	h.StreamHandler.OnProgress(h.progress)
+}
+
+func (h *attemptHandler) OnDone(e EventDone) {
+	h.done = &e
+}
+
+func (h *attemptHandler) OnUnknown(event, data []byte) {
+	if uh, ok := h.StreamHandler.(UnknownEventHandler); ok {
+		uh.OnUnknown(event, data)
+	}
+}
+
+// progressOf returns the progress after receiving the given matches.
+func progressOf(progress EventProgress, fm []*protocol.FileMatch) EventProgress {
+	progress.FileMatchCount += len(fm)
+	for _, m := range fm {
+		progress.MatchCount += m.MatchCount
+	}
+	return progress
+}
+
+func textSearchURLStream(ctx context.Context, url string, handler *attemptHandler) (bool, *protocol.StructuralTimings, error) {
 	req, err := http.NewRequest("GET", url, nil)
 	if err != nil {
-		return false, err
+		return false, nil, err
 	}
 	req = req.WithContext(ctx)
+	req.Header.Set("Accept-Encoding", "gzip")
 
 	req, ht := nethttp.TraceRequest(ot.GetTracer(ctx), req,
 		nethttp.OperationName("Searcher Client"),
@@ -187,45 +538,48 @@ func textSearchURLStream(ctx context.Context, url string, cb func([]*protocol.Fi
 		if ctx.Err() != nil {
 			err = ctx.Err()
 		}
-		return false, errors.Wrap(err, "streaming searcher request failed")
+		return false, nil, errors.Wrap(err, "streaming searcher request failed")
 	}
 	defer resp.Body.Close()
 	if resp.StatusCode != 200 {
-		body, err := io.ReadAll(resp.Body)
-		if err != nil {
-			return false, err
-		}
-		return false, errors.WithStack(&searcherError{StatusCode: resp.StatusCode, Message: string(body)})
+		return false, nil, responseError(resp)
 	}
 
 	var ed EventDone
 	dec := StreamDecoder{
-		OnMatches: cb,
+		OnMatches: handler.OnMatches,
 		OnDone: func(e EventDone) {
 			ed = e
+			handler.OnDone(e)
 		},
-		OnUnknown: func(event []byte, _ []byte) {
-			err = errors.Errorf("unknown event %q", event)
-		},
+		// Unknown events are ignored unless the handler asks for them, so that
+		// a newer searcher can add events without breaking older clients.
+		OnUnknown: handler.OnUnknown,
 	}
-	if err := dec.ReadAll(resp.Body); err != nil {
-		return false, err
+	body, err := decompressedBody(resp)
+	if err != nil {
+		return false, nil, err
+	}
+	defer body.Close()
+	if err := dec.ReadAll(body); err != nil {
+		return false, nil, err
 	}
 	if ed.Error != "" {
-		return false, errors.New(ed.Error)
+		return ed.LimitHit, nil, errors.New(ed.Error)
 	}
 	if ed.DeadlineHit {
 		err = context.DeadlineExceeded
 	}
-	return ed.LimitHit, err
+	return ed.LimitHit, ed.Structural, err
 }
 
-func textSearchURL(ctx context.Context, url string) ([]*protocol.FileMatch, bool, error) {
+func textSearchURL(ctx context.Context, url string) ([]*protocol.FileMatch, bool, *protocol.StructuralTimings, error) {
 	req, err := http.NewRequest("GET", url, nil)
 	if err != nil {
-		return nil, false, err
+		return nil, false, nil, err
 	}
 	req = req.WithContext(ctx)
+	req.Header.Set("Accept-Encoding", "gzip")
 
 	req, ht := nethttp.TraceRequest(ot.GetTracer(ctx), req,
 		nethttp.OperationName("Searcher Client"),
@@ -242,30 +596,164 @@ func textSearchURL(ctx context.Context, url string) ([]*protocol.FileMatch, bool
 		if ctx.Err() != nil {
 			err = ctx.Err()
 		}
-		return nil, false, errors.Wrap(err, "searcher request failed")
+		return nil, false, nil, errors.Wrap(err, "searcher request failed")
 	}
 	defer resp.Body.Close()
 	if resp.StatusCode != 200 {
-		body, err := io.ReadAll(resp.Body)
-		if err != nil {
-			return nil, false, err
-		}
-		return nil, false, errors.WithStack(&searcherError{StatusCode: resp.StatusCode, Message: string(body)})
+		return nil, false, nil, responseError(resp)
 	}
 
-	r := struct {
-		Matches     []*protocol.FileMatch
-		LimitHit    bool
-		DeadlineHit bool
-	}{}
-	err = json.NewDecoder(resp.Body).Decode(&r)
+	body, err := decompressedBody(resp)
+	if err != nil {
+		return nil, false, nil, err
+	}
+	defer body.Close()
+	r, err := decodeTextSearchResponse(body)
 	if err != nil {
-		return nil, false, errors.Wrap(err, "searcher response invalid")
+		return nil, false, nil, errors.Wrap(err, "searcher response invalid")
 	}
 	if r.DeadlineHit {
 		err = context.DeadlineExceeded
 	}
-	return r.Matches, r.LimitHit, err
+	return r.Matches, r.LimitHit, r.Structural, err
+}
+
+// decompressedBody returns the body of the searcher response, which is
+// decompressed if searcher compressed it. Setting the Accept-Encoding header
+// ourselves disables the transparent decompression of net/http, so every
+// request that sets it must read the body through this. Closing the returned
+// body does not close the body of the response.
+func decompressedBody(resp *http.Response) (io.ReadCloser, error) {
+	if resp.Header.Get("Content-Encoding") != "gzip" {
+		return io.NopCloser(resp.Body), nil
+	}
+	zr, err := gzip.NewReader(resp.Body)
+	if err != nil {
+		return nil, errors.Wrap(err, "searcher response invalid gzip")
+	}
+	return zr, nil
+}
+
+// responseError returns the searcherError of a non-200 searcher response. The
+// body is read through decompressedBody, so that errors of compressed responses
+// (e.g. comby errors) are still recognized.
+func responseError(resp *http.Response) error {
+	body, err := decompressedBody(resp)
+	if err != nil {
+		return err
+	}
+	defer body.Close()
+	message, err := io.ReadAll(body)
+	if err != nil {
+		return err
+	}
+	return errors.WithStack(&searcherError{StatusCode: resp.StatusCode, Message: string(message)})
+}
+
+// textSearchResponse is the response of searcher to a non-streaming search.
+type textSearchResponse struct {
+	Matches     []*protocol.FileMatch
+	LimitHit    bool
+	DeadlineHit bool
+	Structural  *protocol.StructuralTimings
+}
+
+// decodeTextSearchResponse decodes the searcher response read from r. Matches
+// are decoded one at a time as they are read, so that the response is never
+// buffered as a whole.
+func decodeTextSearchResponse(r io.Reader) (*textSearchResponse, error) {
+	dec := json.NewDecoder(r)
+	if err := expectDelim(dec, '{'); err != nil {
+		return nil, err
+	}
+
+	var resp textSearchResponse
+	for dec.More() {
+		t, err := dec.Token()
+		if err != nil {
+			return nil, err
+		}
+		// Keys are matched case-insensitively like json.Unmarshal does.
+		key, _ := t.(string)
+		switch {
+		case strings.EqualFold(key, "Matches"):
+			resp.Matches, err = decodeFileMatches(dec)
+		case strings.EqualFold(key, "LimitHit"):
+			err = dec.Decode(&resp.LimitHit)
+		case strings.EqualFold(key, "DeadlineHit"):
+			err = dec.Decode(&resp.DeadlineHit)
+		case strings.EqualFold(key, "Structural"):
+			err = dec.Decode(&resp.Structural)
+		default:
+			var skipped json.RawMessage
+			err = dec.Decode(&skipped)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if err := expectDelim(dec, '}'); err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
+
+// decodeFileMatches decodes the array of file matches, or null, read by dec.
+func decodeFileMatches(dec *json.Decoder) ([]*protocol.FileMatch, error) {
+	t, err := dec.Token()
+	if err != nil {
+		return nil, err
+	}
+	if t == nil {
+		return nil, nil
+	}
+	if d, ok := t.(json.Delim); !ok || d != '[' {
+		return nil, errors.Errorf("unexpected token %v, want an array of matches", t)
+	}
+
+	matches := []*protocol.FileMatch{}
+	for dec.More() {
+		var fm protocol.FileMatch
+		if err := dec.Decode(&fm); err != nil {
+			return nil, err
+		}
+		matches = append(matches, &fm)
+	}
+	if err := expectDelim(dec, ']'); err != nil {
+		return nil, err
+	}
+	return matches, nil
+}
+
+// expectDelim reads the next token of dec and returns an error unless it is the
+// given delimiter.
+func expectDelim(dec *json.Decoder, want json.Delim) error {
+	t, err := dec.Token()
+	if err != nil {
+		return err
+	}
+	if d, ok := t.(json.Delim); !ok || d != want {
+		return errors.Errorf("unexpected token %v, want %v", t, want)
+	}
+	return nil
+}
+
+// retryErrorClass returns a coarse classification of the transient error that
+// caused a retry, which is stable enough to filter traces on.
+func retryErrorClass(err error) string {
+	if errors.Is(err, context.DeadlineExceeded) {
+		return "attempt_timeout"
+	}
+	var se *searcherError
+	if errors.As(err, &se) {
+		return "http_" + strconv.Itoa(se.StatusCode)
+	}
+	var ne net.Error
+	if errors.As(err, &ne) {
+		return "network"
+	}
+	return "other"
 }
 
 type searcherError struct {
@@ -273,12 +761,29 @@ type searcherError struct {
 	Message    string
 }
 
+// combyErrorPrefix is how searcher reports comby failing to run a structural
+// search, followed by what comby wrote to stderr.
+const combyErrorPrefix = "comby error:"
+
+// IsStructuralSyntaxError returns true if comby rejected the structural pattern
+// or rule, which fails the same way regardless of the searcher instance.
+func (e *searcherError) IsStructuralSyntaxError() bool {
+	return e.StatusCode != http.StatusOK && strings.Contains(e.Message, combyErrorPrefix)
+}
+
 func (e *searcherError) BadRequest() bool {
-	return e.StatusCode == http.StatusBadRequest
+	return e.StatusCode == http.StatusBadRequest || e.IsStructuralSyntaxError()
 }
 
 func (e *searcherError) Temporary() bool {
-	return e.StatusCode == http.StatusServiceUnavailable
+	return e.StatusCode == http.StatusServiceUnavailable && !e.IsStructuralSyntaxError()
+}
+
+// isStructuralSyntaxError returns true if err is caused by searcher reporting a
+// structural syntax error.
+func isStructuralSyntaxError(err error) bool {
+	var se *searcherError
+	return errors.As(err, &se) && se.IsStructuralSyntaxError()
 }
 
 func (e *searcherError) Error() string {
@@ -0,0 +1,773 @@
+package searcher
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/cockroachdb/errors"
+	"github.com/google/go-cmp/cmp"
+	"github.com/opentracing/opentracing-go"
+	"github.com/opentracing/opentracing-go/mocktracer"
+
+	"github.com/sourcegraph/sourcegraph/cmd/searcher/protocol"
+	"github.com/sourcegraph/sourcegraph/internal/api"
+	"github.com/sourcegraph/sourcegraph/internal/endpoint"
+	"github.com/sourcegraph/sourcegraph/internal/errcode"
+	"github.com/sourcegraph/sourcegraph/internal/httpcli"
+	"github.com/sourcegraph/sourcegraph/internal/search"
+	"github.com/sourcegraph/sourcegraph/internal/search/filter"
+	"github.com/sourcegraph/sourcegraph/internal/trace/ot"
+)
+
+func TestSearch_retryEvent(t *testing.T) {
+	// The first request fails with a transient error, regardless of which
+	// searcher instance it is routed to.
+	var requests int32
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&requests, 1) == 1 {
+			http.Error(w, "unavailable", http.StatusServiceUnavailable)
+			return
+		}
+		_, _ = w.Write([]byte(`{"Matches":[]}`))
+	})
+	s1 := httptest.NewServer(handler)
+	defer s1.Close()
+	s2 := httptest.NewServer(handler)
+	defer s2.Close()
+
+	// Bypass the retries of the internal HTTP client so the transient error
+	// reaches the searcher client.
+	oldDoer := searchDoer
+	searchDoer = http.DefaultClient
+	defer func() { searchDoer = oldDoer }()
+
+	tracer := mocktracer.New()
+	oldTracer := opentracing.GlobalTracer()
+	opentracing.SetGlobalTracer(tracer)
+	defer opentracing.SetGlobalTracer(oldTracer)
+
+	ctx := ot.WithShouldTrace(context.Background(), true)
+	_, _, _, err := Search(ctx, endpoint.Static(s1.URL, s2.URL), "foo", "", "deadbeef", false, &search.TextPatternInfo{}, 0, nil, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var retries []map[string]interface{}
+	var tags map[string]interface{}
+	for _, span := range tracer.FinishedSpans() {
+		if span.OperationName != "searcher.client" {
+			continue
+		}
+		tags = span.Tags()
+		for _, record := range span.Logs() {
+			fields := make(map[string]interface{}, len(record.Fields))
+			for _, f := range record.Fields {
+				fields[f.Key] = f.ValueString
+			}
+			if fields["event"] == "retry" {
+				retries = append(retries, fields)
+			}
+		}
+	}
+
+	if len(retries) != 1 {
+		t.Fatalf("retry events: want 1 but got %d", len(retries))
+	}
+	got := retries[0]
+	if got["retry.attempt"] != "1" {
+		t.Errorf("retry.attempt: want %q but got %q", "1", got["retry.attempt"])
+	}
+	if url := got["retry.excluded_url"]; url != s1.URL && url != s2.URL {
+		t.Errorf("retry.excluded_url: want one of the searcher URLs but got %q", url)
+	}
+	if got["retry.error_class"] != "http_503" {
+		t.Errorf("retry.error_class: want %q but got %q", "http_503", got["retry.error_class"])
+	}
+
+	// The span is tagged with the endpoint of the last attempt.
+	if url := tags["searcher.endpoint"]; url == got["retry.excluded_url"] || (url != s1.URL && url != s2.URL) {
+		t.Errorf("searcher.endpoint: want the searcher URL of the retry but got %q", url)
+	}
+	if tags["searcher.attempt"] != 2 {
+		t.Errorf("searcher.attempt: want 2 but got %v", tags["searcher.attempt"])
+	}
+}
+
+func TestSearch_onEndpointChosen(t *testing.T) {
+	// The first request fails with a transient error, so the second attempt is
+	// made against the other searcher instance.
+	var requests int32
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&requests, 1) == 1 {
+			http.Error(w, "unavailable", http.StatusServiceUnavailable)
+			return
+		}
+		_, _ = w.Write([]byte(`{"Matches":[]}`))
+	})
+	s1 := httptest.NewServer(handler)
+	defer s1.Close()
+	s2 := httptest.NewServer(handler)
+	defer s2.Close()
+
+	oldDoer := searchDoer
+	searchDoer = http.DefaultClient
+	defer func() { searchDoer = oldDoer }()
+
+	type chosen struct {
+		Endpoint string
+		Attempt  int
+	}
+	var got []chosen
+	_, _, _, err := Search(context.Background(), endpoint.Static(s1.URL, s2.URL), "foo", "", "deadbeef", false, &search.TextPatternInfo{}, 0, nil, nil, func(endpoint string, attempt int) {
+		got = append(got, chosen{Endpoint: endpoint, Attempt: attempt})
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(got) != 2 {
+		t.Fatalf("chosen endpoints: want 2 but got %+v", got)
+	}
+	for i, c := range got {
+		if c.Attempt != i+1 {
+			t.Errorf("attempt: want %d but got %d", i+1, c.Attempt)
+		}
+		if c.Endpoint != s1.URL && c.Endpoint != s2.URL {
+			t.Errorf("endpoint: want one of the searcher URLs but got %q", c.Endpoint)
+		}
+	}
+	if got[0].Endpoint == got[1].Endpoint {
+		t.Errorf("endpoint: want the retry on another searcher but got %q twice", got[0].Endpoint)
+	}
+}
+
+func TestSearch_structuralSyntaxError(t *testing.T) {
+	const msg = "failed to wait for executing comby command: comby error: Error: Invalid pattern: :[x"
+	var requests int32
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		http.Error(w, msg, http.StatusServiceUnavailable)
+	})
+	s1 := httptest.NewServer(handler)
+	defer s1.Close()
+	s2 := httptest.NewServer(handler)
+	defer s2.Close()
+
+	// Bypass the retries of the internal HTTP client so that only retries of
+	// the searcher client are counted.
+	oldDoer := searchDoer
+	searchDoer = http.DefaultClient
+	defer func() { searchDoer = oldDoer }()
+
+	_, _, _, err := Search(context.Background(), endpoint.Static(s1.URL, s2.URL), "foo", "", "deadbeef", false, &search.TextPatternInfo{IsStructuralPat: true}, 0, nil, nil, nil)
+	if !errcode.IsBadRequest(err) || errcode.IsTemporary(err) {
+		t.Fatalf("err: want a permanent bad request but got %v", err)
+	}
+	if !isStructuralSyntaxError(err) {
+		t.Fatalf("err: want a structural syntax error but got %v", err)
+	}
+	if got := atomic.LoadInt32(&requests); got != 1 {
+		t.Fatalf("requests: want 1 but got %d", got)
+	}
+
+	t.Run("other errors are still retried", func(t *testing.T) {
+		atomic.StoreInt32(&requests, 0)
+		handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			atomic.AddInt32(&requests, 1)
+			http.Error(w, "unavailable", http.StatusServiceUnavailable)
+		})
+		s := httptest.NewServer(handler)
+		defer s.Close()
+
+		_, _, _, err := Search(context.Background(), endpoint.Static(s.URL), "foo", "", "deadbeef", false, &search.TextPatternInfo{IsStructuralPat: true}, 0, nil, nil, nil)
+		if !errcode.IsTemporary(err) {
+			t.Fatalf("err: want a temporary error but got %v", err)
+		}
+		if got := atomic.LoadInt32(&requests); got != 2 {
+			t.Fatalf("requests: want 2 but got %d", got)
+		}
+	})
+}
+
+func TestSearch_perAttemptTimeout(t *testing.T) {
+	// The first request hangs until the client gives up on it, regardless of
+	// which searcher instance it is routed to.
+	var requests int32
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&requests, 1) == 1 {
+			select {
+			case <-r.Context().Done():
+			case <-time.After(10 * time.Second):
+			}
+			return
+		}
+		_, _ = w.Write([]byte(`{"Matches":[{"Path":"README.md"}]}`))
+	})
+	s1 := httptest.NewServer(handler)
+	defer s1.Close()
+	s2 := httptest.NewServer(handler)
+	defer s2.Close()
+
+	oldDoer := searchDoer
+	searchDoer = http.DefaultClient
+	defer func() { searchDoer = oldDoer }()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	matches, _, _, err := Search(ctx, endpoint.Static(s1.URL, s2.URL), "foo", "", "deadbeef", false, &search.TextPatternInfo{}, 0, nil, nil, nil,
+		WithPerAttemptTimeout(100*time.Millisecond),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(matches) != 1 || matches[0].Path != "README.md" {
+		t.Fatalf("matches: want the ones of the second attempt but got %+v", matches)
+	}
+	if got := atomic.LoadInt32(&requests); got != 2 {
+		t.Fatalf("requests: want 2 but got %d", got)
+	}
+
+	t.Run("max attempts", func(t *testing.T) {
+		var requests int32
+		s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			atomic.AddInt32(&requests, 1)
+			http.Error(w, "unavailable", http.StatusServiceUnavailable)
+		}))
+		defer s.Close()
+
+		_, _, _, err := Search(context.Background(), endpoint.Static(s.URL), "foo", "", "deadbeef", false, &search.TextPatternInfo{}, 0, nil, nil, nil,
+			WithMaxAttempts(3),
+		)
+		if !errcode.IsTemporary(err) {
+			t.Fatalf("err: want a temporary error but got %v", err)
+		}
+		if got := atomic.LoadInt32(&requests); got != 3 {
+			t.Fatalf("requests: want 3 but got %d", got)
+		}
+	})
+
+	t.Run("last attempt times out", func(t *testing.T) {
+		s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			<-r.Context().Done()
+		}))
+		defer s.Close()
+
+		_, _, _, err := Search(context.Background(), endpoint.Static(s.URL), "foo", "", "deadbeef", false, &search.TextPatternInfo{}, 0, nil, nil, nil,
+			WithMaxAttempts(1),
+			WithPerAttemptTimeout(50*time.Millisecond),
+		)
+		if !errcode.IsTimeout(err) {
+			t.Fatalf("err: want a timeout error but got %v", err)
+		}
+	})
+}
+
+func TestSearch_gzip(t *testing.T) {
+	for _, compress := range []bool{true, false} {
+		t.Run(fmt.Sprintf("compress=%t", compress), func(t *testing.T) {
+			s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if got := r.Header.Get("Accept-Encoding"); got != "gzip" {
+					t.Errorf("Accept-Encoding: want %q but got %q", "gzip", got)
+				}
+
+				var body string
+				if r.URL.Query().Get("Stream") == "true" {
+					body = "event: matches\ndata: [{\"Path\":\"README.md\"}]\n\nevent: done\ndata: {\"limit_hit\":true}\n\n"
+				} else {
+					body = `{"Matches":[{"Path":"README.md"}],"LimitHit":true}`
+				}
+
+				if !compress {
+					_, _ = w.Write([]byte(body))
+					return
+				}
+				w.Header().Set("Content-Encoding", "gzip")
+				zw := gzip.NewWriter(w)
+				_, _ = zw.Write([]byte(body))
+				_ = zw.Close()
+			}))
+			defer s.Close()
+
+			oldDoer := searchDoer
+			searchDoer = http.DefaultClient
+			defer func() { searchDoer = oldDoer }()
+
+			want := []*protocol.FileMatch{{Path: "README.md"}}
+
+			matches, limitHit, _, err := Search(context.Background(), endpoint.Static(s.URL), "foo", "", "deadbeef", false, &search.TextPatternInfo{}, 0, nil, nil, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if diff := cmp.Diff(want, matches); diff != "" || !limitHit {
+				t.Fatalf("non-streaming: limitHit %t, matches mismatch (-want +got):\n%s", limitHit, diff)
+			}
+
+			var streamed []*protocol.FileMatch
+			_, limitHit, _, err = Search(context.Background(), endpoint.Static(s.URL), "foo", "", "deadbeef", false, &search.TextPatternInfo{}, 0, nil, func(fm []*protocol.FileMatch) {
+				streamed = append(streamed, fm...)
+			}, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if diff := cmp.Diff(want, streamed); diff != "" || !limitHit {
+				t.Fatalf("streaming: limitHit %t, matches mismatch (-want +got):\n%s", limitHit, diff)
+			}
+		})
+	}
+}
+
+func TestSearch_gzipError(t *testing.T) {
+	for _, compress := range []bool{true, false} {
+		t.Run(fmt.Sprintf("compress=%t", compress), func(t *testing.T) {
+			s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				// Long enough to be compressed rather than stored as-is.
+				body := "comby error: Invalid pattern" + strings.Repeat(" (unbalanced delimiter)", 100)
+				if !compress {
+					http.Error(w, body, http.StatusBadRequest)
+					return
+				}
+				w.Header().Set("Content-Encoding", "gzip")
+				w.WriteHeader(http.StatusBadRequest)
+				zw := gzip.NewWriter(w)
+				_, _ = zw.Write([]byte(body))
+				_ = zw.Close()
+			}))
+			defer s.Close()
+
+			oldDoer := searchDoer
+			searchDoer = http.DefaultClient
+			defer func() { searchDoer = oldDoer }()
+
+			_, _, _, err := Search(context.Background(), endpoint.Static(s.URL), "foo", "", "deadbeef", false, &search.TextPatternInfo{}, 0, nil, nil, nil)
+			if !isStructuralSyntaxError(err) {
+				t.Fatalf("non-streaming: want a structural syntax error but got %v", err)
+			}
+
+			_, _, _, err = Search(context.Background(), endpoint.Static(s.URL), "foo", "", "deadbeef", false, &search.TextPatternInfo{}, 0, nil, func([]*protocol.FileMatch) {}, nil)
+			if !isStructuralSyntaxError(err) {
+				t.Fatalf("streaming: want a structural syntax error but got %v", err)
+			}
+		})
+	}
+}
+
+func TestSearch_returnedValues(t *testing.T) {
+	const (
+		unavailable = "unavailable"
+		matchesBody = `{"Matches":[{"Path":"README.md"}],"LimitHit":true}`
+		partialBody = `{"Matches":[{"Path":"README.md"}],"LimitHit":true,"DeadlineHit":true}`
+		streamBody  = "event: matches\ndata: [{\"Path\":\"README.md\"}]\n\nevent: done\ndata: {\"limit_hit\":true}\n\n"
+		failedBody  = "event: done\ndata: {\"limit_hit\":true,\"error\":\"boom\"}\n\n"
+	)
+	readme := []*protocol.FileMatch{{Path: "README.md"}}
+
+	tests := []struct {
+		name      string
+		stream    bool
+		responses []string
+
+		wantMatches  []*protocol.FileMatch
+		wantStreamed []*protocol.FileMatch
+		wantLimitHit bool
+		wantErr      func(error) bool
+	}{
+		{
+			name:         "retried after temporary error",
+			responses:    []string{unavailable, matchesBody},
+			wantMatches:  readme,
+			wantLimitHit: true,
+		},
+		{
+			name:      "temporary errors exhaust attempts",
+			responses: []string{unavailable, unavailable},
+			wantErr:   errcode.IsTemporary,
+		},
+		{
+			name:         "partial results on deadline",
+			responses:    []string{partialBody},
+			wantMatches:  readme,
+			wantLimitHit: true,
+			wantErr:      errcode.IsTimeout,
+		},
+		{
+			name:         "streaming retried after temporary error",
+			stream:       true,
+			responses:    []string{unavailable, streamBody},
+			wantStreamed: readme,
+			wantLimitHit: true,
+		},
+		{
+			name:         "streaming keeps limit hit on error",
+			stream:       true,
+			responses:    []string{failedBody},
+			wantLimitHit: true,
+			wantErr:      func(err error) bool { return err != nil },
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var requests int32
+			handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				i := atomic.AddInt32(&requests, 1) - 1
+				if int(i) >= len(test.responses) {
+					t.Errorf("unexpected request %d", i+1)
+					return
+				}
+				if test.responses[i] == unavailable {
+					http.Error(w, unavailable, http.StatusServiceUnavailable)
+					return
+				}
+				_, _ = w.Write([]byte(test.responses[i]))
+			})
+			s1 := httptest.NewServer(handler)
+			defer s1.Close()
+			s2 := httptest.NewServer(handler)
+			defer s2.Close()
+
+			oldDoer := searchDoer
+			searchDoer = http.DefaultClient
+			defer func() { searchDoer = oldDoer }()
+
+			var streamed []*protocol.FileMatch
+			var onMatches func([]*protocol.FileMatch)
+			if test.stream {
+				onMatches = func(fm []*protocol.FileMatch) { streamed = append(streamed, fm...) }
+			}
+			matches, limitHit, _, err := Search(context.Background(), endpoint.Static(s1.URL, s2.URL), "foo", "", "deadbeef", false, &search.TextPatternInfo{}, 0, nil, onMatches, nil)
+			if test.wantErr == nil && err != nil {
+				t.Fatal(err)
+			} else if test.wantErr != nil && !test.wantErr(err) {
+				t.Fatalf("unexpected err: %v", err)
+			}
+
+			if diff := cmp.Diff(test.wantMatches, matches); diff != "" {
+				t.Errorf("matches mismatch (-want +got):\n%s", diff)
+			}
+			if diff := cmp.Diff(test.wantStreamed, streamed); diff != "" {
+				t.Errorf("streamed matches mismatch (-want +got):\n%s", diff)
+			}
+			if limitHit != test.wantLimitHit {
+				t.Errorf("limitHit: want %t but got %t", test.wantLimitHit, limitHit)
+			}
+			if got := int(atomic.LoadInt32(&requests)); got != len(test.responses) {
+				t.Errorf("requests: want %d but got %d", len(test.responses), got)
+			}
+		})
+	}
+}
+
+func TestSearch_validatePatternInfo(t *testing.T) {
+	var requests int32
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		_, _ = w.Write([]byte(`{"Matches":[]}`))
+	}))
+	defer s.Close()
+
+	oldDoer := searchDoer
+	searchDoer = http.DefaultClient
+	defer func() { searchDoer = oldDoer }()
+
+	tests := []struct {
+		name    string
+		p       *search.TextPatternInfo
+		wantErr string
+	}{
+		{
+			name: "no select or languages",
+			p:    &search.TextPatternInfo{},
+		},
+		{
+			name: "valid",
+			p: &search.TextPatternInfo{
+				Select:    filter.SelectPath{"symbol", "type-parameter"},
+				Languages: []string{"go", "TypeScript"},
+			},
+		},
+		{
+			name: "select kind unknown to the client",
+			p:    &search.TextPatternInfo{Select: filter.SelectPath{"notebook", "cell"}},
+		},
+		{
+			name:    "empty select field",
+			p:       &search.TextPatternInfo{Select: filter.SelectPath{"file", ""}},
+			wantErr: `invalid field "" on select path "file."`,
+		},
+		{
+			name:    "malformed select field",
+			p:       &search.TextPatternInfo{Select: filter.SelectPath{"File Path"}},
+			wantErr: `invalid field "File Path" on select path "File Path"`,
+		},
+		{
+			name:    "unknown language",
+			p:       &search.TextPatternInfo{Languages: []string{"go", "notalanguage"}},
+			wantErr: `unknown language: "notalanguage"`,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			atomic.StoreInt32(&requests, 0)
+			_, _, _, err := Search(context.Background(), endpoint.Static(s.URL), "foo", "", "deadbeef", false, test.p, 0, nil, nil, nil)
+			if test.wantErr == "" {
+				if err != nil {
+					t.Fatal(err)
+				}
+				return
+			}
+
+			var se *searcherError
+			if !errors.As(err, &se) || se.StatusCode != http.StatusBadRequest || se.Message != test.wantErr {
+				t.Fatalf("err: want a bad request with %q but got %v", test.wantErr, err)
+			}
+			if got := atomic.LoadInt32(&requests); got != 0 {
+				t.Fatalf("requests: want 0 but got %d", got)
+			}
+		})
+	}
+}
+
+type recordingHandler struct {
+	matches  []*protocol.FileMatch
+	progress []EventProgress
+	done     []EventDone
+}
+
+func (h *recordingHandler) OnMatches(fm []*protocol.FileMatch) { h.matches = append(h.matches, fm...) }
+func (h *recordingHandler) OnProgress(p EventProgress)         { h.progress = append(h.progress, p) }
+func (h *recordingHandler) OnDone(e EventDone)                 { h.done = append(h.done, e) }
+
+type recordingUnknownHandler struct {
+	recordingHandler
+	unknown []string
+}
+
+func (h *recordingUnknownHandler) OnUnknown(event, _ []byte) {
+	h.unknown = append(h.unknown, string(event))
+}
+
+func TestSearchStream(t *testing.T) {
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("event: matches\ndata: [{\"Path\":\"a.go\",\"MatchCount\":2}]\n\n" +
+			"event: stats\ndata: {}\n\n" +
+			"event: matches\ndata: [{\"Path\":\"b.go\",\"MatchCount\":1},{\"Path\":\"c.go\",\"MatchCount\":3}]\n\n" +
+			"event: done\ndata: {\"limit_hit\":true}\n\n"))
+	}))
+	defer s.Close()
+
+	oldDoer := searchDoer
+	searchDoer = http.DefaultClient
+	defer func() { searchDoer = oldDoer }()
+
+	wantMatches := []*protocol.FileMatch{
+		{Path: "a.go", MatchCount: 2},
+		{Path: "b.go", MatchCount: 1},
+		{Path: "c.go", MatchCount: 3},
+	}
+	wantProgress := []EventProgress{
+		{FileMatchCount: 1, MatchCount: 2},
+		{FileMatchCount: 3, MatchCount: 6},
+	}
+	wantDone := []EventDone{{LimitHit: true}}
+
+	t.Run("unknown events are ignored", func(t *testing.T) {
+		h := &recordingHandler{}
+		err := SearchStream(context.Background(), endpoint.Static(s.URL), "foo", "", "deadbeef", false, &search.TextPatternInfo{}, 0, nil, h, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if diff := cmp.Diff(wantMatches, h.matches); diff != "" {
+			t.Errorf("matches mismatch (-want +got):\n%s", diff)
+		}
+		if diff := cmp.Diff(wantProgress, h.progress); diff != "" {
+			t.Errorf("progress mismatch (-want +got):\n%s", diff)
+		}
+		if diff := cmp.Diff(wantDone, h.done); diff != "" {
+			t.Errorf("done mismatch (-want +got):\n%s", diff)
+		}
+	})
+
+	t.Run("unknown events are sent to OnUnknown", func(t *testing.T) {
+		h := &recordingUnknownHandler{}
+		err := SearchStream(context.Background(), endpoint.Static(s.URL), "foo", "", "deadbeef", false, &search.TextPatternInfo{}, 0, nil, h, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if diff := cmp.Diff([]string{"stats"}, h.unknown); diff != "" {
+			t.Errorf("unknown events mismatch (-want +got):\n%s", diff)
+		}
+		if diff := cmp.Diff(wantMatches, h.matches); diff != "" {
+			t.Errorf("matches mismatch (-want +got):\n%s", diff)
+		}
+	})
+}
+
+func TestSearchTransportOpts(t *testing.T) {
+	cli, err := httpcli.NewFactory(nil, searchTransportOpts("1000", "false")...).Client()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tr, ok := cli.Transport.(*http.Transport)
+	if !ok {
+		t.Fatalf("want *http.Transport but got %T", cli.Transport)
+	}
+	if tr.MaxIdleConnsPerHost != 1000 {
+		t.Errorf("MaxIdleConnsPerHost: want 1000 but got %d", tr.MaxIdleConnsPerHost)
+	}
+	if tr.ForceAttemptHTTP2 {
+		t.Error("ForceAttemptHTTP2: want false but got true")
+	}
+
+	t.Run("invalid values keep the defaults", func(t *testing.T) {
+		if opts := searchTransportOpts("-1", "maybe"); len(opts) != 0 {
+			t.Fatalf("want no opts but got %d", len(opts))
+		}
+	})
+}
+
+func TestSearch_scaledFetchTimeout(t *testing.T) {
+	fetchTimeouts := make(chan string, 1)
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fetchTimeouts <- r.URL.Query().Get("FetchTimeout")
+		_, _ = w.Write([]byte(`{"Matches":[]}`))
+	}))
+	defer s.Close()
+
+	oldDoer := searchDoer
+	searchDoer = http.DefaultClient
+	oldScaling := fetchTimeoutScaling
+	fetchTimeoutScaling = parseFetchTimeoutScaling("1000000000", "2m")
+	RepoSizeHint = func(_ context.Context, repo api.RepoName) (int64, bool) {
+		sizes := map[api.RepoName]int64{
+			"small": 100 * 1000 * 1000,
+			"large": 2500 * 1000 * 1000,
+			"huge":  100 * 1000 * 1000 * 1000,
+		}
+		size, ok := sizes[repo]
+		return size, ok
+	}
+	defer func() {
+		searchDoer = oldDoer
+		fetchTimeoutScaling = oldScaling
+		RepoSizeHint = nil
+	}()
+
+	tests := []struct {
+		repo api.RepoName
+		want string
+	}{
+		{repo: "small", want: "30s"},
+		{repo: "large", want: "1m30s"},
+		{repo: "huge", want: "2m0s"},
+		{repo: "unknown", want: "30s"},
+	}
+	for _, test := range tests {
+		t.Run(string(test.repo), func(t *testing.T) {
+			_, _, _, err := Search(context.Background(), endpoint.Static(s.URL), test.repo, "", "deadbeef", false, &search.TextPatternInfo{}, 30*time.Second, nil, nil, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := <-fetchTimeouts; got != test.want {
+				t.Fatalf("FetchTimeout: want %q but got %q", test.want, got)
+			}
+		})
+	}
+
+	t.Run("invalid values disable scaling", func(t *testing.T) {
+		for _, values := range [][2]string{{"0", "2m"}, {"abc", "2m"}, {"1000", "forever"}} {
+			if got := parseFetchTimeoutScaling(values[0], values[1]); got != (timeoutScaling{}) {
+				t.Fatalf("%v: want scaling disabled but got %+v", values, got)
+			}
+		}
+	})
+}
+
+func TestDecodeTextSearchResponse(t *testing.T) {
+	large := &textSearchResponse{LimitHit: true, DeadlineHit: true}
+	for i := 0; i < 100; i++ {
+		large.Matches = append(large.Matches, &protocol.FileMatch{
+			Path:        fmt.Sprintf("dir/file-%d.go", i),
+			LineMatches: []protocol.LineMatch{{Preview: strings.Repeat("x", 100), LineNumber: i}},
+			MatchCount:  1,
+		})
+	}
+	small := &textSearchResponse{
+		Matches: []*protocol.FileMatch{{Path: "README.md", MatchCount: 2}},
+	}
+
+	// Decoding a smaller response after a larger one must not leak any of the
+	// larger one.
+	for _, want := range []*textSearchResponse{large, small, large, small} {
+		body, err := json.Marshal(want)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := decodeTextSearchResponse(bytes.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if diff := cmp.Diff(want, got); diff != "" {
+			t.Fatalf("response mismatch (-want +got):\n%s", diff)
+		}
+	}
+
+	// Unknown fields are skipped, and fields are matched case-insensitively.
+	got, err := decodeTextSearchResponse(strings.NewReader(`{"Unknown":{"a":[1]},"matches":null,"limitHit":true}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if diff := cmp.Diff(&textSearchResponse{LimitHit: true}, got); diff != "" {
+		t.Fatalf("response mismatch (-want +got):\n%s", diff)
+	}
+
+	for _, body := range []string{`{"Matches":`, `{"Matches":[{}`, `{"Matches":{}}`, `[]`} {
+		if _, err := decodeTextSearchResponse(strings.NewReader(body)); err == nil {
+			t.Fatalf("want error for invalid response %q but got nil", body)
+		}
+	}
+}
+
+func BenchmarkDecodeTextSearchResponse(b *testing.B) {
+	resp := &textSearchResponse{}
+	for i := 0; i < 100; i++ {
+		resp.Matches = append(resp.Matches, &protocol.FileMatch{
+			Path:        fmt.Sprintf("dir/file-%d.go", i),
+			LineMatches: []protocol.LineMatch{{Preview: strings.Repeat("x", 100), LineNumber: i}},
+			MatchCount:  1,
+		})
+	}
+	body, err := json.Marshal(resp)
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	b.Run("whole", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			var r textSearchResponse
+			if err := json.NewDecoder(bytes.NewReader(body)).Decode(&r); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+
+	b.Run("streaming", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			if _, err := decodeTextSearchResponse(bytes.NewReader(body)); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
@@ -0,0 +1,117 @@
+package searcher
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/cockroachdb/errors"
+
+	"github.com/sourcegraph/sourcegraph/cmd/searcher/protocol"
+	"github.com/sourcegraph/sourcegraph/internal/api"
+	"github.com/sourcegraph/sourcegraph/internal/endpoint"
+	"github.com/sourcegraph/sourcegraph/internal/search"
+)
+
+// RepoBranchCommit is a revision of a repository to be searched by SearchRepos.
+type RepoBranchCommit struct {
+	Repo   api.RepoName
+	Branch string
+	Commit api.CommitID
+}
+
+// SearchRepos searches an ad-hoc set of repositories with p, running at most
+// concurrency searches at a time, and streams the matches of all repositories to
+// onMatches. Calls to onMatches are serialized.
+//
+// Once p.FileMatchLimit file matches have been streamed, the remaining searches
+// are canceled and limitHit is true. All searches share the deadline of ctx. The
+// first error of any search cancels the remaining searches and is returned.
+func SearchRepos(
+	ctx context.Context,
+	searcherURLs *endpoint.Map,
+	repos []RepoBranchCommit,
+	p *search.TextPatternInfo,
+	fetchTimeout time.Duration,
+	indexerEndpoints []string,
+	concurrency int,
+	onMatches func(RepoBranchCommit, []*protocol.FileMatch),
+) (limitHit bool, err error) {
+	if concurrency <= 0 {
+		concurrency = 1
+	}
+
+	searchCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var (
+		mu        sync.Mutex
+		matched   int
+		limitFull bool // Whether the limit has been reached and the searches are canceled
+		searchErr error
+	)
+	sendResult := func(repo RepoBranchCommit, matches []*protocol.FileMatch) {
+		mu.Lock()
+		defer mu.Unlock()
+
+		if limitFull || len(matches) == 0 {
+			return
+		}
+		if limit := int(p.FileMatchLimit); limit > 0 && matched+len(matches) >= limit {
+			matches = matches[:limit-matched]
+			limitHit = true
+			limitFull = true
+			cancel()
+		}
+		matched += len(matches)
+		onMatches(repo, matches)
+	}
+
+	repoCh := make(chan RepoBranchCommit)
+	var wg sync.WaitGroup
+	for i := 0; i < concurrency && i < len(repos); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for repo := range repoCh {
+				repo := repo
+				matches, repoLimitHit, _, err := Search(searchCtx, searcherURLs, repo.Repo, repo.Branch, repo.Commit, false, p, fetchTimeout, indexerEndpoints, func(matches []*protocol.FileMatch) {
+					sendResult(repo, matches)
+				}, nil)
+				// MockSearch returns the matches instead of streaming them.
+				sendResult(repo, matches)
+
+				mu.Lock()
+				if repoLimitHit {
+					limitHit = true
+				}
+				if err != nil && !limitFull && searchErr == nil {
+					searchErr = errors.Wrapf(err, "search %s@%s", repo.Repo, repo.Commit)
+					cancel()
+				}
+				mu.Unlock()
+			}
+		}()
+	}
+
+feed:
+	for _, repo := range repos {
+		select {
+		case repoCh <- repo:
+		case <-searchCtx.Done():
+			break feed
+		}
+	}
+	close(repoCh)
+	wg.Wait()
+
+	mu.Lock()
+	defer mu.Unlock()
+	if searchErr != nil {
+		return limitHit, searchErr
+	}
+	if !limitFull && ctx.Err() != nil {
+		return limitHit, ctx.Err()
+	}
+	return limitHit, nil
+}
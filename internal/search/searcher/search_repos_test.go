@@ -0,0 +1,112 @@
+package searcher
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/cockroachdb/errors"
+	"github.com/google/go-cmp/cmp"
+
+	"github.com/sourcegraph/sourcegraph/cmd/searcher/protocol"
+	"github.com/sourcegraph/sourcegraph/internal/api"
+	"github.com/sourcegraph/sourcegraph/internal/endpoint"
+	"github.com/sourcegraph/sourcegraph/internal/search"
+)
+
+func TestSearchRepos(t *testing.T) {
+	// Every repository has two matching files, streamed in separate events.
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		repo := r.URL.Query().Get("Repo")
+		for i := 1; i <= 2; i++ {
+			data, _ := json.Marshal([]*protocol.FileMatch{{Path: fmt.Sprintf("%s/file-%d", repo, i)}})
+			_, _ = fmt.Fprintf(w, "event: matches\ndata: %s\n\n", data)
+		}
+		_, _ = fmt.Fprint(w, "event: done\ndata: {}\n\n")
+	}))
+	defer s.Close()
+
+	oldDoer := searchDoer
+	searchDoer = http.DefaultClient
+	defer func() { searchDoer = oldDoer }()
+
+	repos := []RepoBranchCommit{
+		{Repo: "a", Commit: "deadbeef"},
+		{Repo: "b", Commit: "deadbeef"},
+		{Repo: "c", Commit: "deadbeef"},
+	}
+	searchRepos := func(t *testing.T, limit int32) ([]string, bool) {
+		t.Helper()
+
+		var paths []string
+		limitHit, err := SearchRepos(
+			context.Background(),
+			endpoint.Static(s.URL),
+			repos,
+			&search.TextPatternInfo{FileMatchLimit: limit},
+			0,
+			nil,
+			2,
+			func(repo RepoBranchCommit, matches []*protocol.FileMatch) {
+				for _, m := range matches {
+					paths = append(paths, m.Path)
+				}
+			},
+		)
+		if err != nil {
+			t.Fatal(err)
+		}
+		sort.Strings(paths)
+		return paths, limitHit
+	}
+
+	t.Run("merged matches", func(t *testing.T) {
+		paths, limitHit := searchRepos(t, 100)
+		want := []string{"a/file-1", "a/file-2", "b/file-1", "b/file-2", "c/file-1", "c/file-2"}
+		if diff := cmp.Diff(want, paths); diff != "" {
+			t.Fatalf("paths mismatch (-want +got):\n%s", diff)
+		}
+		if limitHit {
+			t.Fatal("want limit not hit")
+		}
+	})
+
+	t.Run("limit", func(t *testing.T) {
+		paths, limitHit := searchRepos(t, 3)
+		if len(paths) != 3 {
+			t.Fatalf("want 3 matches but got %v", paths)
+		}
+		if !limitHit {
+			t.Fatal("want limit hit")
+		}
+	})
+}
+
+func TestSearchRepos_error(t *testing.T) {
+	MockSearch = func(_ context.Context, repo api.RepoName, _ api.CommitID, _ *search.TextPatternInfo, _ time.Duration) ([]*protocol.FileMatch, bool, error) {
+		if repo == "broken" {
+			return nil, false, errors.New("boom")
+		}
+		return []*protocol.FileMatch{{Path: string(repo)}}, false, nil
+	}
+	defer func() { MockSearch = nil }()
+
+	_, err := SearchRepos(
+		context.Background(),
+		endpoint.Static("http://searcher"),
+		[]RepoBranchCommit{{Repo: "a"}, {Repo: "broken"}},
+		&search.TextPatternInfo{},
+		0,
+		nil,
+		1,
+		func(RepoBranchCommit, []*protocol.FileMatch) {},
+	)
+	if err == nil {
+		t.Fatal("want error but got nil")
+	}
+}
@@ -51,8 +51,21 @@ func (rr StreamDecoder) ReadAll(r io.Reader) error {
 	return dec.Err()
 }
 
+// EventProgress is the progress of a streaming search. Searcher does not send
+// progress events, it is derived from the matches received so far.
+type EventProgress struct {
+	// FileMatchCount is the number of file matches received so far.
+	FileMatchCount int
+	// MatchCount is the sum of the number of matches in every file match.
+	MatchCount int
+}
+
 type EventDone struct {
 	LimitHit    bool   `json:"limit_hit"`
 	DeadlineHit bool   `json:"deadline_hit"`
 	Error       string `json:"error"`
+
+	// Structural is the timing breakdown of a structural search. It is nil for
+	// non-structural searches.
+	Structural *protocol.StructuralTimings `json:"structural,omitempty"`
 }
@@ -0,0 +1,55 @@
+package searcher
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+
+	"github.com/sourcegraph/sourcegraph/cmd/searcher/protocol"
+)
+
+func TestStreamDecoder_structuralTimings(t *testing.T) {
+	tests := []struct {
+		name string
+		body string
+		want EventDone
+	}{
+		{
+			name: "structural",
+			body: "event: done\ndata: {\"limit_hit\":true,\"deadline_hit\":false,\"error\":\"\",\"structural\":{\"Parse\":1000000,\"Match\":2000000000}}\n\n",
+			want: EventDone{
+				LimitHit: true,
+				Structural: &protocol.StructuralTimings{
+					Parse: time.Millisecond,
+					Match: 2 * time.Second,
+				},
+			},
+		},
+		{
+			name: "non-structural",
+			body: "event: done\ndata: {\"limit_hit\":false,\"deadline_hit\":true,\"error\":\"\"}\n\n",
+			want: EventDone{
+				DeadlineHit: true,
+			},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var got EventDone
+			dec := StreamDecoder{
+				OnDone: func(e EventDone) {
+					got = e
+				},
+			}
+			if err := dec.ReadAll(strings.NewReader(test.body)); err != nil {
+				t.Fatal(err)
+			}
+
+			if diff := cmp.Diff(test.want, got); diff != "" {
+				t.Fatalf("mismatch (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
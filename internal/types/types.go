@@ -1191,6 +1191,8 @@ type SearchContext struct {
 	NamespaceUserID int32 // if non-zero, the owner is this user. NamespaceUserID/NamespaceOrgID are mutually exclusive.
 	NamespaceOrgID  int32 // if non-zero, the owner is this organization. NamespaceUserID/NamespaceOrgID are mutually exclusive.
 	UpdatedAt       time.Time
+	// DeletedAt is the time the search context was soft-deleted, zero if it is not deleted.
+	DeletedAt time.Time
 
 	// We cache namespace names to avoid separate database lookups when constructing the search context spec
 
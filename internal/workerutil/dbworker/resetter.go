@@ -2,11 +2,13 @@ package dbworker
 
 import (
 	"context"
+	"sync"
 	"time"
 
 	"github.com/cockroachdb/errors"
 	"github.com/derision-test/glock"
 	"github.com/inconshreveable/log15"
+	"github.com/keegancsmith/sqlf"
 	"github.com/prometheus/client_golang/prometheus"
 
 	"github.com/sourcegraph/sourcegraph/internal/workerutil/dbworker/store"
@@ -25,18 +27,35 @@ type Resetter struct {
 	ctx      context.Context // root context passed to the database
 	cancel   func()          // cancels the root context
 	finished chan struct{}   // signals that Start has finished
+
+	pausedMu sync.RWMutex
+	paused   bool // skips resetting stalled records while set
 }
 
 type ResetterOptions struct {
 	Name     string
 	Interval time.Duration
 	Metrics  ResetterMetrics
+
+	// MaxErrorBackoff, if set, makes the resetter back off exponentially while
+	// resetting stalled records fails consecutively (e.g. the database is
+	// unavailable). The wait between iterations doubles on each consecutive
+	// error up to MaxErrorBackoff, and goes back to Interval after a success.
+	// By default, the resetter waits Interval regardless of errors.
+	MaxErrorBackoff time.Duration
+
+	// Conditions, if set, scopes the resetter to only reset stalled records matching
+	// all of the given conditions. By default, all stalled records are reset.
+	Conditions []*sqlf.Query
 }
 
 type ResetterMetrics struct {
 	RecordResets        prometheus.Counter
 	RecordResetFailures prometheus.Counter
 	Errors              prometheus.Counter
+
+	// Paused, if set, is set to 1 while the resetter is paused and 0 otherwise.
+	Paused prometheus.Gauge
 }
 
 func NewResetter(store store.Store, options ResetterOptions) *Resetter {
@@ -64,9 +83,20 @@ func newResetter(store store.Store, options ResetterOptions, clock glock.Clock)
 func (r *Resetter) Start() {
 	defer close(r.finished)
 
+	consecutiveErrors := 0
+
 loop:
 	for {
-		resetLastHeartbeatsByIDs, failedLastHeartbeatsByIDs, err := r.store.ResetStalled(r.ctx)
+		if r.isPaused() {
+			select {
+			case <-r.clock.After(r.options.Interval):
+				continue
+			case <-r.ctx.Done():
+				return
+			}
+		}
+
+		resetLastHeartbeatsByIDs, failedLastHeartbeatsByIDs, err := r.store.ResetStalled(r.ctx, r.options.Conditions)
 		if err != nil {
 			if r.ctx.Err() != nil && errors.Is(err, r.ctx.Err()) {
 				// If the error is due to the loop being shut down, just break
@@ -75,6 +105,9 @@ loop:
 
 			r.options.Metrics.Errors.Inc()
 			log15.Error("Failed to reset stalled records", "name", r.options.Name, "error", err)
+			consecutiveErrors++
+		} else {
+			consecutiveErrors = 0
 		}
 
 		for id, lastHeartbeatAge := range resetLastHeartbeatsByIDs {
@@ -88,13 +121,72 @@ loop:
 		r.options.Metrics.RecordResetFailures.Add(float64(len(failedLastHeartbeatsByIDs)))
 
 		select {
-		case <-r.clock.After(r.options.Interval):
+		case <-r.clock.After(r.wait(consecutiveErrors)):
 		case <-r.ctx.Done():
 			return
 		}
 	}
 }
 
+// wait returns the duration to wait before the next iteration after the given
+// number of consecutive errors.
+func (r *Resetter) wait(consecutiveErrors int) time.Duration {
+	interval := r.options.Interval
+	if r.options.MaxErrorBackoff <= interval {
+		return interval
+	}
+
+	for i := 0; i < consecutiveErrors; i++ {
+		interval *= 2
+		if interval >= r.options.MaxErrorBackoff {
+			return r.options.MaxErrorBackoff
+		}
+	}
+	return interval
+}
+
+// Pause causes the resetter loop to skip resetting stalled records until Resume is
+// called. The loop keeps running on the same interval and still honors Stop.
+func (r *Resetter) Pause() {
+	r.setPaused(true)
+}
+
+// Resume causes a paused resetter loop to reset stalled records again from its
+// next iteration.
+func (r *Resetter) Resume() {
+	r.setPaused(false)
+}
+
+func (r *Resetter) isPaused() bool {
+	r.pausedMu.RLock()
+	defer r.pausedMu.RUnlock()
+	return r.paused
+}
+
+func (r *Resetter) setPaused(paused bool) {
+	r.pausedMu.Lock()
+	defer r.pausedMu.Unlock()
+
+	if r.paused == paused {
+		return
+	}
+	r.paused = paused
+
+	if paused {
+		log15.Info("Paused resetting stalled records", "name", r.options.Name)
+	} else {
+		log15.Info("Resumed resetting stalled records", "name", r.options.Name)
+	}
+
+	if r.options.Metrics.Paused != nil {
+		if paused {
+			r.options.Metrics.Paused.Set(1)
+		} else {
+			r.options.Metrics.Paused.Set(0)
+		}
+	}
+}
+
 // Stop will cause the resetter loop to exit after the current iteration.
 func (r *Resetter) Stop() {
 	r.cancel()
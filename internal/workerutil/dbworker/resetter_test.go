@@ -4,8 +4,11 @@ import (
 	"testing"
 	"time"
 
+	"github.com/cockroachdb/errors"
 	"github.com/derision-test/glock"
+	"github.com/google/go-cmp/cmp"
 	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
 
 	storemocks "github.com/sourcegraph/sourcegraph/internal/workerutil/dbworker/store/mocks"
 )
@@ -32,3 +35,82 @@ func TestResetter(t *testing.T) {
 		t.Errorf("unexpected reset stalled call count. want>=%d have=%d", 1, callCount)
 	}
 }
+
+func TestResetterPauseAndResume(t *testing.T) {
+	store := storemocks.NewMockStore()
+	clock := glock.NewMockClock()
+	paused := prometheus.NewGauge(prometheus.GaugeOpts{})
+	options := ResetterOptions{
+		Name:     "test",
+		Interval: time.Second,
+		Metrics: ResetterMetrics{
+			RecordResets:        prometheus.NewCounter(prometheus.CounterOpts{}),
+			RecordResetFailures: prometheus.NewCounter(prometheus.CounterOpts{}),
+			Errors:              prometheus.NewCounter(prometheus.CounterOpts{}),
+			Paused:              paused,
+		},
+	}
+
+	resetter := newResetter(store, options, clock)
+	resetter.Pause()
+	if value := testutil.ToFloat64(paused); value != 1 {
+		t.Errorf("unexpected paused metric value. want=%v have=%v", 1, value)
+	}
+
+	go func() { resetter.Start() }()
+	clock.BlockingAdvance(time.Second)
+	clock.BlockingAdvance(time.Second)
+
+	if callCount := len(store.ResetStalledFunc.History()); callCount != 0 {
+		t.Errorf("unexpected reset stalled call count while paused. want=%d have=%d", 0, callCount)
+	}
+
+	resetter.Resume()
+	if value := testutil.ToFloat64(paused); value != 0 {
+		t.Errorf("unexpected paused metric value. want=%v have=%v", 0, value)
+	}
+
+	clock.BlockingAdvance(time.Second)
+	clock.BlockingAdvance(time.Second)
+	resetter.Stop()
+
+	if callCount := len(store.ResetStalledFunc.History()); callCount < 1 {
+		t.Errorf("unexpected reset stalled call count after resume. want>=%d have=%d", 1, callCount)
+	}
+}
+
+func TestResetterErrorBackoff(t *testing.T) {
+	store := storemocks.NewMockStore()
+	for i := 0; i < 4; i++ {
+		store.ResetStalledFunc.PushReturn(nil, nil, errors.New("database unavailable"))
+	}
+	clock := glock.NewMockClock()
+	options := ResetterOptions{
+		Name:            "test",
+		Interval:        time.Second,
+		MaxErrorBackoff: 5 * time.Second,
+		Metrics: ResetterMetrics{
+			RecordResets:        prometheus.NewCounter(prometheus.CounterOpts{}),
+			RecordResetFailures: prometheus.NewCounter(prometheus.CounterOpts{}),
+			Errors:              prometheus.NewCounter(prometheus.CounterOpts{}),
+		},
+	}
+
+	resetter := newResetter(store, options, clock)
+	go func() { resetter.Start() }()
+	for i := 0; i < 6; i++ {
+		clock.BlockingAdvance(time.Minute)
+	}
+	resetter.Stop()
+
+	// The wait grows on consecutive failures up to the maximum, and goes back to
+	// the interval after a success.
+	want := []time.Duration{2 * time.Second, 4 * time.Second, 5 * time.Second, 5 * time.Second, time.Second, time.Second}
+	waits := clock.GetAfterArgs()
+	if len(waits) < len(want) {
+		t.Fatalf("unexpected number of waits. want>=%d have=%d", len(want), len(waits))
+	}
+	if diff := cmp.Diff(want, waits[:len(want)]); diff != "" {
+		t.Errorf("unexpected waits (-want +got):\n%s", diff)
+	}
+}
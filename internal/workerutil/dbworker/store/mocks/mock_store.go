@@ -103,7 +103,7 @@ func NewMockStore() *MockStore {
 			},
 		},
 		ResetStalledFunc: &StoreResetStalledFunc{
-			defaultHook: func(context.Context) (map[int]time.Duration, map[int]time.Duration, error) {
+			defaultHook: func(context.Context, []*sqlf.Query) (map[int]time.Duration, map[int]time.Duration, error) {
 				return nil, nil, nil
 			},
 		},
@@ -1152,23 +1152,23 @@ func (c StoreRequeueFuncCall) Results() []interface{} {
 // StoreResetStalledFunc describes the behavior when the ResetStalled method
 // of the parent MockStore instance is invoked.
 type StoreResetStalledFunc struct {
-	defaultHook func(context.Context) (map[int]time.Duration, map[int]time.Duration, error)
-	hooks       []func(context.Context) (map[int]time.Duration, map[int]time.Duration, error)
+	defaultHook func(context.Context, []*sqlf.Query) (map[int]time.Duration, map[int]time.Duration, error)
+	hooks       []func(context.Context, []*sqlf.Query) (map[int]time.Duration, map[int]time.Duration, error)
 	history     []StoreResetStalledFuncCall
 	mutex       sync.Mutex
 }
 
 // ResetStalled delegates to the next hook function in the queue and stores
 // the parameter and result values of this invocation.
-func (m *MockStore) ResetStalled(v0 context.Context) (map[int]time.Duration, map[int]time.Duration, error) {
-	r0, r1, r2 := m.ResetStalledFunc.nextHook()(v0)
-	m.ResetStalledFunc.appendCall(StoreResetStalledFuncCall{v0, r0, r1, r2})
+func (m *MockStore) ResetStalled(v0 context.Context, v1 []*sqlf.Query) (map[int]time.Duration, map[int]time.Duration, error) {
+	r0, r1, r2 := m.ResetStalledFunc.nextHook()(v0, v1)
+	m.ResetStalledFunc.appendCall(StoreResetStalledFuncCall{v0, v1, r0, r1, r2})
 	return r0, r1, r2
 }
 
 // SetDefaultHook sets function that is called when the ResetStalled method
 // of the parent MockStore instance is invoked and the hook queue is empty.
-func (f *StoreResetStalledFunc) SetDefaultHook(hook func(context.Context) (map[int]time.Duration, map[int]time.Duration, error)) {
+func (f *StoreResetStalledFunc) SetDefaultHook(hook func(context.Context, []*sqlf.Query) (map[int]time.Duration, map[int]time.Duration, error)) {
 	f.defaultHook = hook
 }
 
@@ -1176,7 +1176,7 @@ func (f *StoreResetStalledFunc) SetDefaultHook(hook func(context.Context) (map[i
 // ResetStalled method of the parent MockStore instance invokes the hook at
 // the front of the queue and discards it. After the queue is empty, the
 // default hook function is invoked for any future action.
-func (f *StoreResetStalledFunc) PushHook(hook func(context.Context) (map[int]time.Duration, map[int]time.Duration, error)) {
+func (f *StoreResetStalledFunc) PushHook(hook func(context.Context, []*sqlf.Query) (map[int]time.Duration, map[int]time.Duration, error)) {
 	f.mutex.Lock()
 	f.hooks = append(f.hooks, hook)
 	f.mutex.Unlock()
@@ -1185,7 +1185,7 @@ func (f *StoreResetStalledFunc) PushHook(hook func(context.Context) (map[int]tim
 // SetDefaultReturn calls SetDefaultDefaultHook with a function that returns
 // the given values.
 func (f *StoreResetStalledFunc) SetDefaultReturn(r0 map[int]time.Duration, r1 map[int]time.Duration, r2 error) {
-	f.SetDefaultHook(func(context.Context) (map[int]time.Duration, map[int]time.Duration, error) {
+	f.SetDefaultHook(func(context.Context, []*sqlf.Query) (map[int]time.Duration, map[int]time.Duration, error) {
 		return r0, r1, r2
 	})
 }
@@ -1193,12 +1193,12 @@ func (f *StoreResetStalledFunc) SetDefaultReturn(r0 map[int]time.Duration, r1 ma
 // PushReturn calls PushDefaultHook with a function that returns the given
 // values.
 func (f *StoreResetStalledFunc) PushReturn(r0 map[int]time.Duration, r1 map[int]time.Duration, r2 error) {
-	f.PushHook(func(context.Context) (map[int]time.Duration, map[int]time.Duration, error) {
+	f.PushHook(func(context.Context, []*sqlf.Query) (map[int]time.Duration, map[int]time.Duration, error) {
 		return r0, r1, r2
 	})
 }
 
-func (f *StoreResetStalledFunc) nextHook() func(context.Context) (map[int]time.Duration, map[int]time.Duration, error) {
+func (f *StoreResetStalledFunc) nextHook() func(context.Context, []*sqlf.Query) (map[int]time.Duration, map[int]time.Duration, error) {
 	f.mutex.Lock()
 	defer f.mutex.Unlock()
 
@@ -1234,6 +1234,9 @@ type StoreResetStalledFuncCall struct {
 	// Arg0 is the value of the 1st argument passed to this method
 	// invocation.
 	Arg0 context.Context
+	// Arg1 is the value of the 2nd argument passed to this method
+	// invocation.
+	Arg1 []*sqlf.Query
 	// Result0 is the value of the 1st result returned from this method
 	// invocation.
 	Result0 map[int]time.Duration
@@ -1248,7 +1251,7 @@ type StoreResetStalledFuncCall struct {
 // Args returns an interface slice containing the arguments of this
 // invocation.
 func (c StoreResetStalledFuncCall) Args() []interface{} {
-	return []interface{}{c.Arg0}
+	return []interface{}{c.Arg0, c.Arg1}
 }
 
 // Results returns an interface slice containing the results of this
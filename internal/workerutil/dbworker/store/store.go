@@ -117,8 +117,8 @@ type Store interface {
 	// queued state. In order to prevent input that continually crashes worker instances, records that have been reset
 	// more than `MaxNumResets` times will be marked as failed. This method returns a pair of maps from record
 	// identifiers the age of the record's last heartbeat timestamp for each record reset to queued and failed states,
-	// respectively.
-	ResetStalled(ctx context.Context) (resetLastHeartbeatsByIDs, failedLastHeartbeatsByIDs map[int]time.Duration, err error)
+	// respectively. Only records matching the given conditions are considered.
+	ResetStalled(ctx context.Context, conditions []*sqlf.Query) (resetLastHeartbeatsByIDs, failedLastHeartbeatsByIDs map[int]time.Duration, err error)
 }
 
 type ExecutionLogEntry workerutil.ExecutionLogEntry
@@ -691,18 +691,18 @@ RETURNING {id}
 // queued state. In order to prevent input that continually crashes worker instances, records that have been reset
 // more than `MaxNumResets` times will be marked as failed. This method returns a pair of maps from record
 // identifiers the age of the record's last heartbeat timestamp for each record reset to queued and failed states,
-// respectively.
-func (s *store) ResetStalled(ctx context.Context) (resetLastHeartbeatsByIDs, failedLastHeartbeatsByIDs map[int]time.Duration, err error) {
+// respectively. Only records matching the given conditions are considered.
+func (s *store) ResetStalled(ctx context.Context, conditions []*sqlf.Query) (resetLastHeartbeatsByIDs, failedLastHeartbeatsByIDs map[int]time.Duration, err error) {
 	ctx, traceLog, endObservation := s.operations.resetStalled.WithAndLogger(ctx, &err, observation.Args{})
 	defer endObservation(1, observation.Args{})
 
-	resetLastHeartbeatsByIDs, err = s.resetStalled(ctx, resetStalledQuery)
+	resetLastHeartbeatsByIDs, err = s.resetStalled(ctx, resetStalledQuery, conditions)
 	if err != nil {
 		return resetLastHeartbeatsByIDs, failedLastHeartbeatsByIDs, err
 	}
 	traceLog(log.Int("numResetIDs", len(resetLastHeartbeatsByIDs)))
 
-	failedLastHeartbeatsByIDs, err = s.resetStalled(ctx, resetStalledMaxResetsQuery)
+	failedLastHeartbeatsByIDs, err = s.resetStalled(ctx, resetStalledMaxResetsQuery, conditions)
 	if err != nil {
 		return resetLastHeartbeatsByIDs, failedLastHeartbeatsByIDs, err
 	}
@@ -733,7 +733,7 @@ func scanLastHeartbeatTimestampsFrom(now time.Time) func(rows *sql.Rows, queryEr
 	}
 }
 
-func (s *store) resetStalled(ctx context.Context, query string) (map[int]time.Duration, error) {
+func (s *store) resetStalled(ctx context.Context, query string, conditions []*sqlf.Query) (map[int]time.Duration, error) {
 	now := s.now()
 
 	return scanLastHeartbeatTimestampsFrom(now)(s.Query(
@@ -744,6 +744,7 @@ func (s *store) resetStalled(ctx context.Context, query string) (map[int]time.Du
 			now,
 			int(s.options.StalledMaxAge/time.Second),
 			s.options.MaxNumResets,
+			makeConditionSuffix(conditions),
 			quote(s.options.TableName),
 		),
 	))
@@ -757,6 +758,7 @@ WITH stalled AS (
 		{state} = 'processing' AND
 		%s - {last_heartbeat_at} > (%s * '1 second'::interval) AND
 		{num_resets} < %s
+		%s
 	FOR UPDATE SKIP LOCKED
 )
 UPDATE %s
@@ -776,6 +778,7 @@ WITH stalled AS (
 		{state} = 'processing' AND
 		%s - {last_heartbeat_at} > (%s * '1 second'::interval) AND
 		{num_resets} >= %s
+		%s
 	FOR UPDATE SKIP LOCKED
 )
 UPDATE %s
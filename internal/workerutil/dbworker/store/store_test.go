@@ -864,7 +864,7 @@ func TestStoreResetStalled(t *testing.T) {
 		t.Fatal(err)
 	}
 
-	resetLastHeartbeatsByIDs, erroredLastHeartbeatsByIDs, err := testStore(db, defaultTestStoreOptions(nil)).ResetStalled(context.Background())
+	resetLastHeartbeatsByIDs, erroredLastHeartbeatsByIDs, err := testStore(db, defaultTestStoreOptions(nil)).ResetStalled(context.Background(), nil)
 	if err != nil {
 		t.Fatalf("unexpected error resetting stalled records: %s", err)
 	}
@@ -929,6 +929,47 @@ func TestStoreResetStalled(t *testing.T) {
 	}
 }
 
+func TestStoreResetStalledWithConditions(t *testing.T) {
+	db := setupStoreTest(t)
+
+	if _, err := db.ExecContext(context.Background(), `
+		INSERT INTO workerutil_test (id, state, last_heartbeat_at, num_resets)
+		VALUES
+			(1, 'processing', NOW() - '6 second'::interval, 1),
+			(2, 'processing', NOW() - '8 second'::interval, 0),
+			(3, 'processing', NOW() - '6 second'::interval, 5),
+			(4, 'processing', NOW() - '8 second'::interval, 5)
+	`); err != nil {
+		t.Fatalf("unexpected error inserting records: %s", err)
+	}
+
+	conditions := []*sqlf.Query{sqlf.Sprintf("w.id IN (1, 3)")}
+	resetLastHeartbeatsByIDs, erroredLastHeartbeatsByIDs, err := testStore(db, defaultTestStoreOptions(nil)).ResetStalled(context.Background(), conditions)
+	if err != nil {
+		t.Fatalf("unexpected error resetting stalled records: %s", err)
+	}
+
+	var resetIDs []int
+	for id := range resetLastHeartbeatsByIDs {
+		resetIDs = append(resetIDs, id)
+	}
+	sort.Ints(resetIDs)
+
+	var erroredIDs []int
+	for id := range erroredLastHeartbeatsByIDs {
+		erroredIDs = append(erroredIDs, id)
+	}
+	sort.Ints(erroredIDs)
+
+	if diff := cmp.Diff([]int{1}, resetIDs); diff != "" {
+		t.Errorf("unexpected reset ids (-want +got):\n%s", diff)
+	}
+
+	if diff := cmp.Diff([]int{3}, erroredIDs); diff != "" {
+		t.Errorf("unexpected errored ids (-want +got):\n%s", diff)
+	}
+}
+
 func TestStoreHeartbeat(t *testing.T) {
 	db := setupStoreTest(t)
 
@@ -0,0 +1,14 @@
+BEGIN;
+
+-- Insert migration here. See README.md. Highlights:
+--  * Always use IF EXISTS. eg: DROP TABLE IF EXISTS global_dep_private;
+--  * All migrations must be backward-compatible. Old versions of Sourcegraph
+--    need to be able to read/write post migration.
+--  * Historically we advised against transactions since we thought the
+--    migrate library handled it. However, it does not! /facepalm
+
+ALTER TABLE IF EXISTS search_contexts ADD COLUMN IF NOT EXISTS repositories_updated_at timestamp with time zone NOT NULL DEFAULT now();
+
+COMMENT ON COLUMN search_contexts.repositories_updated_at IS 'The time when the repository revisions of the search context were last modified.';
+
+COMMIT;
@@ -0,0 +1,30 @@
+BEGIN;
+
+-- Insert migration here. See README.md. Highlights:
+--  * Always use IF EXISTS. eg: DROP TABLE IF EXISTS global_dep_private;
+--  * All migrations must be backward-compatible. Old versions of Sourcegraph
+--    need to be able to read/write post migration.
+--  * Historically we advised against transactions since we thought the
+--    migrate library handled it. However, it does not! /facepalm
+
+CREATE TABLE IF NOT EXISTS search_context_repos_history (
+    search_context_id bigint NOT NULL,
+    repo_id integer NOT NULL,
+    revision text NOT NULL,
+    recorded_at timestamp with time zone NOT NULL,
+    CONSTRAINT search_context_repos_history_search_context_id_fk FOREIGN KEY (search_context_id) REFERENCES search_contexts(id) ON DELETE CASCADE,
+    CONSTRAINT search_context_repos_history_repo_id_fk FOREIGN KEY (repo_id) REFERENCES repo(id) ON DELETE CASCADE
+);
+
+CREATE INDEX IF NOT EXISTS search_context_repos_history_search_context_id_recorded_at ON search_context_repos_history USING btree (search_context_id, recorded_at);
+
+COMMENT ON TABLE search_context_repos_history IS 'Snapshots of the repository revisions of search contexts, one snapshot is recorded every time the repository revisions are modified.';
+COMMENT ON COLUMN search_context_repos_history.recorded_at IS 'The time when the snapshot was recorded, it is the same for all rows of a snapshot.';
+
+-- Record the current repository revisions as the first snapshot.
+INSERT INTO search_context_repos_history (search_context_id, repo_id, revision, recorded_at)
+SELECT scr.search_context_id, scr.repo_id, scr.revision, sc.repositories_updated_at
+FROM search_context_repos scr
+JOIN search_contexts sc ON sc.id = scr.search_context_id;
+
+COMMIT;
@@ -0,0 +1,21 @@
+BEGIN;
+
+-- Insert migration here. See README.md. Highlights:
+--  * Always use IF EXISTS. eg: DROP TABLE IF EXISTS global_dep_private;
+--  * All migrations must be backward-compatible. Old versions of Sourcegraph
+--    need to be able to read/write post migration.
+--  * Historically we advised against transactions since we thought the
+--    migrate library handled it. However, it does not! /facepalm
+
+CREATE TABLE IF NOT EXISTS user_permissions_sync_errors (
+    user_id integer NOT NULL PRIMARY KEY,
+    error text NOT NULL,
+    errored_at timestamp with time zone NOT NULL,
+    CONSTRAINT user_permissions_sync_errors_user_id_fk FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE
+);
+
+CREATE INDEX IF NOT EXISTS user_permissions_sync_errors_errored_at ON user_permissions_sync_errors USING btree (errored_at);
+
+COMMENT ON TABLE user_permissions_sync_errors IS 'The error of the most recent permissions sync of users whose most recent sync failed, rows are deleted when the next sync succeeds.';
+
+COMMIT;
@@ -0,0 +1,23 @@
+BEGIN;
+
+-- Insert migration here. See README.md. Highlights:
+--  * Always use IF EXISTS. eg: DROP TABLE IF EXISTS global_dep_private;
+--  * All migrations must be backward-compatible. Old versions of Sourcegraph
+--    need to be able to read/write post migration.
+--  * Historically we advised against transactions since we thought the
+--    migrate library handled it. However, it does not! /facepalm
+
+CREATE TABLE IF NOT EXISTS search_context_repo_exclusions (
+    search_context_id bigint NOT NULL,
+    repo_id integer NOT NULL,
+    revision text,
+    CONSTRAINT search_context_repo_exclusions_search_context_id_fk FOREIGN KEY (search_context_id) REFERENCES search_contexts(id) ON DELETE CASCADE,
+    CONSTRAINT search_context_repo_exclusions_repo_id_fk FOREIGN KEY (repo_id) REFERENCES repo(id) ON DELETE CASCADE
+);
+
+CREATE INDEX IF NOT EXISTS search_context_repo_exclusions_search_context_id ON search_context_repo_exclusions USING btree (search_context_id);
+
+COMMENT ON TABLE search_context_repo_exclusions IS 'Repository revisions that are excluded from the repository revisions of search contexts.';
+COMMENT ON COLUMN search_context_repo_exclusions.revision IS 'The excluded revision, NULL excludes all revisions of the repository.';
+
+COMMIT;
@@ -0,0 +1,31 @@
+BEGIN;
+
+-- Insert migration here. See README.md. Highlights:
+--  * Always use IF EXISTS. eg: DROP TABLE IF EXISTS global_dep_private;
+--  * All migrations must be backward-compatible. Old versions of Sourcegraph
+--    need to be able to read/write post migration.
+--  * Historically we advised against transactions since we thought the
+--    migrate library handled it. However, it does not! /facepalm
+
+DROP INDEX IF EXISTS search_contexts_name_namespace_user_id_unique;
+DROP INDEX IF EXISTS search_contexts_name_namespace_org_id_unique;
+DROP INDEX IF EXISTS search_contexts_name_without_namespace_unique;
+
+-- Soft-deleted search contexts may share a name, the ID keeps them unique.
+UPDATE search_contexts
+SET name = 'DELETED-' || id || '-' || name
+WHERE deleted_at IS NOT NULL;
+
+CREATE UNIQUE INDEX IF NOT EXISTS search_contexts_name_namespace_user_id_unique
+    ON search_contexts (name, namespace_user_id)
+    WHERE namespace_user_id IS NOT NULL;
+
+CREATE UNIQUE INDEX IF NOT EXISTS search_contexts_name_namespace_org_id_unique
+    ON search_contexts (name, namespace_org_id)
+    WHERE namespace_org_id IS NOT NULL;
+
+CREATE UNIQUE INDEX IF NOT EXISTS search_contexts_name_without_namespace_unique
+    ON search_contexts (name)
+    WHERE namespace_user_id IS NULL AND namespace_org_id IS NULL;
+
+COMMIT;
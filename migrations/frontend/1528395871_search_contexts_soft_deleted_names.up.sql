@@ -0,0 +1,32 @@
+BEGIN;
+
+-- Insert migration here. See README.md. Highlights:
+--  * Always use IF EXISTS. eg: DROP TABLE IF EXISTS global_dep_private;
+--  * All migrations must be backward-compatible. Old versions of Sourcegraph
+--    need to be able to read/write post migration.
+--  * Historically we advised against transactions since we thought the
+--    migrate library handled it. However, it does not! /facepalm
+
+-- Names only have to be unique among search contexts that are not deleted, so
+-- that soft-deleted search contexts keep their name and can be restored.
+DROP INDEX IF EXISTS search_contexts_name_namespace_user_id_unique;
+DROP INDEX IF EXISTS search_contexts_name_namespace_org_id_unique;
+DROP INDEX IF EXISTS search_contexts_name_without_namespace_unique;
+
+UPDATE search_contexts
+SET name = regexp_replace(name, '^DELETED-[0-9.]+-', '')
+WHERE deleted_at IS NOT NULL;
+
+CREATE UNIQUE INDEX IF NOT EXISTS search_contexts_name_namespace_user_id_unique
+    ON search_contexts (name, namespace_user_id)
+    WHERE namespace_user_id IS NOT NULL AND deleted_at IS NULL;
+
+CREATE UNIQUE INDEX IF NOT EXISTS search_contexts_name_namespace_org_id_unique
+    ON search_contexts (name, namespace_org_id)
+    WHERE namespace_org_id IS NOT NULL AND deleted_at IS NULL;
+
+CREATE UNIQUE INDEX IF NOT EXISTS search_contexts_name_without_namespace_unique
+    ON search_contexts (name)
+    WHERE namespace_user_id IS NULL AND namespace_org_id IS NULL AND deleted_at IS NULL;
+
+COMMIT;
@@ -1111,6 +1111,10 @@ type ParentSourcegraph struct {
 
 // PerforceAuthorization description: If non-null, enforces Perforce depot permissions.
 type PerforceAuthorization struct {
+	// CommandTimeoutSeconds description: The maximum time in seconds a single p4 command run against the Perforce Server for fetching permissions is allowed to take, including reading its output. Zero indicates no timeout.
+	CommandTimeoutSeconds int `json:"commandTimeoutSeconds,omitempty"`
+	// MaxConcurrentP4Exec description: The maximum number of concurrent p4 commands run against the Perforce Server for fetching permissions. Zero indicates no limit.
+	MaxConcurrentP4Exec int `json:"maxConcurrentP4Exec,omitempty"`
 }
 
 // PerforceConnection description: Configuration for a connection to Perforce Server.
@@ -1147,6 +1151,16 @@ type PerforceRateLimit struct {
 	RequestsPerHour float64 `json:"requestsPerHour"`
 }
 
+// PermissionsSyncExclusions description: Users and repositories that are never synced for permissions from code hosts, including syncs triggered by user actions and webhooks. Permissions already stored for them are kept as is.
+type PermissionsSyncExclusions struct {
+	// RepoIDs description: IDs of repositories to exclude.
+	RepoIDs []int `json:"repoIDs,omitempty"`
+	// RepoNamePatterns description: Glob patterns matching names of repositories to exclude.
+	RepoNamePatterns []string `json:"repoNamePatterns,omitempty"`
+	// UserIDs description: IDs of users to exclude.
+	UserIDs []int `json:"userIDs,omitempty"`
+}
+
 // PermissionsUserMapping description: Settings for Sourcegraph permissions, which allow the site admin to explicitly manage repository permissions via the GraphQL API. This setting cannot be enabled if repository permissions for any specific external service are enabled (i.e., when the external service's `authorization` field is set).
 type PermissionsUserMapping struct {
 	// BindID description: The type of identifier to identify a user. The default is "email", which uses the email address to identify a user. Use "username" to identify a user by their username. Changing this setting will erase any permissions created for users that do not yet exist.
@@ -1538,6 +1552,8 @@ type SiteConfiguration struct {
 	ObservabilityTracing *ObservabilityTracing `json:"observability.tracing,omitempty"`
 	// ParentSourcegraph description: URL to fetch unreachable repository details from. Defaults to "https://sourcegraph.com"
 	ParentSourcegraph *ParentSourcegraph `json:"parentSourcegraph,omitempty"`
+	// PermissionsSyncExclusions description: Users and repositories that are never synced for permissions from code hosts, including syncs triggered by user actions and webhooks. Permissions already stored for them are kept as is.
+	PermissionsSyncExclusions *PermissionsSyncExclusions `json:"permissions.syncExclusions,omitempty"`
 	// PermissionsUserMapping description: Settings for Sourcegraph permissions, which allow the site admin to explicitly manage repository permissions via the GraphQL API. This setting cannot be enabled if repository permissions for any specific external service are enabled (i.e., when the external service's `authorization` field is set).
 	PermissionsUserMapping *PermissionsUserMapping `json:"permissions.userMapping,omitempty"`
 	// ProductResearchPageEnabled description: Enables users access to the product research page in their settings.